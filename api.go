@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dx314/movie_beacon_bot/db"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// API key scopes. read covers searching and listing, download covers grabbing
+// and cancelling.
+const (
+	scopeRead     = "read"
+	scopeDownload = "download"
+)
+
+// apiKeyPrefix marks the bot's API keys so they are easy to spot in configs.
+const apiKeyPrefix = "mbb_"
+
+// apiDownloadLimit is how many downloads GET /api/v1/downloads returns.
+const apiDownloadLimit = 100
+
+type apiUserKey struct{}
+
+// api is the JSON API. Users get keys from the bot with /apikey and only see
+// their own releases and downloads.
+type api struct {
+	bot     *Bot
+	allowed map[int64]bool
+}
+
+// loadAPI returns the API when API_LISTEN_ADDR is set.
+func loadAPI(b *Bot) *api {
+	if os.Getenv("API_LISTEN_ADDR") == "" {
+		return nil
+	}
+	return &api{bot: b, allowed: parseUserIDs(os.Getenv("TELEGRAM_ALLOWED_USERS"))}
+}
+
+// Handler returns the API's routes.
+func (a *api) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPISpec)
+	})
+	mux.Handle("GET /api/v1/search", a.requireKey(scopeRead, a.handleSearch))
+	mux.Handle("GET /api/v1/releases", a.requireKey(scopeRead, a.handleReleases))
+	mux.Handle("GET /api/v1/downloads", a.requireKey(scopeRead, a.handleListDownloads))
+	mux.Handle("POST /api/v1/downloads", a.requireKey(scopeDownload, a.handleGrab))
+	mux.Handle("GET /api/v1/downloads/{id}", a.requireKey(scopeRead, a.handleGetDownload))
+	mux.Handle("DELETE /api/v1/downloads/{id}", a.requireKey(scopeDownload, a.handleCancelDownload))
+	return mux
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiError{Error: message})
+}
+
+// Keys
+
+// newAPIKey returns a random API key and the hash stored for it.
+func newAPIKey() (key, hash string, err error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	key = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	return key, hashAPIKey(key), nil
+}
+
+// hashAPIKey returns the hash keys are stored and looked up by, so the database
+// never holds usable keys.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestAPIKey reads the key from an "Authorization: Bearer" or X-API-Key header.
+func requestAPIKey(r *http.Request) string {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(key)
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// requireKey only lets through requests with a key holding scope whose user is
+// still allowed to use the bot.
+func (a *api) requireKey(scope string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestAPIKey(r)
+		if key == "" {
+			writeAPIError(w, http.StatusUnauthorized, "missing API key")
+			return
+		}
+		apiKey, err := a.bot.store.GetAPIKey(r.Context(), hashAPIKey(key))
+		if err != nil {
+			slog.Warn("Rejected API key", "remote", r.RemoteAddr)
+			writeAPIError(w, http.StatusUnauthorized, "invalid API key")
+			return
+		}
+		if len(a.allowed) > 0 && !a.allowed[apiKey.UserID] {
+			writeAPIError(w, http.StatusForbidden, "you are not allowed to use this bot")
+			return
+		}
+		if !slices.Contains(strings.Split(apiKey.Scopes, ","), scope) {
+			writeAPIError(w, http.StatusForbidden, "this key lacks the "+scope+" scope")
+			return
+		}
+
+		err = a.bot.store.TouchAPIKey(r.Context(), db.TouchAPIKeyParams{LastUsed: a.bot.clock.Now().Unix(), KeyHash: apiKey.KeyHash})
+		if err != nil {
+			slog.Error("Error recording API key use", "user_id", apiKey.UserID, "err", err)
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiUserKey{}, apiKey.UserID)))
+	})
+}
+
+// apiUser returns the ID of the user whose key authenticated the request.
+func apiUser(r *http.Request) int64 {
+	userID, _ := r.Context().Value(apiUserKey{}).(int64)
+	return userID
+}
+
+// checkCategory returns the category query parameter, defaulting to movies.
+func checkCategory(category string) (string, bool) {
+	if category == "" {
+		return "movies", true
+	}
+	_, ok := nzbGeekCategories[category]
+	return category, ok
+}
+
+// Search
+
+type apiTitle struct {
+	ImdbID string `json:"imdb_id"`
+	Title  string `json:"title"`
+	Year   string `json:"year"`
+	Type   string `json:"type"`
+}
+
+func (a *api) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	title := strings.TrimSpace(query.Get("title"))
+	if title == "" {
+		writeAPIError(w, http.StatusBadRequest, "title is required")
+		return
+	}
+	category, ok := checkCategory(query.Get("category"))
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "unknown category")
+		return
+	}
+
+	a.bot.events.Publish(eventSearchPerformed, searchEvent{
+		UserID:   apiUser(r),
+		Category: category,
+		Query:    title,
+		Year:     query.Get("year"),
+		Source:   "api",
+	})
+	results, err := a.bot.metadata.SearchTitles(title, query.Get("year"), category)
+	if err != nil {
+		slog.Error("Error searching OMDB", "user_id", apiUser(r), "err", err)
+		writeAPIError(w, http.StatusBadGateway, "metadata search failed")
+		return
+	}
+	titles := make([]apiTitle, 0, len(results))
+	for _, result := range results {
+		titles = append(titles, apiTitle{ImdbID: result.ImdbID, Title: result.Title, Year: result.Year, Type: result.Type})
+	}
+	writeJSON(w, http.StatusOK, titles)
+}
+
+type apiRelease struct {
+	ID         string `json:"id"`
+	Title      string `json:"title"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	Resolution string `json:"resolution"`
+	Group      string `json:"group"`
+	Published  string `json:"published,omitempty"`
+	GUID       string `json:"guid,omitempty"`
+	Grabs      *int   `json:"grabs,omitempty"`
+	Filtered   string `json:"filtered,omitempty"` // Why the filters left it out
+}
+
+// handleReleases lists the releases for an IMDb ID. Each is stored so it can be
+// grabbed by ID, the same way the bot stores the releases it offers. Releases
+// the filters left out are only listed with include_filtered=true.
+func (a *api) handleReleases(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	imdbID := query.Get("imdb_id")
+	if !strings.HasPrefix(imdbID, "tt") {
+		writeAPIError(w, http.StatusBadRequest, "imdb_id must look like tt0133093")
+		return
+	}
+	category, ok := checkCategory(query.Get("category"))
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "unknown category")
+		return
+	}
+
+	userID := apiUser(r)
+	searchResult, err := a.bot.findReleases(newReleaseQuery(imdbID, category, query.Get("title"), query.Get("year")))
+	if err != nil {
+		var userErr userError
+		if errors.As(err, &userErr) {
+			writeAPIError(w, userErr.HTTPStatus(), userErr.Error())
+			return
+		}
+		slog.Error("Error searching NZBGeek", "user_id", userID, "imdb_id", imdbID, "err", err)
+		writeAPIError(w, http.StatusBadGateway, "indexer search failed")
+		return
+	}
+
+	items := make([]FilteredItem, 0, len(searchResult.Items))
+	for _, item := range searchResult.Items {
+		items = append(items, FilteredItem{Item: item})
+	}
+	if query.Get("include_filtered") == "true" {
+		items = append(items, searchResult.Filtered...)
+	}
+
+	// The search ID keeps grabbing one of these releases from discarding any
+	// others, like the options of a search in the user's chat
+	searchID := uuid.New().String()
+	releases := make([]apiRelease, 0, len(items))
+	for _, item := range items {
+		nzbInfo, err := a.bot.storeRelease(userID, searchID, category, imdbID, item.Item)
+		if err != nil {
+			slog.Error("Error storing NZB info", "err", err)
+			continue
+		}
+		titleInfo := parseMovieTitle(item.Title)
+		release := apiRelease{
+			ID:         nzbInfo.ID,
+			Title:      item.Title,
+			Name:       nzbInfo.Name,
+			Size:       item.Size(),
+			Resolution: titleInfo.Resolution,
+			Group:      titleInfo.LastTag,
+			GUID:       item.ID(),
+			Filtered:   item.Reason,
+		}
+		if item.Newznab.Grabs >= 0 {
+			release.Grabs = &item.Newznab.Grabs
+		}
+		if published, err := time.Parse(time.RFC1123Z, item.Posted()); err == nil {
+			release.Published = published.UTC().Format(time.RFC3339)
+		}
+		releases = append(releases, release)
+	}
+	writeJSON(w, http.StatusOK, releases)
+}
+
+// Downloads
+
+type apiDownload struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	ImdbID   string `json:"imdb_id"`
+	Status   string `json:"status"`
+	Progress string `json:"progress,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Updated  string `json:"updated"`
+}
+
+func newAPIDownload(info db.NzbInfo) apiDownload {
+	return apiDownload{
+		ID:       info.ID,
+		Name:     info.Name,
+		Category: info.Category,
+		ImdbID:   info.ImdbID,
+		Status:   info.Status,
+		Path:     info.Path,
+		Updated:  time.Unix(info.LastUpdated, 0).UTC().Format(time.RFC3339),
+	}
+}
+
+func (a *api) handleListDownloads(w http.ResponseWriter, r *http.Request) {
+	downloads, err := a.bot.store.ListChatDownloads(r.Context(), db.ListChatDownloadsParams{
+		ChatID: apiUser(r),
+		Limit:  apiDownloadLimit,
+	})
+	if err != nil {
+		slog.Error("Error listing downloads", "user_id", apiUser(r), "err", err)
+		writeAPIError(w, http.StatusInternalServerError, "couldn't load downloads")
+		return
+	}
+	out := make([]apiDownload, 0, len(downloads))
+	for _, info := range downloads {
+		out = append(out, newAPIDownload(info))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// userDownload loads the download named in the path, answering 404 when it
+// doesn't exist or belongs to someone else.
+func (a *api) userDownload(w http.ResponseWriter, r *http.Request, id string) (db.NzbInfo, bool) {
+	info, err := a.bot.store.GetNZBInfo(r.Context(), id)
+	if err != nil || info.ChatID != apiUser(r) {
+		writeAPIError(w, http.StatusNotFound, "no such release")
+		return db.NzbInfo{}, false
+	}
+	return info, true
+}
+
+// handleGetDownload returns a download along with SABnzbd's progress while it is
+// active.
+func (a *api) handleGetDownload(w http.ResponseWriter, r *http.Request) {
+	info, ok := a.userDownload(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	download := newAPIDownload(info)
+	if info.Selected == 1 && (downloadRow{NzbInfo: info}).Active() {
+		if _, progress, err := a.bot.downloads.Progress(info.SabnzbdID); err == nil {
+			download.Progress = progress
+		}
+	}
+	writeJSON(w, http.StatusOK, download)
+}
+
+type grabRequest struct {
+	ReleaseID string `json:"release_id"`
+	// Category overrides the category the release was found in.
+	Category string `json:"category"`
+}
+
+// handleGrab queues a release listed by /api/v1/releases.
+func (a *api) handleGrab(w http.ResponseWriter, r *http.Request) {
+	var req grabRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	info, ok := a.userDownload(w, r, req.ReleaseID)
+	if !ok {
+		return
+	}
+	if info.Selected == 1 {
+		writeAPIError(w, http.StatusConflict, "release has already been grabbed")
+		return
+	}
+	if req.Category != "" {
+		if _, ok := checkCategory(req.Category); !ok {
+			writeAPIError(w, http.StatusBadRequest, "unknown category")
+			return
+		}
+		info.Category = req.Category
+	}
+
+	// Claim the release first, so two requests can't both queue it
+	claimed, err := a.bot.store.ClaimRelease(r.Context(), info.ID)
+	if err != nil {
+		slog.Error("Error claiming release", "id", info.ID, "err", err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to grab the release")
+		return
+	}
+	if claimed == 0 {
+		writeAPIError(w, http.StatusConflict, "release has already been grabbed")
+		return
+	}
+
+	by := grabber{UserID: apiUser(r), Admin: isAdmin(&tgbotapi.User{ID: apiUser(r)}, 0)}
+	if err := a.bot.queueDownload(info, by); err != nil {
+		// Put the release back so it can be grabbed again
+		if err := a.bot.storeNZBInfo(info.ID, info); err != nil {
+			slog.Error("Error releasing claim", "id", info.ID, "err", err)
+		}
+		var userErr userError
+		if errors.As(err, &userErr) {
+			writeAPIError(w, userErr.HTTPStatus(), userErr.Error())
+			return
+		}
+		slog.Error("Error adding NZB to SABnzbd", "user_id", apiUser(r), "err", err)
+		writeAPIError(w, http.StatusBadGateway, "failed to add the NZB to SABnzbd")
+		return
+	}
+	// Like picking a release in the chat, grabbing discards the other options
+	// of the same search
+	err = a.bot.store.DeleteUnselectedOptions(r.Context(), db.DeleteUnselectedOptionsParams{
+		ChatID:   info.ChatID,
+		SearchID: info.SearchID,
+	})
+	if err != nil {
+		slog.Error("Error removing unselected options", "err", err)
+	}
+
+	queued, err := a.bot.getNZBInfo(info.ID)
+	if err != nil {
+		slog.Error("Error retrieving NZB info", "err", err)
+		queued = info
+	}
+	writeJSON(w, http.StatusAccepted, newAPIDownload(queued))
+}
+
+func (a *api) handleCancelDownload(w http.ResponseWriter, r *http.Request) {
+	info, ok := a.userDownload(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	if info.Selected != 1 {
+		writeAPIError(w, http.StatusNotFound, "no such download")
+		return
+	}
+
+	err := a.bot.cancelDownload(info.ID)
+	if errors.Is(err, errDownloadFinished) {
+		writeAPIError(w, http.StatusConflict, "download has already finished")
+		return
+	}
+	if err != nil {
+		slog.Error("Error cancelling download", "user_id", apiUser(r), "nzb_id", info.ID, "err", err)
+		writeAPIError(w, http.StatusBadGateway, "failed to cancel the download")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAPIKeyCommand issues API keys. "/apikey" creates a key that can search and
+// download, "/apikey read" one that can only search and list, and "/apikey revoke"
+// revokes all of the user's keys. Keys are only handed out in private chats.
+func (b *Bot) handleAPIKeyCommand(message *tgbotapi.Message) {
+	if !message.Chat.IsPrivate() {
+		b.sendErrorMessage(message.Chat.ID, "Send /apikey in a private chat with me.")
+		return
+	}
+	ctx := context.Background()
+	userID := message.From.ID
+
+	scopes := scopeRead + "," + scopeDownload
+	switch arg := strings.TrimSpace(message.CommandArguments()); arg {
+	case "":
+	case scopeRead:
+		scopes = scopeRead
+	case "revoke":
+		if err := b.store.DeleteUserAPIKeys(ctx, userID); err != nil {
+			slog.Error("Error revoking API keys", "user_id", userID, "err", err)
+			b.sendErrorMessage(message.Chat.ID, "Failed to revoke your API keys.")
+			return
+		}
+		b.sender.Send(tgbotapi.NewMessage(message.Chat.ID, "All your API keys have been revoked."))
+		return
+	default:
+		b.sendErrorMessage(message.Chat.ID, "Usage: /apikey, /apikey read or /apikey revoke")
+		return
+	}
+
+	key, hash, err := newAPIKey()
+	if err == nil {
+		err = b.store.InsertAPIKey(ctx, db.InsertAPIKeyParams{
+			KeyHash:   hash,
+			UserID:    userID,
+			Scopes:    scopes,
+			CreatedAt: b.clock.Now().Unix(),
+		})
+	}
+	if err != nil {
+		slog.Error("Error creating API key", "user_id", userID, "err", err)
+		b.sendErrorMessage(message.Chat.ID, "Failed to create an API key.")
+		return
+	}
+
+	msg := tgbotapi.NewMessage(message.Chat.ID, "Your API key ("+scopes+"):\n\n<code>"+key+"</code>\n\n"+
+		"It won't be shown again. Send it as \"Authorization: Bearer &lt;key&gt;\". Use /apikey revoke if it leaks.")
+	msg.ParseMode = "HTML"
+	if _, err := b.sender.Send(msg); err != nil {
+		slog.Error("Error sending API key", "user_id", userID, "err", err)
+	}
+}
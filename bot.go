@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"github.com/dx314/movie_beacon_bot/db"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"sync"
+	"time"
+)
+
+// Sender is the part of the Telegram API the handlers use. *tgbotapi.BotAPI
+// satisfies it.
+type Sender interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+}
+
+// MetadataClient looks up movies and series (OMDB).
+type MetadataClient interface {
+	SearchTitles(title, year, category string) ([]OMDBSearchResult, error)
+	LookupSeries(name, year string) (*OMDBTVSearchResponse, error)
+	Details(imdbID string) (*OMDBTVSearchResponse, error)
+}
+
+// Indexer searches for NZBs (NZBGeek).
+type Indexer interface {
+	// Lookup searches by ID. The result is empty if the indexer can't search
+	// for q that way.
+	Lookup(q ReleaseQuery) (SearchResult, error)
+	Search(query, year, category string) (SearchResult, error)
+}
+
+// DownloadClient queues and tracks NZB downloads (SABnzbd).
+type DownloadClient interface {
+	AddURL(nzbURL, category string) (string, error)
+	Progress(nzoID string) (status string, progress string, err error)
+	StoragePath(nzoID string) (string, error)
+	// Delete removes a download from the queue.
+	Delete(nzoID string) error
+	// FreeSpace returns how many bytes are left for new downloads.
+	FreeSpace() (int64, error)
+}
+
+// MediaServer is a media server (Plex, Jellyfin or Emby) whose libraries pick up
+// completed downloads.
+type MediaServer interface {
+	// Refresh asks the server to scan path in the library configured for category.
+	Refresh(category, path string) error
+	// WatchLink returns a link to the item stored under path, or "" if the
+	// server hasn't indexed it yet.
+	WatchLink(category, path string) (string, error)
+}
+
+// Store is the persistence layer. *db.Queries satisfies it.
+type Store interface {
+	GetNZBInfo(ctx context.Context, id string) (db.NzbInfo, error)
+	UpsertNZBInfo(ctx context.Context, arg db.UpsertNZBInfoParams) error
+	DeleteNZBInfo(ctx context.Context, id string) error
+	GetIncompleteDownloads(ctx context.Context) ([]db.NzbInfo, error)
+	GetGrabbedRelease(ctx context.Context, guid string) (db.NzbInfo, error)
+	GetCompletedDownloads(ctx context.Context, arg db.GetCompletedDownloadsParams) ([]db.NzbInfo, error)
+	ListDownloads(ctx context.Context, limit int64) ([]db.NzbInfo, error)
+	ListChatDownloads(ctx context.Context, arg db.ListChatDownloadsParams) ([]db.NzbInfo, error)
+	SetNZBPath(ctx context.Context, arg db.SetNZBPathParams) error
+	ClaimRelease(ctx context.Context, id string) (int64, error)
+	DeleteUnselectedOptions(ctx context.Context, arg db.DeleteUnselectedOptionsParams) error
+
+	GetMessageData(ctx context.Context, messageID int) (db.MsgDatum, error)
+	InsertMessageData(ctx context.Context, arg db.InsertMessageDataParams) (db.MsgDatum, error)
+	DeleteMessageData(ctx context.Context, messageID int) error
+
+	GetConversation(ctx context.Context, userID int64) (db.Conversation, error)
+	UpsertConversation(ctx context.Context, arg db.UpsertConversationParams) error
+	DeleteConversation(ctx context.Context, userID int64) error
+	DeleteExpiredConversations(ctx context.Context, expiresAt int64) error
+
+	InsertAPIKey(ctx context.Context, arg db.InsertAPIKeyParams) error
+	GetAPIKey(ctx context.Context, keyHash string) (db.ApiKey, error)
+	TouchAPIKey(ctx context.Context, arg db.TouchAPIKeyParams) error
+	DeleteUserAPIKeys(ctx context.Context, userID int64) error
+
+	InsertWebhookDelivery(ctx context.Context, arg db.InsertWebhookDeliveryParams) error
+	GetDueWebhookDeliveries(ctx context.Context, arg db.GetDueWebhookDeliveriesParams) ([]db.WebhookDelivery, error)
+	RescheduleWebhookDelivery(ctx context.Context, arg db.RescheduleWebhookDeliveryParams) error
+	DeleteWebhookDelivery(ctx context.Context, id int) error
+
+	UpsertPlatformRef(ctx context.Context, arg db.UpsertPlatformRefParams) (int64, error)
+	GetPlatformRef(ctx context.Context, id int64) (db.PlatformRef, error)
+	GetUserLink(ctx context.Context, userID int64) (int64, error)
+	UpsertUserLink(ctx context.Context, arg db.UpsertUserLinkParams) error
+	DeleteUserLink(ctx context.Context, userID int64) error
+
+	InsertGrab(ctx context.Context, arg db.InsertGrabParams) error
+	GetGrabUsage(ctx context.Context, arg db.GetGrabUsageParams) (db.GetGrabUsageRow, error)
+	DeleteGrabsBefore(ctx context.Context, grabbedAt int64) error
+	GetQuotaOverride(ctx context.Context, userID int64) (int64, error)
+	UpsertQuotaOverride(ctx context.Context, arg db.UpsertQuotaOverrideParams) error
+	DeleteQuotaOverride(ctx context.Context, userID int64) error
+
+	IncrementIndexerUsage(ctx context.Context, arg db.IncrementIndexerUsageParams) error
+	GetIndexerUsage(ctx context.Context, arg db.GetIndexerUsageParams) (db.IndexerUsage, error)
+	DeleteIndexerUsageBefore(ctx context.Context, day string) error
+}
+
+var _ Store = (*db.Queries)(nil)
+
+// Clock lets tests control time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Deps are the external services a Bot talks to.
+type Deps struct {
+	Sender    Sender
+	Store     Store
+	Metadata  MetadataClient
+	Indexer   Indexer
+	Downloads DownloadClient
+	Media     MediaServer   // Optional
+	Library   LibrarySource // Optional, checked before offering downloads
+	Clock     Clock         // Defaults to the system clock
+
+	// PostProcess renames and moves completed downloads. Optional.
+	PostProcess *postProcessor
+	// NFO writes Kodi metadata for completed downloads. Optional.
+	NFO *nfoWriter
+	// Subtitles fetches missing subtitles for completed downloads. Optional.
+	Subtitles *subtitleFetcher
+	// Health tracks the update loop and checks dependencies for /status. Optional.
+	Health *healthChecker
+	// Webhooks delivers events to outgoing webhooks. Optional.
+	Webhooks *webhookOutbox
+	// Disks refuses downloads that won't fit and warns about low disk space.
+	// Optional.
+	Disks *diskGuard
+	// Sizes filters out releases too small or too big for their runtime.
+	// Optional.
+	Sizes *sizeFilter
+	// APIKeys enables /apikey, which issues keys for the JSON API.
+	APIKeys bool
+	// LinkAccounts enables /link, which lets Discord and Matrix accounts act as
+	// another account, usually a Telegram one.
+	LinkAccounts bool
+	// Quotas limits commands and downloads. The zero value is unlimited.
+	Quotas quotaLimits
+	// IndexerLimits are the indexer account's daily limits. The zero value is
+	// unlimited.
+	IndexerLimits indexerLimits
+
+	// LibraryRefresh is how often the library index is rebuilt. Defaults to an hour.
+	LibraryRefresh time.Duration
+}
+
+// Bot holds the handlers' dependencies and the state shared between them.
+type Bot struct {
+	sender    Sender
+	store     Store
+	metadata  MetadataClient
+	indexer   Indexer
+	downloads DownloadClient
+	media     MediaServer
+	library   *libraryIndex
+	clock     Clock
+
+	postprocess  *postProcessor
+	nfo          *nfoWriter
+	subtitles    *subtitleFetcher
+	health       *healthChecker
+	disks        *diskGuard
+	sizes        *sizeFilter
+	apiKeys      bool
+	linkAccounts bool
+	quotas       quotaLimits
+	events       *eventBus
+
+	indexerLimits indexerLimits
+	indexerState  indexerState
+
+	// pollInterval is how often download progress is checked
+	pollInterval time.Duration
+	// libraryWait is how long to wait for a completed download to appear on
+	// the media server
+	libraryWait time.Duration
+	// libraryRefresh is how often the library index is rebuilt
+	libraryRefresh time.Duration
+
+	messageCacheMutex sync.Mutex
+	messageCache      map[int]string
+
+	activeMonitorsMutex sync.Mutex
+	activeMonitors      map[string]bool
+
+	linkCodesMutex sync.Mutex
+	linkCodes      map[string]linkCode
+
+	// grabMutex serializes queueDownload
+	grabMutex sync.Mutex
+
+	filtered filteredViews
+}
+
+func NewBot(deps Deps) *Bot {
+	b := &Bot{
+		sender:         deps.Sender,
+		store:          deps.Store,
+		metadata:       deps.Metadata,
+		indexer:        deps.Indexer,
+		downloads:      deps.Downloads,
+		media:          deps.Media,
+		postprocess:    deps.PostProcess,
+		nfo:            deps.NFO,
+		subtitles:      deps.Subtitles,
+		health:         deps.Health,
+		disks:          deps.Disks,
+		sizes:          deps.Sizes,
+		apiKeys:        deps.APIKeys,
+		linkAccounts:   deps.LinkAccounts,
+		quotas:         deps.Quotas,
+		indexerLimits:  deps.IndexerLimits,
+		clock:          deps.Clock,
+		pollInterval:   6 * time.Second,
+		libraryWait:    5 * time.Minute,
+		libraryRefresh: deps.LibraryRefresh,
+		messageCache:   make(map[int]string),
+		activeMonitors: make(map[string]bool),
+		linkCodes:      make(map[string]linkCode),
+		filtered:       filteredViews{views: make(map[filteredKey]filteredView)},
+	}
+	if b.clock == nil {
+		b.clock = realClock{}
+	}
+	b.events = newEventBus(b.clock)
+	if deps.Webhooks != nil {
+		b.events.Subscribe(deps.Webhooks.Enqueue)
+	}
+	if deps.Library != nil {
+		b.library = newLibraryIndex(deps.Library)
+	}
+	if b.libraryRefresh == 0 {
+		b.libraryRefresh = time.Hour
+	}
+	return b
+}
+
+// sendWithButtons sends text with an inline keyboard.
+func (b *Bot) sendWithButtons(chatID int64, text string, buttons [][]tgbotapi.InlineKeyboardButton) (tgbotapi.Message, error) {
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(buttons...)
+	return b.sender.Send(msg)
+}
+
+func (b *Bot) manageMonitorState(nzbUUID string) bool {
+	b.activeMonitorsMutex.Lock()
+	defer b.activeMonitorsMutex.Unlock()
+
+	if b.activeMonitors[nzbUUID] {
+		// A monitor is already running for this item
+		return false
+	}
+
+	// No monitor is running, so we can start one
+	b.activeMonitors[nzbUUID] = true
+	activeMonitors.Inc()
+	return true
+}
+
+func (b *Bot) releaseMonitorState(nzbUUID string) {
+	b.activeMonitorsMutex.Lock()
+	defer b.activeMonitorsMutex.Unlock()
+
+	if b.activeMonitors[nzbUUID] {
+		delete(b.activeMonitors, nzbUUID)
+		activeMonitors.Dec()
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dx314/movie_beacon_bot/db"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	_ "modernc.org/sqlite"
+)
+
+// recordingSender is a Sender that keeps what it's given instead of calling
+// Telegram. Sent messages get IDs counting up from 1.
+type recordingSender struct {
+	mu   sync.Mutex
+	sent []tgbotapi.Chattable
+}
+
+func (s *recordingSender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, c)
+	msg := tgbotapi.Message{MessageID: len(s.sent)}
+	if m, ok := c.(tgbotapi.MessageConfig); ok {
+		msg.Chat = &tgbotapi.Chat{ID: m.ChatID}
+		msg.Text = m.Text
+	}
+	return msg, nil
+}
+
+func (s *recordingSender) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, c)
+	return &tgbotapi.APIResponse{Ok: true}, nil
+}
+
+// Sent returns everything sent so far.
+func (s *recordingSender) Sent() []tgbotapi.Chattable {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]tgbotapi.Chattable(nil), s.sent...)
+}
+
+// Texts returns the text of the messages sent and edited so far.
+func (s *recordingSender) Texts() []string {
+	var texts []string
+	for _, c := range s.Sent() {
+		switch c := c.(type) {
+		case tgbotapi.MessageConfig:
+			texts = append(texts, c.Text)
+		case tgbotapi.EditMessageTextConfig:
+			texts = append(texts, c.Text)
+		}
+	}
+	return texts
+}
+
+// newTestStore returns a Store backed by an in-memory SQLite database with the
+// migrations applied.
+func newTestStore(t *testing.T) *db.Queries {
+	t.Helper()
+	conn, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: gets its own database
+	conn.SetMaxOpenConns(1)
+	t.Cleanup(func() { conn.Close() })
+
+	migrations, err := filepath.Glob("migrations/*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range migrations {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		up, _, _ := strings.Cut(string(body), "-- +goose Down")
+		if _, err := conn.Exec(up); err != nil {
+			t.Fatalf("applying %s: %v", path, err)
+		}
+	}
+	return db.New(conn)
+}
+
+// fakeClock is a Clock that only moves when waited on: After advances it by the
+// duration and fires at once, so polling loops run without sleeping.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// fakeProgress is one answer of fakeDownloads.Progress.
+type fakeProgress struct {
+	status   string
+	progress string
+	err      error
+}
+
+// fakeDownloads is a DownloadClient whose downloads go through a script of
+// progress reports, one per poll. The last one repeats.
+type fakeDownloads struct {
+	mu     sync.Mutex
+	script []fakeProgress
+	added  []string // URLs
+	polls  int
+}
+
+func (d *fakeDownloads) AddURL(nzbURL, category string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.added = append(d.added, nzbURL)
+	return fmt.Sprintf("SABnzbd_nzo_%d", len(d.added)), nil
+}
+
+func (d *fakeDownloads) Progress(nzoID string) (string, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.script) == 0 {
+		return "", "", errors.New("no progress scripted")
+	}
+	p := d.script[min(d.polls, len(d.script)-1)]
+	d.polls++
+	return p.status, p.progress, p.err
+}
+
+func (d *fakeDownloads) StoragePath(nzoID string) (string, error) {
+	return "/downloads/complete/" + nzoID, nil
+}
+
+func (d *fakeDownloads) Delete(nzoID string) error {
+	return nil
+}
+
+func (d *fakeDownloads) FreeSpace() (int64, error) {
+	return 500 << 30, nil
+}
+
+// Added returns the URLs queued so far.
+func (d *fakeDownloads) Added() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.added...)
+}
+
+// testBot is a Bot wired to fakes, with what it sends recorded.
+type testBot struct {
+	*Bot
+	sender    *recordingSender
+	store     *db.Queries
+	downloads *fakeDownloads
+}
+
+func newTestBot(t *testing.T, downloads *fakeDownloads) *testBot {
+	t.Helper()
+	tb := &testBot{
+		sender:    &recordingSender{},
+		store:     newTestStore(t),
+		downloads: downloads,
+	}
+	tb.Bot = NewBot(Deps{
+		Sender:    tb.sender,
+		Store:     tb.store,
+		Downloads: downloads,
+		Clock:     newFakeClock(),
+	})
+	return tb
+}
+
+// waitForMonitor waits until a download monitor has sent a message containing
+// text and stopped, failing the test if that takes more than a few seconds.
+func waitForMonitor(t *testing.T, b *Bot, texts func() []string, text string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		b.activeMonitorsMutex.Lock()
+		running := len(b.activeMonitors)
+		b.activeMonitorsMutex.Unlock()
+		if running == 0 && slices.ContainsFunc(texts(), func(s string) bool { return strings.Contains(s, text) }) {
+			return
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("no %q message from a finished monitor; messages sent: %q", text, texts())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// download returns the stored release, failing the test if it's missing.
+func (tb *testBot) download(t *testing.T, id string) db.NzbInfo {
+	t.Helper()
+	info, err := tb.store.GetNZBInfo(context.Background(), id)
+	if err != nil {
+		t.Fatalf("getting release %s: %v", id, err)
+	}
+	return info
+}
+
+// pressButton dispatches a button press by userID in chatID.
+func (tb *testBot) pressButton(t *testing.T, chatID, userID int64, data string) {
+	t.Helper()
+	tb.newBotRouter().Dispatch(tgbotapi.Update{
+		UpdateID: 1,
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      "query-1",
+			From:    &tgbotapi.User{ID: userID, FirstName: "Test"},
+			Message: &tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: chatID, Type: "private"}},
+			Data:    data,
+		},
+	})
+}
+
+func TestPressReleaseTwice(t *testing.T) {
+	tb := newTestBot(t, &fakeDownloads{script: []fakeProgress{{status: "Completed", progress: "Progress: 100%"}}})
+	release := storeTestRelease(t, tb)
+
+	pickRelease(t, tb, release)
+	pickRelease(t, tb, release)
+	waitForMonitor(t, tb.Bot, tb.sender.Texts, "Status: Completed")
+
+	if added := tb.downloads.Added(); len(added) != 1 {
+		t.Errorf("AddURL called %d times, want 1", len(added))
+	}
+	var answers []string
+	for _, c := range tb.sender.Sent() {
+		if answer, ok := c.(tgbotapi.CallbackConfig); ok {
+			answers = append(answers, answer.Text)
+		}
+	}
+	if !slices.Contains(answers, "This button has expired.") {
+		t.Errorf("second press answered with %q, want the button expired", answers)
+	}
+}
@@ -0,0 +1,206 @@
+// Package callbackdata encodes and decodes the data attached to inline keyboard
+// buttons.
+//
+// Payloads look like "<version>:<kind>:<field>:<field>..." so they can be told apart
+// from one another and from buttons sent by older versions of the bot. Telegram
+// limits callback data to 64 bytes, which Encode enforces.
+package callbackdata
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is the current payload version. Bump it when the layout of an existing
+// kind changes so buttons from older messages are rejected instead of misread.
+const Version = 1
+
+// MaxLength is the maximum size of callback data Telegram accepts.
+const MaxLength = 64
+
+const separator = ":"
+
+// Action kinds.
+const (
+	KindRelease  = "r"
+	KindTitle    = "t"
+	KindSeason   = "s"
+	KindCancel   = "x"
+	KindUpgrade  = "u"
+	KindSubs     = "b"
+	KindForce    = "f"
+	KindFiltered = "h"
+)
+
+var (
+	// ErrTooLong is returned when an encoded payload exceeds MaxLength.
+	ErrTooLong = errors.New("callback data too long")
+	// ErrStale is returned for payloads from another version or in a legacy format.
+	ErrStale = errors.New("callback data is stale")
+	// ErrUnknownKind is returned for a current version payload of an unknown kind.
+	ErrUnknownKind = errors.New("unknown callback kind")
+	// ErrMalformed is returned when a payload's fields cannot be parsed.
+	ErrMalformed = errors.New("malformed callback data")
+)
+
+// Action is a typed button action.
+type Action interface {
+	Kind() string
+	fields() []string
+}
+
+// PickRelease selects a stored NZB search result by its ID.
+type PickRelease struct {
+	ID string
+}
+
+func (a PickRelease) Kind() string     { return KindRelease }
+func (a PickRelease) fields() []string { return []string{a.ID} }
+
+// ForceRelease queues a stored NZB search result even though it won't fit on
+// disk.
+type ForceRelease struct {
+	ID string
+}
+
+func (a ForceRelease) Kind() string     { return KindForce }
+func (a ForceRelease) fields() []string { return []string{a.ID} }
+
+// PickTitle selects a movie or series by IMDb ID.
+type PickTitle struct {
+	ImdbID string
+}
+
+func (a PickTitle) Kind() string     { return KindTitle }
+func (a PickTitle) fields() []string { return []string{a.ImdbID} }
+
+// PickSeason selects a season of a series. Season 0 is specials.
+type PickSeason struct {
+	ImdbID string
+	Season int
+}
+
+func (a PickSeason) Kind() string { return KindSeason }
+func (a PickSeason) fields() []string {
+	return []string{a.ImdbID, strconv.Itoa(a.Season)}
+}
+
+// Upgrade searches for a title that is already in the library.
+type Upgrade struct {
+	ImdbID string
+}
+
+func (a Upgrade) Kind() string     { return KindUpgrade }
+func (a Upgrade) fields() []string { return []string{a.ImdbID} }
+
+// FetchSubtitles fetches subtitles for a past download by its ID.
+type FetchSubtitles struct {
+	ID string
+}
+
+func (a FetchSubtitles) Kind() string     { return KindSubs }
+func (a FetchSubtitles) fields() []string { return []string{a.ID} }
+
+// ShowFiltered lists the releases left out of the search results the menu
+// belongs to.
+type ShowFiltered struct{}
+
+func (a ShowFiltered) Kind() string     { return KindFiltered }
+func (a ShowFiltered) fields() []string { return nil }
+
+// Cancel dismisses a menu.
+type Cancel struct{}
+
+func (a Cancel) Kind() string     { return KindCancel }
+func (a Cancel) fields() []string { return nil }
+
+// Encode returns the callback data for an action.
+func Encode(a Action) (string, error) {
+	parts := []string{strconv.Itoa(Version), a.Kind()}
+	for _, f := range a.fields() {
+		if f == "" || strings.Contains(f, separator) {
+			return "", fmt.Errorf("%w: invalid field %q", ErrMalformed, f)
+		}
+		parts = append(parts, f)
+	}
+
+	data := strings.Join(parts, separator)
+	if len(data) > MaxLength {
+		return "", fmt.Errorf("%w: %d bytes", ErrTooLong, len(data))
+	}
+	return data, nil
+}
+
+// Decode parses callback data produced by Encode.
+func Decode(data string) (Action, error) {
+	if len(data) > MaxLength {
+		return nil, ErrTooLong
+	}
+
+	parts := strings.Split(data, separator)
+	if len(parts) < 2 {
+		return nil, ErrStale
+	}
+	version, err := strconv.Atoi(parts[0])
+	if err != nil || version != Version {
+		return nil, ErrStale
+	}
+
+	kind, fields := parts[1], parts[2:]
+	for _, f := range fields {
+		if f == "" {
+			return nil, ErrMalformed
+		}
+	}
+
+	switch kind {
+	case KindRelease:
+		if len(fields) != 1 {
+			return nil, ErrMalformed
+		}
+		return PickRelease{ID: fields[0]}, nil
+	case KindForce:
+		if len(fields) != 1 {
+			return nil, ErrMalformed
+		}
+		return ForceRelease{ID: fields[0]}, nil
+	case KindTitle:
+		if len(fields) != 1 {
+			return nil, ErrMalformed
+		}
+		return PickTitle{ImdbID: fields[0]}, nil
+	case KindUpgrade:
+		if len(fields) != 1 {
+			return nil, ErrMalformed
+		}
+		return Upgrade{ImdbID: fields[0]}, nil
+	case KindSubs:
+		if len(fields) != 1 {
+			return nil, ErrMalformed
+		}
+		return FetchSubtitles{ID: fields[0]}, nil
+	case KindSeason:
+		if len(fields) != 2 {
+			return nil, ErrMalformed
+		}
+		season, err := strconv.Atoi(fields[1])
+		if err != nil || season < 0 {
+			return nil, ErrMalformed
+		}
+		return PickSeason{ImdbID: fields[0], Season: season}, nil
+	case KindCancel:
+		if len(fields) != 0 {
+			return nil, ErrMalformed
+		}
+		return Cancel{}, nil
+	case KindFiltered:
+		if len(fields) != 0 {
+			return nil, ErrMalformed
+		}
+		return ShowFiltered{}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKind, kind)
+	}
+}
@@ -0,0 +1,113 @@
+package callbackdata
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		action Action
+		want   string
+	}{
+		{PickRelease{ID: "5f0c6a56-7d9e-4b0c-9a57-0f4e3d7b8c21"}, "1:r:5f0c6a56-7d9e-4b0c-9a57-0f4e3d7b8c21"},
+		{ForceRelease{ID: "5f0c6a56-7d9e-4b0c-9a57-0f4e3d7b8c21"}, "1:f:5f0c6a56-7d9e-4b0c-9a57-0f4e3d7b8c21"},
+		{PickTitle{ImdbID: "tt0133093"}, "1:t:tt0133093"},
+		{PickSeason{ImdbID: "tt0903747", Season: 3}, "1:s:tt0903747:3"},
+		{PickSeason{ImdbID: "tt0903747", Season: 0}, "1:s:tt0903747:0"},
+		{Upgrade{ImdbID: "tt0133093"}, "1:u:tt0133093"},
+		{FetchSubtitles{ID: "5f0c6a56-7d9e-4b0c-9a57-0f4e3d7b8c21"}, "1:b:5f0c6a56-7d9e-4b0c-9a57-0f4e3d7b8c21"},
+		{ShowFiltered{}, "1:h"},
+		{Cancel{}, "1:x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			data, err := Encode(tt.action)
+			if err != nil {
+				t.Fatalf("Encode(%#v) error: %v", tt.action, err)
+			}
+			if data != tt.want {
+				t.Errorf("Encode(%#v) = %q, want %q", tt.action, data, tt.want)
+			}
+			got, err := Decode(data)
+			if err != nil {
+				t.Fatalf("Decode(%q) error: %v", data, err)
+			}
+			if got != tt.action {
+				t.Errorf("Decode(%q) = %#v, want %#v", data, got, tt.action)
+			}
+		})
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		action Action
+		want   error
+	}{
+		{"too long", PickRelease{ID: strings.Repeat("a", MaxLength)}, ErrTooLong},
+		{"empty field", PickTitle{}, ErrMalformed},
+		{"separator in field", PickRelease{ID: "a:b"}, ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Encode(tt.action); !errors.Is(err, tt.want) {
+				t.Errorf("Encode(%#v) error = %v, want %v", tt.action, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeMaxLength(t *testing.T) {
+	// "1:r:" takes 4 bytes, leaving the rest for the ID
+	fits := PickRelease{ID: strings.Repeat("a", MaxLength-4)}
+	data, err := Encode(fits)
+	if err != nil {
+		t.Fatalf("Encode of %d bytes error: %v", MaxLength, err)
+	}
+	if len(data) != MaxLength {
+		t.Errorf("len(Encode()) = %d, want %d", len(data), MaxLength)
+	}
+
+	tooLong := PickRelease{ID: strings.Repeat("a", MaxLength-3)}
+	if _, err := Encode(tooLong); !errors.Is(err, ErrTooLong) {
+		t.Errorf("Encode of %d bytes error = %v, want %v", MaxLength+1, err, ErrTooLong)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want error
+	}{
+		// Buttons from before the payloads were versioned
+		{"legacy movie", "imdb:tt0133093", ErrStale},
+		{"legacy season", "tvimdb:tt0903747:00 - Specials", ErrStale},
+		{"legacy release", "5f0c6a56-7d9e-4b0c-9a57-0f4e3d7b8c21", ErrStale},
+		{"legacy cancel", "cancel", ErrStale},
+		{"other version", "2:r:5f0c6a56", ErrStale},
+		{"empty", "", ErrStale},
+
+		{"unknown kind", "1:z:tt0133093", ErrUnknownKind},
+		{"too long", "1:r:" + strings.Repeat("a", MaxLength), ErrTooLong},
+
+		{"missing field", "1:r", ErrMalformed},
+		{"extra field", "1:t:tt0133093:extra", ErrMalformed},
+		{"empty field", "1:t:", ErrMalformed},
+		{"season not a number", "1:s:tt0903747:one", ErrMalformed},
+		{"negative season", "1:s:tt0903747:-1", ErrMalformed},
+		{"season missing", "1:s:tt0903747", ErrMalformed},
+		{"cancel with field", "1:x:now", ErrMalformed},
+		{"filtered with field", "1:h:all", ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Decode(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("Decode(%q) = %#v, %v, want error %v", tt.data, got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// indexerCaps is what an indexer's t=caps says it supports.
+type indexerCaps struct {
+	Limits struct {
+		Max     int `xml:"max,attr"`
+		Default int `xml:"default,attr"`
+	} `xml:"limits"`
+	Searching struct {
+		Search      capsSearch `xml:"search"`
+		TVSearch    capsSearch `xml:"tv-search"`
+		MovieSearch capsSearch `xml:"movie-search"`
+	} `xml:"searching"`
+	Categories []capsCategory `xml:"categories>category"`
+}
+
+// capsSearch is one of the search types listed in the caps.
+type capsSearch struct {
+	Available       string `xml:"available,attr"`
+	SupportedParams string `xml:"supportedParams,attr"`
+}
+
+// supports reports whether the search type is available and takes param.
+func (s capsSearch) supports(param string) bool {
+	if s.Available != "yes" {
+		return false
+	}
+	for _, p := range strings.Split(s.SupportedParams, ",") {
+		if strings.TrimSpace(p) == param {
+			return true
+		}
+	}
+	return false
+}
+
+// capsCategory is a category in the indexer's category tree.
+type capsCategory struct {
+	ID      string         `xml:"id,attr"`
+	Name    string         `xml:"name,attr"`
+	Subcats []capsCategory `xml:"subcat"`
+}
+
+// categoryNames are the names indexers give the top level categories in
+// nzbGeekCategories, for finding them when an indexer numbers its own.
+var categoryNames = map[string]string{
+	"2000": "movies",
+	"5000": "tv",
+}
+
+// categoryID returns the indexer's category ID for a bot category: the standard
+// Newznab one unless the caps list it under another ID.
+func (c *indexerCaps) categoryID(category string) string {
+	id := nzbGeekCategories[category]
+	if id == "" {
+		id = "2000" // Default to movies if category is not found
+	}
+	if c == nil || len(c.Categories) == 0 {
+		return id
+	}
+	for _, cat := range c.Categories {
+		if cat.ID == id {
+			return id
+		}
+	}
+	for _, cat := range c.Categories {
+		if strings.EqualFold(cat.Name, categoryNames[id]) {
+			return cat.ID
+		}
+	}
+	return id
+}
+
+// fetchCaps asks the indexer what it supports.
+func (c *nzbGeekClient) fetchCaps(ctx context.Context) (*indexerCaps, error) {
+	fullURL := fmt.Sprintf("%s?apikey=%s&t=caps", c.baseURL, c.apiKey)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fullURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching caps from NZBGeek: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading caps: %v", err)
+	}
+	if err := parseNewznabError(body); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status from NZBGeek: %s", resp.Status)
+	}
+
+	var caps indexerCaps
+	if err := xml.Unmarshal(body, &caps); err != nil {
+		return nil, fmt.Errorf("error decoding caps: %v", err)
+	}
+	return &caps, nil
+}
+
+// capsRetryInterval is how often lookups try loading the caps again when they
+// couldn't be loaded.
+const capsRetryInterval = 10 * time.Minute
+
+// LoadCaps fetches the indexer's capabilities and keeps them for choosing how
+// to search. Until they are loaded, lookups use a plain search by IMDb ID.
+func (c *nzbGeekClient) LoadCaps(ctx context.Context) error {
+	c.mu.Lock()
+	c.capsTried = time.Now()
+	c.mu.Unlock()
+
+	caps, err := c.fetchCaps(ctx)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.caps == nil {
+		slog.Info("Loaded indexer capabilities",
+			"movie_search", caps.Searching.MovieSearch.SupportedParams,
+			"tv_search", caps.Searching.TVSearch.SupportedParams,
+			"categories", len(caps.Categories))
+	}
+	c.caps = caps
+	return nil
+}
+
+// capabilities returns the caps, trying to load them again if they are missing
+// and it has been a while.
+func (c *nzbGeekClient) capabilities() *indexerCaps {
+	c.mu.Lock()
+	caps, retry := c.caps, c.caps == nil && time.Since(c.capsTried) > capsRetryInterval
+	c.mu.Unlock()
+	if !retry {
+		return caps
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := c.LoadCaps(ctx); err != nil {
+		slog.Warn("Error loading indexer capabilities", "err", err)
+		return nil
+	}
+	return c.capabilities()
+}
+
+// rememberTVDBIDs notes the TVDB IDs of the series in a set of results, so
+// later lookups of a series can use them. OMDB doesn't know them, but indexers
+// tag releases with both.
+func (c *nzbGeekClient) rememberTVDBIDs(items []Item) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, item := range items {
+		attrs := item.Newznab
+		if attrs.ImdbID != "" && attrs.TVDBID != "" && attrs.TVDBID != "0" {
+			c.tvdbIDs[strings.TrimPrefix(attrs.ImdbID, "tt")] = attrs.TVDBID
+		}
+	}
+}
+
+func (c *nzbGeekClient) tvdbID(imdbID string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tvdbIDs[imdbID]
+}
+
+// lookupParams picks the most specific search the indexer supports for q:
+// t=movie or t=tvsearch by ID (TVDB where known, else IMDb), t=tvsearch by name
+// for a season, or a plain search by IMDb ID. It returns nil when the indexer
+// can't do better than the text search.
+func (c *nzbGeekClient) lookupParams(q ReleaseQuery) url.Values {
+	caps := c.capabilities()
+	imdbID := strings.TrimPrefix(q.ImdbID, "tt")
+	params := url.Values{"cat": {caps.categoryID(q.Category)}}
+
+	if caps == nil {
+		if imdbID == "" || q.Season >= 0 {
+			return nil
+		}
+		params.Set("t", "search")
+		params.Set("imdbid", imdbID)
+		return params
+	}
+
+	if isSeriesCategory(q.Category) {
+		tv := caps.Searching.TVSearch
+		tvdbID := c.tvdbID(imdbID)
+		switch {
+		case tvdbID != "" && tv.supports("tvdbid"):
+			params.Set("tvdbid", tvdbID)
+		case imdbID != "" && tv.supports("imdbid"):
+			params.Set("imdbid", imdbID)
+		case q.Title != "" && tv.supports("q") && q.Season >= 0:
+			params.Set("q", q.Title)
+		default:
+			return nil
+		}
+		if q.Season >= 0 {
+			if !tv.supports("season") {
+				return nil
+			}
+			params.Set("season", strconv.Itoa(q.Season))
+		}
+		if q.Episode > 0 {
+			if !tv.supports("ep") {
+				return nil
+			}
+			params.Set("ep", strconv.Itoa(q.Episode))
+		}
+		params.Set("t", "tvsearch")
+		return params
+	}
+
+	switch {
+	case imdbID != "" && caps.Searching.MovieSearch.supports("imdbid"):
+		params.Set("t", "movie")
+	case imdbID != "" && caps.Searching.Search.supports("imdbid"):
+		params.Set("t", "search")
+	default:
+		return nil
+	}
+	params.Set("imdbid", imdbID)
+	return params
+}
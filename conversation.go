@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/dx314/movie_beacon_bot/db"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Conversation states. A search moves through them in order, skipping any step
+// whose answer was already given with the command:
+//
+//	await_name -> await_year -> pick_title (or pick_season for TV) -> pick_release
+//
+// A movie that is already in the library stops at confirm_upgrade until the user
+// chooses to look for another copy.
+const (
+	stateAwaitName      = "await_name"
+	stateAwaitYear      = "await_year"
+	statePickTitle      = "pick_title"
+	statePickSeason     = "pick_season"
+	statePickRelease    = "pick_release"
+	stateConfirmUpgrade = "confirm_upgrade"
+)
+
+// conversationTTL is how long a conversation stays alive without the user replying.
+const conversationTTL = 30 * time.Minute
+
+// getConversation returns the user's active conversation, dropping it if it expired.
+func (b *Bot) getConversation(userID int64) (db.Conversation, bool) {
+	conv, err := b.store.GetConversation(context.Background(), userID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Error getting conversation", "user_id", userID, "err", err)
+		}
+		return db.Conversation{}, false
+	}
+
+	if conv.ExpiresAt < b.clock.Now().Unix() {
+		b.endConversation(userID)
+		return db.Conversation{}, false
+	}
+	return conv, true
+}
+
+// saveConversation stores the conversation and pushes its expiry back. A
+// conversation with no state has finished and is removed instead.
+func (b *Bot) saveConversation(conv db.Conversation) {
+	if conv.State == "" {
+		b.endConversation(conv.UserID)
+		return
+	}
+
+	err := b.store.UpsertConversation(context.Background(), db.UpsertConversationParams{
+		UserID:    conv.UserID,
+		ChatID:    conv.ChatID,
+		State:     conv.State,
+		Category:  conv.Category,
+		Name:      conv.Name,
+		Year:      conv.Year,
+		MessageID: conv.MessageID,
+		ExpiresAt: b.clock.Now().Add(conversationTTL).Unix(),
+	})
+	if err != nil {
+		slog.Error("Error saving conversation", "user_id", conv.UserID, "err", err)
+	}
+}
+
+func (b *Bot) endConversation(userID int64) {
+	if err := b.store.DeleteConversation(context.Background(), userID); err != nil {
+		slog.Error("Error deleting conversation", "user_id", userID, "err", err)
+	}
+}
+
+// advanceConversation moves the user's conversation to state, recording the menu
+// message they are expected to pick from next.
+func (b *Bot) advanceConversation(userID int64, state string, messageID int) {
+	conv, ok := b.getConversation(userID)
+	if !ok {
+		return
+	}
+	conv.State = state
+	conv.MessageID = messageID
+	if messageID == 0 {
+		conv.State = ""
+	}
+	b.saveConversation(conv)
+}
+
+func (b *Bot) purgeExpiredConversations() {
+	if err := b.store.DeleteExpiredConversations(context.Background(), b.clock.Now().Unix()); err != nil {
+		slog.Error("Error purging expired conversations", "err", err)
+	}
+}
+
+func isSeriesCategory(category string) bool {
+	return CategoryToType[category] == "series"
+}
+
+// searchCommand builds the command that starts a search conversation for a category.
+func (b *Bot) searchCommand(category string) func(message *tgbotapi.Message) {
+	return func(message *tgbotapi.Message) {
+		name, year := parseMovieCommand(message.CommandArguments())
+		conv := db.Conversation{
+			UserID:   message.From.ID,
+			ChatID:   message.Chat.ID,
+			Category: category,
+			Name:     name,
+			Year:     year,
+		}
+
+		switch {
+		case name == "":
+			b.askForName(&conv)
+		case year == "":
+			b.askForYear(&conv)
+		default:
+			b.runSearch(&conv)
+		}
+		b.saveConversation(conv)
+	}
+}
+
+func (b *Bot) askForName(conv *db.Conversation) {
+	conv.State = stateAwaitName
+	b.sender.Send(tgbotapi.NewMessage(conv.ChatID, "Please provide the name and year."))
+}
+
+func (b *Bot) askForYear(conv *db.Conversation) {
+	conv.State = stateAwaitYear
+	text := fmt.Sprintf("Please provide the year for: %s", conv.Name)
+	if isSeriesCategory(conv.Category) {
+		text += "\n(or send \"skip\" if you don't know it)"
+	}
+	b.sender.Send(tgbotapi.NewMessage(conv.ChatID, text))
+}
+
+// runSearch searches OMDB once the name and year are known, moving the
+// conversation on to picking a result.
+func (b *Bot) runSearch(conv *db.Conversation) {
+	conv.MessageID = 0
+	b.events.Publish(eventSearchPerformed, searchEvent{
+		UserID:   conv.UserID,
+		Category: conv.Category,
+		Query:    conv.Name,
+		Year:     conv.Year,
+		Source:   "telegram",
+	})
+	if isSeriesCategory(conv.Category) {
+		b.doTVSearch(conv)
+	} else {
+		b.doMovieSearch(conv)
+	}
+	if conv.MessageID == 0 {
+		// Nothing was offered, so there is nothing left to pick
+		conv.State = ""
+	}
+}
+
+// handleInput answers free text according to where the user is in their conversation.
+func (b *Bot) handleInput(message *tgbotapi.Message) {
+	conv, ok := b.getConversation(message.From.ID)
+	if !ok {
+		return
+	}
+	text := strings.TrimSpace(message.Text)
+
+	switch conv.State {
+	case stateAwaitName:
+		conv.Name, conv.Year = parseMovieCommand(text)
+		switch {
+		case conv.Name == "":
+			b.askForName(&conv)
+		case conv.Year == "":
+			b.askForYear(&conv)
+		default:
+			b.runSearch(&conv)
+		}
+	case stateAwaitYear:
+		if isSeriesCategory(conv.Category) && strings.EqualFold(text, "skip") {
+			conv.Year = ""
+		} else if year := yearRegex.FindString(text); year != "" {
+			conv.Year = year
+		} else {
+			b.sender.Send(tgbotapi.NewMessage(conv.ChatID, "That doesn't look like a year. Please send something like 1999, or /cancel."))
+			break
+		}
+		b.runSearch(&conv)
+	default:
+		b.sender.Send(tgbotapi.NewMessage(conv.ChatID, "Please pick one of the options above, or use /cancel to start over."))
+	}
+	b.saveConversation(conv)
+}
+
+// handleCancelCommand aborts the user's conversation and removes any open menu.
+func (b *Bot) handleCancelCommand(message *tgbotapi.Message) {
+	conv, ok := b.getConversation(message.From.ID)
+	if !ok {
+		b.sender.Send(tgbotapi.NewMessage(message.Chat.ID, "There's nothing to cancel."))
+		return
+	}
+
+	if conv.MessageID != 0 {
+		if err := b.store.DeleteMessageData(context.Background(), conv.MessageID); err != nil {
+			slog.Error("Error deleting message data", "message_id", conv.MessageID, "err", err)
+		}
+		if _, err := b.sender.Request(tgbotapi.NewDeleteMessage(conv.ChatID, conv.MessageID)); err != nil {
+			slog.Error("Error deleting menu message", "err", err)
+		}
+	}
+	if err := b.store.DeleteUnselectedOptions(context.Background(), db.DeleteUnselectedOptionsParams{ChatID: conv.ChatID}); err != nil {
+		slog.Error("Error removing unselected options", "err", err)
+	}
+
+	b.endConversation(conv.UserID)
+	b.sender.Send(tgbotapi.NewMessage(message.Chat.ID, "Cancelled."))
+}
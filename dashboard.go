@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dx314/movie_beacon_bot/db"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+//go:embed templates/*.html.tmpl
+var dashboardTemplateFS embed.FS
+
+const (
+	sessionCookie   = "beacon_session"
+	sessionLifetime = 12 * time.Hour
+	// telegramLoginMaxAge is how old a Telegram login widget signature may be.
+	telegramLoginMaxAge = 24 * time.Hour
+)
+
+// dashboard is the admin web UI. Admins sign in with DASHBOARD_TOKEN or, when
+// enabled, the Telegram login widget.
+type dashboard struct {
+	bot       *Bot
+	templates *template.Template
+
+	token string
+	// botToken verifies Telegram login widget signatures, and botName shows the
+	// widget. Both are empty when Telegram login is disabled.
+	botToken string
+	botName  string
+
+	// sessionKey signs session cookies. It is generated at startup, so restarting
+	// signs everyone out.
+	sessionKey []byte
+}
+
+// loadDashboard returns the dashboard when DASHBOARD_LISTEN_ADDR is set.
+// DASHBOARD_TELEGRAM_LOGIN enables the Telegram login widget for botName, which
+// needs the bot's domain set with BotFather.
+func loadDashboard(b *Bot, botToken, botName string) (*dashboard, error) {
+	if os.Getenv("DASHBOARD_LISTEN_ADDR") == "" {
+		return nil, nil
+	}
+
+	d := &dashboard{bot: b, token: os.Getenv("DASHBOARD_TOKEN")}
+	if enabled, _ := strconv.ParseBool(os.Getenv("DASHBOARD_TELEGRAM_LOGIN")); enabled {
+		d.botToken = botToken
+		d.botName = botName
+	}
+	if d.token == "" && d.botToken == "" {
+		return nil, errors.New("the dashboard needs DASHBOARD_TOKEN or DASHBOARD_TELEGRAM_LOGIN")
+	}
+
+	d.sessionKey = make([]byte, 32)
+	if _, err := rand.Read(d.sessionKey); err != nil {
+		return nil, err
+	}
+
+	funcs := template.FuncMap{"since": func(t time.Time) string { return time.Since(t).Round(time.Second).String() }}
+	templates, err := template.New("dashboard").Funcs(funcs).ParseFS(dashboardTemplateFS, "templates/*.html.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	d.templates = templates
+	return d, nil
+}
+
+// Handler returns the dashboard's routes.
+func (d *dashboard) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /login", d.handleLoginPage)
+	mux.HandleFunc("POST /login", d.handleTokenLogin)
+	mux.HandleFunc("GET /login/telegram", d.handleTelegramLogin)
+	mux.HandleFunc("POST /logout", d.handleLogout)
+	mux.Handle("GET /{$}", d.requireSession(http.HandlerFunc(d.handleIndex)))
+	mux.Handle("POST /downloads/{id}/cancel", d.requireSession(http.HandlerFunc(d.handleCancel)))
+	mux.Handle("POST /downloads/{id}/retry", d.requireSession(http.HandlerFunc(d.handleRetry)))
+	return mux
+}
+
+func (d *dashboard) render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := d.templates.ExecuteTemplate(w, name, data); err != nil {
+		slog.Error("Error rendering dashboard", "template", name, "err", err)
+	}
+}
+
+// Sessions
+
+// newSession returns a cookie value naming subject, signed with the session key.
+func (d *dashboard) newSession(subject string, expires time.Time) string {
+	payload := fmt.Sprintf("%s|%d", subject, expires.Unix())
+	return payload + "|" + d.sign(payload)
+}
+
+func (d *dashboard) sign(payload string) string {
+	mac := hmac.New(sha256.New, d.sessionKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkSession returns the session's subject if the cookie is valid and unexpired.
+func (d *dashboard) checkSession(value string, now time.Time) (string, bool) {
+	i := strings.LastIndex(value, "|")
+	if i < 0 {
+		return "", false
+	}
+	payload, sig := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(d.sign(payload))) {
+		return "", false
+	}
+	subject, expires, ok := strings.Cut(payload, "|")
+	if !ok {
+		return "", false
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > unix {
+		return "", false
+	}
+	return subject, true
+}
+
+func (d *dashboard) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			if _, ok := d.checkSession(cookie.Value, time.Now()); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	})
+}
+
+func (d *dashboard) startSession(w http.ResponseWriter, r *http.Request, subject string) {
+	expires := time.Now().Add(sessionLifetime)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    d.newSession(subject, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// Strict keeps the action forms from being posted by other sites
+		SameSite: http.SameSiteStrictMode,
+	})
+	slog.Info("Dashboard login", "subject", subject)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Login
+
+type loginPage struct {
+	Error    string
+	Token    bool
+	BotName  string
+	LoginURL string
+}
+
+func (d *dashboard) handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	d.render(w, "login.html.tmpl", loginPage{
+		Error:    r.URL.Query().Get("error"),
+		Token:    d.token != "",
+		BotName:  d.botName,
+		LoginURL: "/login/telegram",
+	})
+}
+
+func (d *dashboard) handleTokenLogin(w http.ResponseWriter, r *http.Request) {
+	token := r.PostFormValue("token")
+	if d.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) != 1 {
+		slog.Warn("Rejected dashboard login", "remote", r.RemoteAddr)
+		http.Redirect(w, r, "/login?error="+url.QueryEscape("Wrong token."), http.StatusSeeOther)
+		return
+	}
+	d.startSession(w, r, "token")
+}
+
+func (d *dashboard) handleTelegramLogin(w http.ResponseWriter, r *http.Request) {
+	if d.botToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	userID, err := verifyTelegramLogin(r.URL.Query(), d.botToken, time.Now())
+	if err != nil {
+		slog.Warn("Rejected Telegram dashboard login", "remote", r.RemoteAddr, "err", err)
+		http.Redirect(w, r, "/login?error="+url.QueryEscape("Telegram login failed."), http.StatusSeeOther)
+		return
+	}
+	if !isAdmin(&tgbotapi.User{ID: userID}, 0) {
+		slog.Warn("Rejected Telegram dashboard login", "user_id", userID, "err", "not an admin")
+		http.Redirect(w, r, "/login?error="+url.QueryEscape("Only admins can use the dashboard."), http.StatusSeeOther)
+		return
+	}
+	d.startSession(w, r, fmt.Sprintf("telegram:%d", userID))
+}
+
+// verifyTelegramLogin checks the signature the Telegram login widget adds to its
+// redirect and returns the signed-in user's ID. See
+// https://core.telegram.org/widgets/login#checking-authorization.
+func verifyTelegramLogin(values url.Values, botToken string, now time.Time) (int64, error) {
+	hash := values.Get("hash")
+	if hash == "" {
+		return 0, errors.New("missing hash")
+	}
+
+	var fields []string
+	for key := range values {
+		if key != "hash" {
+			fields = append(fields, key+"="+values.Get(key))
+		}
+	}
+	sort.Strings(fields)
+
+	secret := sha256.Sum256([]byte(botToken))
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte(strings.Join(fields, "\n")))
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(hash)) {
+		return 0, errors.New("bad signature")
+	}
+
+	authDate, err := strconv.ParseInt(values.Get("auth_date"), 10, 64)
+	if err != nil {
+		return 0, errors.New("missing auth_date")
+	}
+	if now.Sub(time.Unix(authDate, 0)) > telegramLoginMaxAge {
+		return 0, errors.New("login has expired")
+	}
+
+	return strconv.ParseInt(values.Get("id"), 10, 64)
+}
+
+func (d *dashboard) handleLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// Pages
+
+type dashboardPage struct {
+	Message string
+	Error   string
+	// Refresh reloads the page every so many seconds while downloads are active.
+	Refresh int
+
+	HasHealth  bool
+	Live       bool
+	LiveReason string
+	Checks     []checkResult
+
+	Active  []downloadRow
+	History []downloadRow
+	Users   []userRow
+}
+
+type downloadRow struct {
+	db.NzbInfo
+	Progress string
+	Updated  time.Time
+}
+
+// Active reports whether the download is still in SABnzbd.
+func (r downloadRow) Active() bool {
+	switch r.Status {
+	case "Completed", "Failed", "Cancelled", "Deleted":
+		return false
+	}
+	return true
+}
+
+// Retryable reports whether the download can be queued again.
+func (r downloadRow) Retryable() bool {
+	return r.Status == "Failed" || r.Status == "Cancelled"
+}
+
+type userRow struct {
+	ID        int64
+	Role      string
+	Downloads int
+}
+
+// dashboardHistory is how many past downloads the dashboard lists.
+const dashboardHistory = 100
+
+func (d *dashboard) handleIndex(w http.ResponseWriter, r *http.Request) {
+	page := dashboardPage{
+		Message: r.URL.Query().Get("message"),
+		Error:   r.URL.Query().Get("error"),
+	}
+
+	if d.bot.health != nil {
+		page.HasHealth = true
+		page.Live, page.LiveReason = d.bot.health.Live()
+		_, page.Checks = d.bot.health.Ready(r.Context())
+	}
+
+	downloads, err := d.bot.store.ListDownloads(r.Context(), dashboardHistory)
+	if err != nil {
+		slog.Error("Error listing downloads", "err", err)
+		page.Error = "Couldn't load downloads."
+	}
+	for _, info := range downloads {
+		row := downloadRow{NzbInfo: info, Updated: time.Unix(info.LastUpdated, 0)}
+		if row.Active() {
+			if _, progress, err := d.bot.downloads.Progress(info.SabnzbdID); err == nil {
+				row.Progress = progress
+			}
+			page.Active = append(page.Active, row)
+		} else {
+			page.History = append(page.History, row)
+		}
+	}
+	page.Users = dashboardUsers(downloads)
+	if len(page.Active) > 0 {
+		page.Refresh = 15
+	}
+
+	d.render(w, "dashboard.html.tmpl", page)
+}
+
+// dashboardUsers lists the configured users and anyone who has downloaded
+// something, with their role and download count.
+func dashboardUsers(downloads []db.NzbInfo) []userRow {
+	allowed := parseUserIDs(os.Getenv("TELEGRAM_ALLOWED_USERS"))
+	admins := parseUserIDs(os.Getenv("TELEGRAM_ADMIN_USERS"))
+
+	counts := make(map[int64]int)
+	for id := range allowed {
+		counts[id] = 0
+	}
+	for id := range admins {
+		counts[id] = 0
+	}
+	for _, info := range downloads {
+		// Downloads are keyed by chat, which is the user for private chats
+		counts[info.ChatID]++
+	}
+
+	var users []userRow
+	for id, n := range counts {
+		role := "not allowed"
+		switch {
+		case admins[id]:
+			role = "admin"
+		case len(allowed) == 0 || allowed[id]:
+			role = "user"
+		}
+		users = append(users, userRow{ID: id, Role: role, Downloads: n})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+func (d *dashboard) handleCancel(w http.ResponseWriter, r *http.Request) {
+	d.runAction(w, r, "Cancelled", d.bot.cancelDownload)
+}
+
+func (d *dashboard) handleRetry(w http.ResponseWriter, r *http.Request) {
+	// Retries from the dashboard are an admin's decision, so no quota applies
+	d.runAction(w, r, "Retrying", func(nzbUUID string) error {
+		return d.bot.retryDownload(nzbUUID, grabber{Admin: true})
+	})
+}
+
+// runAction applies action to the download in the path and redirects back to the
+// dashboard with the outcome.
+func (d *dashboard) runAction(w http.ResponseWriter, r *http.Request, done string, action func(string) error) {
+	id := r.PathValue("id")
+	info, err := d.bot.store.GetNZBInfo(context.Background(), id)
+	if err == nil {
+		err = action(id)
+	}
+	if err != nil {
+		slog.Error("Dashboard action failed", "nzb_id", id, "err", err)
+		http.Redirect(w, r, "/?error="+url.QueryEscape(redactSecrets(err.Error())), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/?message="+url.QueryEscape(done+" "+info.Name), http.StatusSeeOther)
+}
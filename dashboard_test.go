@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBotToken = "123456:test-bot-token"
+
+// signTelegramLogin adds the hash the Telegram login widget would to values.
+func signTelegramLogin(values url.Values, botToken string) url.Values {
+	var fields []string
+	for key := range values {
+		fields = append(fields, key+"="+values.Get(key))
+	}
+	sort.Strings(fields)
+	secret := sha256.Sum256([]byte(botToken))
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte(strings.Join(fields, "\n")))
+
+	signed := url.Values{"hash": {hex.EncodeToString(mac.Sum(nil))}}
+	for key := range values {
+		signed.Set(key, values.Get(key))
+	}
+	return signed
+}
+
+func TestVerifyTelegramLogin(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	login := func(authDate time.Time) url.Values {
+		return url.Values{
+			"id":         {"2002"},
+			"first_name": {"Test"},
+			"username":   {"tester"},
+			"auth_date":  {strconv.FormatInt(authDate.Unix(), 10)},
+		}
+	}
+	tampered := signTelegramLogin(login(now), testBotToken)
+	tampered.Set("id", "1")
+	badHash := signTelegramLogin(login(now), testBotToken)
+	badHash.Set("hash", strings.Repeat("0", 64))
+	noHash := signTelegramLogin(login(now), testBotToken)
+	noHash.Del("hash")
+
+	tests := []struct {
+		name    string
+		values  url.Values
+		wantID  int64
+		wantErr string
+	}{
+		{"valid", signTelegramLogin(login(now.Add(-time.Hour)), testBotToken), 2002, ""},
+		{"tampered field", tampered, 0, "bad signature"},
+		{"tampered hash", badHash, 0, "bad signature"},
+		{"missing hash", noHash, 0, "missing hash"},
+		{"other bot's token", signTelegramLogin(login(now), "654321:other-token"), 0, "bad signature"},
+		{"expired auth_date", signTelegramLogin(login(now.Add(-telegramLoginMaxAge-time.Minute)), testBotToken), 0, "expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := verifyTelegramLogin(tt.values, testBotToken, now)
+			if tt.wantErr == "" {
+				if err != nil || id != tt.wantID {
+					t.Errorf("verifyTelegramLogin() = %d, %v, want %d", id, err, tt.wantID)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verifyTelegramLogin() = %d, %v, want error %q", id, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckSession(t *testing.T) {
+	d := &dashboard{sessionKey: []byte("0123456789abcdef0123456789abcdef")}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	valid := d.newSession("telegram:2002", now.Add(sessionLifetime))
+	parts := strings.Split(valid, "|") // subject|expiry|signature
+	subject, expires, sig := parts[0], parts[1], parts[2]
+
+	tests := []struct {
+		name   string
+		cookie string
+		now    time.Time
+		want   bool
+	}{
+		{"valid", valid, now, true},
+		{"at expiry", valid, now.Add(sessionLifetime), true},
+		{"expired", valid, now.Add(sessionLifetime + time.Second), false},
+		{"tampered subject", "telegram:1|" + expires + "|" + sig, now, false},
+		{"tampered expiry", subject + "|" + strconv.FormatInt(now.Add(365*24*time.Hour).Unix(), 10) + "|" + sig, now, false},
+		{"tampered signature", subject + "|" + expires + "|" + strings.Repeat("A", len(sig)), now, false},
+		{"other key", (&dashboard{sessionKey: []byte("another key")}).newSession("telegram:2002", now.Add(time.Hour)), now, false},
+		{"no signature", subject + "|" + expires, now, false},
+		{"empty", "", now, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := d.checkSession(tt.cookie, tt.now)
+			if ok != tt.want {
+				t.Fatalf("checkSession(%q) ok = %v, want %v", tt.cookie, ok, tt.want)
+			}
+			if ok && got != subject {
+				t.Errorf("checkSession() subject = %q, want %q", got, subject)
+			}
+		})
+	}
+}
@@ -4,12 +4,47 @@
 
 package db
 
+type ApiKey struct {
+	KeyHash   string `json:"key_hash"`
+	UserID    int64  `json:"user_id"`
+	Scopes    string `json:"scopes"`
+	CreatedAt int64  `json:"created_at"`
+	LastUsed  int64  `json:"last_used"`
+}
+
+type Conversation struct {
+	UserID    int64  `json:"user_id"`
+	ChatID    int64  `json:"chat_id"`
+	State     string `json:"state"`
+	Category  string `json:"category"`
+	Name      string `json:"name"`
+	Year      string `json:"year"`
+	MessageID int    `json:"message_id"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type Grab struct {
+	ID        int    `json:"id"`
+	UserID    int64  `json:"user_id"`
+	NzbID     string `json:"nzb_id"`
+	Size      int64  `json:"size"`
+	GrabbedAt int64  `json:"grabbed_at"`
+}
+
+type IndexerUsage struct {
+	Indexer string `json:"indexer"`
+	Day     string `json:"day"`
+	Hits    int64  `json:"hits"`
+	Grabs   int64  `json:"grabs"`
+}
+
 type MsgDatum struct {
 	MessageID int    `json:"message_id"`
 	UserID    int64  `json:"user_id"`
 	Search    string `json:"search"`
 	Year      string `json:"year"`
 	Category  string `json:"category"`
+	ImdbID    string `json:"imdb_id"`
 }
 
 type NzbInfo struct {
@@ -23,4 +58,37 @@ type NzbInfo struct {
 	Status      string `json:"status"`
 	LastUpdated int64  `json:"last_updated"`
 	Selected    int    `json:"selected"`
+	ImdbID      string `json:"imdb_id"`
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	Guid        string `json:"guid"`
+	SearchID    string `json:"search_id"`
+}
+
+type PlatformRef struct {
+	ID         int64  `json:"id"`
+	Platform   string `json:"platform"`
+	Kind       string `json:"kind"`
+	ExternalID string `json:"external_id"`
+}
+
+type QuotaOverride struct {
+	UserID    int64 `json:"user_id"`
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+type UserLink struct {
+	UserID   int64 `json:"user_id"`
+	LinkedTo int64 `json:"linked_to"`
+}
+
+type WebhookDelivery struct {
+	ID          int    `json:"id"`
+	Webhook     string `json:"webhook"`
+	Event       string `json:"event"`
+	Payload     string `json:"payload"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"next_attempt"`
+	LastError   string `json:"last_error"`
+	CreatedAt   int64  `json:"created_at"`
 }
@@ -9,6 +9,65 @@ import (
 	"context"
 )
 
+const claimRelease = `-- name: ClaimRelease :execrows
+UPDATE nzb_info
+SET selected = TRUE
+WHERE id = ?
+  AND selected = FALSE
+`
+
+func (q *Queries) ClaimRelease(ctx context.Context, id string) (int64, error) {
+	result, err := q.db.ExecContext(ctx, claimRelease, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteConversation = `-- name: DeleteConversation :exec
+DELETE
+FROM conversation
+WHERE user_id = ?
+`
+
+func (q *Queries) DeleteConversation(ctx context.Context, userID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteConversation, userID)
+	return err
+}
+
+const deleteExpiredConversations = `-- name: DeleteExpiredConversations :exec
+DELETE
+FROM conversation
+WHERE expires_at < ?
+`
+
+func (q *Queries) DeleteExpiredConversations(ctx context.Context, expiresAt int64) error {
+	_, err := q.db.ExecContext(ctx, deleteExpiredConversations, expiresAt)
+	return err
+}
+
+const deleteGrabsBefore = `-- name: DeleteGrabsBefore :exec
+DELETE
+FROM grab
+WHERE grabbed_at < ?
+`
+
+func (q *Queries) DeleteGrabsBefore(ctx context.Context, grabbedAt int64) error {
+	_, err := q.db.ExecContext(ctx, deleteGrabsBefore, grabbedAt)
+	return err
+}
+
+const deleteIndexerUsageBefore = `-- name: DeleteIndexerUsageBefore :exec
+DELETE
+FROM indexer_usage
+WHERE day < ?
+`
+
+func (q *Queries) DeleteIndexerUsageBefore(ctx context.Context, day string) error {
+	_, err := q.db.ExecContext(ctx, deleteIndexerUsageBefore, day)
+	return err
+}
+
 const deleteMessageData = `-- name: DeleteMessageData :exec
 DELETE FROM msg_data
 WHERE message_id = ?
@@ -30,23 +89,271 @@ func (q *Queries) DeleteNZBInfo(ctx context.Context, id string) error {
 	return err
 }
 
+const deleteQuotaOverride = `-- name: DeleteQuotaOverride :exec
+DELETE
+FROM quota_override
+WHERE user_id = ?
+`
+
+func (q *Queries) DeleteQuotaOverride(ctx context.Context, userID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteQuotaOverride, userID)
+	return err
+}
+
 const deleteUnselectedOptions = `-- name: DeleteUnselectedOptions :exec
 DELETE
 FROM nzb_info
 WHERE chat_id = ?
+  AND search_id = ?
   AND selected = FALSE
 `
 
-func (q *Queries) DeleteUnselectedOptions(ctx context.Context, chatID int64) error {
-	_, err := q.db.ExecContext(ctx, deleteUnselectedOptions, chatID)
+type DeleteUnselectedOptionsParams struct {
+	ChatID   int64  `json:"chat_id"`
+	SearchID string `json:"search_id"`
+}
+
+func (q *Queries) DeleteUnselectedOptions(ctx context.Context, arg DeleteUnselectedOptionsParams) error {
+	_, err := q.db.ExecContext(ctx, deleteUnselectedOptions, arg.ChatID, arg.SearchID)
+	return err
+}
+
+const deleteUserAPIKeys = `-- name: DeleteUserAPIKeys :exec
+DELETE
+FROM api_key
+WHERE user_id = ?
+`
+
+func (q *Queries) DeleteUserAPIKeys(ctx context.Context, userID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteUserAPIKeys, userID)
+	return err
+}
+
+const deleteUserLink = `-- name: DeleteUserLink :exec
+DELETE
+FROM user_link
+WHERE user_id = ?
+`
+
+func (q *Queries) DeleteUserLink(ctx context.Context, userID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteUserLink, userID)
+	return err
+}
+
+const deleteWebhookDelivery = `-- name: DeleteWebhookDelivery :exec
+DELETE
+FROM webhook_delivery
+WHERE id = ?
+`
+
+func (q *Queries) DeleteWebhookDelivery(ctx context.Context, id int) error {
+	_, err := q.db.ExecContext(ctx, deleteWebhookDelivery, id)
 	return err
 }
 
+const getAPIKey = `-- name: GetAPIKey :one
+SELECT key_hash, user_id, scopes, created_at, last_used
+FROM api_key
+WHERE key_hash = ?
+LIMIT 1
+`
+
+func (q *Queries) GetAPIKey(ctx context.Context, keyHash string) (ApiKey, error) {
+	row := q.db.QueryRowContext(ctx, getAPIKey, keyHash)
+	var i ApiKey
+	err := row.Scan(
+		&i.KeyHash,
+		&i.UserID,
+		&i.Scopes,
+		&i.CreatedAt,
+		&i.LastUsed,
+	)
+	return i, err
+}
+
+const getCompletedDownloads = `-- name: GetCompletedDownloads :many
+SELECT id, url, name, category, sabnzbd_id, chat_id, message_id, status, last_updated, selected, imdb_id, path, size, guid, search_id
+FROM nzb_info
+WHERE chat_id = ?
+  AND status = 'Completed'
+ORDER BY last_updated DESC
+LIMIT ?
+`
+
+type GetCompletedDownloadsParams struct {
+	ChatID int64 `json:"chat_id"`
+	Limit  int64 `json:"limit"`
+}
+
+func (q *Queries) GetCompletedDownloads(ctx context.Context, arg GetCompletedDownloadsParams) ([]NzbInfo, error) {
+	rows, err := q.db.QueryContext(ctx, getCompletedDownloads, arg.ChatID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []NzbInfo
+	for rows.Next() {
+		var i NzbInfo
+		if err := rows.Scan(
+			&i.ID,
+			&i.Url,
+			&i.Name,
+			&i.Category,
+			&i.SabnzbdID,
+			&i.ChatID,
+			&i.MessageID,
+			&i.Status,
+			&i.LastUpdated,
+			&i.Selected,
+			&i.ImdbID,
+			&i.Path,
+			&i.Size,
+			&i.Guid,
+			&i.SearchID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getConversation = `-- name: GetConversation :one
+SELECT user_id, chat_id, state, category, name, year, message_id, expires_at
+FROM conversation
+WHERE user_id = ?
+LIMIT 1
+`
+
+func (q *Queries) GetConversation(ctx context.Context, userID int64) (Conversation, error) {
+	row := q.db.QueryRowContext(ctx, getConversation, userID)
+	var i Conversation
+	err := row.Scan(
+		&i.UserID,
+		&i.ChatID,
+		&i.State,
+		&i.Category,
+		&i.Name,
+		&i.Year,
+		&i.MessageID,
+		&i.ExpiresAt,
+	)
+	return i, err
+}
+
+const getDueWebhookDeliveries = `-- name: GetDueWebhookDeliveries :many
+SELECT id, webhook, event, payload, attempts, next_attempt, last_error, created_at
+FROM webhook_delivery
+WHERE next_attempt <= ?
+ORDER BY id
+LIMIT ?
+`
+
+type GetDueWebhookDeliveriesParams struct {
+	NextAttempt int64 `json:"next_attempt"`
+	Limit       int64 `json:"limit"`
+}
+
+func (q *Queries) GetDueWebhookDeliveries(ctx context.Context, arg GetDueWebhookDeliveriesParams) ([]WebhookDelivery, error) {
+	rows, err := q.db.QueryContext(ctx, getDueWebhookDeliveries, arg.NextAttempt, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []WebhookDelivery
+	for rows.Next() {
+		var i WebhookDelivery
+		if err := rows.Scan(
+			&i.ID,
+			&i.Webhook,
+			&i.Event,
+			&i.Payload,
+			&i.Attempts,
+			&i.NextAttempt,
+			&i.LastError,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getGrabUsage = `-- name: GetGrabUsage :one
+SELECT COUNT(*)                               AS grabs,
+       CAST(COALESCE(SUM(size), 0) AS INTEGER) AS bytes
+FROM grab
+WHERE user_id = ?
+  AND grabbed_at >= ?
+`
+
+type GetGrabUsageParams struct {
+	UserID    int64 `json:"user_id"`
+	GrabbedAt int64 `json:"grabbed_at"`
+}
+
+type GetGrabUsageRow struct {
+	Grabs int64 `json:"grabs"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (q *Queries) GetGrabUsage(ctx context.Context, arg GetGrabUsageParams) (GetGrabUsageRow, error) {
+	row := q.db.QueryRowContext(ctx, getGrabUsage, arg.UserID, arg.GrabbedAt)
+	var i GetGrabUsageRow
+	err := row.Scan(&i.Grabs, &i.Bytes)
+	return i, err
+}
+
+const getGrabbedRelease = `-- name: GetGrabbedRelease :one
+SELECT id, url, name, category, sabnzbd_id, chat_id, message_id, status, last_updated, selected, imdb_id, path, size, guid, search_id
+FROM nzb_info
+WHERE guid = ?
+  AND selected = TRUE
+ORDER BY last_updated DESC
+LIMIT 1
+`
+
+func (q *Queries) GetGrabbedRelease(ctx context.Context, guid string) (NzbInfo, error) {
+	row := q.db.QueryRowContext(ctx, getGrabbedRelease, guid)
+	var i NzbInfo
+	err := row.Scan(
+		&i.ID,
+		&i.Url,
+		&i.Name,
+		&i.Category,
+		&i.SabnzbdID,
+		&i.ChatID,
+		&i.MessageID,
+		&i.Status,
+		&i.LastUpdated,
+		&i.Selected,
+		&i.ImdbID,
+		&i.Path,
+		&i.Size,
+		&i.Guid,
+		&i.SearchID,
+	)
+	return i, err
+}
+
 const getIncompleteDownloads = `-- name: GetIncompleteDownloads :many
-SELECT id, url, name, category, sabnzbd_id, chat_id, message_id, status, last_updated, selected
+SELECT id, url, name, category, sabnzbd_id, chat_id, message_id, status, last_updated, selected, imdb_id, path, size, guid, search_id
 FROM nzb_info
 WHERE selected = TRUE
-  AND status NOT IN ('Completed', 'Failed')
+  AND status NOT IN ('Completed', 'Failed', 'Cancelled')
 `
 
 func (q *Queries) GetIncompleteDownloads(ctx context.Context) ([]NzbInfo, error) {
@@ -69,6 +376,11 @@ func (q *Queries) GetIncompleteDownloads(ctx context.Context) ([]NzbInfo, error)
 			&i.Status,
 			&i.LastUpdated,
 			&i.Selected,
+			&i.ImdbID,
+			&i.Path,
+			&i.Size,
+			&i.Guid,
+			&i.SearchID,
 		); err != nil {
 			return nil, err
 		}
@@ -83,8 +395,33 @@ func (q *Queries) GetIncompleteDownloads(ctx context.Context) ([]NzbInfo, error)
 	return items, nil
 }
 
+const getIndexerUsage = `-- name: GetIndexerUsage :one
+SELECT indexer, day, hits, grabs
+FROM indexer_usage
+WHERE indexer = ?
+  AND day = ?
+LIMIT 1
+`
+
+type GetIndexerUsageParams struct {
+	Indexer string `json:"indexer"`
+	Day     string `json:"day"`
+}
+
+func (q *Queries) GetIndexerUsage(ctx context.Context, arg GetIndexerUsageParams) (IndexerUsage, error) {
+	row := q.db.QueryRowContext(ctx, getIndexerUsage, arg.Indexer, arg.Day)
+	var i IndexerUsage
+	err := row.Scan(
+		&i.Indexer,
+		&i.Day,
+		&i.Hits,
+		&i.Grabs,
+	)
+	return i, err
+}
+
 const getMessageData = `-- name: GetMessageData :one
-SELECT message_id, user_id, search, year, category FROM msg_data
+SELECT message_id, user_id, search, year, category, imdb_id FROM msg_data
 WHERE message_id = ?
 `
 
@@ -97,12 +434,13 @@ func (q *Queries) GetMessageData(ctx context.Context, messageID int) (MsgDatum,
 		&i.Search,
 		&i.Year,
 		&i.Category,
+		&i.ImdbID,
 	)
 	return i, err
 }
 
 const getNZBInfo = `-- name: GetNZBInfo :one
-SELECT id, url, name, category, sabnzbd_id, chat_id, message_id, status, last_updated, selected
+SELECT id, url, name, category, sabnzbd_id, chat_id, message_id, status, last_updated, selected, imdb_id, path, size, guid, search_id
 FROM nzb_info
 WHERE id = ?
 LIMIT 1
@@ -122,12 +460,134 @@ func (q *Queries) GetNZBInfo(ctx context.Context, id string) (NzbInfo, error) {
 		&i.Status,
 		&i.LastUpdated,
 		&i.Selected,
+		&i.ImdbID,
+		&i.Path,
+		&i.Size,
+		&i.Guid,
+		&i.SearchID,
+	)
+	return i, err
+}
+
+const getPlatformRef = `-- name: GetPlatformRef :one
+SELECT id, platform, kind, external_id
+FROM platform_ref
+WHERE id = ?
+LIMIT 1
+`
+
+func (q *Queries) GetPlatformRef(ctx context.Context, id int64) (PlatformRef, error) {
+	row := q.db.QueryRowContext(ctx, getPlatformRef, id)
+	var i PlatformRef
+	err := row.Scan(
+		&i.ID,
+		&i.Platform,
+		&i.Kind,
+		&i.ExternalID,
 	)
 	return i, err
 }
 
+const getQuotaOverride = `-- name: GetQuotaOverride :one
+SELECT expires_at
+FROM quota_override
+WHERE user_id = ?
+LIMIT 1
+`
+
+func (q *Queries) GetQuotaOverride(ctx context.Context, userID int64) (int64, error) {
+	row := q.db.QueryRowContext(ctx, getQuotaOverride, userID)
+	var expires_at int64
+	err := row.Scan(&expires_at)
+	return expires_at, err
+}
+
+const getUserLink = `-- name: GetUserLink :one
+SELECT linked_to
+FROM user_link
+WHERE user_id = ?
+LIMIT 1
+`
+
+func (q *Queries) GetUserLink(ctx context.Context, userID int64) (int64, error) {
+	row := q.db.QueryRowContext(ctx, getUserLink, userID)
+	var linked_to int64
+	err := row.Scan(&linked_to)
+	return linked_to, err
+}
+
+const incrementIndexerUsage = `-- name: IncrementIndexerUsage :exec
+INSERT INTO indexer_usage (indexer, day, hits, grabs)
+VALUES (?, ?, ?, ?)
+ON CONFLICT(indexer, day)
+    DO UPDATE
+    SET hits  = hits + excluded.hits,
+        grabs = grabs + excluded.grabs
+`
+
+type IncrementIndexerUsageParams struct {
+	Indexer string `json:"indexer"`
+	Day     string `json:"day"`
+	Hits    int64  `json:"hits"`
+	Grabs   int64  `json:"grabs"`
+}
+
+func (q *Queries) IncrementIndexerUsage(ctx context.Context, arg IncrementIndexerUsageParams) error {
+	_, err := q.db.ExecContext(ctx, incrementIndexerUsage,
+		arg.Indexer,
+		arg.Day,
+		arg.Hits,
+		arg.Grabs,
+	)
+	return err
+}
+
+const insertAPIKey = `-- name: InsertAPIKey :exec
+INSERT INTO api_key (key_hash, user_id, scopes, created_at)
+VALUES (?, ?, ?, ?)
+`
+
+type InsertAPIKeyParams struct {
+	KeyHash   string `json:"key_hash"`
+	UserID    int64  `json:"user_id"`
+	Scopes    string `json:"scopes"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func (q *Queries) InsertAPIKey(ctx context.Context, arg InsertAPIKeyParams) error {
+	_, err := q.db.ExecContext(ctx, insertAPIKey,
+		arg.KeyHash,
+		arg.UserID,
+		arg.Scopes,
+		arg.CreatedAt,
+	)
+	return err
+}
+
+const insertGrab = `-- name: InsertGrab :exec
+INSERT INTO grab (user_id, nzb_id, size, grabbed_at)
+VALUES (?, ?, ?, ?)
+`
+
+type InsertGrabParams struct {
+	UserID    int64  `json:"user_id"`
+	NzbID     string `json:"nzb_id"`
+	Size      int64  `json:"size"`
+	GrabbedAt int64  `json:"grabbed_at"`
+}
+
+func (q *Queries) InsertGrab(ctx context.Context, arg InsertGrabParams) error {
+	_, err := q.db.ExecContext(ctx, insertGrab,
+		arg.UserID,
+		arg.NzbID,
+		arg.Size,
+		arg.GrabbedAt,
+	)
+	return err
+}
+
 const insertMessageData = `-- name: InsertMessageData :one
-INSERT INTO msg_data (message_id, user_id, category, year, search) VALUES (?, ?, ?, ?, ?) RETURNING message_id, user_id, search, year, category
+INSERT INTO msg_data (message_id, user_id, category, year, search, imdb_id) VALUES (?, ?, ?, ?, ?, ?) RETURNING message_id, user_id, search, year, category, imdb_id
 `
 
 type InsertMessageDataParams struct {
@@ -136,6 +596,7 @@ type InsertMessageDataParams struct {
 	Category  string `json:"category"`
 	Year      string `json:"year"`
 	Search    string `json:"search"`
+	ImdbID    string `json:"imdb_id"`
 }
 
 func (q *Queries) InsertMessageData(ctx context.Context, arg InsertMessageDataParams) (MsgDatum, error) {
@@ -145,6 +606,7 @@ func (q *Queries) InsertMessageData(ctx context.Context, arg InsertMessageDataPa
 		arg.Category,
 		arg.Year,
 		arg.Search,
+		arg.ImdbID,
 	)
 	var i MsgDatum
 	err := row.Scan(
@@ -153,13 +615,234 @@ func (q *Queries) InsertMessageData(ctx context.Context, arg InsertMessageDataPa
 		&i.Search,
 		&i.Year,
 		&i.Category,
+		&i.ImdbID,
 	)
 	return i, err
 }
 
+const insertWebhookDelivery = `-- name: InsertWebhookDelivery :exec
+INSERT INTO webhook_delivery (webhook, event, payload, next_attempt, created_at)
+VALUES (?, ?, ?, ?, ?)
+`
+
+type InsertWebhookDeliveryParams struct {
+	Webhook     string `json:"webhook"`
+	Event       string `json:"event"`
+	Payload     string `json:"payload"`
+	NextAttempt int64  `json:"next_attempt"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+func (q *Queries) InsertWebhookDelivery(ctx context.Context, arg InsertWebhookDeliveryParams) error {
+	_, err := q.db.ExecContext(ctx, insertWebhookDelivery,
+		arg.Webhook,
+		arg.Event,
+		arg.Payload,
+		arg.NextAttempt,
+		arg.CreatedAt,
+	)
+	return err
+}
+
+const listChatDownloads = `-- name: ListChatDownloads :many
+SELECT id, url, name, category, sabnzbd_id, chat_id, message_id, status, last_updated, selected, imdb_id, path, size, guid, search_id
+FROM nzb_info
+WHERE chat_id = ?
+  AND selected = TRUE
+ORDER BY last_updated DESC
+LIMIT ?
+`
+
+type ListChatDownloadsParams struct {
+	ChatID int64 `json:"chat_id"`
+	Limit  int64 `json:"limit"`
+}
+
+func (q *Queries) ListChatDownloads(ctx context.Context, arg ListChatDownloadsParams) ([]NzbInfo, error) {
+	rows, err := q.db.QueryContext(ctx, listChatDownloads, arg.ChatID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []NzbInfo
+	for rows.Next() {
+		var i NzbInfo
+		if err := rows.Scan(
+			&i.ID,
+			&i.Url,
+			&i.Name,
+			&i.Category,
+			&i.SabnzbdID,
+			&i.ChatID,
+			&i.MessageID,
+			&i.Status,
+			&i.LastUpdated,
+			&i.Selected,
+			&i.ImdbID,
+			&i.Path,
+			&i.Size,
+			&i.Guid,
+			&i.SearchID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listDownloads = `-- name: ListDownloads :many
+SELECT id, url, name, category, sabnzbd_id, chat_id, message_id, status, last_updated, selected, imdb_id, path, size, guid, search_id
+FROM nzb_info
+WHERE selected = TRUE
+ORDER BY last_updated DESC
+LIMIT ?
+`
+
+func (q *Queries) ListDownloads(ctx context.Context, limit int64) ([]NzbInfo, error) {
+	rows, err := q.db.QueryContext(ctx, listDownloads, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []NzbInfo
+	for rows.Next() {
+		var i NzbInfo
+		if err := rows.Scan(
+			&i.ID,
+			&i.Url,
+			&i.Name,
+			&i.Category,
+			&i.SabnzbdID,
+			&i.ChatID,
+			&i.MessageID,
+			&i.Status,
+			&i.LastUpdated,
+			&i.Selected,
+			&i.ImdbID,
+			&i.Path,
+			&i.Size,
+			&i.Guid,
+			&i.SearchID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const rescheduleWebhookDelivery = `-- name: RescheduleWebhookDelivery :exec
+UPDATE webhook_delivery
+SET attempts     = ?,
+    next_attempt = ?,
+    last_error   = ?
+WHERE id = ?
+`
+
+type RescheduleWebhookDeliveryParams struct {
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"next_attempt"`
+	LastError   string `json:"last_error"`
+	ID          int    `json:"id"`
+}
+
+func (q *Queries) RescheduleWebhookDelivery(ctx context.Context, arg RescheduleWebhookDeliveryParams) error {
+	_, err := q.db.ExecContext(ctx, rescheduleWebhookDelivery,
+		arg.Attempts,
+		arg.NextAttempt,
+		arg.LastError,
+		arg.ID,
+	)
+	return err
+}
+
+const setNZBPath = `-- name: SetNZBPath :exec
+UPDATE nzb_info
+SET path = ?
+WHERE id = ?
+`
+
+type SetNZBPathParams struct {
+	Path string `json:"path"`
+	ID   string `json:"id"`
+}
+
+func (q *Queries) SetNZBPath(ctx context.Context, arg SetNZBPathParams) error {
+	_, err := q.db.ExecContext(ctx, setNZBPath, arg.Path, arg.ID)
+	return err
+}
+
+const touchAPIKey = `-- name: TouchAPIKey :exec
+UPDATE api_key
+SET last_used = ?
+WHERE key_hash = ?
+`
+
+type TouchAPIKeyParams struct {
+	LastUsed int64  `json:"last_used"`
+	KeyHash  string `json:"key_hash"`
+}
+
+func (q *Queries) TouchAPIKey(ctx context.Context, arg TouchAPIKeyParams) error {
+	_, err := q.db.ExecContext(ctx, touchAPIKey, arg.LastUsed, arg.KeyHash)
+	return err
+}
+
+const upsertConversation = `-- name: UpsertConversation :exec
+INSERT INTO conversation (user_id, chat_id, state, category, name, year, message_id, expires_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(user_id)
+    DO UPDATE
+    SET chat_id    = excluded.chat_id,
+        state      = excluded.state,
+        category   = excluded.category,
+        name       = excluded.name,
+        year       = excluded.year,
+        message_id = excluded.message_id,
+        expires_at = excluded.expires_at
+`
+
+type UpsertConversationParams struct {
+	UserID    int64  `json:"user_id"`
+	ChatID    int64  `json:"chat_id"`
+	State     string `json:"state"`
+	Category  string `json:"category"`
+	Name      string `json:"name"`
+	Year      string `json:"year"`
+	MessageID int    `json:"message_id"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+func (q *Queries) UpsertConversation(ctx context.Context, arg UpsertConversationParams) error {
+	_, err := q.db.ExecContext(ctx, upsertConversation,
+		arg.UserID,
+		arg.ChatID,
+		arg.State,
+		arg.Category,
+		arg.Name,
+		arg.Year,
+		arg.MessageID,
+		arg.ExpiresAt,
+	)
+	return err
+}
+
 const upsertNZBInfo = `-- name: UpsertNZBInfo :exec
-INSERT INTO nzb_info (id, url, name, category, sabnzbd_id, chat_id, message_id, status, last_updated, selected)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+INSERT INTO nzb_info (id, url, name, category, sabnzbd_id, chat_id, message_id, status, last_updated, selected, imdb_id, size, guid, search_id)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 ON CONFLICT(id)
     DO UPDATE
     SET url          = excluded.url,
@@ -170,7 +853,11 @@ ON CONFLICT(id)
         message_id   = excluded.message_id,
         status       = excluded.status,
         last_updated = excluded.last_updated,
-        selected     = excluded.selected
+        selected     = excluded.selected,
+        imdb_id      = excluded.imdb_id,
+        size         = excluded.size,
+        guid         = excluded.guid,
+        search_id    = excluded.search_id
 `
 
 type UpsertNZBInfoParams struct {
@@ -184,6 +871,10 @@ type UpsertNZBInfoParams struct {
 	Status      string `json:"status"`
 	LastUpdated int64  `json:"last_updated"`
 	Selected    int    `json:"selected"`
+	ImdbID      string `json:"imdb_id"`
+	Size        int64  `json:"size"`
+	Guid        string `json:"guid"`
+	SearchID    string `json:"search_id"`
 }
 
 func (q *Queries) UpsertNZBInfo(ctx context.Context, arg UpsertNZBInfoParams) error {
@@ -198,6 +889,68 @@ func (q *Queries) UpsertNZBInfo(ctx context.Context, arg UpsertNZBInfoParams) er
 		arg.Status,
 		arg.LastUpdated,
 		arg.Selected,
+		arg.ImdbID,
+		arg.Size,
+		arg.Guid,
+		arg.SearchID,
 	)
 	return err
 }
+
+const upsertPlatformRef = `-- name: UpsertPlatformRef :one
+INSERT INTO platform_ref (platform, kind, external_id)
+VALUES (?, ?, ?)
+ON CONFLICT(platform, kind, external_id)
+    DO UPDATE
+    SET external_id = excluded.external_id
+RETURNING id
+`
+
+type UpsertPlatformRefParams struct {
+	Platform   string `json:"platform"`
+	Kind       string `json:"kind"`
+	ExternalID string `json:"external_id"`
+}
+
+func (q *Queries) UpsertPlatformRef(ctx context.Context, arg UpsertPlatformRefParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, upsertPlatformRef, arg.Platform, arg.Kind, arg.ExternalID)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const upsertQuotaOverride = `-- name: UpsertQuotaOverride :exec
+INSERT INTO quota_override (user_id, expires_at)
+VALUES (?, ?)
+ON CONFLICT(user_id)
+    DO UPDATE
+    SET expires_at = excluded.expires_at
+`
+
+type UpsertQuotaOverrideParams struct {
+	UserID    int64 `json:"user_id"`
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+func (q *Queries) UpsertQuotaOverride(ctx context.Context, arg UpsertQuotaOverrideParams) error {
+	_, err := q.db.ExecContext(ctx, upsertQuotaOverride, arg.UserID, arg.ExpiresAt)
+	return err
+}
+
+const upsertUserLink = `-- name: UpsertUserLink :exec
+INSERT INTO user_link (user_id, linked_to)
+VALUES (?, ?)
+ON CONFLICT(user_id)
+    DO UPDATE
+    SET linked_to = excluded.linked_to
+`
+
+type UpsertUserLinkParams struct {
+	UserID   int64 `json:"user_id"`
+	LinkedTo int64 `json:"linked_to"`
+}
+
+func (q *Queries) UpsertUserLink(ctx context.Context, arg UpsertUserLinkParams) error {
+	_, err := q.db.ExecContext(ctx, upsertUserLink, arg.UserID, arg.LinkedTo)
+	return err
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	discordAPIURL = "https://discord.com/api/v10"
+	// discordMaxContent is the longest message Discord accepts, in characters.
+	discordMaxContent = 2000
+	// discordReplyCommand answers the bot's questions. Discord only delivers
+	// interactions to the HTTP endpoint, never plain messages.
+	discordReplyCommand = "reply"
+)
+
+// Discord interaction and component types.
+const (
+	discordPing             = 1
+	discordSlashCommand     = 2
+	discordButtonPress      = 3
+	discordRespondMessage   = 4
+	discordRespondDeferEdit = 6
+	discordActionRow        = 1
+	discordButton           = 2
+	discordButtonPrimary    = 1
+	discordButtonLink       = 5
+	discordOptionString     = 3
+)
+
+// discordFrontend runs the bot on Discord. Slash commands and button presses
+// arrive as interactions POSTed to the bot's endpoint, and messages are sent
+// with the REST API.
+type discordFrontend struct {
+	appID     string
+	token     string
+	publicKey ed25519.PublicKey
+	apiURL    string
+	http      *http.Client
+	refs      *platformRefs
+
+	mu       sync.Mutex
+	dispatch func(tgbotapi.Update)
+}
+
+// loadDiscord returns the Discord frontend configured with DISCORD_BOT_TOKEN,
+// DISCORD_APPLICATION_ID and DISCORD_PUBLIC_KEY, or nil when DISCORD_BOT_TOKEN
+// is not set. Interactions are served on DISCORD_LISTEN_ADDR.
+func loadDiscord(refs *platformRefs, httpClient *http.Client) (*discordFrontend, error) {
+	token := os.Getenv("DISCORD_BOT_TOKEN")
+	if token == "" {
+		return nil, nil
+	}
+	d := &discordFrontend{
+		appID:  os.Getenv("DISCORD_APPLICATION_ID"),
+		token:  token,
+		apiURL: discordAPIURL,
+		http:   httpClient,
+		refs:   refs,
+	}
+	if d.appID == "" {
+		return nil, errors.New("DISCORD_APPLICATION_ID is not set")
+	}
+	if os.Getenv("DISCORD_LISTEN_ADDR") == "" {
+		return nil, errors.New("DISCORD_LISTEN_ADDR is not set")
+	}
+	key, err := hex.DecodeString(os.Getenv("DISCORD_PUBLIC_KEY"))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("DISCORD_PUBLIC_KEY must be the application's hex encoded public key")
+	}
+	d.publicKey = key
+	return d, nil
+}
+
+func (d *discordFrontend) Platform() string {
+	return "discord"
+}
+
+// discordMessage is the part of a Discord message the bot sends and reads back.
+type discordMessage struct {
+	ID         string             `json:"id,omitempty"`
+	Content    string             `json:"content"`
+	Components []discordComponent `json:"components"`
+}
+
+type discordComponent struct {
+	Type       int                `json:"type"`
+	Style      int                `json:"style,omitempty"`
+	Label      string             `json:"label,omitempty"`
+	CustomID   string             `json:"custom_id,omitempty"`
+	URL        string             `json:"url,omitempty"`
+	Components []discordComponent `json:"components,omitempty"`
+}
+
+func (d *discordFrontend) SendText(chatID int64, text Text) (int, error) {
+	return d.SendButtons(chatID, text, nil)
+}
+
+func (d *discordFrontend) SendButtons(chatID int64, text Text, buttons [][]Button) (int, error) {
+	channel, err := d.refs.ExternalID(chatID, refChat)
+	if err != nil {
+		return 0, err
+	}
+	var sent discordMessage
+	err = d.call(http.MethodPost, "/channels/"+channel+"/messages", discordContent(text, buttons), &sent)
+	if err != nil {
+		return 0, err
+	}
+	id, err := d.refs.LocalID(d.Platform(), refMessage, sent.ID)
+	return int(id), err
+}
+
+func (d *discordFrontend) Edit(chatID int64, messageID int, text Text, buttons [][]Button) error {
+	channel, message, err := d.messageIDs(chatID, messageID)
+	if err != nil {
+		return err
+	}
+	return d.call(http.MethodPatch, "/channels/"+channel+"/messages/"+message, discordContent(text, buttons), nil)
+}
+
+func (d *discordFrontend) Delete(chatID int64, messageID int) error {
+	channel, message, err := d.messageIDs(chatID, messageID)
+	if err != nil {
+		return err
+	}
+	return d.call(http.MethodDelete, "/channels/"+channel+"/messages/"+message, nil, nil)
+}
+
+func (d *discordFrontend) messageIDs(chatID int64, messageID int) (channel, message string, err error) {
+	if channel, err = d.refs.ExternalID(chatID, refChat); err != nil {
+		return "", "", err
+	}
+	if message, err = d.refs.ExternalID(int64(messageID), refMessage); err != nil {
+		return "", "", err
+	}
+	return channel, message, nil
+}
+
+// discordContent builds a message body. Empty components remove any buttons
+// when editing.
+func discordContent(text Text, buttons [][]Button) discordMessage {
+	message := discordMessage{Content: truncate(text.Markdown(), discordMaxContent), Components: []discordComponent{}}
+	for _, row := range discordRows(buttons) {
+		actionRow := discordComponent{Type: discordActionRow}
+		for _, button := range row {
+			component := discordComponent{Type: discordButton, Style: discordButtonPrimary, Label: truncate(button.Label, 80), CustomID: button.Data}
+			if button.URL != "" {
+				component.Style = discordButtonLink
+				component.CustomID = ""
+				component.URL = button.URL
+			}
+			actionRow.Components = append(actionRow.Components, component)
+		}
+		message.Components = append(message.Components, actionRow)
+	}
+	return message
+}
+
+// discordRows fits buttons into Discord's limit of five rows of five. Layouts
+// that don't fit as they are are packed five to a row, dropping any past 25.
+func discordRows(buttons [][]Button) [][]Button {
+	fits := len(buttons) <= 5
+	var all []Button
+	for _, row := range buttons {
+		if len(row) > 5 {
+			fits = false
+		}
+		all = append(all, row...)
+	}
+	if fits {
+		return buttons
+	}
+	if len(all) > 25 {
+		slog.Warn("Dropping buttons Discord can't show", "buttons", len(all))
+		all = all[:25]
+	}
+	var rows [][]Button
+	for len(all) > 0 {
+		n := min(5, len(all))
+		rows = append(rows, all[:n])
+		all = all[n:]
+	}
+	return rows
+}
+
+// truncate shortens s to at most n characters.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// discordCommand is a slash command registration.
+type discordCommand struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Options     []discordCommandOption `json:"options,omitempty"`
+}
+
+type discordCommandOption struct {
+	Type        int    `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+}
+
+// SetCommands registers the commands as slash commands, each taking its
+// arguments as a single optional text option, along with /reply.
+func (d *discordFrontend) SetCommands(commands []tgbotapi.BotCommand) error {
+	var slash []discordCommand
+	for _, cmd := range commands {
+		slash = append(slash, discordCommand{
+			Name:        cmd.Command,
+			Description: truncate(cmd.Description, 100),
+			Options: []discordCommandOption{{
+				Type:        discordOptionString,
+				Name:        "args",
+				Description: "Arguments, as you would type them after the command",
+			}},
+		})
+	}
+	slash = append(slash, discordCommand{
+		Name:        discordReplyCommand,
+		Description: "Answer the bot's question",
+		Options: []discordCommandOption{{
+			Type:        discordOptionString,
+			Name:        "text",
+			Description: "Your answer",
+			Required:    true,
+		}},
+	})
+	return d.call(http.MethodPut, "/applications/"+d.appID+"/commands", slash, nil)
+}
+
+// call makes a REST API request, decoding the response into out when it is
+// not nil.
+func (d *discordFrontend) call(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, d.apiURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+d.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("discord %s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(detail))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (d *discordFrontend) Receive(ctx context.Context, dispatch func(tgbotapi.Update)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dispatch = dispatch
+	return nil
+}
+
+// discordInteraction is the part of an interaction the bot uses.
+type discordInteraction struct {
+	ID        string `json:"id"`
+	Type      int    `json:"type"`
+	GuildID   string `json:"guild_id"`
+	ChannelID string `json:"channel_id"`
+	// Member is set in servers and User in direct messages.
+	Member *struct {
+		User discordUser `json:"user"`
+	} `json:"member"`
+	User    *discordUser `json:"user"`
+	Message *struct {
+		ID string `json:"id"`
+	} `json:"message"`
+	Data struct {
+		Name    string `json:"name"`
+		Options []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"options"`
+		CustomID string `json:"custom_id"`
+	} `json:"data"`
+}
+
+type discordUser struct {
+	ID         string `json:"id"`
+	Username   string `json:"username"`
+	GlobalName string `json:"global_name"`
+}
+
+// ServeHTTP is the interactions endpoint. Requests must carry a valid signature
+// from Discord.
+func (d *discordFrontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if !d.verify(r.Header.Get("X-Signature-Ed25519"), r.Header.Get("X-Signature-Timestamp"), body) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var interaction discordInteraction
+	if err := json.Unmarshal(body, &interaction); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if interaction.Type == discordPing {
+		writeJSON(w, http.StatusOK, map[string]int{"type": discordPing})
+		return
+	}
+
+	d.mu.Lock()
+	dispatch := d.dispatch
+	d.mu.Unlock()
+	if dispatch == nil {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	update, echo, err := d.update(interaction)
+	if err != nil {
+		slog.Error("Error reading Discord interaction", "interaction_id", interaction.ID, "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// Discord wants an answer within three seconds, so acknowledge before the
+	// handlers run. Commands are echoed so the channel shows what was asked.
+	if interaction.Type == discordSlashCommand {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"type": discordRespondMessage,
+			"data": map[string]string{"content": truncate(echo, discordMaxContent)},
+		})
+	} else {
+		writeJSON(w, http.StatusOK, map[string]int{"type": discordRespondDeferEdit})
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	dispatch(update)
+}
+
+// verify checks an interaction's signature over its timestamp and body.
+func (d *discordFrontend) verify(signature, timestamp string, body []byte) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil || timestamp == "" {
+		return false
+	}
+	return ed25519.Verify(d.publicKey, append([]byte(timestamp), body...), sig)
+}
+
+// update converts a slash command or button press to an update. For commands
+// it also returns the command as the user would have typed it.
+func (d *discordFrontend) update(interaction discordInteraction) (tgbotapi.Update, string, error) {
+	user := interaction.User
+	if interaction.Member != nil {
+		user = &interaction.Member.User
+	}
+	if user == nil {
+		return tgbotapi.Update{}, "", errors.New("interaction has no user")
+	}
+	name := user.GlobalName
+	if name == "" {
+		name = user.Username
+	}
+	from, err := platformUser(d.refs, d.Platform(), user.ID, name)
+	if err != nil {
+		return tgbotapi.Update{}, "", err
+	}
+	chat, err := platformChat(d.refs, d.Platform(), interaction.ChannelID, interaction.GuildID == "")
+	if err != nil {
+		return tgbotapi.Update{}, "", err
+	}
+
+	switch interaction.Type {
+	case discordSlashCommand:
+		var args []string
+		for _, option := range interaction.Data.Options {
+			args = append(args, option.Value)
+		}
+		text := strings.TrimSpace(strings.Join(args, " "))
+		if interaction.Data.Name == discordReplyCommand {
+			return commandUpdate(chat, from, 0, text), text, nil
+		}
+		text = strings.TrimSpace("/" + interaction.Data.Name + " " + text)
+		return commandUpdate(chat, from, 0, text), text, nil
+	case discordButtonPress:
+		if interaction.Message == nil {
+			return tgbotapi.Update{}, "", errors.New("button press has no message")
+		}
+		messageID, err := d.refs.LocalID(d.Platform(), refMessage, interaction.Message.ID)
+		if err != nil {
+			return tgbotapi.Update{}, "", err
+		}
+		return callbackUpdate(d.Platform(), interaction.ID, chat, from, int(messageID), interaction.Data.CustomID), "", nil
+	}
+	return tgbotapi.Update{}, "", fmt.Errorf("unsupported interaction type %d", interaction.Type)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dx314/movie_beacon_bot/db"
+)
+
+const (
+	defaultDiskMargin        = 5 << 30
+	defaultDiskCheckInterval = 15 * time.Minute
+)
+
+// diskGuard keeps downloads from filling the disks. Releases that won't fit with
+// a margin to spare are refused, and admins are warned when free space drops
+// below a threshold.
+type diskGuard struct {
+	margin    int64
+	warnBelow int64 // Zero disables the warnings
+	interval  time.Duration
+	roots     map[string]string // Category -> library root, measured with statfs
+
+	// low holds the disks that were below warnBelow at the last check
+	low map[string]bool
+}
+
+// loadDiskGuard reads DISK_SPACE_MARGIN (default 5GB, "off" disables the guard),
+// DISK_SPACE_WARN and DISK_SPACE_CHECK_INTERVAL. Besides SABnzbd's folders, the
+// library roots post-processing moves downloads to are checked.
+func loadDiskGuard(postProcess *postProcessor) (*diskGuard, error) {
+	g := &diskGuard{
+		margin:   defaultDiskMargin,
+		interval: defaultDiskCheckInterval,
+		roots:    make(map[string]string),
+		low:      make(map[string]bool),
+	}
+	switch v := os.Getenv("DISK_SPACE_MARGIN"); v {
+	case "":
+	case "off":
+		return nil, nil
+	default:
+		margin, err := parseSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DISK_SPACE_MARGIN: %w", err)
+		}
+		g.margin = margin
+	}
+	if v := os.Getenv("DISK_SPACE_WARN"); v != "" {
+		warnBelow, err := parseSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DISK_SPACE_WARN: %w", err)
+		}
+		g.warnBelow = warnBelow
+	}
+	if v := os.Getenv("DISK_SPACE_CHECK_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid DISK_SPACE_CHECK_INTERVAL %q", v)
+		}
+		g.interval = interval
+	}
+	if postProcess != nil {
+		for category, root := range postProcess.roots {
+			if root != "" {
+				g.roots[category] = root
+			}
+		}
+	}
+	return g, nil
+}
+
+// diskSpaceError is returned when a release won't fit on a disk. Admins can
+// download it anyway.
+type diskSpaceError struct {
+	disk   string
+	free   int64
+	size   int64
+	margin int64
+}
+
+func (e *diskSpaceError) Error() string {
+	return fmt.Sprintf("Not enough disk space: the release is %s and %s has %s free, with %s kept spare.",
+		formatSize(e.size), e.disk, formatSize(max(0, e.free)), formatSize(e.margin))
+}
+
+func (e *diskSpaceError) HTTPStatus() int {
+	return http.StatusInsufficientStorage
+}
+
+// diskFree is the free space on one disk.
+type diskFree struct {
+	name string
+	free int64
+}
+
+// measureDisks returns the free space on the disks a download of category uses:
+// SABnzbd's, and the library root post-processing moves it to. An empty
+// category measures every disk. Disks that can't be measured are logged and
+// left out, so a broken measurement never blocks downloads.
+func (b *Bot) measureDisks(category string) []diskFree {
+	var disks []diskFree
+	if free, err := b.downloads.FreeSpace(); err != nil {
+		slog.Warn("Error measuring SABnzbd disk space", "err", err)
+	} else {
+		disks = append(disks, diskFree{name: "SABnzbd", free: free})
+	}
+
+	seen := make(map[string]bool)
+	for c, root := range b.disks.roots {
+		if category != "" && c != category || seen[root] {
+			continue
+		}
+		seen[root] = true
+		free, err := freeSpace(root)
+		if err != nil {
+			slog.Warn("Error measuring library disk space", "path", root, "err", err)
+			continue
+		}
+		disks = append(disks, diskFree{name: root, free: free})
+	}
+	return disks
+}
+
+// checkDiskSpace returns a *diskSpaceError if nzbInfo won't fit with the margin
+// to spare.
+func (b *Bot) checkDiskSpace(nzbInfo db.NzbInfo) error {
+	if b.disks == nil {
+		return nil
+	}
+	for _, disk := range b.measureDisks(nzbInfo.Category) {
+		if disk.free < nzbInfo.Size+b.disks.margin {
+			slog.Info("Refusing download for lack of disk space", "name", nzbInfo.Name, "size", nzbInfo.Size,
+				"disk", disk.name, "free", disk.free)
+			return &diskSpaceError{disk: disk.name, free: disk.free, size: nzbInfo.Size, margin: b.disks.margin}
+		}
+	}
+	return nil
+}
+
+// watchDiskSpace tells the admins when a disk's free space crosses
+// DISK_SPACE_WARN, in either direction.
+func (b *Bot) watchDiskSpace() {
+	if b.disks == nil || b.disks.warnBelow == 0 {
+		return
+	}
+	for {
+		for _, disk := range b.measureDisks("") {
+			low := disk.free < b.disks.warnBelow
+			if low == b.disks.low[disk.name] {
+				continue
+			}
+			b.disks.low[disk.name] = low
+			if low {
+				slog.Warn("Low disk space", "disk", disk.name, "free", disk.free)
+				b.notifyAdmin(fmt.Sprintf("Low disk space: %s has %s free, below the %s warning level.",
+					disk.name, formatSize(max(0, disk.free)), formatSize(b.disks.warnBelow)))
+			} else {
+				slog.Info("Disk space recovered", "disk", disk.name, "free", disk.free)
+				b.notifyAdmin(fmt.Sprintf("%s has %s free again.", disk.name, formatSize(disk.free)))
+			}
+		}
+		<-b.clock.After(b.disks.interval)
+	}
+}
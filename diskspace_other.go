@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+// freeSpace is not implemented on this platform, so library roots aren't
+// checked.
+func freeSpace(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
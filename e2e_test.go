@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dx314/movie_beacon_bot/callbackdata"
+	"github.com/dx314/movie_beacon_bot/internal/fakes"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// scenario is a bot wired to the fake services in internal/fakes, talking to
+// them over HTTP through the real clients.
+type scenario struct {
+	bot      *Bot
+	router   *Router
+	telegram *fakes.Telegram
+	newznab  *fakes.Newznab
+	sabnzbd  *fakes.SABnzbd
+}
+
+func newScenario(t *testing.T) *scenario {
+	t.Helper()
+	telegram := fakes.NewTelegram()
+	omdb := fakes.NewOMDB("omdb-key", fakes.OMDBTitle{
+		Title:   "The Matrix",
+		Year:    "1999",
+		ImdbID:  "tt0133093",
+		Type:    "movie",
+		Runtime: "136 min",
+	})
+	newznab := fakes.NewNewznab("newznab-key")
+	sabnzbd := fakes.NewSABnzbd("sabnzbd-key")
+	for _, s := range []interface{ Close() }{telegram, omdb, newznab, sabnzbd} {
+		t.Cleanup(s.Close)
+	}
+
+	botAPI, err := tgbotapi.NewBotAPIWithAPIEndpoint("token", telegram.Endpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &scenario{
+		telegram: telegram,
+		newznab:  newznab,
+		sabnzbd:  sabnzbd,
+	}
+	sc.bot = NewBot(Deps{
+		Sender:    botAPI,
+		Store:     newTestStore(t),
+		Metadata:  newOMDBClient(omdb.URL+"/", "omdb-key", http.DefaultClient),
+		Indexer:   newNZBGeekClient(newznab.URL+"/api", "newznab-key", http.DefaultClient),
+		Downloads: newSABnzbdClient(sabnzbd.URL, "sabnzbd-key", http.DefaultClient),
+		Clock:     newFakeClock(),
+	})
+	sc.router = sc.bot.newBotRouter()
+	return sc
+}
+
+// press finds the last message offering a button of the given kind and
+// presses the first such button.
+func (sc *scenario) press(t *testing.T, kind string) {
+	t.Helper()
+	calls := sc.telegram.Calls("sendMessage")
+	for i := len(calls) - 1; i >= 0; i-- {
+		for _, button := range calls[i].Buttons() {
+			action, err := callbackdata.Decode(button.CallbackData)
+			if err != nil || action.Kind() != kind {
+				continue
+			}
+			sc.router.Dispatch(fakes.CallbackUpdate(testUserID, testChatID, calls[i].MessageID, button.CallbackData))
+			return
+		}
+	}
+	t.Fatalf("no %q button was offered; messages sent: %q", kind, sc.texts())
+}
+
+// texts returns the text of every message sent or edited.
+func (sc *scenario) texts() []string {
+	var texts []string
+	for _, call := range sc.telegram.Calls("") {
+		if text := call.Params.Get("text"); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return texts
+}
+
+func TestMovieScenario(t *testing.T) {
+	sc := newScenario(t)
+	sc.newznab.OnIMDb("tt0133093", "movie.xml")
+
+	sc.router.Dispatch(fakes.MessageUpdate(testUserID, testChatID, "/movie The Matrix 1999"))
+	sc.press(t, callbackdata.KindTitle)
+	sc.press(t, callbackdata.KindRelease)
+
+	waitForMonitor(t, sc.bot, sc.texts, "Status: Completed")
+
+	jobs := sc.sabnzbd.Jobs()
+	if len(jobs) != 1 {
+		t.Fatalf("SABnzbd has %d jobs, want 1", len(jobs))
+	}
+	if !strings.HasPrefix(jobs[0].URL, sc.newznab.URL+"/getnzb/") {
+		t.Errorf("SABnzbd was given %q, want an NZB from the indexer", jobs[0].URL)
+	}
+	if jobs[0].Step.State != fakes.StateCompleted {
+		t.Errorf("job is %s, want %s", jobs[0].Step.State, fakes.StateCompleted)
+	}
+}
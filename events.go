@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dx314/movie_beacon_bot/db"
+	"github.com/google/uuid"
+)
+
+// Event types published on the bot's event bus.
+const (
+	eventSearchPerformed   = "search.performed"
+	eventReleaseGrabbed    = "release.grabbed"
+	eventDownloadProgress  = "download.progress"
+	eventDownloadCompleted = "download.completed"
+	eventDownloadFailed    = "download.failed"
+	eventDownloadRemoved   = "download.removed"
+)
+
+// eventTypes lists every event type, for validating configuration.
+var eventTypes = []string{
+	eventSearchPerformed,
+	eventReleaseGrabbed,
+	eventDownloadProgress,
+	eventDownloadCompleted,
+	eventDownloadFailed,
+	eventDownloadRemoved,
+}
+
+// Event is something that happened in the bot. Data is one of the *Event
+// payload types below.
+type Event struct {
+	ID   string      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// searchEvent is the payload of search.performed.
+type searchEvent struct {
+	UserID   int64  `json:"user_id"`
+	Category string `json:"category"`
+	Query    string `json:"query"`
+	Year     string `json:"year,omitempty"`
+	// Source is "telegram" or "api".
+	Source string `json:"source"`
+}
+
+// downloadEvent is the payload of release.grabbed and the download.* events.
+type downloadEvent struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	ImdbID   string `json:"imdb_id,omitempty"`
+	GUID     string `json:"guid,omitempty"` // The indexer's ID for the release
+	ChatID   int64  `json:"chat_id"`
+	Status   string `json:"status"`
+	Progress string `json:"progress,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func newDownloadEvent(info db.NzbInfo) downloadEvent {
+	return downloadEvent{
+		ID:       info.ID,
+		Name:     info.Name,
+		Category: info.Category,
+		ImdbID:   info.ImdbID,
+		GUID:     info.Guid,
+		ChatID:   info.ChatID,
+		Status:   info.Status,
+		Path:     info.Path,
+	}
+}
+
+// eventBus passes events to its subscribers. Subscribers are called
+// synchronously, so they should hand slow work off elsewhere.
+type eventBus struct {
+	clock Clock
+
+	mu          sync.RWMutex
+	subscribers []func(Event)
+}
+
+func newEventBus(clock Clock) *eventBus {
+	return &eventBus{clock: clock}
+}
+
+// Subscribe calls fn for every event published from now on.
+func (e *eventBus) Subscribe(fn func(Event)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.subscribers = append(e.subscribers, fn)
+}
+
+// Publish sends an event of type typ carrying data to the subscribers.
+func (e *eventBus) Publish(typ string, data interface{}) {
+	event := Event{ID: uuid.New().String(), Type: typ, Time: e.clock.Now().UTC(), Data: data}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, fn := range e.subscribers {
+		fn(event)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dx314/movie_beacon_bot/db"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Frontend is a chat platform other than Telegram, such as Discord or Matrix.
+//
+// The handlers are written against Telegram's types, so a frontend translates to
+// and from them: commands, messages and button presses arrive as
+// tgbotapi.Updates, and platformSender turns the handlers' outgoing Telegram
+// requests into calls on the frontend. Chat, user and message IDs are local IDs
+// from platformRefs, which never collide with Telegram's.
+type Frontend interface {
+	// Platform names the platform, e.g. "discord".
+	Platform() string
+	// SendText sends a message and returns its local ID.
+	SendText(chatID int64, text Text) (int, error)
+	// SendButtons sends a message with buttons and returns its local ID.
+	SendButtons(chatID int64, text Text, buttons [][]Button) (int, error)
+	// Edit replaces a message's text and buttons. Nil buttons removes them.
+	Edit(chatID int64, messageID int, text Text, buttons [][]Button) error
+	// Delete removes a message.
+	Delete(chatID int64, messageID int) error
+	// SetCommands publishes the commands users can run, where the platform
+	// has a command menu.
+	SetCommands(commands []tgbotapi.BotCommand) error
+	// Receive starts passing incoming commands, messages and button presses to
+	// dispatch, until ctx is cancelled.
+	Receive(ctx context.Context, dispatch func(tgbotapi.Update)) error
+}
+
+// Text is message text, formatted with Telegram's HTML subset when HTML is set.
+type Text struct {
+	Body string
+	HTML bool
+}
+
+// Button is either a callback button carrying Data or a link to URL.
+type Button struct {
+	Label string
+	Data  string
+	URL   string
+}
+
+// Plain returns the text without formatting.
+func (t Text) Plain() string {
+	if !t.HTML {
+		return t.Body
+	}
+	return html.UnescapeString(htmlTagRegex.ReplaceAllString(t.Body, ""))
+}
+
+// Markdown returns the text with its formatting converted to Markdown.
+func (t Text) Markdown() string {
+	if !t.HTML {
+		return t.Body
+	}
+	body := htmlMarkdown.Replace(t.Body)
+	return html.UnescapeString(htmlTagRegex.ReplaceAllString(body, ""))
+}
+
+var (
+	htmlTagRegex = regexp.MustCompile(`<[^>]+>`)
+	htmlMarkdown = strings.NewReplacer(
+		"<b>", "**", "</b>", "**",
+		"<strong>", "**", "</strong>", "**",
+		"<i>", "_", "</i>", "_",
+		"<em>", "_", "</em>", "_",
+		"<code>", "`", "</code>", "`",
+		"<pre>", "```\n", "</pre>", "\n```",
+	)
+)
+
+// platformIDBase offsets local IDs past anything Telegram uses. Telegram IDs
+// fit in 52 bits.
+const platformIDBase = 1 << 53
+
+// isPlatformID reports whether id was assigned by platformRefs rather than
+// Telegram.
+func isPlatformID(id int64) bool {
+	return id >= platformIDBase
+}
+
+// Kinds of platform ID.
+const (
+	refChat    = "chat"
+	refUser    = "user"
+	refMessage = "message"
+)
+
+// platformRefs assigns local int64 IDs to chats, users and messages on other
+// platforms, so they fit the columns and handlers built around Telegram's IDs.
+type platformRefs struct {
+	store Store
+
+	mu       sync.Mutex
+	byID     map[int64]db.PlatformRef
+	external map[db.PlatformRef]int64
+}
+
+func newPlatformRefs(store Store) *platformRefs {
+	return &platformRefs{
+		store:    store,
+		byID:     make(map[int64]db.PlatformRef),
+		external: make(map[db.PlatformRef]int64),
+	}
+}
+
+// LocalID returns the local ID for a platform's chat, user or message,
+// assigning one the first time it is seen.
+func (r *platformRefs) LocalID(platform, kind, externalID string) (int64, error) {
+	key := db.PlatformRef{Platform: platform, Kind: kind, ExternalID: externalID}
+	r.mu.Lock()
+	id, ok := r.external[key]
+	r.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	rowID, err := r.store.UpsertPlatformRef(context.Background(), db.UpsertPlatformRefParams{
+		Platform:   platform,
+		Kind:       kind,
+		ExternalID: externalID,
+	})
+	if err != nil {
+		return 0, err
+	}
+	id = platformIDBase + rowID
+
+	key.ID = id
+	r.mu.Lock()
+	r.external[db.PlatformRef{Platform: platform, Kind: kind, ExternalID: externalID}] = id
+	r.byID[id] = key
+	r.mu.Unlock()
+	return id, nil
+}
+
+// Lookup returns what a local ID refers to. ID is set to the local ID.
+func (r *platformRefs) Lookup(id int64) (db.PlatformRef, error) {
+	r.mu.Lock()
+	ref, ok := r.byID[id]
+	r.mu.Unlock()
+	if ok {
+		return ref, nil
+	}
+	if !isPlatformID(id) {
+		return db.PlatformRef{}, fmt.Errorf("%d is a Telegram ID", id)
+	}
+
+	ref, err := r.store.GetPlatformRef(context.Background(), id-platformIDBase)
+	if err != nil {
+		return db.PlatformRef{}, fmt.Errorf("unknown platform ID %d: %w", id, err)
+	}
+	ref.ID = id
+	r.mu.Lock()
+	r.byID[id] = ref
+	r.external[db.PlatformRef{Platform: ref.Platform, Kind: ref.Kind, ExternalID: ref.ExternalID}] = id
+	r.mu.Unlock()
+	return ref, nil
+}
+
+// ExternalID returns the platform's own ID for a local ID of the given kind.
+func (r *platformRefs) ExternalID(id int64, kind string) (string, error) {
+	ref, err := r.Lookup(id)
+	if err != nil {
+		return "", err
+	}
+	if ref.Kind != kind {
+		return "", fmt.Errorf("platform ID %d is a %s, not a %s", id, ref.Kind, kind)
+	}
+	return ref.ExternalID, nil
+}
+
+// platformSender is the bot's Sender when other frontends are configured. It
+// passes requests for Telegram chats to Telegram and translates those for other
+// platforms' chats into calls on their frontend.
+type platformSender struct {
+	telegram  Sender
+	refs      *platformRefs
+	frontends map[string]Frontend
+}
+
+func newPlatformSender(telegram Sender, refs *platformRefs, frontends ...Frontend) *platformSender {
+	s := &platformSender{telegram: telegram, refs: refs, frontends: make(map[string]Frontend)}
+	for _, f := range frontends {
+		s.frontends[f.Platform()] = f
+	}
+	return s
+}
+
+// frontendCallbackID prefixes a button press's ID with its platform, so answers
+// to it aren't sent to Telegram.
+func frontendCallbackID(platform, id string) string {
+	return platform + ":" + id
+}
+
+// frontend returns the frontend owning chatID, or nil for Telegram chats.
+func (s *platformSender) frontend(chatID int64) (Frontend, error) {
+	if !isPlatformID(chatID) {
+		return nil, nil
+	}
+	ref, err := s.refs.Lookup(chatID)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := s.frontends[ref.Platform]
+	if !ok {
+		return nil, fmt.Errorf("%s is not configured", ref.Platform)
+	}
+	return f, nil
+}
+
+func (s *platformSender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	switch c := c.(type) {
+	case tgbotapi.MessageConfig:
+		f, err := s.frontend(c.ChatID)
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		if f == nil {
+			return s.telegram.Send(c)
+		}
+		text := Text{Body: c.Text, HTML: c.ParseMode == tgbotapi.ModeHTML}
+		var messageID int
+		if markup, ok := c.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup); ok {
+			messageID, err = f.SendButtons(c.ChatID, text, fromInlineKeyboard(&markup))
+		} else {
+			messageID, err = f.SendText(c.ChatID, text)
+		}
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		return tgbotapi.Message{
+			MessageID: messageID,
+			From:      &tgbotapi.User{IsBot: true},
+			Chat:      &tgbotapi.Chat{ID: c.ChatID},
+			Text:      c.Text,
+		}, nil
+	case tgbotapi.EditMessageTextConfig:
+		f, err := s.frontend(c.ChatID)
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		if f == nil {
+			return s.telegram.Send(c)
+		}
+		text := Text{Body: c.Text, HTML: c.ParseMode == tgbotapi.ModeHTML}
+		if err := f.Edit(c.ChatID, c.MessageID, text, fromInlineKeyboard(c.ReplyMarkup)); err != nil {
+			return tgbotapi.Message{}, err
+		}
+		return tgbotapi.Message{MessageID: c.MessageID, Chat: &tgbotapi.Chat{ID: c.ChatID}, Text: c.Text}, nil
+	}
+
+	_, err := s.Request(c)
+	return tgbotapi.Message{}, err
+}
+
+func (s *platformSender) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	switch c := c.(type) {
+	case tgbotapi.DeleteMessageConfig:
+		f, err := s.frontend(c.ChatID)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			return &tgbotapi.APIResponse{Ok: true}, f.Delete(c.ChatID, c.MessageID)
+		}
+	case tgbotapi.CallbackConfig:
+		// Other platforms acknowledge button presses as they arrive
+		if platform, _, ok := strings.Cut(c.CallbackQueryID, ":"); ok {
+			if _, ok := s.frontends[platform]; ok {
+				return &tgbotapi.APIResponse{Ok: true}, nil
+			}
+		}
+	case tgbotapi.SetMyCommandsConfig:
+		for _, f := range s.frontends {
+			if err := f.SetCommands(c.Commands); err != nil {
+				slog.Error("Error setting commands", "platform", f.Platform(), "err", err)
+			}
+		}
+	case tgbotapi.MessageConfig, tgbotapi.EditMessageTextConfig:
+		if _, err := s.Send(c); err != nil {
+			return nil, err
+		}
+		return &tgbotapi.APIResponse{Ok: true}, nil
+	}
+	if chatID, ok := chattableChatID(c); ok && isPlatformID(chatID) {
+		return nil, fmt.Errorf("%T can't be sent to other platforms", c)
+	}
+	return s.telegram.Request(c)
+}
+
+// chattableChatID returns the chat a Telegram request is for, if it names one.
+func chattableChatID(c tgbotapi.Chattable) (int64, bool) {
+	v := reflect.Indirect(reflect.ValueOf(c))
+	if v.Kind() != reflect.Struct {
+		return 0, false
+	}
+	// Found on the request or its embedded BaseChat or BaseEdit
+	f := v.FieldByName("ChatID")
+	if !f.IsValid() || f.Kind() != reflect.Int64 {
+		return 0, false
+	}
+	return f.Int(), true
+}
+
+// fromInlineKeyboard converts a Telegram inline keyboard to buttons.
+func fromInlineKeyboard(markup *tgbotapi.InlineKeyboardMarkup) [][]Button {
+	if markup == nil {
+		return nil
+	}
+	rows := make([][]Button, 0, len(markup.InlineKeyboard))
+	for _, row := range markup.InlineKeyboard {
+		var buttons []Button
+		for _, b := range row {
+			button := Button{Label: b.Text}
+			if b.CallbackData != nil {
+				button.Data = *b.CallbackData
+			}
+			if b.URL != nil {
+				button.URL = *b.URL
+			}
+			buttons = append(buttons, button)
+		}
+		rows = append(rows, buttons)
+	}
+	return rows
+}
+
+// platformUpdateID numbers the updates built by frontends, for logging.
+var platformUpdateID atomic.Int64
+
+// commandUpdate builds the update for text sent by a user on another platform.
+// Text starting with "/" is marked as a command, as Telegram does.
+func commandUpdate(chat *tgbotapi.Chat, from *tgbotapi.User, messageID int, text string) tgbotapi.Update {
+	message := &tgbotapi.Message{MessageID: messageID, From: from, Chat: chat, Text: text}
+	if strings.HasPrefix(text, "/") {
+		length := strings.IndexFunc(text, func(r rune) bool { return r == ' ' || r == '\n' })
+		if length < 0 {
+			length = len(text)
+		}
+		message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}
+	}
+	return tgbotapi.Update{UpdateID: int(platformUpdateID.Add(1)), Message: message}
+}
+
+// callbackUpdate builds the update for a button press on another platform.
+func callbackUpdate(platform, id string, chat *tgbotapi.Chat, from *tgbotapi.User, messageID int, data string) tgbotapi.Update {
+	return tgbotapi.Update{
+		UpdateID: int(platformUpdateID.Add(1)),
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      frontendCallbackID(platform, id),
+			From:    from,
+			Message: &tgbotapi.Message{MessageID: messageID, Chat: chat},
+			Data:    data,
+		},
+	}
+}
+
+// platformUser returns the Telegram-shaped user for a platform's user.
+func platformUser(refs *platformRefs, platform, externalID, name string) (*tgbotapi.User, error) {
+	id, err := refs.LocalID(platform, refUser, externalID)
+	if err != nil {
+		return nil, err
+	}
+	return &tgbotapi.User{ID: id, FirstName: name, UserName: name}, nil
+}
+
+// platformChat returns the Telegram-shaped chat for a platform's chat.
+func platformChat(refs *platformRefs, platform, externalID string, private bool) (*tgbotapi.Chat, error) {
+	id, err := refs.LocalID(platform, refChat, externalID)
+	if err != nil {
+		return nil, err
+	}
+	chatType := "group"
+	if private {
+		chatType = "private"
+	}
+	return &tgbotapi.Chat{ID: id, Type: chatType}, nil
+}
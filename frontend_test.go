@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestPlatformSenderUnsupported(t *testing.T) {
+	telegram := &recordingSender{}
+	sender := newPlatformSender(telegram, nil)
+
+	tests := []struct {
+		name    string
+		c       tgbotapi.Chattable
+		wantErr bool
+	}{
+		{"photo to platform chat", tgbotapi.NewPhoto(platformIDBase+1, tgbotapi.FilePath("poster.jpg")), true},
+		{"markup edit to platform chat", tgbotapi.NewEditMessageReplyMarkup(platformIDBase+1, 2, tgbotapi.InlineKeyboardMarkup{}), true},
+		{"chat action to platform chat", tgbotapi.NewChatAction(platformIDBase+1, tgbotapi.ChatTyping), true},
+		{"photo to Telegram chat", tgbotapi.NewPhoto(42, tgbotapi.FilePath("poster.jpg")), false},
+		{"webhook removal", tgbotapi.DeleteWebhookConfig{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(telegram.Sent())
+			_, err := sender.Request(tt.c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Request() error = %v, want error %v", err, tt.wantErr)
+			}
+			forwarded := len(telegram.Sent()) > before
+			if forwarded == tt.wantErr {
+				t.Errorf("forwarded to Telegram = %v, want %v", forwarded, !tt.wantErr)
+			}
+		})
+	}
+}
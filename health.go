@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// healthCheck is a readiness check for one dependency.
+type healthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// checkResult is the outcome of a healthCheck.
+type checkResult struct {
+	Name    string        `json:"name"`
+	OK      bool          `json:"ok"`
+	Error   string        `json:"error,omitempty"`
+	Latency time.Duration `json:"-"`
+}
+
+// MarshalJSON reports the latency in milliseconds.
+func (r checkResult) MarshalJSON() ([]byte, error) {
+	type result checkResult
+	return json.Marshal(struct {
+		result
+		LatencyMS float64 `json:"latency_ms"`
+	}{result(r), float64(r.Latency.Microseconds()) / 1000})
+}
+
+// healthChecker answers liveness and readiness probes. Liveness fails when a
+// handler has been running for longer than stuckAfter, which blocks the update
+// loop. Readiness runs the dependency checks.
+type healthChecker struct {
+	checks     []healthCheck
+	timeout    time.Duration
+	stuckAfter time.Duration
+
+	mu         sync.Mutex
+	busySince  time.Time
+	lastUpdate time.Time
+}
+
+func newHealthChecker(stuckAfter time.Duration, checks ...healthCheck) *healthChecker {
+	if stuckAfter == 0 {
+		stuckAfter = 5 * time.Minute
+	}
+	return &healthChecker{checks: checks, timeout: 5 * time.Second, stuckAfter: stuckAfter}
+}
+
+// trackUpdates is router middleware recording when each update starts and ends.
+func (h *healthChecker) trackUpdates(next HandlerFunc) HandlerFunc {
+	return func(req *Request) {
+		h.mu.Lock()
+		h.busySince = time.Now()
+		h.mu.Unlock()
+
+		defer func() {
+			h.mu.Lock()
+			h.busySince = time.Time{}
+			h.lastUpdate = time.Now()
+			h.mu.Unlock()
+		}()
+		next(req)
+	}
+}
+
+// Live reports whether the update loop is moving, with a reason when it isn't.
+func (h *healthChecker) Live() (bool, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.busySince.IsZero() {
+		if busy := time.Since(h.busySince); busy > h.stuckAfter {
+			return false, fmt.Sprintf("update handler running for %s", busy.Round(time.Second))
+		}
+	}
+	return true, ""
+}
+
+// LastUpdate returns when the last update finished being handled.
+func (h *healthChecker) LastUpdate() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastUpdate
+}
+
+// Ready runs the checks concurrently and returns their results in order.
+func (h *healthChecker) Ready(ctx context.Context) (bool, []checkResult) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	results := make([]checkResult, len(h.checks))
+	var wg sync.WaitGroup
+	for i, check := range h.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runCheck(ctx, check)
+		}()
+	}
+	wg.Wait()
+
+	ready := true
+	for _, r := range results {
+		ready = ready && r.OK
+	}
+	return ready, results
+}
+
+// runCheck runs check, giving up when ctx expires even if the check ignores it.
+func runCheck(ctx context.Context, check healthCheck) checkResult {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check.Check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := checkResult{Name: check.Name, OK: err == nil, Latency: time.Since(start)}
+	if err != nil {
+		result.Error = redactSecrets(err.Error())
+	}
+	return result
+}
+
+func (h *healthChecker) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	live, reason := h.Live()
+	status := http.StatusOK
+	body := map[string]interface{}{"status": "ok"}
+	if !live {
+		status = http.StatusServiceUnavailable
+		body = map[string]interface{}{"status": "fail", "error": reason}
+	}
+	if last := h.LastUpdate(); !last.IsZero() {
+		body["last_update"] = last.UTC().Format(time.RFC3339)
+	}
+	writeJSON(w, status, body)
+}
+
+func (h *healthChecker) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready, results := h.Ready(r.Context())
+	status := http.StatusOK
+	body := map[string]interface{}{"status": "ok", "checks": results}
+	if !ready {
+		status = http.StatusServiceUnavailable
+		body["status"] = "fail"
+	}
+	writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// sqliteCheck confirms the database accepts writes by starting a write
+// transaction and rolling it back.
+func sqliteCheck(dbConn *sql.DB) healthCheck {
+	return healthCheck{Name: "sqlite", Check: func(ctx context.Context) error {
+		tx, err := dbConn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		_, err = tx.ExecContext(ctx, "DELETE FROM conversation WHERE 0")
+		return err
+	}}
+}
+
+// telegramCheck calls getMe.
+func telegramCheck(api *tgbotapi.BotAPI) healthCheck {
+	return healthCheck{Name: "telegram", Check: func(ctx context.Context) error {
+		_, err := api.GetMe()
+		return err
+	}}
+}
+
+// sabnzbdCheck asks SABnzbd for its version.
+func sabnzbdCheck(client *sabnzbdClient) healthCheck {
+	return healthCheck{Name: "sabnzbd", Check: func(ctx context.Context) error {
+		_, err := client.Version(ctx)
+		return err
+	}}
+}
+
+// indexerCheck fetches an indexer's capabilities.
+func indexerCheck(name string, client *nzbGeekClient) healthCheck {
+	return healthCheck{Name: "indexer:" + name, Check: client.Ping}
+}
+
+// handleStatusCommand shows admins the same information as the health endpoints.
+func (b *Bot) handleStatusCommand(message *tgbotapi.Message) {
+	if !isAdmin(message.From, message.Chat.ID) {
+		b.sendErrorMessage(message.Chat.ID, "Only admins can use /status.")
+		return
+	}
+
+	var sb strings.Builder
+	if live, reason := b.health.Live(); live {
+		sb.WriteString("✅ Update loop running\n")
+	} else {
+		fmt.Fprintf(&sb, "❌ Update loop stuck: %s\n", reason)
+	}
+
+	_, results := b.health.Ready(context.Background())
+	for _, r := range results {
+		latency := r.Latency.Round(time.Millisecond)
+		if r.OK {
+			fmt.Fprintf(&sb, "✅ %s (%s)\n", r.Name, latency)
+		} else {
+			fmt.Fprintf(&sb, "❌ %s (%s): %s\n", r.Name, latency, r.Error)
+		}
+	}
+
+	b.activeMonitorsMutex.Lock()
+	monitors := len(b.activeMonitors)
+	b.activeMonitorsMutex.Unlock()
+	fmt.Fprintf(&sb, "\n%s\n", b.describeIndexer())
+	fmt.Fprintf(&sb, "\nMonitoring %d downloads", monitors)
+	if b.library != nil {
+		fmt.Fprintf(&sb, "\nLibrary index: %d titles", b.library.size())
+	}
+
+	b.sender.Send(tgbotapi.NewMessage(message.Chat.ID, sb.String()))
+}
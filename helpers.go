@@ -4,7 +4,7 @@ import (
 	"errors"
 	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	"log"
+	"log/slog"
 	"regexp"
 	"strconv"
 	"strings"
@@ -51,7 +51,7 @@ func calculateTotalTime(downloadTime, postProcessTime interface{}) (int, error)
 func calculateAge(pubDate string) string {
 	t, err := time.Parse(time.RFC1123Z, pubDate)
 	if err != nil {
-		log.Printf("Error parsing date: %v", err)
+		slog.Error("Error parsing date", "err", err)
 		return "Unknown"
 	}
 
@@ -79,10 +79,42 @@ func formatSize(size int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
 }
 
-func sendErrorMessage(chatID int64, message string) {
+// parseSize parses a size like "50GB", "1.5 TB" or "700", which is in bytes.
+// Units are powers of 1024, matching formatSize.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	number := strings.TrimRight(s, "KMGTPEIB ")
+	unit := strings.TrimSpace(s[len(number):])
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I")
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	exp := 0
+	if unit != "" {
+		exp = strings.Index("KMGTPE", unit) + 1
+		if exp == 0 || len(unit) != 1 {
+			return 0, fmt.Errorf("invalid size unit in %q", s)
+		}
+	}
+	for ; exp > 0; exp-- {
+		n *= 1024
+	}
+	return int64(n), nil
+}
+
+// userError is an error whose message can be shown to the user as it is.
+// HTTPStatus is what the API answers it with.
+type userError interface {
+	error
+	HTTPStatus() int
+}
+
+func (b *Bot) sendErrorMessage(chatID int64, message string) {
 	msg := tgbotapi.NewMessage(chatID, message)
-	if _, err := bot.Send(msg); err != nil {
-		log.Printf("Error sending error message: %v", err)
+	if _, err := b.sender.Send(msg); err != nil {
+		slog.Error("Error sending error message", "err", err)
 	}
 }
 
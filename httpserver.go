@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// httpServers groups the optional HTTP endpoints by listen address, so features
+// configured with the same address share one server. Endpoints with an empty
+// address are disabled.
+type httpServers struct {
+	muxes   map[string]*http.ServeMux
+	servers []*http.Server
+}
+
+func newHTTPServers() *httpServers {
+	return &httpServers{muxes: make(map[string]*http.ServeMux)}
+}
+
+// Handle registers handler for pattern on addr. It does nothing when addr is empty.
+func (s *httpServers) Handle(addr, pattern string, handler http.Handler) {
+	if addr == "" {
+		return
+	}
+	mux := s.muxes[addr]
+	if mux == nil {
+		mux = http.NewServeMux()
+		s.muxes[addr] = mux
+	}
+	mux.Handle(pattern, handler)
+}
+
+// Start starts a server for each address.
+func (s *httpServers) Start() {
+	for addr, mux := range s.muxes {
+		server := &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		s.servers = append(s.servers, server)
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("HTTP server failed", "addr", addr, "err", err)
+			}
+		}()
+		slog.Info("Serving HTTP", "addr", addr)
+	}
+}
+
+// Shutdown stops the servers, waiting up to five seconds for requests to finish.
+func (s *httpServers) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range s.servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("Error shutting down HTTP server", "addr", server.Addr, "err", err)
+		}
+	}
+}
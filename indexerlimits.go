@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dx314/movie_beacon_bot/db"
+)
+
+const (
+	// nzbGeekIndexer names the indexer in the usage table.
+	nzbGeekIndexer = "nzbgeek"
+	// indexerMaxFailures is how many errors in a row pause the indexer.
+	indexerMaxFailures = 3
+	// The first pause after repeated errors lasts indexerBackoffMin, and each
+	// failure after it doubles that, up to indexerBackoffMax.
+	indexerBackoffMin = 5 * time.Minute
+	indexerBackoffMax = 2 * time.Hour
+	// indexerUsageDays is how many days of usage are kept.
+	indexerUsageDays = 30
+)
+
+// indexerLimits are what the indexer account allows per day. Zero means
+// unlimited. Days are UTC, which is when NZBGeek resets its counters.
+type indexerLimits struct {
+	APIHits int
+	Grabs   int
+}
+
+// loadIndexerLimits reads NZBGEEK_API_LIMIT and NZBGEEK_GRAB_LIMIT.
+func loadIndexerLimits() (indexerLimits, error) {
+	var limits indexerLimits
+	counts := map[string]*int{
+		"NZBGEEK_API_LIMIT":  &limits.APIHits,
+		"NZBGEEK_GRAB_LIMIT": &limits.Grabs,
+	}
+	for name, limit := range counts {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return indexerLimits{}, fmt.Errorf("invalid %s %q", name, v)
+		}
+		*limit = n
+	}
+	return limits, nil
+}
+
+// indexerPause is why the indexer is paused, which decides whether grabs are
+// still let through.
+type indexerPause int
+
+const (
+	pauseFailures  indexerPause = iota + 1 // Errors in a row
+	pauseAPILimit                          // Daily API hits used up (Newznab code 500)
+	pauseGrabLimit                         // Daily grabs used up (Newznab code 501)
+)
+
+// blocks reports whether the pause stops searches, or grabs when grab is set.
+// Grabs are counted apart from API hits, so running out of hits leaves them be.
+func (p indexerPause) blocks(grab bool) bool {
+	return !grab || p != pauseAPILimit
+}
+
+// indexerState is whether the indexer is paused, and why.
+type indexerState struct {
+	sync.Mutex
+	failures    int // Errors in a row
+	pausedUntil time.Time
+	pause       indexerPause
+	reason      string
+}
+
+// indexerUnavailableError is returned instead of using a paused indexer or one
+// whose daily limit is used up.
+type indexerUnavailableError struct {
+	until  time.Time
+	reason string
+}
+
+func (e *indexerUnavailableError) Error() string {
+	return fmt.Sprintf("NZBGeek is paused until %s, %s.", e.until.Format("Jan 2 15:04 MST"), e.reason)
+}
+
+func (e *indexerUnavailableError) HTTPStatus() int {
+	return http.StatusServiceUnavailable
+}
+
+// indexerDay is the usage table's key for the day t falls on.
+func indexerDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// nextIndexerDay is when the indexer's daily limits reset after t.
+func nextIndexerDay(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC)
+}
+
+// indexerUsage returns the indexer's hits and grabs today.
+func (b *Bot) indexerUsage() (db.IndexerUsage, error) {
+	usage, err := b.store.GetIndexerUsage(context.Background(), db.GetIndexerUsageParams{
+		Indexer: nzbGeekIndexer,
+		Day:     indexerDay(b.clock.Now()),
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return db.IndexerUsage{}, nil
+	}
+	return usage, err
+}
+
+// checkIndexer returns an *indexerUnavailableError if the indexer is paused or
+// today's API hits, or grabs when grab is set, are used up. Grabs are only
+// refused by a pause for repeated errors or used up grabs.
+func (b *Bot) checkIndexer(grab bool) error {
+	now := b.clock.Now()
+	b.indexerState.Lock()
+	until, pause, reason := b.indexerState.pausedUntil, b.indexerState.pause, b.indexerState.reason
+	b.indexerState.Unlock()
+	if now.Before(until) && pause.blocks(grab) {
+		return &indexerUnavailableError{until: until, reason: reason}
+	}
+
+	limit, what := b.indexerLimits.APIHits, "search"
+	if grab {
+		limit, what = b.indexerLimits.Grabs, "download"
+	}
+	if limit == 0 {
+		return nil
+	}
+	usage, err := b.indexerUsage()
+	if err != nil {
+		// Let the indexer enforce its own limits rather than refuse everything
+		slog.Error("Error checking indexer usage", "err", err)
+		return nil
+	}
+	used := usage.Hits
+	if grab {
+		used = usage.Grabs
+	}
+	if used >= int64(limit) {
+		return &indexerUnavailableError{
+			until:  nextIndexerDay(now),
+			reason: fmt.Sprintf("the daily %s limit (%d) is used up", what, limit),
+		}
+	}
+	return nil
+}
+
+// countIndexerUse adds to today's hits and grabs, and forgets usage older than
+// indexerUsageDays.
+func (b *Bot) countIndexerUse(hits, grabs int64) {
+	ctx := context.Background()
+	now := b.clock.Now()
+	err := b.store.IncrementIndexerUsage(ctx, db.IncrementIndexerUsageParams{
+		Indexer: nzbGeekIndexer,
+		Day:     indexerDay(now),
+		Hits:    hits,
+		Grabs:   grabs,
+	})
+	if err != nil {
+		slog.Error("Error recording indexer usage", "err", err)
+	}
+	if err := b.store.DeleteIndexerUsageBefore(ctx, indexerDay(now.AddDate(0, 0, -indexerUsageDays))); err != nil {
+		slog.Error("Error removing old indexer usage", "err", err)
+	}
+}
+
+// searchIndexer runs search unless the indexer is paused, counting the API hit
+// and pausing the indexer when it reports a limit or keeps failing.
+func (b *Bot) searchIndexer(search func() (SearchResult, error)) (SearchResult, error) {
+	if err := b.checkIndexer(false); err != nil {
+		return SearchResult{}, err
+	}
+	b.countIndexerUse(1, 0)
+	result, err := search()
+	b.trackIndexerError(err)
+	return result, err
+}
+
+// trackIndexerError pauses the indexer until its limits reset when it says
+// they are reached, and for a while after indexerMaxFailures errors in a row.
+func (b *Bot) trackIndexerError(err error) {
+	now := b.clock.Now()
+	s := &b.indexerState
+	s.Lock()
+	if err == nil {
+		s.failures = 0
+		s.Unlock()
+		return
+	}
+
+	var until time.Time
+	var pause indexerPause
+	var reason string
+	var nzErr *newznabError
+	switch {
+	case errors.As(err, &nzErr) && nzErr.Code == 500:
+		until, pause = nextIndexerDay(now), pauseAPILimit
+		reason = "its daily API limit is reached"
+	case errors.As(err, &nzErr) && nzErr.Code == 501:
+		until, pause = nextIndexerDay(now), pauseGrabLimit
+		reason = "its daily download limit is reached"
+	default:
+		s.failures++
+		if s.failures < indexerMaxFailures {
+			s.Unlock()
+			return
+		}
+		backoff := indexerBackoffMin << min(s.failures-indexerMaxFailures, 10)
+		until, pause = now.Add(min(backoff, indexerBackoffMax)), pauseFailures
+		reason = "it keeps failing"
+	}
+	s.pausedUntil, s.pause, s.reason = until, pause, reason
+	failures := s.failures
+	s.Unlock()
+
+	slog.Warn("Pausing indexer", "indexer", nzbGeekIndexer, "until", until, "failures", failures, "err", err)
+	b.notifyAdmin(fmt.Sprintf("⚠️ NZBGeek paused until %s, %s.\nLast error: %s",
+		until.Format("Jan 2 15:04 MST"), reason, redactSecrets(err.Error())))
+}
+
+// describeIndexer reports today's indexer usage against its limits and whether
+// it's paused, for admins.
+func (b *Bot) describeIndexer() string {
+	usage, err := b.indexerUsage()
+	if err != nil {
+		slog.Error("Error checking indexer usage", "err", err)
+		return "NZBGeek usage unknown"
+	}
+	count := func(used int64, limit int, what string) string {
+		if limit == 0 {
+			return fmt.Sprintf("%d %s", used, what)
+		}
+		return fmt.Sprintf("%d of %d %s", used, limit, what)
+	}
+	lines := []string{"NZBGeek today: " + count(usage.Hits, b.indexerLimits.APIHits, "API hits") +
+		", " + count(usage.Grabs, b.indexerLimits.Grabs, "grabs")}
+
+	b.indexerState.Lock()
+	until, reason, failures := b.indexerState.pausedUntil, b.indexerState.reason, b.indexerState.failures
+	b.indexerState.Unlock()
+	switch {
+	case b.clock.Now().Before(until):
+		lines = append(lines, fmt.Sprintf("⏸ Paused until %s, %s", until.Format("Jan 2 15:04 MST"), reason))
+	case failures > 0:
+		lines = append(lines, fmt.Sprintf("%d errors in a row", failures))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// describeIndexerError words an indexer error for users, leaving out what is
+// only useful in the logs.
+func describeIndexerError(err error) string {
+	var userErr userError
+	var nzErr *newznabError
+	switch {
+	case errors.As(err, &userErr):
+		return userErr.Error()
+	case errors.As(err, &nzErr):
+		return "NZBGeek refused the search: " + nzErr.Description
+	default:
+		return "Error searching NZBGeek. Please try again later."
+	}
+}
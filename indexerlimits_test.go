@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTrackIndexerErrorBacksOff(t *testing.T) {
+	tb := newTestBot(t, &fakeDownloads{})
+	clock := tb.clock.(*fakeClock)
+	failure := errors.New("connection refused")
+
+	for i := 1; i < indexerMaxFailures; i++ {
+		tb.trackIndexerError(failure)
+		if err := tb.checkIndexer(false); err != nil {
+			t.Fatalf("paused after %d errors: %v", i, err)
+		}
+	}
+
+	// Each error after the pause doubles it, up to indexerBackoffMax
+	for _, want := range []time.Duration{
+		5 * time.Minute, 10 * time.Minute, 20 * time.Minute, 40 * time.Minute, 80 * time.Minute,
+		indexerBackoffMax, indexerBackoffMax,
+	} {
+		tb.trackIndexerError(failure)
+		if got := tb.indexerState.pausedUntil.Sub(clock.Now()); got != want {
+			t.Errorf("paused for %v after %d errors, want %v", got, tb.indexerState.failures, want)
+		}
+		for _, grab := range []bool{false, true} {
+			var unavailable *indexerUnavailableError
+			if err := tb.checkIndexer(grab); !errors.As(err, &unavailable) {
+				t.Errorf("checkIndexer(grab=%v) = %v while failing, want the indexer unavailable", grab, err)
+			}
+		}
+		<-clock.After(want)
+	}
+
+	tb.trackIndexerError(nil)
+	if err := tb.checkIndexer(false); err != nil {
+		t.Errorf("checkIndexer() = %v after the pause, want nil", err)
+	}
+	if tb.indexerState.failures != 0 {
+		t.Errorf("%d errors in a row after a success, want 0", tb.indexerState.failures)
+	}
+}
+
+func TestTrackIndexerErrorLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        int
+		blocksGrabs bool
+	}{
+		{"API limit", 500, false},
+		{"download limit", 501, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := newTestBot(t, &fakeDownloads{})
+			clock := tb.clock.(*fakeClock)
+			tb.trackIndexerError(&newznabError{Code: tt.code, Description: "Request limit reached"})
+
+			// Limits reset at midnight UTC
+			if want := nextIndexerDay(clock.Now()); !tb.indexerState.pausedUntil.Equal(want) {
+				t.Errorf("paused until %v, want %v", tb.indexerState.pausedUntil, want)
+			}
+			if err := tb.checkIndexer(false); err == nil {
+				t.Error("searches allowed while paused")
+			}
+			if err := tb.checkIndexer(true); (err != nil) != tt.blocksGrabs {
+				t.Errorf("checkIndexer(grab) = %v, want blocked %v", err, tt.blocksGrabs)
+			}
+
+			<-clock.After(24 * time.Hour)
+			if err := tb.checkIndexer(false); err != nil {
+				t.Errorf("checkIndexer() = %v the next day, want nil", err)
+			}
+		})
+	}
+}
+
+func TestParseNewznabError(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want *newznabError
+	}{
+		{"error", `<?xml version="1.0" encoding="UTF-8"?><error code="100" description="Incorrect user credentials"/>`,
+			&newznabError{Code: 100, Description: "Incorrect user credentials"}},
+		{"download limit", `<error code="501" description="Download limit reached"/>`,
+			&newznabError{Code: 501, Description: "Download limit reached"}},
+		{"code not a number", `<error code="oops" description="Unknown"/>`, &newznabError{Code: 0, Description: "Unknown"}},
+		{"results", `<rss version="2.0"><channel><item><title>The.Matrix.1999</title></item></channel></rss>`, nil},
+		{"not XML", `{"error": "nope"}`, nil},
+		{"empty", ``, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := parseNewznabError([]byte(tt.body))
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("parseNewznabError() = %v, want nil", err)
+				}
+				return
+			}
+			var got *newznabError
+			if !errors.As(err, &got) || *got != *tt.want {
+				t.Errorf("parseNewznabError() = %#v, want %#v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package fakes
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiscordCall is one REST API request received by the fake.
+type DiscordCall struct {
+	Method string
+	Path   string
+	Body   map[string]interface{} // The JSON object sent, if the body was one
+}
+
+// Discord is a fake Discord REST API. It records requests and gives sent
+// messages IDs. It also holds an application key pair, so it can send the bot
+// signed interactions the way Discord does.
+type Discord struct {
+	*httptest.Server
+	PublicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+
+	mu            sync.Mutex
+	calls         []DiscordCall
+	nextMessageID int
+}
+
+// NewDiscord starts a fake Discord API.
+func NewDiscord() (*Discord, error) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	d := &Discord{PublicKey: public, privateKey: private, nextMessageID: 5000}
+	d.Server = httptest.NewServer(http.HandlerFunc(d.handle))
+	return d, nil
+}
+
+// PublicKeyHex is the key to configure as DISCORD_PUBLIC_KEY.
+func (d *Discord) PublicKeyHex() string {
+	return hex.EncodeToString(d.PublicKey)
+}
+
+// Calls returns the recorded requests using method whose path ends with
+// suffix. Empty arguments match every request.
+func (d *Discord) Calls(method, suffix string) []DiscordCall {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var calls []DiscordCall
+	for _, c := range d.calls {
+		if (method == "" || c.Method == method) && strings.HasSuffix(c.Path, suffix) {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+func (d *Discord) handle(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bot ") {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJSON(w, map[string]interface{}{"message": "401: Unauthorized", "code": 0})
+		return
+	}
+
+	var body map[string]interface{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	d.mu.Lock()
+	d.calls = append(d.calls, DiscordCall{Method: r.Method, Path: r.URL.Path, Body: body})
+	d.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/messages"):
+		d.mu.Lock()
+		d.nextMessageID++
+		id := strconv.Itoa(d.nextMessageID)
+		d.mu.Unlock()
+		body["id"] = id
+		writeJSON(w, body)
+	case r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, body)
+	}
+}
+
+// Interact POSTs a signed interaction to the bot's interactions endpoint and
+// returns the response.
+func (d *Discord) Interact(endpoint string, interaction interface{}) (*http.Response, error) {
+	body, err := json.Marshal(interaction)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := ed25519.Sign(d.privateKey, append([]byte(timestamp), body...))
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature-Ed25519", hex.EncodeToString(signature))
+	req.Header.Set("X-Signature-Timestamp", timestamp)
+	return http.DefaultClient.Do(req)
+}
+
+// SlashCommand builds an interaction for /name typed by userID in channelID.
+// An empty guildID makes it a direct message.
+func SlashCommand(userID, guildID, channelID, name, args string) map[string]interface{} {
+	interaction := discordInteraction(userID, guildID, channelID, 2)
+	data := map[string]interface{}{"name": name}
+	if args != "" {
+		data["options"] = []map[string]interface{}{{"name": "args", "type": 3, "value": args}}
+	}
+	interaction["data"] = data
+	return interaction
+}
+
+// ButtonPress builds an interaction for a press on the button carrying
+// customID, on messageID.
+func ButtonPress(userID, guildID, channelID, messageID, customID string) map[string]interface{} {
+	interaction := discordInteraction(userID, guildID, channelID, 3)
+	interaction["message"] = map[string]interface{}{"id": messageID}
+	interaction["data"] = map[string]interface{}{"custom_id": customID, "component_type": 2}
+	return interaction
+}
+
+var interactionIDs struct {
+	sync.Mutex
+	next int
+}
+
+func discordInteraction(userID, guildID, channelID string, typ int) map[string]interface{} {
+	interactionIDs.Lock()
+	interactionIDs.next++
+	id := strconv.Itoa(9000 + interactionIDs.next)
+	interactionIDs.Unlock()
+
+	user := map[string]interface{}{"id": userID, "username": "user" + userID}
+	interaction := map[string]interface{}{
+		"id":         id,
+		"type":       typ,
+		"token":      "token-" + id,
+		"channel_id": channelID,
+	}
+	if guildID == "" {
+		interaction["user"] = user
+	} else {
+		interaction["guild_id"] = guildID
+		interaction["member"] = map[string]interface{}{"user": user}
+	}
+	return interaction
+}
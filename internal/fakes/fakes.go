@@ -0,0 +1,37 @@
+// Package fakes provides local stand-ins for the external services the bot talks
+// to (OMDB, a Newznab indexer, SABnzbd, the Telegram Bot API, Discord and a Matrix
+// homeserver) so whole flows can be exercised without network access.
+//
+// Each fake wraps an httptest.Server; point the bot's client at its URL.
+package fakes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// recorder keeps the query parameters of requests made to a fake.
+type recorder struct {
+	mu       sync.Mutex
+	requests []url.Values
+}
+
+func (r *recorder) record(values url.Values) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, values)
+}
+
+// Requests returns the query parameters of every request received so far.
+func (r *recorder) Requests() []url.Values {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]url.Values(nil), r.requests...)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,191 @@
+package fakes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MatrixEvent is an event sent by the bot to the fake homeserver.
+type MatrixEvent struct {
+	Room    string
+	Type    string
+	EventID string
+	Content map[string]interface{}
+}
+
+// Matrix is a fake Matrix homeserver. Events pushed with Message and React are
+// returned by the next /sync, and events the bot sends are recorded. Every room
+// has two members, so rooms look like direct chats.
+type Matrix struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	pending  map[string][]map[string]interface{}
+	invites  []string
+	sent     []MatrixEvent
+	redacted []string
+	joined   []string
+	batch    int
+	nextID   int
+	notify   chan struct{}
+}
+
+// NewMatrix starts a fake homeserver.
+func NewMatrix() *Matrix {
+	m := &Matrix{pending: make(map[string][]map[string]interface{}), notify: make(chan struct{}, 1)}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.handle))
+	return m
+}
+
+// Message queues a text message from sender in room and returns its event ID.
+func (m *Matrix) Message(room, sender, body string) string {
+	return m.push(room, sender, "m.room.message", map[string]interface{}{"msgtype": "m.text", "body": body})
+}
+
+// React queues a reaction from sender to eventID in room.
+func (m *Matrix) React(room, sender, eventID, key string) string {
+	return m.push(room, sender, "m.reaction", map[string]interface{}{
+		"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": eventID, "key": key},
+	})
+}
+
+// Invite queues an invite to room.
+func (m *Matrix) Invite(room string) {
+	m.mu.Lock()
+	m.invites = append(m.invites, room)
+	m.mu.Unlock()
+	m.wake()
+}
+
+// Sent returns the events of type typ sent by the bot, or every event if typ
+// is empty.
+func (m *Matrix) Sent(typ string) []MatrixEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []MatrixEvent
+	for _, e := range m.sent {
+		if typ == "" || e.Type == typ {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// Redacted returns the IDs of the events the bot redacted.
+func (m *Matrix) Redacted() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.redacted...)
+}
+
+// Joined returns the rooms the bot joined.
+func (m *Matrix) Joined() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.joined...)
+}
+
+func (m *Matrix) push(room, sender, typ string, content map[string]interface{}) string {
+	m.mu.Lock()
+	m.nextID++
+	id := "$in" + strconv.Itoa(m.nextID)
+	m.pending[room] = append(m.pending[room], map[string]interface{}{
+		"type": typ, "event_id": id, "sender": sender, "content": content,
+	})
+	m.mu.Unlock()
+	m.wake()
+	return id
+}
+
+func (m *Matrix) wake() {
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Matrix) handle(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJSON(w, map[string]string{"errcode": "M_MISSING_TOKEN", "error": "Missing access token"})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/_matrix/client/v3")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case parts[0] == "sync":
+		m.handleSync(w, r)
+	case len(parts) == 5 && parts[0] == "rooms" && parts[2] == "send":
+		var content map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&content)
+		m.mu.Lock()
+		m.nextID++
+		id := "$out" + strconv.Itoa(m.nextID)
+		m.sent = append(m.sent, MatrixEvent{Room: unescape(parts[1]), Type: parts[3], EventID: id, Content: content})
+		m.mu.Unlock()
+		writeJSON(w, map[string]string{"event_id": id})
+	case len(parts) == 5 && parts[0] == "rooms" && parts[2] == "redact":
+		m.mu.Lock()
+		m.nextID++
+		id := "$out" + strconv.Itoa(m.nextID)
+		m.redacted = append(m.redacted, unescape(parts[3]))
+		m.mu.Unlock()
+		writeJSON(w, map[string]string{"event_id": id})
+	case len(parts) == 3 && parts[0] == "rooms" && parts[2] == "join":
+		m.mu.Lock()
+		m.joined = append(m.joined, unescape(parts[1]))
+		m.mu.Unlock()
+		writeJSON(w, map[string]string{"room_id": unescape(parts[1])})
+	case len(parts) == 3 && parts[0] == "rooms" && parts[2] == "joined_members":
+		writeJSON(w, map[string]interface{}{"joined": map[string]interface{}{
+			"@bot:fake": map[string]string{}, "@user:fake": map[string]string{},
+		}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, map[string]string{"errcode": "M_UNRECOGNIZED", "error": "Unrecognized request"})
+	}
+}
+
+func (m *Matrix) handleSync(w http.ResponseWriter, r *http.Request) {
+	timeout, _ := strconv.Atoi(r.URL.Query().Get("timeout"))
+	if timeout > 0 {
+		select {
+		case <-m.notify:
+		case <-time.After(time.Duration(timeout) * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batch++
+	join := make(map[string]interface{})
+	for room, events := range m.pending {
+		join[room] = map[string]interface{}{"timeline": map[string]interface{}{"events": events}}
+	}
+	invite := make(map[string]interface{})
+	for _, room := range m.invites {
+		invite[room] = map[string]interface{}{}
+	}
+	m.pending = make(map[string][]map[string]interface{})
+	m.invites = nil
+	writeJSON(w, map[string]interface{}{
+		"next_batch": "s" + strconv.Itoa(m.batch),
+		"rooms":      map[string]interface{}{"join": join, "invite": invite},
+	})
+}
+
+func unescape(s string) string {
+	if unescaped, err := url.PathUnescape(s); err == nil {
+		return unescaped
+	}
+	return s
+}
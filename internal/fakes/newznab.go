@@ -0,0 +1,154 @@
+package fakes
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+//go:embed fixtures/*.xml
+var fixtures embed.FS
+
+// Newznab is a fake Newznab indexer answering searches with RSS fixtures.
+//
+// Fixtures live in the fixtures directory and may reference {{.BaseURL}}, which is
+// replaced with the server's URL so enclosure links point back at the fake.
+type Newznab struct {
+	*httptest.Server
+	recorder
+	APIKey string
+
+	mu      sync.Mutex
+	byIMDb  map[string]string
+	byTVDB  map[string]string
+	byQuery map[string]string
+	failure *newznabFailure
+}
+
+type newznabFailure struct {
+	code        int
+	description string
+}
+
+// NewNewznab starts a fake indexer. Requests must carry apiKey.
+func NewNewznab(apiKey string) *Newznab {
+	n := &Newznab{
+		APIKey:  apiKey,
+		byIMDb:  make(map[string]string),
+		byTVDB:  make(map[string]string),
+		byQuery: make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api", n.handleAPI)
+	mux.HandleFunc("/getnzb/", n.handleNZB)
+	n.Server = httptest.NewServer(mux)
+	return n
+}
+
+// OnIMDb answers searches for imdbID (with or without the "tt" prefix) with the
+// named fixture, e.g. "movie.xml".
+func (n *Newznab) OnIMDb(imdbID, fixture string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.byIMDb[strings.TrimPrefix(imdbID, "tt")] = fixture
+}
+
+// Fail makes every API request get a Newznab error, e.g. 500 "Request limit
+// reached", until Recover is called.
+func (n *Newznab) Fail(code int, description string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.failure = &newznabFailure{code: code, description: description}
+}
+
+// Recover undoes Fail.
+func (n *Newznab) Recover() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.failure = nil
+}
+
+// OnTVDB answers TV searches for tvdbID with the named fixture.
+func (n *Newznab) OnTVDB(tvdbID, fixture string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.byTVDB[tvdbID] = fixture
+}
+
+// OnQuery answers text searches containing query (case-insensitive) with the named
+// fixture.
+func (n *Newznab) OnQuery(query, fixture string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.byQuery[strings.ToLower(query)] = fixture
+}
+
+func (n *Newznab) handleAPI(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	n.record(q)
+
+	if q.Get("apikey") != n.APIKey {
+		n.writeError(w, 100, "Incorrect user credentials")
+		return
+	}
+
+	fixture := "empty.xml"
+	n.mu.Lock()
+	if failure := n.failure; failure != nil {
+		n.mu.Unlock()
+		n.writeError(w, failure.code, failure.description)
+		return
+	}
+	if q.Get("t") == "caps" {
+		fixture = "caps.xml"
+	} else if f, ok := n.byIMDb[strings.TrimPrefix(q.Get("imdbid"), "tt")]; ok && q.Get("imdbid") != "" {
+		fixture = f
+	} else if f, ok := n.byTVDB[q.Get("tvdbid")]; ok && q.Get("tvdbid") != "" {
+		fixture = f
+	} else if search := strings.ToLower(q.Get("q")); search != "" {
+		for query, f := range n.byQuery {
+			if strings.Contains(search, query) {
+				fixture = f
+				break
+			}
+		}
+	}
+	n.mu.Unlock()
+
+	body, err := n.render(fixture)
+	if err != nil {
+		n.writeError(w, 900, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/rss+xml")
+	w.Write(body)
+}
+
+func (n *Newznab) render(fixture string) ([]byte, error) {
+	tmpl, err := template.ParseFS(fixtures, "fixtures/"+fixture)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, struct{ BaseURL string }{n.URL}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *Newznab) writeError(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+`<error code="%d" description="%s"/>`, code, html.EscapeString(description))
+}
+
+func (n *Newznab) handleNZB(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-nzb")
+	fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?>
+<nzb xmlns="http://www.newzbin.com/DTD/2003/nzb"></nzb>`)
+}
@@ -0,0 +1,115 @@
+package fakes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+)
+
+// OMDBTitle is a movie or series known to the fake OMDB API.
+type OMDBTitle struct {
+	Title        string
+	Year         string
+	ImdbID       string
+	Type         string // "movie" or "series"
+	Plot         string
+	Genre        string
+	Actors       string
+	Runtime      string
+	Poster       string
+	ImdbRating   string
+	TotalSeasons string
+}
+
+// OMDB is a fake OMDB API serving a fixed set of titles.
+type OMDB struct {
+	*httptest.Server
+	recorder
+	APIKey string
+	titles []OMDBTitle
+}
+
+// NewOMDB starts a fake OMDB API. Requests must carry apiKey.
+func NewOMDB(apiKey string, titles ...OMDBTitle) *OMDB {
+	o := &OMDB{APIKey: apiKey, titles: titles}
+	o.Server = httptest.NewServer(http.HandlerFunc(o.handle))
+	return o
+}
+
+func (o *OMDB) handle(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	o.record(q)
+
+	if q.Get("apikey") != o.APIKey {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJSON(w, map[string]string{"Response": "False", "Error": "Invalid API key!"})
+		return
+	}
+
+	year, kind := q.Get("y"), q.Get("type")
+	matches := func(t OMDBTitle) bool {
+		return (year == "" || strings.HasPrefix(t.Year, year)) && (kind == "" || t.Type == kind)
+	}
+
+	switch {
+	case q.Get("t") != "":
+		for _, t := range o.titles {
+			if strings.EqualFold(t.Title, q.Get("t")) && matches(t) {
+				writeJSON(w, titleResponse(t))
+				return
+			}
+		}
+		writeJSON(w, map[string]string{"Response": "False", "Error": "Movie not found!"})
+	case q.Get("i") != "":
+		for _, t := range o.titles {
+			if t.ImdbID == q.Get("i") {
+				writeJSON(w, titleResponse(t))
+				return
+			}
+		}
+		writeJSON(w, map[string]string{"Response": "False", "Error": "Incorrect IMDb ID."})
+	case q.Get("s") != "":
+		var results []map[string]string
+		search := strings.ToLower(q.Get("s"))
+		for _, t := range o.titles {
+			if strings.Contains(strings.ToLower(t.Title), search) && matches(t) {
+				results = append(results, map[string]string{
+					"Title":  t.Title,
+					"Year":   t.Year,
+					"imdbID": t.ImdbID,
+					"Type":   t.Type,
+				})
+			}
+		}
+		if len(results) == 0 {
+			writeJSON(w, map[string]string{"Response": "False", "Error": "Movie not found!"})
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"Search":       results,
+			"totalResults": strconv.Itoa(len(results)),
+			"Response":     "True",
+		})
+	default:
+		writeJSON(w, map[string]string{"Response": "False", "Error": "Incorrect IMDb ID."})
+	}
+}
+
+func titleResponse(t OMDBTitle) map[string]interface{} {
+	return map[string]interface{}{
+		"Title":        t.Title,
+		"Year":         t.Year,
+		"Genre":        t.Genre,
+		"Actors":       t.Actors,
+		"Plot":         t.Plot,
+		"Runtime":      t.Runtime,
+		"Poster":       t.Poster,
+		"imdbRating":   t.ImdbRating,
+		"imdbID":       t.ImdbID,
+		"Type":         t.Type,
+		"totalSeasons": t.TotalSeasons,
+		"Ratings":      []interface{}{},
+		"Response":     "True",
+	}
+}
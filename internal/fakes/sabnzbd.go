@@ -0,0 +1,272 @@
+package fakes
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SABnzbd job states, matching the status strings SABnzbd reports.
+const (
+	StateQueued      = "Queued"
+	StateDownloading = "Downloading"
+	StateCompleted   = "Completed"
+	StateFailed      = "Failed"
+	StateDeleted     = "Deleted"
+)
+
+// SABStep is one step of a job's scripted lifecycle.
+type SABStep struct {
+	State   string
+	Percent int // Download progress while Queued or Downloading
+}
+
+// DefaultLifecycle takes a job from queued to completed over a few polls.
+var DefaultLifecycle = []SABStep{
+	{State: StateQueued},
+	{State: StateDownloading, Percent: 25},
+	{State: StateDownloading, Percent: 75},
+	{State: StateCompleted, Percent: 100},
+}
+
+// SABJob is a download known to the fake SABnzbd.
+type SABJob struct {
+	NzoID       string
+	URL         string
+	Name        string
+	Category    string
+	SizeMB      float64
+	Storage     string
+	FailMessage string
+	Step        SABStep
+	script      []SABStep
+}
+
+// SABnzbd is a fake SABnzbd API. Jobs move one step along their script each time
+// a queue request names them in nzo_ids, the way the bot checks a download's
+// progress, so a test drives a download through its lifecycle by polling it.
+// Listing the whole queue, as the free space check does, moves nothing.
+type SABnzbd struct {
+	*httptest.Server
+	recorder
+	APIKey string
+
+	// DiskSpaceGB is reported as free space in queue responses.
+	DiskSpaceGB float64
+
+	mu     sync.Mutex
+	jobs   map[string]*SABJob
+	order  []string
+	nextID int
+	script []SABStep
+}
+
+// NewSABnzbd starts a fake SABnzbd. Requests must carry apiKey.
+func NewSABnzbd(apiKey string) *SABnzbd {
+	s := &SABnzbd{
+		APIKey:      apiKey,
+		DiskSpaceGB: 500,
+		jobs:        make(map[string]*SABJob),
+		script:      DefaultLifecycle,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// SetLifecycle sets the script used for jobs added from now on.
+func (s *SABnzbd) SetLifecycle(steps ...SABStep) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script = steps
+}
+
+// SetState forces a job into state, e.g. StateDeleted to simulate a user removing
+// it from SABnzbd.
+func (s *SABnzbd) SetState(nzoID, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[nzoID]; ok {
+		job.Step = SABStep{State: state, Percent: job.Step.Percent}
+		job.script = nil
+	}
+}
+
+// Jobs returns a copy of every job in the order they were added.
+func (s *SABnzbd) Jobs() []SABJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []SABJob
+	for _, id := range s.order {
+		jobs = append(jobs, *s.jobs[id])
+	}
+	return jobs
+}
+
+func (s *SABnzbd) handle(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.record(q)
+
+	if q.Get("apikey") != s.APIKey {
+		writeJSON(w, map[string]interface{}{"status": false, "error": "API Key Incorrect"})
+		return
+	}
+
+	switch q.Get("mode") {
+	case "version":
+		writeJSON(w, map[string]string{"version": "4.3.3"})
+	case "addurl":
+		s.handleAddURL(w, q.Get("name"), q.Get("cat"), q.Get("nzbname"))
+	case "queue":
+		if q.Get("name") == "delete" {
+			s.handleDelete(w, q.Get("value"))
+			return
+		}
+		start, _ := strconv.Atoi(q.Get("start"))
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		s.handleQueue(w, splitIDs(q.Get("nzo_ids")), start, limit)
+	case "history":
+		s.handleHistory(w, splitIDs(q.Get("nzo_ids")))
+	default:
+		writeJSON(w, map[string]interface{}{"status": false, "error": "not implemented"})
+	}
+}
+
+func splitIDs(s string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, id := range strings.Split(s, ",") {
+		if id != "" {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func (s *SABnzbd) handleAddURL(w http.ResponseWriter, nzbURL, category, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	id := fmt.Sprintf("SABnzbd_nzo_%04d", s.nextID)
+	if name == "" {
+		name = nzbURL[strings.LastIndex(nzbURL, "/")+1:]
+		name = strings.TrimSuffix(name, ".nzb")
+	}
+	job := &SABJob{
+		NzoID:    id,
+		URL:      nzbURL,
+		Name:     name,
+		Category: category,
+		SizeMB:   1024,
+		Storage:  "/downloads/complete/" + category + "/" + name,
+		script:   append([]SABStep(nil), s.script...),
+	}
+	if len(job.script) > 0 {
+		job.Step, job.script = job.script[0], job.script[1:]
+	}
+	s.jobs[id] = job
+	s.order = append(s.order, id)
+
+	writeJSON(w, map[string]interface{}{"status": true, "nzo_ids": []string{id}})
+}
+
+func (s *SABnzbd) handleDelete(w http.ResponseWriter, nzoID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[nzoID]; ok {
+		job.Step.State = StateDeleted
+		job.script = nil
+	}
+	writeJSON(w, map[string]interface{}{"status": true, "nzo_ids": []string{nzoID}})
+}
+
+func (s *SABnzbd) selected(ids map[string]bool) []*SABJob {
+	var jobs []*SABJob
+	for _, id := range s.order {
+		if len(ids) == 0 || ids[id] {
+			jobs = append(jobs, s.jobs[id])
+		}
+	}
+	return jobs
+}
+
+// handleQueue lists the queued jobs among ids, or all of them when ids is empty.
+// Like SABnzbd, it returns at most limit slots from start when limit is set,
+// while noofslots and mbleft cover the whole queue. Jobs named in ids advance.
+func (s *SABnzbd) handleQueue(w http.ResponseWriter, ids map[string]bool, start, limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slots := []map[string]interface{}{}
+	var totalLeft float64
+	for _, job := range s.selected(ids) {
+		if job.Step.State == StateQueued || job.Step.State == StateDownloading {
+			mbLeft := job.SizeMB * float64(100-job.Step.Percent) / 100
+			totalLeft += mbLeft
+			slots = append(slots, map[string]interface{}{
+				"nzo_id":     job.NzoID,
+				"status":     job.Step.State,
+				"filename":   job.Name,
+				"cat":        job.Category,
+				"percentage": fmt.Sprintf("%d", job.Step.Percent),
+				"mb":         fmt.Sprintf("%.2f", job.SizeMB),
+				"mbleft":     fmt.Sprintf("%.2f", mbLeft),
+			})
+		}
+		// Each progress check moves the job along its script
+		if len(ids) > 0 && len(job.script) > 0 {
+			job.Step, job.script = job.script[0], job.script[1:]
+		}
+	}
+
+	total := len(slots)
+	slots = slots[min(start, total):]
+	if limit > 0 {
+		slots = slots[:min(limit, len(slots))]
+	}
+	writeJSON(w, map[string]interface{}{
+		"queue": map[string]interface{}{
+			"slots":      slots,
+			"noofslots":  total,
+			"mbleft":     fmt.Sprintf("%.2f", totalLeft),
+			"diskspace1": fmt.Sprintf("%.2f", s.DiskSpaceGB),
+			"diskspace2": fmt.Sprintf("%.2f", s.DiskSpaceGB),
+		},
+	})
+}
+
+func (s *SABnzbd) handleHistory(w http.ResponseWriter, ids map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slots := []map[string]interface{}{}
+	for _, job := range s.selected(ids) {
+		if job.Step.State != StateCompleted && job.Step.State != StateFailed {
+			continue
+		}
+		bytes := int(job.SizeMB * 1024 * 1024)
+		slots = append(slots, map[string]interface{}{
+			"nzo_id":        job.NzoID,
+			"name":          job.Name,
+			"nzb_name":      job.Name + ".nzb",
+			"category":      job.Category,
+			"status":        job.Step.State,
+			"storage":       job.Storage,
+			"path":          job.Storage,
+			"fail_message":  job.FailMessage,
+			"bytes":         bytes,
+			"completed":     bytes,
+			"download_time": 60,
+			"postproc_time": 5,
+		})
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"history": map[string]interface{}{
+			"slots":     slots,
+			"noofslots": len(slots),
+		},
+	})
+}
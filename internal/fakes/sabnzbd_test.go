@@ -0,0 +1,146 @@
+package fakes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+type queueResponse struct {
+	Queue struct {
+		Slots []struct {
+			NzoID      string `json:"nzo_id"`
+			Status     string `json:"status"`
+			Percentage string `json:"percentage"`
+		} `json:"slots"`
+		NoOfSlots int    `json:"noofslots"`
+		MBLeft    string `json:"mbleft"`
+	} `json:"queue"`
+}
+
+type historyResponse struct {
+	History struct {
+		Slots []struct {
+			NzoID  string `json:"nzo_id"`
+			Status string `json:"status"`
+		} `json:"slots"`
+	} `json:"history"`
+}
+
+// call makes a request to the fake SABnzbd API and decodes the response.
+func call(t *testing.T, s *SABnzbd, params url.Values, v interface{}) {
+	t.Helper()
+	params.Set("apikey", s.APIKey)
+	params.Set("output", "json")
+	resp, err := http.Get(s.URL + "/api?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addJobs(t *testing.T, s *SABnzbd, n int) []string {
+	t.Helper()
+	var ids []string
+	for i := 0; i < n; i++ {
+		var added struct {
+			NzoIDs []string `json:"nzo_ids"`
+		}
+		call(t, s, url.Values{"mode": {"addurl"}, "name": {"https://indexer.example/get/release.nzb"}, "cat": {"movies"}}, &added)
+		ids = append(ids, added.NzoIDs...)
+	}
+	return ids
+}
+
+func TestSABnzbdQueueLimit(t *testing.T) {
+	s := NewSABnzbd("key")
+	defer s.Close()
+	ids := addJobs(t, s, 3)
+
+	tests := []struct {
+		name  string
+		start string
+		limit string
+		want  []string
+	}{
+		{"no limit", "", "", ids},
+		{"first slot", "", "1", ids[:1]},
+		{"page", "1", "1", ids[1:2]},
+		{"limit past the end", "2", "5", ids[2:]},
+		{"start past the end", "5", "1", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp queueResponse
+			call(t, s, url.Values{"mode": {"queue"}, "start": {tt.start}, "limit": {tt.limit}}, &resp)
+			var got []string
+			for _, slot := range resp.Queue.Slots {
+				got = append(got, slot.NzoID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("slots = %q, want %q", got, tt.want)
+			}
+			// Like SABnzbd, the totals cover the whole queue, not the page
+			if resp.Queue.NoOfSlots != len(ids) {
+				t.Errorf("noofslots = %d, want %d", resp.Queue.NoOfSlots, len(ids))
+			}
+			if resp.Queue.MBLeft != "3072.00" {
+				t.Errorf("mbleft = %s, want 3072.00", resp.Queue.MBLeft)
+			}
+		})
+	}
+
+	// Listing the queue leaves the jobs where they were
+	for _, job := range s.Jobs() {
+		if job.Step.State != StateQueued {
+			t.Errorf("job %s is %s after listing the queue, want %s", job.NzoID, job.Step.State, StateQueued)
+		}
+	}
+}
+
+func TestSABnzbdLifecycle(t *testing.T) {
+	s := NewSABnzbd("key")
+	defer s.Close()
+	ids := addJobs(t, s, 2)
+	polled := url.Values{"mode": {"queue"}, "nzo_ids": {ids[0]}}
+
+	for _, want := range []struct {
+		status  string
+		percent string
+	}{
+		{StateQueued, "0"},
+		{StateDownloading, "25"},
+		{StateDownloading, "75"},
+	} {
+		var resp queueResponse
+		call(t, s, polled, &resp)
+		if len(resp.Queue.Slots) != 1 {
+			t.Fatalf("queue has %d slots for %s, want 1", len(resp.Queue.Slots), ids[0])
+		}
+		slot := resp.Queue.Slots[0]
+		if slot.Status != want.status || slot.Percentage != want.percent {
+			t.Errorf("slot = %s %s%%, want %s %s%%", slot.Status, slot.Percentage, want.status, want.percent)
+		}
+	}
+
+	var queue queueResponse
+	call(t, s, polled, &queue)
+	if len(queue.Queue.Slots) != 0 {
+		t.Errorf("completed job still queued: %+v", queue.Queue.Slots)
+	}
+	var history historyResponse
+	call(t, s, url.Values{"mode": {"history"}, "nzo_ids": {ids[0]}}, &history)
+	if len(history.History.Slots) != 1 || history.History.Slots[0].Status != StateCompleted {
+		t.Errorf("history = %+v, want %s completed", history.History.Slots, ids[0])
+	}
+
+	// Only the polled job moved
+	if other := s.Jobs()[1]; other.Step.State != StateQueued {
+		t.Errorf("job %s is %s, want %s", other.NzoID, other.Step.State, StateQueued)
+	}
+}
@@ -0,0 +1,195 @@
+package fakes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TelegramBotID and TelegramBotUsername identify the bot the fake Telegram API
+// pretends to be.
+const (
+	TelegramBotID       = 1000
+	TelegramBotUsername = "fake_beacon_bot"
+)
+
+// TelegramCall is one Bot API method call received by the fake.
+type TelegramCall struct {
+	Method string
+	Params url.Values
+	// MessageID is the ID of the message sent or edited, if the call did.
+	MessageID int
+}
+
+// TelegramButton is an inline keyboard button sent to the fake.
+type TelegramButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+	URL          string `json:"url"`
+}
+
+// Buttons returns the inline keyboard sent with the call, row after row.
+func (c TelegramCall) Buttons() []TelegramButton {
+	var markup struct {
+		InlineKeyboard [][]TelegramButton `json:"inline_keyboard"`
+	}
+	if err := json.Unmarshal([]byte(c.Params.Get("reply_markup")), &markup); err != nil {
+		return nil
+	}
+	var buttons []TelegramButton
+	for _, row := range markup.InlineKeyboard {
+		buttons = append(buttons, row...)
+	}
+	return buttons
+}
+
+// Telegram is a fake Telegram Bot API. It records every call and answers with
+// plausible responses, so the bot's outgoing messages can be inspected.
+type Telegram struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	calls         []TelegramCall
+	nextMessageID int
+}
+
+// NewTelegram starts a fake Telegram Bot API.
+func NewTelegram() *Telegram {
+	t := &Telegram{nextMessageID: 100}
+	t.Server = httptest.NewServer(http.HandlerFunc(t.handle))
+	return t
+}
+
+// Endpoint is the API endpoint format to pass to tgbotapi.NewBotAPIWithClient.
+func (t *Telegram) Endpoint() string {
+	return t.URL + "/bot%s/%s"
+}
+
+// Calls returns the recorded calls to method, or every call if method is empty.
+func (t *Telegram) Calls(method string) []TelegramCall {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var calls []TelegramCall
+	for _, c := range t.calls {
+		if method == "" || c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// Reset forgets the calls recorded so far.
+func (t *Telegram) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.calls = nil
+}
+
+func (t *Telegram) handle(w http.ResponseWriter, r *http.Request) {
+	// Paths look like /bot<token>/<method>
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "bot") {
+		http.NotFound(w, r)
+		return
+	}
+	method := parts[1]
+
+	params, err := parseParams(r)
+	if err != nil {
+		writeTelegram(w, false, nil, err.Error())
+		return
+	}
+
+	call := TelegramCall{Method: method, Params: params}
+	defer func() {
+		t.mu.Lock()
+		t.calls = append(t.calls, call)
+		t.mu.Unlock()
+	}()
+
+	switch method {
+	case "getMe":
+		writeTelegram(w, true, botUser(), "")
+	case "sendMessage", "editMessageText", "editMessageReplyMarkup", "sendPhoto", "sendDocument":
+		msg, id := t.message(method, params)
+		call.MessageID = id
+		writeTelegram(w, true, msg, "")
+	case "getUpdates":
+		writeTelegram(w, true, []interface{}{}, "")
+	case "deleteMessage", "answerCallbackQuery", "setMyCommands", "deleteMyCommands",
+		"setWebhook", "deleteWebhook", "sendChatAction":
+		writeTelegram(w, true, true, "")
+	default:
+		writeTelegram(w, false, nil, "Not Found: method not implemented by fake")
+	}
+}
+
+func parseParams(r *http.Request) (url.Values, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			return nil, err
+		}
+		return r.MultipartForm.Value, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	return r.Form, nil
+}
+
+// message builds the Message the Bot API returns for a send or edit, and
+// returns its ID.
+func (t *Telegram) message(method string, params url.Values) (map[string]interface{}, int) {
+	// Edits keep the ID of the message they change
+	id, err := strconv.Atoi(params.Get("message_id"))
+	if err != nil || !strings.HasPrefix(method, "edit") {
+		t.mu.Lock()
+		t.nextMessageID++
+		id = t.nextMessageID
+		t.mu.Unlock()
+	}
+
+	msg := map[string]interface{}{
+		"message_id": id,
+		"from":       botUser(),
+		"chat":       map[string]interface{}{"id": json.Number(orZero(params.Get("chat_id"))), "type": "private"},
+		"date":       time.Now().Unix(),
+		"text":       params.Get("text"),
+	}
+	if markup := params.Get("reply_markup"); markup != "" {
+		msg["reply_markup"] = json.RawMessage(markup)
+	}
+	return msg, id
+}
+
+func orZero(s string) string {
+	if s == "" {
+		return "0"
+	}
+	return s
+}
+
+func botUser() map[string]interface{} {
+	return map[string]interface{}{
+		"id":         TelegramBotID,
+		"is_bot":     true,
+		"first_name": "Beacon",
+		"username":   TelegramBotUsername,
+	}
+}
+
+func writeTelegram(w http.ResponseWriter, ok bool, result interface{}, description string) {
+	resp := map[string]interface{}{"ok": ok}
+	if ok {
+		resp["result"] = result
+	} else {
+		resp["error_code"] = 400
+		resp["description"] = description
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,58 @@
+package fakes
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var lastUpdateID int32
+
+func newUpdate() tgbotapi.Update {
+	return tgbotapi.Update{UpdateID: int(atomic.AddInt32(&lastUpdateID, 1))}
+}
+
+func user(userID int64) *tgbotapi.User {
+	return &tgbotapi.User{ID: userID, FirstName: "Test", UserName: "tester"}
+}
+
+// MessageUpdate builds an update for a text message from userID. Text starting
+// with "/" is marked as a bot command, as Telegram does.
+func MessageUpdate(userID, chatID int64, text string) tgbotapi.Update {
+	u := newUpdate()
+	u.Message = &tgbotapi.Message{
+		MessageID: u.UpdateID,
+		From:      user(userID),
+		Chat:      &tgbotapi.Chat{ID: chatID, Type: "private"},
+		Date:      int(time.Now().Unix()),
+		Text:      text,
+	}
+	if strings.HasPrefix(text, "/") {
+		length := strings.IndexByte(text, ' ')
+		if length < 0 {
+			length = len(text)
+		}
+		u.Message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}
+	}
+	return u
+}
+
+// CallbackUpdate builds an update for userID pressing an inline button carrying
+// data on messageID.
+func CallbackUpdate(userID, chatID int64, messageID int, data string) tgbotapi.Update {
+	u := newUpdate()
+	u.CallbackQuery = &tgbotapi.CallbackQuery{
+		ID:   "cb" + strconv.Itoa(u.UpdateID),
+		From: user(userID),
+		Message: &tgbotapi.Message{
+			MessageID: messageID,
+			From:      &tgbotapi.User{ID: TelegramBotID, IsBot: true, UserName: TelegramBotUsername},
+			Chat:      &tgbotapi.Chat{ID: chatID, Type: "private"},
+		},
+		Data: data,
+	}
+	return u
+}
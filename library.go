@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LibraryItem is a title that is already in the library.
+type LibraryItem struct {
+	ImdbID     string
+	Title      string
+	Resolution string    // e.g. "1080p", empty if unknown
+	Added      time.Time // When the file was added to the library
+}
+
+// Describe summarises the copy in the library, e.g. "1080p, 2019 file".
+func (i LibraryItem) Describe() string {
+	var parts []string
+	if i.Resolution != "" {
+		parts = append(parts, i.Resolution)
+	}
+	if !i.Added.IsZero() {
+		parts = append(parts, fmt.Sprintf("%d file", i.Added.Year()))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// LibrarySource lists the titles already in the library. The media server
+// clients and dirLibrary satisfy it.
+type LibrarySource interface {
+	LibraryItems() ([]LibraryItem, error)
+}
+
+// libraryIndex caches a LibrarySource by IMDb ID.
+type libraryIndex struct {
+	source LibrarySource
+
+	mu    sync.RWMutex
+	items map[string]LibraryItem
+}
+
+func newLibraryIndex(source LibrarySource) *libraryIndex {
+	return &libraryIndex{source: source, items: make(map[string]LibraryItem)}
+}
+
+// refresh reloads the index from its source, keeping the best copy of each title.
+func (l *libraryIndex) refresh() error {
+	items, err := l.source.LibraryItems()
+	if err != nil {
+		return err
+	}
+
+	index := make(map[string]LibraryItem, len(items))
+	for _, item := range items {
+		if item.ImdbID == "" {
+			continue
+		}
+		if existing, ok := index[item.ImdbID]; ok && resolutionRank(existing.Resolution) >= resolutionRank(item.Resolution) {
+			continue
+		}
+		index[item.ImdbID] = item
+	}
+
+	l.mu.Lock()
+	l.items = index
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *libraryIndex) lookup(imdbID string) (LibraryItem, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	item, ok := l.items[imdbID]
+	return item, ok
+}
+
+func (l *libraryIndex) size() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.items)
+}
+
+func resolutionRank(resolution string) int {
+	switch resolution {
+	case "2160p":
+		return 4
+	case "1080p":
+		return 3
+	case "720p":
+		return 2
+	case "":
+		return 0
+	default:
+		return 1
+	}
+}
+
+// resolutionFromWidth names a video's resolution by its frame width, which unlike
+// the height doesn't depend on the aspect ratio.
+func resolutionFromWidth(width int) string {
+	switch {
+	case width >= 3200:
+		return "2160p"
+	case width >= 1700:
+		return "1080p"
+	case width >= 1100:
+		return "720p"
+	case width > 0:
+		return "SD"
+	default:
+		return ""
+	}
+}
+
+// refreshLibraryPeriodically keeps the library index up to date.
+func (b *Bot) refreshLibraryPeriodically() {
+	if b.library == nil {
+		return
+	}
+	for {
+		if err := b.library.refresh(); err != nil {
+			slog.Error("Error refreshing library index", "err", err)
+		} else {
+			slog.Info("Library index refreshed", "titles", b.library.size())
+		}
+		<-b.clock.After(b.libraryRefresh)
+	}
+}
+
+var (
+	imdbIDRegex     = regexp.MustCompile(`tt\d{7,9}`)
+	imdbTagRegex    = regexp.MustCompile(`\s*[\[{]imdb(id)?-tt\d+[\]}]`)
+	resolutionRegex = regexp.MustCompile(`(?i)\b(2160|1080|720|576|480)p\b|\b(4k|uhd)\b`)
+)
+
+var videoExtensions = map[string]bool{
+	".mkv": true, ".mp4": true, ".avi": true, ".m4v": true, ".ts": true, ".wmv": true, ".mov": true,
+}
+
+// dirLibrary indexes video files in local directories. IMDb IDs are taken from
+// the file or folder name (e.g. "Movie (2019) {imdb-tt1234567}") or from an NFO
+// file next to the video.
+type dirLibrary struct {
+	dirs []string
+}
+
+func (d dirLibrary) LibraryItems() ([]LibraryItem, error) {
+	var items []LibraryItem
+	for _, dir := range d.dirs {
+		err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				slog.Warn("Error scanning library path", "path", path, "err", err)
+				return nil
+			}
+			if entry.IsDir() || !videoExtensions[strings.ToLower(filepath.Ext(path))] {
+				return nil
+			}
+
+			imdbID := imdbIDRegex.FindString(path)
+			if imdbID == "" {
+				imdbID = imdbIDFromNFO(path)
+			}
+			if imdbID == "" {
+				return nil
+			}
+
+			item := LibraryItem{
+				ImdbID:     imdbID,
+				Title:      imdbTagRegex.ReplaceAllString(filepath.Base(filepath.Dir(path)), ""),
+				Resolution: resolutionFromName(filepath.Base(path)),
+			}
+			if info, err := entry.Info(); err == nil {
+				item.Added = info.ModTime()
+			}
+			items = append(items, item)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// imdbIDFromNFO looks for an IMDb ID in <name>.nfo or movie.nfo beside a video.
+func imdbIDFromNFO(videoPath string) string {
+	dir := filepath.Dir(videoPath)
+	candidates := []string{
+		strings.TrimSuffix(videoPath, filepath.Ext(videoPath)) + ".nfo",
+		filepath.Join(dir, "movie.nfo"),
+	}
+	for _, nfo := range candidates {
+		data, err := os.ReadFile(nfo)
+		if err != nil {
+			continue
+		}
+		if id := imdbIDRegex.FindString(string(data)); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+func resolutionFromName(name string) string {
+	m := resolutionRegex.FindStringSubmatch(name)
+	switch {
+	case m == nil:
+		return ""
+	case m[1] != "":
+		return m[1] + "p"
+	default:
+		return "2160p"
+	}
+}
+
+// loadLibrarySource picks where the library index comes from: LIBRARY_DIRS if
+// set, otherwise the media server. It returns nil when neither is configured.
+func loadLibrarySource(media MediaServer) LibrarySource {
+	if dirs := os.Getenv("LIBRARY_DIRS"); dirs != "" {
+		var d dirLibrary
+		for _, dir := range strings.Split(dirs, ",") {
+			if dir = strings.TrimSpace(dir); dir != "" {
+				d.dirs = append(d.dirs, dir)
+			}
+		}
+		return d
+	}
+	if source, ok := media.(LibrarySource); ok {
+		return source
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/dx314/movie_beacon_bot/db"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// linkCodeTTL is how long a /link code can be redeemed.
+const linkCodeTTL = 10 * time.Minute
+
+// linkCode is a pending /link, redeemable by another account to share userID's
+// identity.
+type linkCode struct {
+	userID    int64
+	expiresAt time.Time
+}
+
+// canonicalUserID returns the user a Discord or Matrix account has been linked
+// to, or userID itself when it isn't linked. Links to accounts that were
+// themselves linked later are followed.
+func (b *Bot) canonicalUserID(userID int64) (int64, error) {
+	for hops := 0; hops < 5 && isPlatformID(userID); hops++ {
+		linked, err := b.store.GetUserLink(context.Background(), userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		userID = linked
+	}
+	return userID, nil
+}
+
+// linkMiddleware makes linked accounts act as the user they are linked to, so
+// they share conversations, downloads, API keys and permissions. /link itself
+// sees the account that sent it.
+func (b *Bot) linkMiddleware(next HandlerFunc) HandlerFunc {
+	return func(req *Request) {
+		user := req.User()
+		if user == nil || !isPlatformID(user.ID) || req.Route == "/link" {
+			next(req)
+			return
+		}
+
+		linked, err := b.canonicalUserID(user.ID)
+		if err != nil {
+			req.Log.Error("Error looking up linked account", "err", err)
+		} else if linked != user.ID {
+			// SentFrom returns a pointer into the update, so this is what the
+			// handlers see
+			user.ID = linked
+			req.Log = req.Log.With("linked_user_id", linked)
+		}
+		next(req)
+	}
+}
+
+// handleLinkCommand links a Discord or Matrix account to another account,
+// usually a Telegram one. "/link" gives a code, and "/link CODE" sent from the
+// account being linked redeems it. "/link remove" undoes the link.
+func (b *Bot) handleLinkCommand(message *tgbotapi.Message) {
+	ctx := context.Background()
+	rawID := message.From.ID
+
+	switch arg := strings.ToUpper(strings.TrimSpace(message.CommandArguments())); arg {
+	case "":
+		if !message.Chat.IsPrivate() {
+			b.sendErrorMessage(message.Chat.ID, "Send /link in a private chat with me.")
+			return
+		}
+		userID, err := b.canonicalUserID(rawID)
+		if err != nil {
+			slog.Error("Error looking up linked account", "user_id", rawID, "err", err)
+			b.sendErrorMessage(message.Chat.ID, "Failed to create a link code.")
+			return
+		}
+		code, err := b.newLinkCode(userID)
+		if err != nil {
+			slog.Error("Error creating link code", "user_id", userID, "err", err)
+			b.sendErrorMessage(message.Chat.ID, "Failed to create a link code.")
+			return
+		}
+		b.sender.Send(tgbotapi.NewMessage(message.Chat.ID, "Send this from your Discord or Matrix account within 10 minutes:\n\n"+
+			"/link "+code+"\n\nOn Matrix you can also start it with ! instead of /."))
+	case "REMOVE":
+		if !isPlatformID(rawID) {
+			b.sendErrorMessage(message.Chat.ID, "Send /link remove from the Discord or Matrix account you want to unlink.")
+			return
+		}
+		if err := b.store.DeleteUserLink(ctx, rawID); err != nil {
+			slog.Error("Error removing account link", "user_id", rawID, "err", err)
+			b.sendErrorMessage(message.Chat.ID, "Failed to unlink this account.")
+			return
+		}
+		b.sender.Send(tgbotapi.NewMessage(message.Chat.ID, "This account is no longer linked."))
+	default:
+		if !isPlatformID(rawID) {
+			b.sendErrorMessage(message.Chat.ID, "Send the code from the Discord or Matrix account you want to link.")
+			return
+		}
+		userID, ok := b.redeemLinkCode(arg)
+		if !ok {
+			b.sendErrorMessage(message.Chat.ID, "That code is invalid or has expired. Send /link to get a new one.")
+			return
+		}
+		if userID == rawID {
+			b.sendErrorMessage(message.Chat.ID, "Send the code from a different account than the one that asked for it.")
+			return
+		}
+		if err := b.store.UpsertUserLink(ctx, db.UpsertUserLinkParams{UserID: rawID, LinkedTo: userID}); err != nil {
+			slog.Error("Error linking account", "user_id", rawID, "linked_to", userID, "err", err)
+			b.sendErrorMessage(message.Chat.ID, "Failed to link this account.")
+			return
+		}
+		slog.Info("Linked account", "user_id", rawID, "linked_to", userID)
+		b.sender.Send(tgbotapi.NewMessage(message.Chat.ID, "Linked. Your searches, downloads and permissions are now shared with your other account."))
+	}
+}
+
+// newLinkCode returns a code that links the account redeeming it to userID.
+func (b *Bot) newLinkCode(userID int64) (string, error) {
+	buf := make([]byte, 5)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := base32.StdEncoding.EncodeToString(buf)
+
+	b.linkCodesMutex.Lock()
+	defer b.linkCodesMutex.Unlock()
+	now := b.clock.Now()
+	for c, pending := range b.linkCodes {
+		if now.After(pending.expiresAt) {
+			delete(b.linkCodes, c)
+		}
+	}
+	b.linkCodes[code] = linkCode{userID: userID, expiresAt: now.Add(linkCodeTTL)}
+	return code, nil
+}
+
+// redeemLinkCode returns the user a code links to. Codes work once.
+func (b *Bot) redeemLinkCode(code string) (int64, bool) {
+	b.linkCodesMutex.Lock()
+	defer b.linkCodesMutex.Unlock()
+	pending, ok := b.linkCodes[code]
+	if !ok {
+		return 0, false
+	}
+	delete(b.linkCodes, code)
+	if b.clock.Now().After(pending.expiresAt) {
+		return 0, false
+	}
+	return pending.userID, true
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// setupLogging installs the default slog logger. LOG_LEVEL is debug, info
+// (default), warn or error, and LOG_FORMAT is text (default) or json. Everything
+// logged, including through the standard log package, passes through a redactor
+// that removes API keys and tokens.
+func setupLogging(w io.Writer) error {
+	level := slog.LevelInfo
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL %q", v)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown LOG_FORMAT %q", format)
+	}
+
+	secrets = newRedactor(secretsFromEnv())
+	slog.SetDefault(slog.New(&redactingHandler{next: handler, redactor: secrets}))
+	return nil
+}
+
+// secrets redacts credentials from text shown outside the logs, such as health
+// check errors. setupLogging loads the secrets from the environment.
+var secrets = newRedactor(nil)
+
+// redactSecrets removes API keys and tokens from s.
+func redactSecrets(s string) string {
+	return secrets.redact(s)
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+var (
+	// secretParamRegex matches credentials passed as query parameters, e.g.
+	// apikey=... or X-Plex-Token=...
+	secretParamRegex = regexp.MustCompile(`(?i)\b((?:api_?key|api_?token|x-plex-token|token|password|secret)=)[^&\s"']+`)
+	// botTokenRegex matches the token in Telegram Bot API URLs.
+	botTokenRegex = regexp.MustCompile(`\bbot\d+:[A-Za-z0-9_-]+`)
+	// secretEnvRegex matches environment variables holding credentials.
+	secretEnvRegex = regexp.MustCompile(`(?:_KEY|_TOKEN|_SECRET|_PASSWORD)$`)
+)
+
+const redacted = "REDACTED"
+
+// secretsFromEnv returns the values of environment variables whose names look
+// like credentials, such as OMDB_API_KEY or TELEGRAM_BOT_TOKEN.
+func secretsFromEnv() []string {
+	var values []string
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		// Short values would blank out unrelated text
+		if secretEnvRegex.MatchString(name) && len(value) >= 6 {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// redactor removes credentials from text before it is logged.
+type redactor struct {
+	secrets []string
+}
+
+func newRedactor(values []string) *redactor {
+	// Replace longer secrets first so one containing another is fully removed
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	return &redactor{secrets: values}
+}
+
+func (r *redactor) redact(s string) string {
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	s = secretParamRegex.ReplaceAllString(s, "${1}"+redacted)
+	return botTokenRegex.ReplaceAllString(s, "bot"+redacted)
+}
+
+func (r *redactor) redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, r.redact(v.String()))
+	case slog.KindGroup:
+		attrs := v.Group()
+		redactedAttrs := make([]slog.Attr, len(attrs))
+		for i, attr := range attrs {
+			redactedAttrs[i] = r.redactAttr(attr)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redactedAttrs...)}
+	case slog.KindAny:
+		// Errors from net/http include the request URL
+		switch x := v.Any().(type) {
+		case error:
+			return slog.String(a.Key, r.redact(x.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, r.redact(x.String()))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// redactingHandler redacts the message and attributes of each record before
+// passing it on.
+type redactingHandler struct {
+	next     slog.Handler
+	redactor *redactor
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, rec slog.Record) error {
+	out := slog.NewRecord(rec.Time, rec.Level, h.redactor.redact(rec.Message), rec.PC)
+	rec.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.redactor.redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = h.redactor.redactAttr(a)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redactedAttrs), redactor: h.redactor}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
+
+// telegramLogger routes the Telegram library's own logging through slog.
+type telegramLogger struct{}
+
+func (telegramLogger) Println(v ...interface{}) {
+	slog.Warn(strings.TrimSuffix(fmt.Sprintln(v...), "\n"), "component", "telegram")
+}
+
+func (telegramLogger) Printf(format string, v ...interface{}) {
+	slog.Warn(fmt.Sprintf(format, v...), "component", "telegram")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSecretsFromEnv(t *testing.T) {
+	t.Setenv("OMDB_API_KEY", "omdb-secret-1234")
+	t.Setenv("TELEGRAM_BOT_TOKEN", "123456:telegram-secret")
+	t.Setenv("DASHBOARD_SECRET", "dashboard-secret")
+	t.Setenv("PLEX_PASSWORD", "abc") // Too short to redact safely
+	t.Setenv("LIBRARY_ROOT_MOVIES", "/srv/movies")
+	t.Setenv("TOKEN_FILE", "/run/secrets/token")
+
+	values := secretsFromEnv()
+	for _, want := range []string{"omdb-secret-1234", "123456:telegram-secret", "dashboard-secret"} {
+		if !slices.Contains(values, want) {
+			t.Errorf("secretsFromEnv() is missing %q", want)
+		}
+	}
+	for _, notWant := range []string{"abc", "/srv/movies", "/run/secrets/token"} {
+		if slices.Contains(values, notWant) {
+			t.Errorf("secretsFromEnv() has %q", notWant)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	r := newRedactor([]string{"omdb-secret", "omdb-secret-long", "sab-secret-99"})
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"env secret", "OMDB rejected omdb-secret-long", "OMDB rejected REDACTED"},
+		{"shorter env secret", "key omdb-secret in use", "key REDACTED in use"},
+		{"env secret in URL path", "GET http://sab/api/sab-secret-99/queue", "GET http://sab/api/REDACTED/queue"},
+		{"apikey param", "GET https://api.nzbgeek.info/api?t=search&apikey=abc123&q=matrix",
+			"GET https://api.nzbgeek.info/api?t=search&apikey=REDACTED&q=matrix"},
+		{"api_key param", `Get "https://omdb/?api_key=abc123": EOF`, `Get "https://omdb/?api_key=REDACTED": EOF`},
+		{"Plex token param", "http://plex:32400/library?X-Plex-Token=xyz789", "http://plex:32400/library?X-Plex-Token=REDACTED"},
+		{"password param", "login?user=me&password=hunter2 failed", "login?user=me&password=REDACTED failed"},
+		{"bot token in URL", `Post "https://api.telegram.org/bot123456:AAH-abc_def/sendMessage": timeout`,
+			`Post "https://api.telegram.org/botREDACTED/sendMessage": timeout`},
+		{"nothing secret", "Download completed: The Matrix (1999)", "Download completed: The Matrix (1999)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.redact(tt.in); got != tt.want {
+				t.Errorf("redact(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// stringer is a fmt.Stringer, like *url.URL.
+type stringer string
+
+func (s stringer) String() string { return string(s) }
+
+func TestRedactingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	r := newRedactor([]string{"env-secret-value"})
+	logger := slog.New(&redactingHandler{next: slog.NewTextHandler(&buf, nil), redactor: r})
+
+	logger.With("base_url", "http://sab/api?apikey=with-attrs").
+		WithGroup("request").
+		Info("Fetching https://api.telegram.org/bot42:message-token/getMe",
+			"url", "http://indexer/api?apikey=string-attr",
+			"err", errors.New(`Get "http://indexer/api?apikey=error-attr": EOF`),
+			"link", stringer("http://plex/?X-Plex-Token=stringer-attr"),
+			slog.Group("client",
+				"key", "env-secret-value",
+				slog.Group("retry", "url", "http://omdb/?apikey=nested-attr"),
+			),
+			"count", 3,
+		)
+
+	out := buf.String()
+	for _, secret := range []string{
+		"with-attrs", "message-token", "string-attr", "error-attr", "stringer-attr", "env-secret-value", "nested-attr",
+	} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log output has %q:\n%s", secret, out)
+		}
+	}
+	for _, want := range []string{"request.client.retry.url=", "request.count=3", "botREDACTED"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log output is missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"github.com/dx314/movie_beacon_bot/db"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joho/godotenv"
-	"log"
+	"log/slog"
 	_ "modernc.org/sqlite"
+	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
-	"sync"
+	"syscall"
+	"time"
 )
 
 const (
@@ -24,97 +29,272 @@ type Enclosure struct {
 	Type   string `xml:"type,attr"`
 }
 
-type customBotAPI struct {
-	*tgbotapi.BotAPI
-}
-
-func (c *customBotAPI) SendMessage(msg tgbotapi.MessageConfig) (tgbotapi.Message, error) {
-	return c.Send(msg)
-}
-
-func (c *customBotAPI) SendMessageWithButtons(chatID int64, text string, buttons [][]tgbotapi.InlineKeyboardButton) (tgbotapi.Message, error) {
-	msg := tgbotapi.NewMessage(chatID, text)
-	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(buttons...)
-	return c.Send(msg)
-}
-
-var (
-	bot                 *customBotAPI
-	yearRegex           = regexp.MustCompile(`\b(19|20)\d{2}\b`)
-	userStates          = make(map[int64]string)
-	sabnzbdAPI          string
-	sabnzbdAPIKey       string
-	activeMonitors      = make(map[string]bool)
-	activeMonitorsMutex sync.Mutex
-	queries             *db.Queries
-)
+var yearRegex = regexp.MustCompile(`\b(19|20)\d{2}\b`)
 
 func main() {
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		fatal("Error loading .env file", "err", err)
+	}
+	if err := setupLogging(os.Stderr); err != nil {
+		fatal("Error configuring logging", "err", err)
 	}
+	tgbotapi.SetLogger(telegramLogger{})
 
 	// Initialize SQLite database
 	dbConn, err := sql.Open("sqlite", "./nzbot.db")
 	if err != nil {
-		log.Fatal(err)
+		fatal("Error opening database", "err", err)
 	}
 	defer dbConn.Close()
 
-	// Initialize queries
-	queries = db.New(dbConn)
-
 	botAPI, err := tgbotapi.NewBotAPI(os.Getenv("TELEGRAM_BOT_TOKEN"))
 	if err != nil {
-		log.Panic(err)
+		fatal("Error connecting to Telegram", "err", err)
 	}
+	slog.Info("Authorized on Telegram", "account", botAPI.Self.UserName)
 
-	bot = &customBotAPI{botAPI}
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	mediaServer, err := loadMediaServer(httpClient)
+	if err != nil {
+		fatal("Error configuring media server", "err", err)
+	}
+	postProcess, err := loadPostProcessor()
+	if err != nil {
+		fatal("Error configuring post-processing", "err", err)
+	}
+	nfo, err := loadNFOWriter(httpClient)
+	if err != nil {
+		fatal("Error configuring NFO writer", "err", err)
+	}
+	subtitles, err := loadSubtitleFetcher(httpClient)
+	if err != nil {
+		fatal("Error configuring subtitles", "err", err)
+	}
+	var libraryRefresh time.Duration
+	if v := os.Getenv("LIBRARY_REFRESH_INTERVAL"); v != "" {
+		if libraryRefresh, err = time.ParseDuration(v); err != nil {
+			fatal("Invalid LIBRARY_REFRESH_INTERVAL", "err", err)
+		}
+	}
+	var stuckAfter time.Duration
+	if v := os.Getenv("HEALTH_STUCK_AFTER"); v != "" {
+		if stuckAfter, err = time.ParseDuration(v); err != nil {
+			fatal("Invalid HEALTH_STUCK_AFTER", "err", err)
+		}
+	}
+	disks, err := loadDiskGuard(postProcess)
+	if err != nil {
+		fatal("Error configuring disk space checks", "err", err)
+	}
+	sizes, err := loadSizeFilter()
+	if err != nil {
+		fatal("Error configuring release size filter", "err", err)
+	}
+	quotas, err := loadQuotaLimits()
+	if err != nil {
+		fatal("Error configuring quotas", "err", err)
+	}
+	indexerLimits, err := loadIndexerLimits()
+	if err != nil {
+		fatal("Error configuring indexer limits", "err", err)
+	}
+	store := db.New(dbConn)
+	webhooks, err := loadWebhookOutbox(store, httpClient)
+	if err != nil {
+		fatal("Error configuring outgoing webhooks", "err", err)
+	}
+	refs := newPlatformRefs(store)
+	discord, err := loadDiscord(refs, httpClient)
+	if err != nil {
+		fatal("Error configuring Discord", "err", err)
+	}
+	matrix, err := loadMatrix(refs, httpClient)
+	if err != nil {
+		fatal("Error configuring Matrix", "err", err)
+	}
+	var frontends []Frontend
+	if discord != nil {
+		frontends = append(frontends, discord)
+	}
+	if matrix != nil {
+		frontends = append(frontends, matrix)
+	}
+	var sender Sender = botAPI
+	if len(frontends) > 0 {
+		sender = newPlatformSender(botAPI, refs, frontends...)
+	}
+	nzbGeek := newNZBGeekClient(os.Getenv("NZBGEEK_API_URL"), os.Getenv("NZBGEEK_API_KEY"), httpClient)
+	capsCtx, cancelCaps := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := nzbGeek.LoadCaps(capsCtx); err != nil {
+		slog.Warn("Error loading indexer capabilities, searching by IMDb ID until they load", "err", err)
+	}
+	cancelCaps()
+	sabnzbd := newSABnzbdClient(os.Getenv("SABNZBD_API_URL"), os.Getenv("SABNZBD_API_KEY"), httpClient)
+	health := newHealthChecker(stuckAfter,
+		sqliteCheck(dbConn),
+		telegramCheck(botAPI),
+		sabnzbdCheck(sabnzbd),
+		indexerCheck(nzbGeekIndexer, nzbGeek),
+	)
 
-	sabnzbdAPI = os.Getenv("SABNZBD_API_URL")
-	sabnzbdAPIKey = os.Getenv("SABNZBD_API_KEY")
+	b := NewBot(Deps{
+		Sender:    sender,
+		Store:     store,
+		Metadata:  instrumentedMetadata{newOMDBClient(os.Getenv("OMDB_API_URL"), os.Getenv("OMDB_API_KEY"), httpClient)},
+		Indexer:   instrumentedIndexer{nzbGeek},
+		Downloads: instrumentedDownloads{sabnzbd},
+		Media:     mediaServer,
+		Library:   loadLibrarySource(mediaServer),
 
-	bot.Debug = true
-	log.Printf("Authorized on account %s", bot.Self.UserName)
+		PostProcess:    postProcess,
+		NFO:            nfo,
+		Subtitles:      subtitles,
+		Health:         health,
+		Webhooks:       webhooks,
+		Disks:          disks,
+		Sizes:          sizes,
+		APIKeys:        os.Getenv("API_LISTEN_ADDR") != "",
+		LinkAccounts:   len(frontends) > 0,
+		Quotas:         quotas,
+		IndexerLimits:  indexerLimits,
+		LibraryRefresh: libraryRefresh,
+	})
+	b.purgeExpiredConversations()
 
-	go resumeDownloadMonitoring()
+	router := b.newBotRouter()
+	if err := router.SyncCommands(); err != nil {
+		slog.Error("Error setting bot commands", "err", err)
+	}
+
+	b.goSafe("resume monitoring", b.resumeDownloadMonitoring)
+	b.goSafe("library index", b.refreshLibraryPeriodically)
+	b.goSafe("disk space", b.watchDiskSpace)
+	if webhooks != nil {
+		b.goSafe("outgoing webhooks", webhooks.Run)
+	}
+
+	servers := newHTTPServers()
+	servers.Handle(os.Getenv("METRICS_LISTEN_ADDR"), "/metrics", metricsHandler())
+	servers.Handle(os.Getenv("HEALTH_LISTEN_ADDR"), "/healthz", http.HandlerFunc(health.handleHealthz))
+	servers.Handle(os.Getenv("HEALTH_LISTEN_ADDR"), "/readyz", http.HandlerFunc(health.handleReadyz))
+	dashboard, err := loadDashboard(b, os.Getenv("TELEGRAM_BOT_TOKEN"), botAPI.Self.UserName)
+	if err != nil {
+		fatal("Error configuring dashboard", "err", err)
+	}
+	if dashboard != nil {
+		servers.Handle(os.Getenv("DASHBOARD_LISTEN_ADDR"), "/", dashboard.Handler())
+	}
+	if api := loadAPI(b); api != nil {
+		servers.Handle(os.Getenv("API_LISTEN_ADDR"), "/api/", api.Handler())
+	}
+	if discord != nil {
+		servers.Handle(os.Getenv("DISCORD_LISTEN_ADDR"), "/discord/interactions", discord)
+	}
+	servers.Start()
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	updates := bot.GetUpdatesChan(u)
+	updates, updateErrs, stopUpdates, err := receiveUpdates(botAPI)
+	if err != nil {
+		fatal("Error receiving updates", "err", err)
+	}
 
-	for update := range updates {
-		if update.Message != nil {
-			if update.Message.IsCommand() {
-				handleCommand(update.Message)
-			} else {
-				handleInput(update.Message)
+	// Discord and Matrix updates are handled on this goroutine too, so handlers
+	// never run concurrently
+	platformUpdates := make(chan tgbotapi.Update)
+	for _, f := range frontends {
+		err := f.Receive(ctx, func(update tgbotapi.Update) {
+			select {
+			case platformUpdates <- update:
+			case <-ctx.Done():
 			}
-		} else if update.CallbackQuery != nil {
-			handleCallbackQuery(update.CallbackQuery)
+		})
+		if err != nil {
+			fatal("Error receiving updates", "platform", f.Platform(), "err", err)
 		}
+		slog.Info("Receiving updates", "platform", f.Platform())
 	}
-}
 
-func manageMonitorState(nzbUUID string) bool {
-	activeMonitorsMutex.Lock()
-	defer activeMonitorsMutex.Unlock()
+	// Failing to receive updates shuts down the same way as a signal, and then
+	// exits with an error
+	failed := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			slog.Info("Shutting down")
+		case err := <-updateErrs:
+			slog.Error("Stopped receiving updates, shutting down", "err", err)
+			failed <- err
+		}
+		stopUpdates()
+		servers.Shutdown()
+	}()
 
-	if activeMonitors[nzbUUID] {
-		// A monitor is already running for this item
-		return false
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				exitAfterStop(failed, dbConn)
+				return
+			}
+			router.Dispatch(update)
+		case update := <-platformUpdates:
+			router.Dispatch(update)
+		case <-stopped:
+			// The webhook leaves its channel open if shutting down timed out
+			exitAfterStop(failed, dbConn)
+			return
+		}
 	}
+}
 
-	// No monitor is running, so we can start one
-	activeMonitors[nzbUUID] = true
-	return true
+// exitAfterStop exits with an error if updates stopped because receiving them
+// failed.
+func exitAfterStop(failed <-chan error, dbConn *sql.DB) {
+	select {
+	case <-failed:
+		dbConn.Close()
+		os.Exit(1)
+	default:
+	}
 }
 
-func releaseMonitorState(nzbUUID string) {
-	activeMonitorsMutex.Lock()
-	defer activeMonitorsMutex.Unlock()
+// receiveUpdates starts receiving updates using the mode selected by
+// TELEGRAM_UPDATE_MODE ("polling" by default, or "webhook") and returns the
+// update channel, a channel reporting errors that stop updates from arriving,
+// and a function that stops it.
+func receiveUpdates(botAPI *tgbotapi.BotAPI) (tgbotapi.UpdatesChannel, <-chan error, func(), error) {
+	switch mode := os.Getenv("TELEGRAM_UPDATE_MODE"); mode {
+	case "", "polling":
+		// A previously registered webhook would make getUpdates fail
+		if _, err := botAPI.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+			slog.Error("Error deleting webhook", "err", err)
+		}
 
-	delete(activeMonitors, nzbUUID)
+		u := tgbotapi.NewUpdate(0)
+		u.Timeout = 60
+		// The library retries polling errors itself, so none are reported
+		return botAPI.GetUpdatesChan(u), nil, botAPI.StopReceivingUpdates, nil
+	case "webhook":
+		cfg, err := loadWebhookConfig()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		wr, err := startWebhook(botAPI, cfg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		stop := func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			wr.Stop(ctx)
+		}
+		return wr.Updates(), wr.Errors(), stop, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown TELEGRAM_UPDATE_MODE %q", mode)
+	}
 }
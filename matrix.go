@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	// matrixSyncTimeout is how long a /sync request waits for events. It stays
+	// under the HTTP client's timeout.
+	matrixSyncTimeout = 20 * time.Second
+	// matrixRetryDelay is how long to wait after a failed /sync.
+	matrixRetryDelay = 5 * time.Second
+)
+
+// matrixKeycaps are the reactions offered for buttons that don't start with an
+// emoji of their own.
+var matrixKeycaps = []string{"1️⃣", "2️⃣", "3️⃣", "4️⃣", "5️⃣", "6️⃣", "7️⃣", "8️⃣", "9️⃣", "🔟"}
+
+// matrixFrontend runs the bot on Matrix. Commands are messages starting with
+// "!" or "/", and since Matrix has no buttons, menus are shown as a legend of
+// reactions that the bot adds to the message for users to press.
+type matrixFrontend struct {
+	homeserver string
+	token      string
+	userID     string
+	http       *http.Client
+	refs       *platformRefs
+
+	mu sync.Mutex
+	// menus maps the event ID of a message with buttons to its menu.
+	menus map[string]*matrixMenu
+	// direct caches whether a room is a one to one chat.
+	direct map[string]bool
+}
+
+// matrixOption is a reaction standing in for a button.
+type matrixOption struct {
+	key  string
+	data string
+}
+
+// matrixMenu is the reactions offered on a message.
+type matrixMenu struct {
+	// actions maps a reaction key to its button's callback data.
+	actions map[string]string
+	// reactions are the event IDs of the bot's own reactions.
+	reactions []string
+}
+
+// loadMatrix returns the Matrix frontend configured with MATRIX_HOMESERVER,
+// MATRIX_ACCESS_TOKEN and MATRIX_USER_ID, or nil when MATRIX_HOMESERVER is not
+// set.
+func loadMatrix(refs *platformRefs, httpClient *http.Client) (*matrixFrontend, error) {
+	homeserver := strings.TrimSuffix(os.Getenv("MATRIX_HOMESERVER"), "/")
+	if homeserver == "" {
+		return nil, nil
+	}
+	m := &matrixFrontend{
+		homeserver: homeserver,
+		token:      os.Getenv("MATRIX_ACCESS_TOKEN"),
+		userID:     os.Getenv("MATRIX_USER_ID"),
+		http:       httpClient,
+		refs:       refs,
+		menus:      make(map[string]*matrixMenu),
+		direct:     make(map[string]bool),
+	}
+	if m.token == "" {
+		return nil, errors.New("MATRIX_ACCESS_TOKEN is not set")
+	}
+	if m.userID == "" {
+		return nil, errors.New("MATRIX_USER_ID is not set")
+	}
+	return m, nil
+}
+
+func (m *matrixFrontend) Platform() string {
+	return "matrix"
+}
+
+func (m *matrixFrontend) SendText(chatID int64, text Text) (int, error) {
+	return m.SendButtons(chatID, text, nil)
+}
+
+func (m *matrixFrontend) SendButtons(chatID int64, text Text, buttons [][]Button) (int, error) {
+	room, err := m.refs.ExternalID(chatID, refChat)
+	if err != nil {
+		return 0, err
+	}
+	menu, content := matrixMenuContent(text, buttons)
+	eventID, err := m.send(room, "m.room.message", content)
+	if err != nil {
+		return 0, err
+	}
+	if len(menu) > 0 {
+		m.offer(room, eventID, menu)
+	}
+	id, err := m.refs.LocalID(m.Platform(), refMessage, eventID)
+	return int(id), err
+}
+
+func (m *matrixFrontend) Edit(chatID int64, messageID int, text Text, buttons [][]Button) error {
+	room, eventID, err := m.eventIDs(chatID, messageID)
+	if err != nil {
+		return err
+	}
+	menu, content := matrixMenuContent(text, buttons)
+	edit := map[string]interface{}{
+		"msgtype":       content["msgtype"],
+		"body":          "* " + content["body"].(string),
+		"m.new_content": content,
+		"m.relates_to":  map[string]string{"rel_type": "m.replace", "event_id": eventID},
+	}
+	if _, err := m.send(room, "m.room.message", edit); err != nil {
+		return err
+	}
+
+	m.withdraw(room, eventID)
+	if len(menu) > 0 {
+		m.offer(room, eventID, menu)
+	}
+	return nil
+}
+
+func (m *matrixFrontend) Delete(chatID int64, messageID int) error {
+	room, eventID, err := m.eventIDs(chatID, messageID)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.menus, eventID)
+	m.mu.Unlock()
+	return m.redact(room, eventID)
+}
+
+// SetCommands does nothing, as Matrix has no command menu.
+func (m *matrixFrontend) SetCommands([]tgbotapi.BotCommand) error {
+	return nil
+}
+
+func (m *matrixFrontend) eventIDs(chatID int64, messageID int) (room, eventID string, err error) {
+	if room, err = m.refs.ExternalID(chatID, refChat); err != nil {
+		return "", "", err
+	}
+	if eventID, err = m.refs.ExternalID(int64(messageID), refMessage); err != nil {
+		return "", "", err
+	}
+	return room, eventID, nil
+}
+
+// matrixMenuContent builds a notice for text, listing each button with the
+// reaction that presses it. Link buttons are listed as links. It returns the
+// reactions to offer, in order, with their callback data.
+func matrixMenuContent(text Text, buttons [][]Button) ([]matrixOption, map[string]interface{}) {
+	plain := text.Plain()
+	formatted := text.Body
+	if !text.HTML {
+		formatted = html.EscapeString(text.Body)
+	}
+
+	var menu []matrixOption
+	var legendPlain, legendHTML []string
+	used := make(map[string]bool)
+	for _, row := range buttons {
+		for _, button := range row {
+			if button.URL != "" {
+				legendPlain = append(legendPlain, button.Label+": "+button.URL)
+				legendHTML = append(legendHTML, fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(button.URL), html.EscapeString(button.Label)))
+				continue
+			}
+			key := matrixReactionKey(button.Label, used)
+			used[key] = true
+			menu = append(menu, matrixOption{key: key, data: button.Data})
+			if button.Label == key {
+				// The message already explains what the emoji stands for
+				continue
+			}
+			line := button.Label
+			if !strings.HasPrefix(line, key) {
+				line = key + " " + line
+			}
+			legendPlain = append(legendPlain, line)
+			legendHTML = append(legendHTML, html.EscapeString(line))
+		}
+	}
+	if len(legendPlain) > 0 {
+		plain = strings.TrimRight(plain, "\n") + "\n\n" + strings.Join(legendPlain, "\n")
+		formatted = strings.TrimRight(formatted, "\n") + "\n\n" + strings.Join(legendHTML, "\n")
+	}
+	if len(menu) > 0 {
+		plain += "\n\nReact to choose."
+		formatted += "\n\n<i>React to choose.</i>"
+	}
+
+	return menu, map[string]interface{}{
+		"msgtype":        "m.notice",
+		"body":           plain,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": strings.ReplaceAll(formatted, "\n", "<br>"),
+	}
+}
+
+// matrixReactionKey picks the reaction for a button: the emoji its label starts
+// with, or else the first unused keycap or letter.
+func matrixReactionKey(label string, used map[string]bool) string {
+	if fields := strings.Fields(label); len(fields) > 0 && isEmoji(fields[0]) && !used[fields[0]] {
+		return fields[0]
+	}
+	for _, key := range matrixKeycaps {
+		if !used[key] {
+			return key
+		}
+	}
+	for r := '🇦'; r <= '🇿'; r++ {
+		if !used[string(r)] {
+			return string(r)
+		}
+	}
+	return "❓"
+}
+
+// isEmoji reports whether s is made of symbols only, as emoji are.
+func isEmoji(s string) bool {
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsPunct(r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// offer reacts to eventID with each key of menu and remembers what they do.
+func (m *matrixFrontend) offer(room, eventID string, menu []matrixOption) {
+	offered := &matrixMenu{actions: make(map[string]string)}
+	for _, option := range menu {
+		offered.actions[option.key] = option.data
+	}
+	m.mu.Lock()
+	m.menus[eventID] = offered
+	m.mu.Unlock()
+
+	for _, option := range menu {
+		reaction, err := m.send(room, "m.reaction", map[string]interface{}{
+			"m.relates_to": map[string]string{"rel_type": "m.annotation", "event_id": eventID, "key": option.key},
+		})
+		if err != nil {
+			slog.Warn("Error adding Matrix reaction", "room", room, "key", option.key, "err", err)
+			continue
+		}
+		m.mu.Lock()
+		offered.reactions = append(offered.reactions, reaction)
+		m.mu.Unlock()
+	}
+}
+
+// withdraw removes the menu on eventID, along with the bot's reactions.
+func (m *matrixFrontend) withdraw(room, eventID string) {
+	m.mu.Lock()
+	menu := m.menus[eventID]
+	delete(m.menus, eventID)
+	m.mu.Unlock()
+	if menu == nil {
+		return
+	}
+	for _, reaction := range menu.reactions {
+		if err := m.redact(room, reaction); err != nil {
+			slog.Warn("Error removing Matrix reaction", "room", room, "err", err)
+		}
+	}
+}
+
+// send sends an event to room and returns its ID.
+func (m *matrixFrontend) send(room, eventType string, content interface{}) (string, error) {
+	path := fmt.Sprintf("/rooms/%s/send/%s/%s", url.PathEscape(room), eventType, uuid.New().String())
+	var sent struct {
+		EventID string `json:"event_id"`
+	}
+	err := m.call(context.Background(), http.MethodPut, path, content, &sent)
+	return sent.EventID, err
+}
+
+func (m *matrixFrontend) redact(room, eventID string) error {
+	path := fmt.Sprintf("/rooms/%s/redact/%s/%s", url.PathEscape(room), url.PathEscape(eventID), uuid.New().String())
+	return m.call(context.Background(), http.MethodPut, path, map[string]string{}, nil)
+}
+
+// call makes a client-server API request, decoding the response into out when
+// it is not nil.
+func (m *matrixFrontend) call(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, m.homeserver+"/_matrix/client/v3"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("matrix %s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(detail))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// matrixSync is the part of a /sync response the bot uses.
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]json.RawMessage `json:"invite"`
+	} `json:"rooms"`
+}
+
+type matrixEvent struct {
+	Type    string `json:"type"`
+	EventID string `json:"event_id"`
+	Sender  string `json:"sender"`
+	Content struct {
+		MsgType   string `json:"msgtype"`
+		Body      string `json:"body"`
+		RelatesTo *struct {
+			RelType string `json:"rel_type"`
+			EventID string `json:"event_id"`
+			Key     string `json:"key"`
+		} `json:"m.relates_to"`
+	} `json:"content"`
+}
+
+// Receive syncs with the homeserver in the background. Events from before the
+// bot started are skipped, and invites are accepted.
+func (m *matrixFrontend) Receive(ctx context.Context, dispatch func(tgbotapi.Update)) error {
+	var initial matrixSync
+	if err := m.call(ctx, http.MethodGet, "/sync?timeout=0", nil, &initial); err != nil {
+		return err
+	}
+	m.join(ctx, initial)
+
+	go func() {
+		since := initial.NextBatch
+		for ctx.Err() == nil {
+			var batch matrixSync
+			path := fmt.Sprintf("/sync?timeout=%d&since=%s", matrixSyncTimeout.Milliseconds(), url.QueryEscape(since))
+			if err := m.call(ctx, http.MethodGet, path, nil, &batch); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Error("Error syncing with Matrix", "err", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(matrixRetryDelay):
+				}
+				continue
+			}
+			since = batch.NextBatch
+
+			m.join(ctx, batch)
+			for room, joined := range batch.Rooms.Join {
+				for _, event := range joined.Timeline.Events {
+					update, ok, err := m.update(ctx, room, event)
+					if err != nil {
+						slog.Error("Error reading Matrix event", "room", room, "event_id", event.EventID, "err", err)
+						continue
+					}
+					if ok {
+						dispatch(update)
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// join accepts the invites in a sync response.
+func (m *matrixFrontend) join(ctx context.Context, batch matrixSync) {
+	for room := range batch.Rooms.Invite {
+		if err := m.call(ctx, http.MethodPost, "/rooms/"+url.PathEscape(room)+"/join", map[string]string{}, nil); err != nil {
+			slog.Error("Error joining Matrix room", "room", room, "err", err)
+			continue
+		}
+		slog.Info("Joined Matrix room", "room", room)
+	}
+}
+
+// update converts a message or reaction to an update. It reports false for
+// events the bot ignores: its own, edits, and reactions to anything but a menu.
+func (m *matrixFrontend) update(ctx context.Context, room string, event matrixEvent) (tgbotapi.Update, bool, error) {
+	if event.Sender == m.userID {
+		return tgbotapi.Update{}, false, nil
+	}
+
+	var data string
+	switch event.Type {
+	case "m.room.message":
+		if event.Content.MsgType != "m.text" || event.Content.RelatesTo != nil && event.Content.RelatesTo.RelType == "m.replace" {
+			return tgbotapi.Update{}, false, nil
+		}
+	case "m.reaction":
+		relates := event.Content.RelatesTo
+		if relates == nil {
+			return tgbotapi.Update{}, false, nil
+		}
+		m.mu.Lock()
+		menu := m.menus[relates.EventID]
+		if menu != nil {
+			data = menu.actions[relates.Key]
+		}
+		m.mu.Unlock()
+		if data == "" {
+			return tgbotapi.Update{}, false, nil
+		}
+	default:
+		return tgbotapi.Update{}, false, nil
+	}
+
+	from, err := platformUser(m.refs, m.Platform(), event.Sender, event.Sender)
+	if err != nil {
+		return tgbotapi.Update{}, false, err
+	}
+	chat, err := platformChat(m.refs, m.Platform(), room, m.isDirect(ctx, room))
+	if err != nil {
+		return tgbotapi.Update{}, false, err
+	}
+
+	if event.Type == "m.reaction" {
+		messageID, err := m.refs.LocalID(m.Platform(), refMessage, event.Content.RelatesTo.EventID)
+		if err != nil {
+			return tgbotapi.Update{}, false, err
+		}
+		return callbackUpdate(m.Platform(), event.EventID, chat, from, int(messageID), data), true, nil
+	}
+
+	messageID, err := m.refs.LocalID(m.Platform(), refMessage, event.EventID)
+	if err != nil {
+		return tgbotapi.Update{}, false, err
+	}
+	text := strings.TrimSpace(event.Content.Body)
+	if strings.HasPrefix(text, "!") {
+		text = "/" + text[1:]
+	}
+	return commandUpdate(chat, from, int(messageID), text), true, nil
+}
+
+// isDirect reports whether room is a one to one chat with the bot.
+func (m *matrixFrontend) isDirect(ctx context.Context, room string) bool {
+	m.mu.Lock()
+	direct, ok := m.direct[room]
+	m.mu.Unlock()
+	if ok {
+		return direct
+	}
+
+	var members struct {
+		Joined map[string]json.RawMessage `json:"joined"`
+	}
+	if err := m.call(ctx, http.MethodGet, "/rooms/"+url.PathEscape(room)+"/joined_members", nil, &members); err != nil {
+		slog.Warn("Error listing Matrix room members", "room", room, "err", err)
+		return false
+	}
+	direct = len(members.Joined) == 2
+	m.mu.Lock()
+	m.direct[room] = direct
+	m.mu.Unlock()
+	return direct
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNoLibrary is returned for categories with no media server library configured.
+var errNoLibrary = errors.New("no media server library configured for category")
+
+// mediaLibraries maps categories to media server libraries and translates
+// SABnzbd paths into the paths the media server sees.
+type mediaLibraries struct {
+	sections map[string]string // Category -> library/section ID
+	pathMap  [][2]string       // SABnzbd path prefix -> media server path prefix
+}
+
+func (l mediaLibraries) section(category string) (string, error) {
+	id := l.sections[category]
+	if id == "" {
+		return "", errNoLibrary
+	}
+	return id, nil
+}
+
+// uniqueSections returns each configured library once.
+func (l mediaLibraries) uniqueSections() []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, id := range l.sections {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// serverPath rewrites path using the first matching prefix in the path map.
+func (l mediaLibraries) serverPath(path string) string {
+	for _, m := range l.pathMap {
+		if strings.HasPrefix(path, m[0]) {
+			return m[1] + strings.TrimPrefix(path, m[0])
+		}
+	}
+	return path
+}
+
+// inDir reports whether file is dir or lives somewhere beneath it.
+func inDir(file, dir string) bool {
+	dir = strings.TrimRight(dir, "/")
+	return file == dir || strings.HasPrefix(file, dir+"/")
+}
+
+// loadMediaServer builds the media server client selected by MEDIA_SERVER_TYPE.
+// It returns nil when no media server is configured.
+func loadMediaServer(httpClient *http.Client) (MediaServer, error) {
+	kind := strings.ToLower(os.Getenv("MEDIA_SERVER_TYPE"))
+	if kind == "" {
+		return nil, nil
+	}
+
+	baseURL := strings.TrimRight(os.Getenv("MEDIA_SERVER_URL"), "/")
+	token := os.Getenv("MEDIA_SERVER_TOKEN")
+	if baseURL == "" || token == "" {
+		return nil, errors.New("MEDIA_SERVER_URL and MEDIA_SERVER_TOKEN must be set when MEDIA_SERVER_TYPE is set")
+	}
+	publicURL := strings.TrimRight(os.Getenv("MEDIA_SERVER_PUBLIC_URL"), "/")
+	if publicURL == "" {
+		publicURL = baseURL
+	}
+
+	libs := mediaLibraries{sections: make(map[string]string)}
+	for category := range nzbGeekCategories {
+		libs.sections[category] = os.Getenv("MEDIA_SERVER_LIBRARY_" + strings.ToUpper(category))
+	}
+	for _, pair := range strings.Split(os.Getenv("MEDIA_SERVER_PATH_MAP"), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid MEDIA_SERVER_PATH_MAP entry %q, expected from=to", pair)
+		}
+		libs.pathMap = append(libs.pathMap, [2]string{from, to})
+	}
+
+	switch kind {
+	case "plex":
+		return &plexClient{baseURL: baseURL, token: token, libs: libs, http: httpClient}, nil
+	case "jellyfin", "emby":
+		return &jellyfinClient{baseURL: baseURL, publicURL: publicURL, token: token, emby: kind == "emby", libs: libs, http: httpClient}, nil
+	default:
+		return nil, fmt.Errorf("unknown MEDIA_SERVER_TYPE %q", kind)
+	}
+}
+
+// plexClient talks to a Plex Media Server.
+type plexClient struct {
+	baseURL string
+	token   string
+	libs    mediaLibraries
+	http    *http.Client
+
+	machineIDMutex sync.Mutex
+	machineID      string // Cached server identifier used in app.plex.tv links
+}
+
+func (c *plexClient) get(path string, query url.Values, v interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("X-Plex-Token", c.token)
+
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach Plex: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status from Plex: %s", resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode Plex response: %v", err)
+	}
+	return nil
+}
+
+// Refresh scans just the download's folder in the category's library section.
+func (c *plexClient) Refresh(category, path string) error {
+	section, err := c.libs.section(category)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"path": {c.libs.serverPath(path)}}
+	return c.get("/library/sections/"+section+"/refresh", query, nil)
+}
+
+// WatchLink looks through the section's most recently added items for a file
+// under path.
+func (c *plexClient) WatchLink(category, path string) (string, error) {
+	section, err := c.libs.section(category)
+	if err != nil {
+		return "", err
+	}
+	dir := c.libs.serverPath(path)
+
+	itemType := "1" // Movies
+	if isSeriesCategory(category) {
+		itemType = "4" // Episodes
+	}
+	query := url.Values{
+		"type":                   {itemType},
+		"sort":                   {"addedAt:desc"},
+		"X-Plex-Container-Start": {"0"},
+		"X-Plex-Container-Size":  {"50"},
+	}
+
+	var result struct {
+		MediaContainer struct {
+			Metadata []struct {
+				RatingKey string `json:"ratingKey"`
+				Media     []struct {
+					Part []struct {
+						File string `json:"file"`
+					} `json:"Part"`
+				} `json:"Media"`
+			} `json:"Metadata"`
+		} `json:"MediaContainer"`
+	}
+	if err := c.get("/library/sections/"+section+"/all", query, &result); err != nil {
+		return "", err
+	}
+
+	for _, item := range result.MediaContainer.Metadata {
+		for _, media := range item.Media {
+			for _, part := range media.Part {
+				if inDir(part.File, dir) {
+					return c.link(item.RatingKey)
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// LibraryItems lists the movies and shows in every configured section.
+func (c *plexClient) LibraryItems() ([]LibraryItem, error) {
+	var items []LibraryItem
+	for _, section := range c.libs.uniqueSections() {
+		var result struct {
+			MediaContainer struct {
+				Metadata []struct {
+					Title   string `json:"title"`
+					AddedAt int64  `json:"addedAt"`
+					Guid    []struct {
+						ID string `json:"id"`
+					} `json:"Guid"`
+					Media []struct {
+						Width int `json:"width"`
+					} `json:"Media"`
+				} `json:"Metadata"`
+			} `json:"MediaContainer"`
+		}
+		query := url.Values{"includeGuids": {"1"}}
+		if err := c.get("/library/sections/"+section+"/all", query, &result); err != nil {
+			return nil, err
+		}
+
+		for _, m := range result.MediaContainer.Metadata {
+			item := LibraryItem{Title: m.Title, Added: time.Unix(m.AddedAt, 0)}
+			for _, guid := range m.Guid {
+				if id, ok := strings.CutPrefix(guid.ID, "imdb://"); ok {
+					item.ImdbID = id
+				}
+			}
+			for _, media := range m.Media {
+				if r := resolutionFromWidth(media.Width); resolutionRank(r) > resolutionRank(item.Resolution) {
+					item.Resolution = r
+				}
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (c *plexClient) link(ratingKey string) (string, error) {
+	machineID, err := c.serverID()
+	if err != nil {
+		return "", err
+	}
+	key := url.QueryEscape("/library/metadata/" + ratingKey)
+	return fmt.Sprintf("https://app.plex.tv/desktop#!/server/%s/details?key=%s", machineID, key), nil
+}
+
+// serverID returns the server's machine identifier, fetching it the first time
+// it's needed. Failures aren't cached, so the next link tries again.
+func (c *plexClient) serverID() (string, error) {
+	c.machineIDMutex.Lock()
+	defer c.machineIDMutex.Unlock()
+	if c.machineID != "" {
+		return c.machineID, nil
+	}
+
+	var identity struct {
+		MediaContainer struct {
+			MachineIdentifier string `json:"machineIdentifier"`
+		} `json:"MediaContainer"`
+	}
+	if err := c.get("/identity", nil, &identity); err != nil {
+		return "", err
+	}
+	if identity.MediaContainer.MachineIdentifier == "" {
+		return "", errors.New("plex didn't report its machine identifier")
+	}
+	c.machineID = identity.MediaContainer.MachineIdentifier
+	return c.machineID, nil
+}
+
+// jellyfinClient talks to Jellyfin, or to Emby which shares its API.
+type jellyfinClient struct {
+	baseURL   string
+	publicURL string // Base of "Watch now" links, if users reach the server at a different address
+	token     string
+	emby      bool
+	libs      mediaLibraries
+	http      *http.Client
+}
+
+func (c *jellyfinClient) do(method, path string, body, v interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Emby-Token", c.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach media server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("bad status from media server: %s", resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode media server response: %v", err)
+	}
+	return nil
+}
+
+// Refresh reports the new folder to the server, which scans it in whichever
+// library contains it.
+func (c *jellyfinClient) Refresh(category, path string) error {
+	if _, err := c.libs.section(category); err != nil {
+		return err
+	}
+	body := map[string]interface{}{
+		"Updates": []map[string]string{{
+			"Path":       c.libs.serverPath(path),
+			"UpdateType": "Created",
+		}},
+	}
+	return c.do(http.MethodPost, "/Library/Media/Updated", body, nil)
+}
+
+// WatchLink looks through the library's most recently added items for a file
+// under path.
+func (c *jellyfinClient) WatchLink(category, path string) (string, error) {
+	library, err := c.libs.section(category)
+	if err != nil {
+		return "", err
+	}
+	dir := c.libs.serverPath(path)
+
+	query := url.Values{
+		"ParentId":         {library},
+		"Recursive":        {"true"},
+		"Fields":           {"Path"},
+		"IncludeItemTypes": {"Movie,Episode"},
+		"SortBy":           {"DateCreated"},
+		"SortOrder":        {"Descending"},
+		"Limit":            {"50"},
+	}
+
+	var result struct {
+		Items []struct {
+			ID       string `json:"Id"`
+			ServerID string `json:"ServerId"`
+			Path     string `json:"Path"`
+		} `json:"Items"`
+	}
+	if err := c.do(http.MethodGet, "/Items?"+query.Encode(), nil, &result); err != nil {
+		return "", err
+	}
+
+	for _, item := range result.Items {
+		if inDir(item.Path, dir) {
+			page := "details"
+			if c.emby {
+				page = "item"
+			}
+			return fmt.Sprintf("%s/web/index.html#!/%s?id=%s&serverId=%s", c.publicURL, page, item.ID, item.ServerID), nil
+		}
+	}
+	return "", nil
+}
+
+// LibraryItems lists the movies and series in every configured library.
+func (c *jellyfinClient) LibraryItems() ([]LibraryItem, error) {
+	var items []LibraryItem
+	for _, library := range c.libs.uniqueSections() {
+		query := url.Values{
+			"ParentId":         {library},
+			"Recursive":        {"true"},
+			"Fields":           {"ProviderIds,DateCreated,MediaStreams"},
+			"IncludeItemTypes": {"Movie,Series"},
+		}
+
+		var result struct {
+			Items []struct {
+				Name         string            `json:"Name"`
+				DateCreated  time.Time         `json:"DateCreated"`
+				ProviderIds  map[string]string `json:"ProviderIds"`
+				MediaStreams []struct {
+					Type  string `json:"Type"`
+					Width int    `json:"Width"`
+				} `json:"MediaStreams"`
+			} `json:"Items"`
+		}
+		if err := c.do(http.MethodGet, "/Items?"+query.Encode(), nil, &result); err != nil {
+			return nil, err
+		}
+
+		for _, m := range result.Items {
+			item := LibraryItem{ImdbID: m.ProviderIds["Imdb"], Title: m.Name, Added: m.DateCreated}
+			for _, stream := range m.MediaStreams {
+				if stream.Type == "Video" {
+					item.Resolution = resolutionFromWidth(stream.Width)
+					break
+				}
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
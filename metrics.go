@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "beacon"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	commandsHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "commands_total",
+		Help:      "Commands handled, by command.",
+	}, []string{"command"})
+
+	callbacksHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "callbacks_total",
+		Help:      "Inline button presses handled, by callback type.",
+	}, []string{"type"})
+
+	handlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Time taken to handle an update, by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+
+	externalRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "external_request_duration_seconds",
+		Help:      "Latency of requests to OMDB, the indexer and SABnzbd.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"service", "operation"})
+
+	externalRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "external_request_errors_total",
+		Help:      "Failed requests to OMDB, the indexer and SABnzbd.",
+	}, []string{"service", "operation"})
+
+	indexerResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "indexer_results_total",
+		Help:      "Indexer results returned, filtered out and shown to users.",
+	}, []string{"outcome"})
+
+	grabs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "grabs_total",
+		Help:      "NZBs sent to SABnzbd, by category.",
+	}, []string{"category"})
+
+	downloadOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "downloads_total",
+		Help:      "Finished downloads, by outcome (Completed, Failed or Deleted).",
+	}, []string{"outcome"})
+
+	downloadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "download_duration_seconds",
+		Help:      "Time from monitoring a download to it finishing, by outcome.",
+		Buckets:   prometheus.ExponentialBuckets(60, 2, 10), // 1 minute to ~8.5 hours
+	}, []string{"outcome"})
+
+	activeMonitors = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_monitors",
+		Help:      "Downloads currently being monitored.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		commandsHandled,
+		callbacksHandled,
+		handlerDuration,
+		externalRequestDuration,
+		externalRequestErrors,
+		indexerResults,
+		grabs,
+		downloadOutcomes,
+		downloadDuration,
+		activeMonitors,
+	)
+}
+
+// observeRoute records a handled update in the Prometheus metrics.
+func observeRoute(route string, d time.Duration) {
+	switch {
+	case strings.HasPrefix(route, "/"):
+		commandsHandled.WithLabelValues(route).Inc()
+	case strings.HasPrefix(route, "callback:"):
+		callbacksHandled.WithLabelValues(strings.TrimPrefix(route, "callback:")).Inc()
+	}
+	handlerDuration.WithLabelValues(route).Observe(d.Seconds())
+}
+
+// observeRequest times a request to an external service and counts its errors.
+func observeRequest(service, operation string, start time.Time, err error) {
+	externalRequestDuration.WithLabelValues(service, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		externalRequestErrors.WithLabelValues(service, operation).Inc()
+	}
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// instrumentedMetadata records metrics for a MetadataClient.
+type instrumentedMetadata struct {
+	MetadataClient
+}
+
+func (m instrumentedMetadata) SearchTitles(title, year, category string) (results []OMDBSearchResult, err error) {
+	defer func(start time.Time) { observeRequest("omdb", "search", start, err) }(time.Now())
+	return m.MetadataClient.SearchTitles(title, year, category)
+}
+
+func (m instrumentedMetadata) LookupSeries(name, year string) (result *OMDBTVSearchResponse, err error) {
+	defer func(start time.Time) { observeRequest("omdb", "lookup_series", start, err) }(time.Now())
+	return m.MetadataClient.LookupSeries(name, year)
+}
+
+func (m instrumentedMetadata) Details(imdbID string) (result *OMDBTVSearchResponse, err error) {
+	defer func(start time.Time) { observeRequest("omdb", "details", start, err) }(time.Now())
+	return m.MetadataClient.Details(imdbID)
+}
+
+// instrumentedIndexer records metrics for an Indexer.
+type instrumentedIndexer struct {
+	Indexer
+}
+
+func (i instrumentedIndexer) Lookup(q ReleaseQuery) (result SearchResult, err error) {
+	defer func(start time.Time) { observeIndexer("lookup", start, result, err) }(time.Now())
+	return i.Indexer.Lookup(q)
+}
+
+func (i instrumentedIndexer) Search(query, year, category string) (result SearchResult, err error) {
+	defer func(start time.Time) { observeIndexer("search", start, result, err) }(time.Now())
+	return i.Indexer.Search(query, year, category)
+}
+
+func observeIndexer(operation string, start time.Time, result SearchResult, err error) {
+	observeRequest("indexer", operation, start, err)
+	if err == nil {
+		indexerResults.WithLabelValues("returned").Add(float64(result.TotalFound))
+	}
+}
+
+// observeShown records how many of a search's results were filtered out and how
+// many were offered.
+func observeShown(result SearchResult) {
+	indexerResults.WithLabelValues("filtered").Add(float64(result.FilteredCount))
+	indexerResults.WithLabelValues("shown").Add(float64(len(result.Items)))
+}
+
+// instrumentedDownloads records metrics for a DownloadClient.
+type instrumentedDownloads struct {
+	DownloadClient
+}
+
+func (d instrumentedDownloads) AddURL(nzbURL, category string) (nzoID string, err error) {
+	defer func(start time.Time) {
+		observeRequest("sabnzbd", "add", start, err)
+		if err == nil {
+			grabs.WithLabelValues(category).Inc()
+		}
+	}(time.Now())
+	return d.DownloadClient.AddURL(nzbURL, category)
+}
+
+func (d instrumentedDownloads) Progress(nzoID string) (status, progress string, err error) {
+	defer func(start time.Time) { observeRequest("sabnzbd", "progress", start, err) }(time.Now())
+	return d.DownloadClient.Progress(nzoID)
+}
+
+func (d instrumentedDownloads) StoragePath(nzoID string) (path string, err error) {
+	defer func(start time.Time) { observeRequest("sabnzbd", "storage_path", start, err) }(time.Now())
+	return d.DownloadClient.StoragePath(nzoID)
+}
+
+func (d instrumentedDownloads) Delete(nzoID string) (err error) {
+	defer func(start time.Time) { observeRequest("sabnzbd", "delete", start, err) }(time.Now())
+	return d.DownloadClient.Delete(nzoID)
+}
+
+func (d instrumentedDownloads) FreeSpace() (free int64, err error) {
+	defer func(start time.Time) { observeRequest("sabnzbd", "free_space", start, err) }(time.Now())
+	return d.DownloadClient.FreeSpace()
+}
+
+// observeDownload records a finished download and how long it was monitored for.
+func observeDownload(outcome string, d time.Duration) {
+	downloadOutcomes.WithLabelValues(outcome).Inc()
+	downloadDuration.WithLabelValues(outcome).Observe(d.Seconds())
+}
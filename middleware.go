@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recoverMiddleware stops a panicking handler from taking down the update loop. The
+// panic is logged with its stack under a correlation ID, which is also shown to the
+// user and sent to the admin chat so reports can be matched to the logs.
+func (b *Bot) recoverMiddleware(next HandlerFunc) HandlerFunc {
+	return func(req *Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				b.reportPanic(req, r, debug.Stack())
+			}
+		}()
+		next(req)
+	}
+}
+
+func (b *Bot) reportPanic(req *Request, r interface{}, stack []byte) {
+	correlationID := newCorrelationID()
+	req.Log.Error("Panic handling update", "correlation_id", correlationID, "panic", fmt.Sprint(r), "stack", string(stack))
+
+	userMsg := fmt.Sprintf("Sorry, something went wrong while handling that. Please try again.\nReference: %s", correlationID)
+	if query := req.Update.CallbackQuery; query != nil {
+		b.sender.Request(tgbotapi.NewCallback(query.ID, "Something went wrong."))
+	}
+	if chatID := req.ChatID(); chatID != 0 {
+		b.sendErrorMessage(chatID, userMsg)
+	}
+
+	var userID int64
+	if user := req.User(); user != nil {
+		userID = user.ID
+	}
+	b.notifyAdmin(fmt.Sprintf("Panic handling %s for user %d in chat %d\nReference: %s\nError: %v",
+		req.Route, userID, req.ChatID(), correlationID, r))
+}
+
+// newCorrelationID returns a short random ID used to match user reports to log lines.
+func newCorrelationID() string {
+	return strings.SplitN(uuid.New().String(), "-", 2)[0]
+}
+
+// notifyAdmin sends a message to TELEGRAM_ADMIN_CHAT_ID, if configured.
+func (b *Bot) notifyAdmin(text string) {
+	chatID, err := strconv.ParseInt(os.Getenv("TELEGRAM_ADMIN_CHAT_ID"), 10, 64)
+	if err != nil || chatID == 0 {
+		return
+	}
+	if _, err := b.sender.Send(tgbotapi.NewMessage(chatID, text)); err != nil {
+		slog.Error("Error notifying admin", "err", err)
+	}
+}
+
+// isAdmin reports whether user is listed in TELEGRAM_ADMIN_USERS or is writing in
+// TELEGRAM_ADMIN_CHAT_ID.
+func isAdmin(user *tgbotapi.User, chatID int64) bool {
+	if adminChat, err := strconv.ParseInt(os.Getenv("TELEGRAM_ADMIN_CHAT_ID"), 10, 64); err == nil && adminChat != 0 && chatID == adminChat {
+		return true
+	}
+	return user != nil && parseUserIDs(os.Getenv("TELEGRAM_ADMIN_USERS"))[user.ID]
+}
+
+// goSafe runs fn in a goroutine, logging and reporting any panic instead of
+// crashing the process.
+func (b *Bot) goSafe(name string, fn func()) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				correlationID := newCorrelationID()
+				slog.Error("Panic in goroutine", "goroutine", name, "correlation_id", correlationID,
+					"panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+				b.notifyAdmin(fmt.Sprintf("Panic in %s\nReference: %s\nError: %v", name, correlationID, r))
+			}
+		}()
+		fn()
+	}()
+}
+
+// loggingMiddleware logs each routed update and how long it took.
+func loggingMiddleware(next HandlerFunc) HandlerFunc {
+	return func(req *Request) {
+		start := time.Now()
+		next(req)
+		req.Log.Info("Handled update", "duration", time.Since(start))
+	}
+}
+
+// parseUserIDs parses a comma separated list of Telegram user IDs.
+func parseUserIDs(s string) map[int64]bool {
+	ids := make(map[int64]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			slog.Warn("Ignoring invalid user ID", "id", part)
+			continue
+		}
+		ids[id] = true
+	}
+	return ids
+}
+
+// authMiddleware only lets through users listed in TELEGRAM_ALLOWED_USERS. When the
+// variable is empty everyone is allowed. Discord and Matrix accounts are allowed
+// once linked to an allowed user, and can always use /link to get there.
+func (b *Bot) authMiddleware() Middleware {
+	allowed := parseUserIDs(os.Getenv("TELEGRAM_ALLOWED_USERS"))
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request) {
+			if len(allowed) == 0 {
+				next(req)
+				return
+			}
+
+			user := req.User()
+			if user != nil && (allowed[user.ID] || isPlatformID(user.ID) && req.Route == "/link") {
+				next(req)
+				return
+			}
+
+			text := "You are not allowed to use this bot."
+			if user != nil && isPlatformID(user.ID) && b.linkAccounts {
+				text += " If you use it on Telegram, send /link to it there and then send the code here."
+			}
+			if query := req.Update.CallbackQuery; query != nil {
+				b.sender.Request(tgbotapi.NewCallback(query.ID, "You are not allowed to use this bot."))
+			} else if chatID := req.ChatID(); chatID != 0 {
+				b.sendErrorMessage(chatID, text)
+			}
+		}
+	}
+}
+
+// rateLimiter is a sliding window limiter keyed by user ID.
+type rateLimiter struct {
+	sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[int64][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, hits: make(map[int64][]time.Time)}
+}
+
+// Allow records a hit for userID and reports whether it is within the limit.
+func (l *rateLimiter) Allow(userID int64) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	hits := l.hits[userID][:0]
+	for _, t := range l.hits[userID] {
+		if now.Sub(t) < l.window {
+			hits = append(hits, t)
+		}
+	}
+
+	if len(hits) >= l.limit {
+		l.hits[userID] = hits
+		return false
+	}
+
+	l.hits[userID] = append(hits, now)
+	return true
+}
+
+// rateLimitMiddleware limits how many updates a user can send per minute, set by
+// TELEGRAM_RATE_LIMIT (default 30). Commands are also limited by
+// QUOTA_COMMANDS_PER_MINUTE, which admins are exempt from.
+func (b *Bot) rateLimitMiddleware() Middleware {
+	limit := 30
+	if v, err := strconv.Atoi(os.Getenv("TELEGRAM_RATE_LIMIT")); err == nil && v > 0 {
+		limit = v
+	}
+	limiter := newRateLimiter(limit, time.Minute)
+	var commands *rateLimiter
+	if b.quotas.CommandsPerMinute > 0 {
+		commands = newRateLimiter(b.quotas.CommandsPerMinute, time.Minute)
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request) {
+			user := req.User()
+			if user != nil && commands != nil && strings.HasPrefix(req.Route, "/") &&
+				!isAdmin(user, req.ChatID()) && !commands.Allow(user.ID) {
+				if chatID := req.ChatID(); chatID != 0 {
+					b.sendErrorMessage(chatID, fmt.Sprintf("You can send up to %d commands a minute. Please wait a moment.", b.quotas.CommandsPerMinute))
+				}
+				return
+			}
+			if user == nil || limiter.Allow(user.ID) {
+				next(req)
+				return
+			}
+
+			if query := req.Update.CallbackQuery; query != nil {
+				b.sender.Request(tgbotapi.NewCallback(query.ID, "Slow down a little."))
+			} else if chatID := req.ChatID(); chatID != 0 {
+				b.sendErrorMessage(chatID, "You're sending requests too quickly. Please wait a minute.")
+			}
+		}
+	}
+}
+
+// metricsMiddleware counts handled updates and their duration per route.
+func metricsMiddleware(next HandlerFunc) HandlerFunc {
+	return func(req *Request) {
+		start := time.Now()
+		defer func() { observeRoute(req.Route, time.Since(start)) }()
+		next(req)
+	}
+}
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE conversation
+(
+    user_id    integer PRIMARY KEY,
+    chat_id    integer NOT NULL,
+    state      text    NOT NULL,
+    category   text    NOT NULL,
+    name       text    NOT NULL,
+    year       text    NOT NULL,
+    message_id integer NOT NULL, -- Menu message the user is expected to pick from, 0 if none
+    expires_at integer NOT NULL
+) STRICT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE conversation;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE msg_data ADD COLUMN imdb_id text NOT NULL DEFAULT '';
+ALTER TABLE nzb_info ADD COLUMN imdb_id text NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE nzb_info DROP COLUMN imdb_id;
+ALTER TABLE msg_data DROP COLUMN imdb_id;
+-- +goose StatementEnd
@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE nzb_info ADD COLUMN path text NOT NULL DEFAULT ''; -- Where the completed download ended up
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE nzb_info DROP COLUMN path;
+-- +goose StatementEnd
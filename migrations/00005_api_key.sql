@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE api_key
+(
+    key_hash   text PRIMARY KEY, -- SHA-256 of the key, hex encoded
+    user_id    integer NOT NULL,
+    scopes     text    NOT NULL, -- Comma separated, e.g. "read,download"
+    created_at integer NOT NULL,
+    last_used  integer NOT NULL DEFAULT 0
+) STRICT;
+CREATE INDEX api_key_user_id ON api_key (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE api_key;
+-- +goose StatementEnd
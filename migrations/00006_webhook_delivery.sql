@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE webhook_delivery
+(
+    id           integer PRIMARY KEY AUTOINCREMENT,
+    webhook      text    NOT NULL, -- Name of the configured webhook
+    event        text    NOT NULL,
+    payload      text    NOT NULL, -- JSON body, signed when sent
+    attempts     integer NOT NULL DEFAULT 0,
+    next_attempt integer NOT NULL,
+    last_error   text    NOT NULL DEFAULT '',
+    created_at   integer NOT NULL
+) STRICT;
+CREATE INDEX webhook_delivery_next_attempt ON webhook_delivery (next_attempt);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE webhook_delivery;
+-- +goose StatementEnd
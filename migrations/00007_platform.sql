@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE platform_ref
+(
+    id          integer PRIMARY KEY AUTOINCREMENT, -- Offset by 2^53 to give the ID used in place of Telegram's
+    platform    text    NOT NULL,                  -- discord or matrix
+    kind        text    NOT NULL,                  -- chat, user or message
+    external_id text    NOT NULL,
+    UNIQUE (platform, kind, external_id)
+) STRICT;
+
+CREATE TABLE user_link
+(
+    user_id   integer PRIMARY KEY, -- Discord or Matrix user
+    linked_to integer NOT NULL     -- User whose identity they share, usually a Telegram user
+) STRICT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE user_link;
+DROP TABLE platform_ref;
+-- +goose StatementEnd
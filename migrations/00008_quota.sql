@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE nzb_info ADD COLUMN size integer NOT NULL DEFAULT 0; -- Release size in bytes, as listed by the indexer
+
+CREATE TABLE grab
+(
+    id         integer PRIMARY KEY AUTOINCREMENT,
+    user_id    integer NOT NULL,
+    nzb_id     text    NOT NULL,
+    size       integer NOT NULL, -- Bytes
+    grabbed_at integer NOT NULL
+) STRICT;
+
+CREATE INDEX grab_user_grabbed_at ON grab (user_id, grabbed_at);
+
+CREATE TABLE quota_override
+(
+    user_id    integer PRIMARY KEY,
+    expires_at integer NOT NULL -- Quotas apply again from this time
+) STRICT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE quota_override;
+DROP TABLE grab;
+ALTER TABLE nzb_info DROP COLUMN size;
+-- +goose StatementEnd
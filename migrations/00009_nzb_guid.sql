@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE nzb_info ADD COLUMN guid text NOT NULL DEFAULT ''; -- The indexer's ID for the release, stable across searches
+
+CREATE INDEX nzb_info_guid ON nzb_info (guid);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX nzb_info_guid;
+ALTER TABLE nzb_info DROP COLUMN guid;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE indexer_usage
+(
+    indexer text    NOT NULL,
+    day     text    NOT NULL, -- UTC date, YYYY-MM-DD
+    hits    integer NOT NULL DEFAULT 0, -- API requests
+    grabs   integer NOT NULL DEFAULT 0, -- NZBs downloaded from the indexer
+    PRIMARY KEY (indexer, day)
+) STRICT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE indexer_usage;
+-- +goose StatementEnd
@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE nzb_info ADD COLUMN search_id text NOT NULL DEFAULT ''; -- The API search that listed the release, empty for chat searches
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE nzb_info DROP COLUMN search_id;
+-- +goose StatementEnd
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newznabAttr is a <newznab:attr name="..." value="..."/> element.
+type newznabAttr struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// NewznabAttrs are the newznab:attr elements an indexer attaches to an item.
+// Numbers the indexer didn't send are -1, except Size, Season and Episode,
+// which are 0.
+type NewznabAttrs struct {
+	Size       int64
+	Grabs      int
+	Files      int
+	Comments   int
+	Passworded bool // password=1. 2, "might be passworded", doesn't count.
+	UsenetDate time.Time
+	GUID       string
+	TVDBID     string
+	ImdbID     string // With the "tt" prefix
+	Season     int
+	Episode    int
+	Categories []string
+}
+
+// parseNewznabAttrs types the attributes of an item.
+func parseNewznabAttrs(attrs []newznabAttr) NewznabAttrs {
+	a := NewznabAttrs{Grabs: -1, Files: -1, Comments: -1}
+	count := func(v string) int {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	for _, attr := range attrs {
+		v := strings.TrimSpace(attr.Value)
+		switch strings.ToLower(attr.Name) {
+		case "size":
+			a.Size, _ = strconv.ParseInt(v, 10, 64)
+		case "grabs":
+			a.Grabs = count(v)
+		case "files":
+			a.Files = count(v)
+		case "comments":
+			a.Comments = count(v)
+		case "password":
+			a.Passworded = v == "1"
+		case "usenetdate":
+			a.UsenetDate, _ = time.Parse(time.RFC1123Z, v)
+		case "guid":
+			a.GUID = v
+		case "tvdbid":
+			a.TVDBID = v
+		case "imdb":
+			if v != "" && v != "0" {
+				a.ImdbID = "tt" + strings.TrimPrefix(v, "tt")
+			}
+		case "season":
+			a.Season, _ = strconv.Atoi(strings.TrimLeft(v, "Ss"))
+		case "episode":
+			a.Episode, _ = strconv.Atoi(strings.TrimLeft(v, "Ee"))
+		case "category":
+			a.Categories = append(a.Categories, v)
+		}
+	}
+	return a
+}
+
+// newznabError is an <error code="..." description="..."/> response.
+type newznabError struct {
+	Code        int
+	Description string
+}
+
+func (e *newznabError) Error() string {
+	return fmt.Sprintf("NZBGeek error %d: %s", e.Code, e.Description)
+}
+
+// parseNewznabError returns the error in body, or nil if body isn't an error
+// response.
+func parseNewznabError(body []byte) error {
+	var resp struct {
+		XMLName     xml.Name
+		Code        string `xml:"code,attr"`
+		Description string `xml:"description,attr"`
+	}
+	if err := xml.Unmarshal(body, &resp); err != nil || resp.XMLName.Local != "error" {
+		return nil
+	}
+	code, _ := strconv.Atoi(resp.Code)
+	return &newznabError{Code: code, Description: resp.Description}
+}
+
+// parseRSS decodes a Newznab RSS feed and types the attributes of its items. An
+// error response is returned as a *newznabError.
+func parseRSS(body []byte) (RSS, error) {
+	if err := parseNewznabError(body); err != nil {
+		return RSS{}, err
+	}
+	var rss RSS
+	if err := xml.Unmarshal(body, &rss); err != nil {
+		return RSS{}, fmt.Errorf("error decoding XML: %w", err)
+	}
+	for i := range rss.Channel.Items {
+		item := &rss.Channel.Items[i]
+		item.Newznab = parseNewznabAttrs(item.Attrs)
+	}
+	return rss, nil
+}
+
+// Size returns the release size in bytes, or 0 if the indexer didn't say.
+func (i Item) Size() int64 {
+	if size, err := strconv.ParseInt(i.Enclosure.Length, 10, 64); err == nil && size > 0 {
+		return size
+	}
+	return i.Newznab.Size
+}
+
+// ID returns the indexer's stable identifier for the release, or "" if it has
+// none.
+func (i Item) ID() string {
+	if i.Newznab.GUID != "" {
+		return i.Newznab.GUID
+	}
+	return strings.TrimSpace(i.GUID)
+}
+
+// Posted returns when the release was posted to usenet, falling back to when
+// the indexer listed it, in the RSS date format.
+func (i Item) Posted() string {
+	if !i.Newznab.UsenetDate.IsZero() {
+		return i.Newznab.UsenetDate.Format(time.RFC1123Z)
+	}
+	return i.PubDate
+}
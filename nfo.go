@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/xml"
+	"fmt"
+	"github.com/dx314/movie_beacon_bot/db"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//go:embed templates/*.nfo.tmpl
+var nfoTemplateFS embed.FS
+
+// nfoData is what the NFO templates are rendered with.
+type nfoData struct {
+	Title     string
+	Year      string
+	ImdbID    string
+	Plot      string
+	Runtime   int // Minutes
+	Rated     string
+	Released  string // YYYY-MM-DD
+	Seasons   string
+	Genres    []string
+	Countries []string
+	Directors []string
+	Writers   []string
+	Actors    []string
+	Ratings   []nfoRating
+	Poster    string
+}
+
+type nfoRating struct {
+	Name    string // Kodi rating name, e.g. "imdb"
+	Value   string
+	Max     int
+	Votes   string
+	Default bool
+}
+
+// nfoWriter writes Kodi NFO files and poster art next to completed downloads.
+type nfoWriter struct {
+	templates *template.Template
+	http      *http.Client
+}
+
+// loadNFOWriter returns a writer when WRITE_NFO is enabled. Templates named
+// movie.nfo.tmpl and tvshow.nfo.tmpl in NFO_TEMPLATE_DIR replace the built-in ones.
+func loadNFOWriter(httpClient *http.Client) (*nfoWriter, error) {
+	if enabled, _ := strconv.ParseBool(os.Getenv("WRITE_NFO")); !enabled {
+		return nil, nil
+	}
+	return newNFOWriter(os.Getenv("NFO_TEMPLATE_DIR"), httpClient)
+}
+
+func newNFOWriter(templateDir string, httpClient *http.Client) (*nfoWriter, error) {
+	funcs := template.FuncMap{"xml": xmlEscape}
+	templates, err := template.New("nfo").Funcs(funcs).ParseFS(nfoTemplateFS, "templates/*.nfo.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	if templateDir != "" {
+		for _, name := range []string{"movie.nfo.tmpl", "tvshow.nfo.tmpl"} {
+			path := filepath.Join(templateDir, name)
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			if templates, err = templates.ParseFiles(path); err != nil {
+				return nil, fmt.Errorf("failed to parse NFO template: %v", err)
+			}
+		}
+	}
+	return &nfoWriter{templates: templates, http: httpClient}, nil
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// splitList splits OMDB's comma separated fields, dropping "N/A".
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" && item != "N/A" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func notAvailable(s string) string {
+	if s == "N/A" {
+		return ""
+	}
+	return s
+}
+
+// newNFOData converts OMDB details into template data.
+func newNFOData(details *OMDBTVSearchResponse) nfoData {
+	data := nfoData{
+		Title:     details.Title,
+		Year:      strings.TrimRight(notAvailable(details.Year), "–-"),
+		ImdbID:    details.ImdbID,
+		Plot:      notAvailable(details.Plot),
+		Rated:     notAvailable(details.Rated),
+		Seasons:   notAvailable(details.TotalSeasons),
+		Genres:    splitList(details.Genre),
+		Countries: splitList(details.Country),
+		Directors: splitList(details.Director),
+		Writers:   splitList(details.Writer),
+		Actors:    splitList(details.Actors),
+		Poster:    notAvailable(details.Poster),
+	}
+	// Series years look like "2008–2013"
+	if len(data.Year) > 4 {
+		data.Year = data.Year[:4]
+	}
+	if minutes, err := strconv.Atoi(strings.TrimSuffix(details.Runtime, " min")); err == nil {
+		data.Runtime = minutes
+	}
+	if released, err := time.Parse("02 Jan 2006", details.Released); err == nil {
+		data.Released = released.Format("2006-01-02")
+	}
+
+	for _, r := range details.Ratings {
+		var rating nfoRating
+		switch r.Source {
+		case "Internet Movie Database":
+			rating = nfoRating{Name: "imdb", Value: strings.TrimSuffix(r.Value, "/10"), Max: 10, Default: true}
+			rating.Votes = strings.ReplaceAll(notAvailable(details.ImdbVotes), ",", "")
+		case "Rotten Tomatoes":
+			rating = nfoRating{Name: "tomatometerallcritics", Value: strings.TrimSuffix(r.Value, "%"), Max: 100}
+		case "Metacritic":
+			rating = nfoRating{Name: "metacritic", Value: strings.TrimSuffix(r.Value, "/100"), Max: 100}
+		default:
+			continue
+		}
+		data.Ratings = append(data.Ratings, rating)
+	}
+	return data
+}
+
+// Render renders the movie or tvshow NFO for details.
+func (w *nfoWriter) Render(details *OMDBTVSearchResponse, series bool) ([]byte, error) {
+	name := "movie.nfo.tmpl"
+	if series {
+		name = "tvshow.nfo.tmpl"
+	}
+	var buf bytes.Buffer
+	if err := w.templates.ExecuteTemplate(&buf, name, newNFOData(details)); err != nil {
+		return nil, fmt.Errorf("failed to render %s: %v", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Write puts movie.nfo (or tvshow.nfo) and poster.jpg in dir, leaving any
+// existing files alone.
+func (w *nfoWriter) Write(dir string, details *OMDBTVSearchResponse, series bool) error {
+	nfoName := "movie.nfo"
+	if series {
+		nfoName = "tvshow.nfo"
+	}
+
+	nfoPath := filepath.Join(dir, nfoName)
+	if _, err := os.Stat(nfoPath); os.IsNotExist(err) {
+		nfo, err := w.Render(details, series)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(nfoPath, nfo, 0o644); err != nil {
+			return err
+		}
+	}
+
+	posterPath := filepath.Join(dir, "poster.jpg")
+	if poster := notAvailable(details.Poster); poster != "" {
+		if _, err := os.Stat(posterPath); os.IsNotExist(err) {
+			if err := w.downloadPoster(poster, posterPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *nfoWriter) downloadPoster(posterURL, path string) error {
+	resp, err := w.http.Get(posterURL)
+	if err != nil {
+		return fmt.Errorf("failed to download poster: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status downloading poster: %s", resp.Status)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to save poster: %v", err)
+	}
+	return f.Close()
+}
+
+// writeMetadata writes NFO and poster files from details for a completed
+// download at path.
+func (b *Bot) writeMetadata(nzbInfo db.NzbInfo, details *OMDBTVSearchResponse, path string) {
+	if b.nfo == nil || details == nil {
+		return
+	}
+
+	dir := path
+	if info, err := os.Stat(path); err != nil {
+		slog.Error("Error writing metadata", "release", nzbInfo.Name, "err", err)
+		return
+	} else if !info.IsDir() {
+		dir = filepath.Dir(path)
+	}
+
+	series := isSeriesCategory(nzbInfo.Category)
+	if series && strings.HasPrefix(filepath.Base(dir), "Season ") {
+		// tvshow.nfo belongs in the show's folder, above the seasons
+		dir = filepath.Dir(dir)
+	}
+
+	if err := b.nfo.Write(dir, details, series); err != nil {
+		slog.Error("Error writing metadata", "release", nzbInfo.Name, "err", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// loadOMDBFixture reads OMDB details saved in testdata.
+func loadOMDBFixture(t *testing.T, name string) *OMDBTVSearchResponse {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var details OMDBTVSearchResponse
+	if err := json.Unmarshal(body, &details); err != nil {
+		t.Fatalf("decoding %s: %v", name, err)
+	}
+	return &details
+}
+
+func newTestNFOWriter(t *testing.T) *nfoWriter {
+	t.Helper()
+	w, err := newNFOWriter("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestRenderGolden(t *testing.T) {
+	tests := []struct {
+		fixture string
+		series  bool
+		golden  string
+	}{
+		{"movie.json", false, "movie.nfo.golden"},
+		{"tvshow.json", true, "tvshow.nfo.golden"},
+	}
+	w := newTestNFOWriter(t)
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			got, err := w.Render(loadOMDBFixture(t, tt.fixture), tt.series)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Render() differs from %s (run with -update to accept):\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestRenderNotAvailable(t *testing.T) {
+	details := &OMDBTVSearchResponse{
+		Title:    "Unknown Film",
+		Year:     "N/A",
+		Rated:    "N/A",
+		Released: "N/A",
+		Runtime:  "N/A",
+		Genre:    "N/A",
+		Director: "N/A",
+		Writer:   "N/A",
+		Actors:   "N/A",
+		Plot:     "N/A",
+		Country:  "N/A",
+		Poster:   "N/A",
+		ImdbID:   "tt0000001",
+	}
+	for _, series := range []bool{false, true} {
+		got, err := newTestNFOWriter(t).Render(details, series)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(got, []byte("N/A")) {
+			t.Errorf("Render(series=%v) kept an N/A field:\n%s", series, got)
+		}
+		for _, tag := range []string{"<plot>", "<runtime>", "<mpaa>", "<premiered>", "<genre>", "<director>", "<actor>", "<thumb"} {
+			if bytes.Contains(got, []byte(tag)) {
+				t.Errorf("Render(series=%v) has %s for an N/A field", series, tag)
+			}
+		}
+	}
+}
+
+func TestRenderEscaping(t *testing.T) {
+	details := &OMDBTVSearchResponse{
+		Title:  "Tom & Jerry",
+		Year:   "2021",
+		Plot:   `Jerry moves into New York's finest hotel <again> & Tom is hired to "deal" with him.`,
+		Actors: "Chloë Grace Moretz, Michael Peña, Colin Jost & <Friends>",
+		ImdbID: "tt1361336",
+	}
+	got, err := newTestNFOWriter(t).Render(details, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var movie struct {
+		Title  string `xml:"title"`
+		Plot   string `xml:"plot"`
+		Actors []struct {
+			Name string `xml:"name"`
+		} `xml:"actor"`
+	}
+	if err := xml.Unmarshal(got, &movie); err != nil {
+		t.Fatalf("Render() isn't valid XML: %v\n%s", err, got)
+	}
+	if movie.Title != details.Title {
+		t.Errorf("title = %q, want %q", movie.Title, details.Title)
+	}
+	if movie.Plot != details.Plot {
+		t.Errorf("plot = %q, want %q", movie.Plot, details.Plot)
+	}
+	var names []string
+	for _, actor := range movie.Actors {
+		names = append(names, actor.Name)
+	}
+	if got, want := strings.Join(names, ", "), details.Actors; got != want {
+		t.Errorf("actors = %q, want %q", got, want)
+	}
+}
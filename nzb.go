@@ -2,28 +2,29 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"encoding/xml"
 	"errors"
 	"fmt"
 	"github.com/dx314/movie_beacon_bot/db"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-func storeNZBInfo(nzbUUID string, info db.NzbInfo) error {
+func (b *Bot) storeNZBInfo(nzbUUID string, info db.NzbInfo) error {
 	ctx := context.Background()
 
-	return queries.UpsertNZBInfo(ctx, db.UpsertNZBInfoParams{
+	return b.store.UpsertNZBInfo(ctx, db.UpsertNZBInfoParams{
 		ID:          nzbUUID,
 		Url:         info.Url,
 		Name:        info.Name,
@@ -34,180 +35,361 @@ func storeNZBInfo(nzbUUID string, info db.NzbInfo) error {
 		Status:      info.Status,
 		LastUpdated: info.LastUpdated,
 		Selected:    info.Selected,
+		ImdbID:      info.ImdbID,
+		Size:        info.Size,
+		Guid:        info.Guid,
+		SearchID:    info.SearchID,
 	})
 }
 
-func getNZBInfo(nzbUUID string) (db.NzbInfo, error) {
+func (b *Bot) getNZBInfo(nzbUUID string) (db.NzbInfo, error) {
 	ctx := context.Background()
-	return queries.GetNZBInfo(ctx, nzbUUID)
+	return b.store.GetNZBInfo(ctx, nzbUUID)
 }
 
-func deleteNZBInfo(nzbUUID string) error {
-	return queries.DeleteNZBInfo(context.Background(), nzbUUID)
+func (b *Bot) deleteNZBInfo(nzbUUID string) error {
+	return b.store.DeleteNZBInfo(context.Background(), nzbUUID)
 }
 
-var x = 0
-
-func monitorDownloadProgress(nzbUUID string) {
-	x++
-	fmt.Printf("MONITORING THREAD %d\n", x)
-	if !manageMonitorState(nzbUUID) {
+func (b *Bot) monitorDownloadProgress(nzbUUID string) {
+	if !b.manageMonitorState(nzbUUID) {
 		// A monitor is already running for this item
-		fmt.Printf("RELEASING MONITOR %d\n", x)
+		slog.Debug("Download already monitored", "nzb_id", nzbUUID)
 		return
 	}
+	slog.Debug("Monitoring download", "nzb_id", nzbUUID)
 	defer func() {
-		fmt.Printf("RELEASING MONITOR %d\n", x)
-		releaseMonitorState(nzbUUID)
+		slog.Debug("Stopped monitoring download", "nzb_id", nzbUUID)
+		b.releaseMonitorState(nzbUUID)
 	}()
+	started := b.clock.Now()
+	var lastStatus, lastProgress string
 
 	for {
-		nzbInfo, err := getNZBInfo(nzbUUID)
+		nzbInfo, err := b.getNZBInfo(nzbUUID)
 		if err != nil {
-			log.Printf("Error getting NZB info: %v", err)
+			slog.Error("Error getting NZB info", "err", err)
+			return
+		}
+		if nzbInfo.Status == "Cancelled" {
 			return
 		}
 
-		status, progress, err := getSABnzbdProgress(nzbInfo.SabnzbdID)
+		status, progress, err := b.downloads.Progress(nzbInfo.SabnzbdID)
 		if err != nil {
-			log.Printf("Error getting SABnzbd progress: %v", err)
-
-			updateNZBStatus(nzbUUID, "Failed", fmt.Sprintf("Error monitoring '%s': %v", nzbInfo.Name, err))
+			slog.Error("Error getting SABnzbd progress", "err", err)
+
+			b.updateNZBStatus(nzbUUID, "Failed", fmt.Sprintf("Error monitoring '%s': %v", nzbInfo.Name, err))
+			observeDownload("Failed", b.clock.Now().Sub(started))
+			event := newDownloadEvent(nzbInfo)
+			event.Status = "Failed"
+			event.Error = redactSecrets(err.Error())
+			b.events.Publish(eventDownloadFailed, event)
 			return
 		}
 
 		if status == "Deleted" {
-			timeSinceLastUpdate := time.Now().Unix() - int64(nzbInfo.LastUpdated)
+			timeSinceLastUpdate := b.clock.Now().Unix() - int64(nzbInfo.LastUpdated)
 			if timeSinceLastUpdate > 150 { // 5 minutes in seconds
 				message := fmt.Sprintf("%s download has been removed from queue.", nzbInfo.Name)
-				err = editMessage(nzbInfo.ChatID, nzbInfo.MessageID, message)
+				err = b.editMessage(nzbInfo.ChatID, nzbInfo.MessageID, message)
 				if err != nil {
-					log.Printf("Error editing message %s: %v", nzbInfo.MessageID, err)
+					slog.Error("Error editing message", "chat_id", nzbInfo.ChatID, "message_id", nzbInfo.MessageID, "err", err)
 				} else {
-					log.Printf("Message for %s edited successfully", nzbInfo.Name)
+					slog.Info("Download removed from queue", "chat_id", nzbInfo.ChatID, "release", nzbInfo.Name)
 				}
-				if err := deleteNZBInfo(nzbUUID); err != nil {
-					log.Printf("Error deleting NZB info from database: %v", err)
+				if err := b.deleteNZBInfo(nzbUUID); err != nil {
+					slog.Error("Error deleting NZB info from database", "err", err)
 				}
+				observeDownload(status, b.clock.Now().Sub(started))
+				event := newDownloadEvent(nzbInfo)
+				event.Status = status
+				b.events.Publish(eventDownloadRemoved, event)
 				return
 			}
 		} else {
 			progressMsg := fmt.Sprintf("NZB: %s\nStatus: %s\n%s", nzbInfo.Name, status, progress)
-			updateNZBStatus(nzbUUID, status, progressMsg)
+			b.updateNZBStatus(nzbUUID, status, progressMsg)
 		}
 
+		event := newDownloadEvent(nzbInfo)
+		event.Status = status
+		event.Progress = progress
 		if status == "Completed" || status == "Failed" {
+			observeDownload(status, b.clock.Now().Sub(started))
+		}
+		if status == "Completed" {
+			b.finishDownload(nzbInfo, fmt.Sprintf("NZB: %s\nStatus: %s\n%s", nzbInfo.Name, status, progress))
+			return
+		}
+		if status == "Failed" {
+			b.events.Publish(eventDownloadFailed, event)
 			return
 		}
+		// Only report changes, not every poll
+		if status != "Deleted" && (status != lastStatus || progress != lastProgress) {
+			b.events.Publish(eventDownloadProgress, event)
+			lastStatus, lastProgress = status, progress
+		}
 
-		time.Sleep(6 * time.Second)
+		<-b.clock.After(b.pollInterval)
 	}
 }
 
-func getSABnzbdProgress(nzbID string) (string, string, error) {
-	if nzbID == "" {
-		return "Unknown", "", errors.New("NZB ID not provided")
-	}
-	apiURL := fmt.Sprintf("%s/api?output=json&apikey=%s&mode=queue&nzo_ids=%s", sabnzbdAPI, sabnzbdAPIKey, nzbID)
+// storeRelease saves an indexer result as a pending download for chatID, ready
+// to be picked, and returns it with its new ID. searchID groups the results of
+// an API search, and is empty for searches in the chat.
+func (b *Bot) storeRelease(chatID int64, searchID, category, imdbID string, item Item) (db.NzbInfo, error) {
+	titleInfo := parseMovieTitle(item.Title)
+	nzbInfo := db.NzbInfo{
+		ID:          uuid.New().String(),
+		Url:         item.Enclosure.URL,
+		Name:        fmt.Sprintf("%s (%s)", titleInfo.Title, titleInfo.Year),
+		ChatID:      chatID,
+		Status:      "Pending",
+		LastUpdated: b.clock.Now().Unix(),
+		Selected:    0, // Initialize as not selected
+		Category:    category,
+		ImdbID:      imdbID,
+		Size:        item.Size(),
+		Guid:        item.ID(),
+		SearchID:    searchID,
+	}
+	return nzbInfo, b.storeNZBInfo(nzbInfo.ID, nzbInfo)
+}
 
-	resp, err := http.Get(apiURL)
+// findReleases looks up NZBs by ID, falling back to a text search when the
+// indexer can't search by ID or has nothing tagged with it. The results are
+// filtered with filterReleases.
+func (b *Bot) findReleases(q ReleaseQuery) (SearchResult, error) {
+	searchResult, err := b.searchIndexer(func() (SearchResult, error) { return b.indexer.Lookup(q) })
 	if err != nil {
-		return "", "", fmt.Errorf("failed to get SABnzbd queue: %v", err)
+		return SearchResult{}, fmt.Errorf("error looking up %s: %w", q.ImdbID, err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", "", fmt.Errorf("bad status from SABnzbd API: %s", resp.Status)
+	if searchResult.TotalFound == 0 && q.Title != "" {
+		slog.Debug("No ID matches, searching NZBGeek by title", "imdb_id", q.ImdbID)
+		query, year := q.text()
+		searchResult, err = b.searchIndexer(func() (SearchResult, error) { return b.indexer.Search(query, year, q.Category) })
+		if err != nil {
+			return SearchResult{}, err
+		}
 	}
+	return b.filterReleases(searchResult, q.ImdbID, q.Category), nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+// queueDownload sends a stored release to SABnzbd, announces it in the release's
+// chat and starts monitoring it.
+func (b *Bot) queueDownload(nzbInfo db.NzbInfo, by grabber) error {
+	// Grabs are checked against the limits and recorded one at a time, so
+	// parallel grabs can't all pass the same check
+	b.grabMutex.Lock()
+	defer b.grabMutex.Unlock()
+
+	if err := b.checkQuota(by, nzbInfo); err != nil {
+		return err
+	}
+	if !by.IgnoreDiskSpace {
+		if err := b.checkDiskSpace(nzbInfo); err != nil {
+			return err
+		}
+	}
+	if err := b.checkIndexer(true); err != nil {
+		return err
+	}
+	sabnzbdID, err := b.downloads.AddURL(nzbInfo.Url, nzbInfo.Category)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to read response body: %v", err)
+		return err
 	}
+	// SABnzbd fetches the NZB from the indexer, which counts it as a grab
+	b.countIndexerUse(0, 1)
+
+	nzbInfo.SabnzbdID = sabnzbdID
+	nzbInfo.Status = "Queued"
+	nzbInfo.LastUpdated = b.clock.Now().Unix()
+	nzbInfo.Selected = 1 // Mark as selected
 
-	var result struct {
-		Queue struct {
-			Slots []struct {
-				Status          string `json:"status"`
-				Filename        string `json:"filename"`
-				PercentComplete string `json:"percentage"`
-				SizeMB          string `json:"mb"`
-				SizeLeft        string `json:"mbleft"`
-			} `json:"slots"`
-		} `json:"queue"`
+	msg := tgbotapi.NewMessage(nzbInfo.ChatID, fmt.Sprintf("NZB '%s' added to SABnzbd. Initializing...", nzbInfo.Name))
+	sentMsg, err := b.sender.Send(msg)
+	if err != nil {
+		slog.Error("Error sending initial status message", "chat_id", nzbInfo.ChatID, "err", err)
+	} else {
+		nzbInfo.MessageID = sentMsg.MessageID
 	}
 
-	if err := json.Unmarshal(body, &result); err != nil {
-		fmt.Println(string(body))
-		return "", "", fmt.Errorf("failed to decode SABnzbd response: %v", err)
+	if err := b.storeNZBInfo(nzbInfo.ID, nzbInfo); err != nil {
+		slog.Error("Error updating NZB info with SABnzbd ID", "err", err)
 	}
+	b.recordGrab(by, nzbInfo)
+	b.events.Publish(eventReleaseGrabbed, newDownloadEvent(nzbInfo))
 
-	for _, slot := range result.Queue.Slots {
-		if slot.Status == "Downloading" || slot.Status == "Queued" {
-			totalSize, _ := strconv.ParseFloat(slot.SizeMB, 64)
-			sizeLeft, _ := strconv.ParseFloat(slot.SizeLeft, 64)
-			downloaded := totalSize - sizeLeft
-			percentage, _ := strconv.ParseFloat(strings.TrimRight(slot.PercentComplete, "%"), 64)
+	b.goSafe("download monitor", func() { b.monitorDownloadProgress(nzbInfo.ID) })
+	return nil
+}
 
-			progress := fmt.Sprintf("Progress: %.2f MB / %.2f MB (%.1f%%)", downloaded, totalSize, percentage)
-			return slot.Status, progress, nil
-		}
-	}
+// errDownloadFinished is returned when cancelling a download that is no longer
+// in SABnzbd.
+var errDownloadFinished = errors.New("download has already finished")
 
-	// If not found in queue, check history
-	status, progress, err := checkSABnzbdHistory(nzbID)
+// cancelDownload removes a download from SABnzbd and marks it cancelled.
+func (b *Bot) cancelDownload(nzbUUID string) error {
+	nzbInfo, err := b.getNZBInfo(nzbUUID)
 	if err != nil {
-		return "", "", err
+		return err
 	}
-
-	// If not found in history either, it might have been deleted
-	if status == "Unknown" {
-		return "Deleted", "Download has been removed from queue", nil
+	switch nzbInfo.Status {
+	case "Completed", "Failed", "Cancelled", "Deleted":
+		return fmt.Errorf("%s: %w (%s)", nzbInfo.Name, errDownloadFinished, nzbInfo.Status)
+	}
+	if err := b.downloads.Delete(nzbInfo.SabnzbdID); err != nil {
+		return err
+	}
+	if err := b.updateNZBStatus(nzbUUID, "Cancelled", fmt.Sprintf("NZB: %s\nStatus: Cancelled", nzbInfo.Name)); err != nil {
+		return err
 	}
+	event := newDownloadEvent(nzbInfo)
+	event.Status = "Cancelled"
+	b.events.Publish(eventDownloadRemoved, event)
+	return nil
+}
 
-	return status, progress, nil
+// retryDownload queues a failed or cancelled download again.
+func (b *Bot) retryDownload(nzbUUID string, by grabber) error {
+	nzbInfo, err := b.getNZBInfo(nzbUUID)
+	if err != nil {
+		return err
+	}
+	if nzbInfo.Status != "Failed" && nzbInfo.Status != "Cancelled" {
+		return fmt.Errorf("only failed or cancelled downloads can be retried, %s is %s", nzbInfo.Name, nzbInfo.Status)
+	}
+	return b.queueDownload(nzbInfo, by)
 }
 
-func addNZBToSABnzbd(nzbURL, category string) (string, error) {
-	fmt.Println("#############")
-	fmt.Println("ADDING TO :" + category)
-	fmt.Println("#############")
+// finishDownload post-processes a completed download, reports where it ended
+// up and gets it into the media server's library.
+func (b *Bot) finishDownload(nzbInfo db.NzbInfo, text string) {
+	event := newDownloadEvent(nzbInfo)
+	event.Status = "Completed"
+	if b.postprocess == nil && b.nfo == nil && b.subtitles == nil && b.media == nil {
+		b.events.Publish(eventDownloadCompleted, event)
+		return
+	}
 
-	apiURL := fmt.Sprintf("%s/api?output=json&apikey=%s&mode=addurl&name=%s&cat=%s",
-		sabnzbdAPI, sabnzbdAPIKey, url.QueryEscape(nzbURL), url.QueryEscape(category))
+	path, err := b.downloads.StoragePath(nzbInfo.SabnzbdID)
+	if err != nil {
+		slog.Error("Error getting storage path", "release", nzbInfo.Name, "err", err)
+		b.events.Publish(eventDownloadCompleted, event)
+		return
+	}
 
-	log.Printf("Adding NZB to SABnzbd: %s", apiURL)
+	var details *OMDBTVSearchResponse
+	if nzbInfo.ImdbID != "" && (b.postprocess != nil || b.nfo != nil) {
+		details, err = b.metadata.Details(nzbInfo.ImdbID)
+		if err != nil {
+			slog.Error("Error fetching details", "imdb_id", nzbInfo.ImdbID, "err", err)
+			details = nil
+		}
+	}
+
+	if b.postprocess != nil {
+		finalPath, err := b.postprocess.Process(nzbInfo.Category, releaseFor(nzbInfo.Name, details), path)
+		if finalPath != "" {
+			path = finalPath
+			text += fmt.Sprintf("\n\nMoved to: %s", finalPath)
+		}
+		switch {
+		case err != nil && finalPath != "":
+			slog.Error("Error post-processing some files", "release", nzbInfo.Name, "err", err)
+			text += fmt.Sprintf("\n\nCouldn't move these into the library:\n%v", err)
+		case err != nil:
+			slog.Error("Error post-processing", "release", nzbInfo.Name, "err", err)
+			text += fmt.Sprintf("\n\nCouldn't move it into the library: %v", err)
+		}
+	}
 
-	resp, err := http.Get(apiURL)
+	err = b.store.SetNZBPath(context.Background(), db.SetNZBPathParams{Path: path, ID: nzbInfo.ID})
 	if err != nil {
-		return "", fmt.Errorf("failed to add NZB to SABnzbd: %v", err)
+		slog.Error("Error saving path", "release", nzbInfo.Name, "err", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("bad status from SABnzbd API: %s", resp.Status)
+	b.writeMetadata(nzbInfo, details, path)
+
+	if b.subtitles != nil {
+		text += "\n\n" + b.fetchSubtitles(nzbInfo, path)
 	}
 
-	var result struct {
-		Status bool     `json:"status"`
-		NzoIDs []string `json:"nzo_ids"`
+	if err := b.editMessage(nzbInfo.ChatID, nzbInfo.MessageID, text); err != nil {
+		slog.Error("Error editing message", "chat_id", nzbInfo.ChatID, "message_id", nzbInfo.MessageID, "err", err)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %v", err)
+	event.Path = path
+	b.events.Publish(eventDownloadCompleted, event)
+
+	b.addToLibrary(nzbInfo, text, path)
+}
+
+// addToLibrary has the media server scan a completed download and, once the
+// item shows up, adds a "Watch now" button to the progress message.
+func (b *Bot) addToLibrary(nzbInfo db.NzbInfo, text, path string) {
+	if b.media == nil {
+		return
+	}
+
+	// Media servers scan folders, so point them at the one holding a single file
+	scanPath := path
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		scanPath = filepath.Dir(path)
+	}
+	if err := b.media.Refresh(nzbInfo.Category, scanPath); err != nil {
+		if !errors.Is(err, errNoLibrary) {
+			slog.Error("Error refreshing media library", "release", nzbInfo.Name, "err", err)
+		}
+		return
 	}
+	deadline := b.clock.Now().Add(b.libraryWait)
+	for b.clock.Now().Before(deadline) {
+		<-b.clock.After(b.pollInterval)
 
-	if err := json.Unmarshal(body, &result); err != nil {
-		fmt.Println(string(body))
-		return "", fmt.Errorf("failed to decode SABnzbd response: %v", err)
+		link, err := b.media.WatchLink(nzbInfo.Category, path)
+		if err != nil {
+			slog.Error("Error looking up release on the media server", "release", nzbInfo.Name, "err", err)
+			return
+		}
+		if link != "" {
+			text += "\n\nAvailable in your library."
+			if err := b.editMessageWithLink(nzbInfo.ChatID, nzbInfo.MessageID, text, "▶️ Watch now", link); err != nil {
+				slog.Error("Error adding watch link", "release", nzbInfo.Name, "err", err)
+			}
+			return
+		}
 	}
+	slog.Warn("Release did not appear on the media server", "release", nzbInfo.Name, "waited", b.libraryWait)
+}
+
+const nzbGeekBaseURL = "https://api.nzbgeek.info/api"
 
-	if !result.Status || len(result.NzoIDs) == 0 {
-		return "", fmt.Errorf("SABnzbd failed to add NZB")
+// nzbGeekClient searches the NZBGeek indexer.
+type nzbGeekClient struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+
+	mu        sync.Mutex
+	caps      *indexerCaps // nil until LoadCaps succeeds
+	capsTried time.Time
+	tvdbIDs   map[string]string // By IMDb ID without the "tt"
+}
+
+func newNZBGeekClient(baseURL, apiKey string, httpClient *http.Client) *nzbGeekClient {
+	if baseURL == "" {
+		baseURL = nzbGeekBaseURL
 	}
+	return &nzbGeekClient{baseURL: baseURL, apiKey: apiKey, http: httpClient, tvdbIDs: make(map[string]string)}
+}
 
-	return result.NzoIDs[0], nil
+// Ping fetches the indexer's capabilities, confirming the API is reachable and
+// the key is accepted, and refreshes the ones used to pick searches.
+func (c *nzbGeekClient) Ping(ctx context.Context) error {
+	return c.LoadCaps(ctx)
 }
 
 // Define NZBGeek category IDs
@@ -218,11 +400,39 @@ var nzbGeekCategories = map[string]string{
 	"kids_tv":     "5000",
 }
 
+// ReleaseQuery is what to look for on an indexer. Make one with
+// newReleaseQuery, since Season's zero value means specials.
+type ReleaseQuery struct {
+	Category string
+	ImdbID   string
+	// Title and Year are for searching by name when the ID finds nothing
+	Title, Year string
+	// Season is -1 for all of a series. Episode is 0 for a whole season.
+	Season, Episode int
+}
+
+func newReleaseQuery(imdbID, category, title, year string) ReleaseQuery {
+	return ReleaseQuery{Category: category, ImdbID: imdbID, Title: title, Year: year, Season: -1}
+}
+
+// text returns the query and year for a text search.
+func (q ReleaseQuery) text() (string, string) {
+	if q.Season < 0 {
+		return q.Title, q.Year
+	}
+	query := q.Title + ".S" + addLeadingZero(q.Season)
+	if q.Episode > 0 {
+		query += "E" + addLeadingZero(q.Episode)
+	}
+	return query + ".", ""
+}
+
 type SearchResult struct {
 	Items          []Item
 	TotalFound     int
 	FilteredCount  int
 	RemainingCount int
+	Filtered       []FilteredItem
 }
 
 type RSS struct {
@@ -232,43 +442,67 @@ type RSS struct {
 }
 
 type Item struct {
-	Title       string    `xml:"title"`
-	Link        string    `xml:"link"`
-	Description string    `xml:"description"`
-	Enclosure   Enclosure `xml:"enclosure"`
-	PubDate     string    `xml:"pubDate"`
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	Description string        `xml:"description"`
+	Enclosure   Enclosure     `xml:"enclosure"`
+	PubDate     string        `xml:"pubDate"`
+	GUID        string        `xml:"guid"`
+	Attrs       []newznabAttr `xml:"http://www.newznab.com/DTD/2010/feeds/attributes/ attr"`
+
+	// Newznab is Attrs typed, filled in by parseRSS
+	Newznab NewznabAttrs `xml:"-"`
 }
 
-func lookupNZBGeek(imdbID string, category string) (SearchResult, error) {
-	apiKey := os.Getenv("NZBGEEK_API_KEY")
-	baseURL := "https://api.nzbgeek.info/api"
-
-	imdbID = strings.TrimPrefix(imdbID, "tt")
-
-	categoryID := nzbGeekCategories[category]
-	if categoryID == "" {
-		categoryID = "2000" // Default to movies if category is not found
-	}
-
-	fullURL := fmt.Sprintf("%s?apikey=%s&t=search&cat=%s&imdbid=%s&limit=50", baseURL, apiKey, categoryID, imdbID)
+// fetchRSS runs an API request and decodes the feed it returns. Indexer errors
+// are returned as a *newznabError.
+func (c *nzbGeekClient) fetchRSS(params url.Values) (RSS, error) {
+	fullURL := fmt.Sprintf("%s?apikey=%s&%s", c.baseURL, c.apiKey, params.Encode())
 
-	log.Println("Fetching from NZBGeek:", fullURL)
+	slog.Debug("Fetching from NZBGeek", "url", fullURL)
 
-	resp, err := http.Get(fullURL)
+	resp, err := c.http.Get(fullURL)
 	if err != nil {
-		return SearchResult{}, fmt.Errorf("error fetching from NZBGeek: %v", err)
+		return RSS{}, fmt.Errorf("error fetching from NZBGeek: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return SearchResult{}, fmt.Errorf("error reading response body: %v", err)
+		return RSS{}, fmt.Errorf("error reading response body: %w", err)
+	}
+	if err := parseNewznabError(body); err != nil {
+		return RSS{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return RSS{}, fmt.Errorf("bad status from NZBGeek: %s", resp.Status)
 	}
 
-	var rss RSS
-	err = xml.Unmarshal(body, &rss)
+	rss, err := parseRSS(body)
 	if err != nil {
-		return SearchResult{}, fmt.Errorf("error decoding XML: %v", err)
+		return RSS{}, err
+	}
+	c.rememberTVDBIDs(rss.Channel.Items)
+	return rss, nil
+}
+
+// Lookup finds NZBs for a title by ID, with the most specific search the
+// indexer supports. The result is empty if it can't search for q by ID.
+func (c *nzbGeekClient) Lookup(q ReleaseQuery) (SearchResult, error) {
+	params := c.lookupParams(q)
+	if params == nil {
+		slog.Debug("Indexer can't look this up by ID", "imdb_id", q.ImdbID, "category", q.Category)
+		return SearchResult{}, nil
+	}
+	limit := 50
+	if caps := c.capabilities(); caps != nil && caps.Limits.Max > 0 {
+		limit = min(limit, caps.Limits.Max)
+	}
+	params.Set("limit", strconv.Itoa(limit))
+
+	rss, err := c.fetchRSS(params)
+	if err != nil {
+		return SearchResult{}, err
 	}
 
 	totalFound := len(rss.Channel.Items)
@@ -284,53 +518,43 @@ func lookupNZBGeek(imdbID string, category string) (SearchResult, error) {
 		return timeI.After(timeJ)
 	})
 
-	// Prepare the result
-	result := SearchResult{
+	return SearchResult{
+		Items:          rss.Channel.Items,
 		TotalFound:     totalFound,
-		FilteredCount:  0,
 		RemainingCount: totalFound,
-	}
-
-	// Return the 10 most recent items
-	if len(rss.Channel.Items) > 9 {
-		result.Items = rss.Channel.Items[:9]
-	} else {
-		result.Items = rss.Channel.Items
-	}
-
-	return result, nil
+	}, nil
 }
 
 // resumeDownloadMonitoring resumes monitoring of all incomplete downloads
-func resumeDownloadMonitoring() {
+func (b *Bot) resumeDownloadMonitoring() {
 	ctx := context.Background()
-	log.Println("Resuming download monitoring...")
+	slog.Info("Resuming download monitoring")
 
-	incompleteDownloads, err := queries.GetIncompleteDownloads(ctx)
+	incompleteDownloads, err := b.store.GetIncompleteDownloads(ctx)
 	if err != nil {
-		log.Printf("Error getting incomplete downloads: %v", err)
+		slog.Error("Error getting incomplete downloads", "err", err)
 		return
 	}
 
 	for _, dbNzbInfo := range incompleteDownloads {
-		go monitorDownloadProgress(dbNzbInfo.ID)
+		b.goSafe("download monitor", func() { b.monitorDownloadProgress(dbNzbInfo.ID) })
 	}
 
-	log.Printf("Resumed monitoring for %d incomplete downloads", len(incompleteDownloads))
+	slog.Info("Resumed download monitoring", "downloads", len(incompleteDownloads))
 }
 
-func updateNZBStatus(nzbUUID, status, message string) error {
+func (b *Bot) updateNZBStatus(nzbUUID, status, message string) error {
 	ctx := context.Background()
 
 	// Fetch the current NZB info
-	currentInfo, err := queries.GetNZBInfo(ctx, nzbUUID)
+	currentInfo, err := b.store.GetNZBInfo(ctx, nzbUUID)
 	if err != nil {
 		return fmt.Errorf("failed to get NZB info: %v", err)
 	}
 
 	// Update the status and last updated time
 	currentInfo.Status = status
-	currentInfo.LastUpdated = time.Now().Unix()
+	currentInfo.LastUpdated = b.clock.Now().Unix()
 
 	// Prepare the update parameters
 	updateParams := db.UpsertNZBInfoParams{
@@ -344,56 +568,37 @@ func updateNZBStatus(nzbUUID, status, message string) error {
 		Status:      status,
 		LastUpdated: currentInfo.LastUpdated,
 		Selected:    currentInfo.Selected,
+		ImdbID:      currentInfo.ImdbID,
+		Size:        currentInfo.Size,
+		Guid:        currentInfo.Guid,
+		SearchID:    currentInfo.SearchID,
 	}
 
 	// Update the NZB info in the database
-	err = queries.UpsertNZBInfo(ctx, updateParams)
+	err = b.store.UpsertNZBInfo(ctx, updateParams)
 	if err != nil {
 		return fmt.Errorf("failed to update NZB info: %v", err)
 	}
 
 	// Edit the message
-	editMessage(currentInfo.ChatID, int(currentInfo.MessageID), message)
+	b.editMessage(currentInfo.ChatID, int(currentInfo.MessageID), message)
 
 	return nil
 }
 
-func searchNZBGeek(movieName string, year string, category string) (SearchResult, error) {
-	apiKey := os.Getenv("NZBGEEK_API_KEY")
-	baseURL := "https://api.nzbgeek.info/api"
-
+// Search finds NZBs with a text query.
+func (c *nzbGeekClient) Search(movieName string, year string, category string) (SearchResult, error) {
 	movieName = strings.ReplaceAll(movieName, " ", ".")
 	movieName = strings.ReplaceAll(movieName, "'", "")
 	movieName = strings.ReplaceAll(movieName, "’", "")
 	movieName = strings.ReplaceAll(movieName, ":", "")
 
-	fmt.Printf("Movie Name: %s\n", movieName)
-
-	query := url.QueryEscape(fmt.Sprintf("%s %s", movieName, year))
-	categoryID := nzbGeekCategories[category]
-	if categoryID == "" {
-		categoryID = "2000" // Default to movies if category is not found
-	}
-
-	fullURL := fmt.Sprintf("%s?apikey=%s&t=search&cat=%s&q=%s", baseURL, apiKey, categoryID, query)
-
-	fmt.Printf("Fetching from NZBGeek: %s\n", fullURL)
-
-	resp, err := http.Get(fullURL)
-	if err != nil {
-		return SearchResult{}, fmt.Errorf("error fetching from NZBGeek: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return SearchResult{}, fmt.Errorf("error reading response body: %w", err)
-	}
+	query := fmt.Sprintf("%s %s", movieName, year)
+	categoryID := c.capabilities().categoryID(category)
 
-	var rss RSS
-	err = xml.Unmarshal(body, &rss)
+	rss, err := c.fetchRSS(url.Values{"t": {"search"}, "cat": {categoryID}, "q": {query}})
 	if err != nil {
-		return SearchResult{}, fmt.Errorf("error decoding XML: %w (XML Content: %s)", err, string(body))
+		return SearchResult{}, err
 	}
 
 	totalFound := len(rss.Channel.Items)
@@ -407,7 +612,7 @@ func searchNZBGeek(movieName string, year string, category string) (SearchResult
 		timeI, _ := time.Parse(time.RFC1123Z, rss.Channel.Items[i].PubDate)
 		timeJ, _ := time.Parse(time.RFC1123Z, rss.Channel.Items[j].PubDate)
 
-		if categoryID == "5000" {
+		if isSeriesCategory(category) {
 			title := strings.ToLower(rss.Channel.Items[i].Title)
 			titleJ := strings.ToLower(rss.Channel.Items[j].Title)
 			normSearchQuery := strings.ToLower(strings.ReplaceAll(movieName, " ", "."))
@@ -439,21 +644,11 @@ func searchNZBGeek(movieName string, year string, category string) (SearchResult
 		return timeI.After(timeJ)
 	})
 
-	// Prepare the result
-	result := SearchResult{
+	return SearchResult{
+		Items:          rss.Channel.Items,
 		TotalFound:     totalFound,
-		FilteredCount:  0,
 		RemainingCount: len(rss.Channel.Items),
-	}
-
-	// Return the 10 most recent items
-	if len(rss.Channel.Items) > 9 {
-		result.Items = rss.Channel.Items[:9]
-	} else {
-		result.Items = rss.Channel.Items
-	}
-
-	return result, nil
+	}, nil
 }
 
 func filterNZBResults(searchQuery string, items []Item, threshold float64) []Item {
@@ -461,8 +656,7 @@ func filterNZBResults(searchQuery string, items []Item, threshold float64) []Ite
 		threshold = 0.6 // Default threshold if not specified
 	}
 
-	log.Printf("Filtering results for query: %s with threshold: %f", searchQuery, threshold)
-	log.Printf("Total items before filtering: %d", len(items))
+	slog.Debug("Filtering results", "query", searchQuery, "threshold", threshold, "items", len(items))
 
 	searchQuery = strings.ToLower(searchQuery)
 	searchParts := strings.Fields(searchQuery)
@@ -491,28 +685,21 @@ func filterNZBResults(searchQuery string, items []Item, threshold float64) []Ite
 		for _, part := range searchParts {
 			if !strings.Contains(cleanedTitle, part) {
 				allPartsPresent = false
-				log.Printf("Part '%s' not found in cleaned title", part)
 				break
 			}
 		}
 
 		if allPartsPresent {
-			log.Printf("All parts present in cleaned title")
 			similarity := calculateSimilarity(normalizedSearch, cleanedTitle)
-			log.Printf("Similarity between '%s' and '%s': %f", normalizedSearch, cleanedTitle, similarity)
+			slog.Debug("Compared result to query", "query", normalizedSearch, "title", cleanedTitle, "similarity", similarity)
 
 			if similarity >= threshold {
-				log.Printf("Item passed threshold, adding to filtered results")
 				filteredItems = append(filteredItems, item)
-			} else {
-				log.Printf("Item did not pass threshold")
 			}
-		} else {
-			log.Printf("Not all parts present, skipping similarity check")
 		}
 	}
 
-	log.Printf("Total items after filtering: %d", len(filteredItems))
+	slog.Debug("Filtered results", "query", searchQuery, "items", len(filteredItems))
 	return filteredItems
 }
 
@@ -562,12 +749,5 @@ func calculateSimilarity(s1, s2 string) float64 {
 	}
 	similarity := float64(2*matchingPairs) / float64(totalPairs)
 
-	log.Printf("Similarity calculation details:")
-	log.Printf("String 1: %s", s1)
-	log.Printf("String 2: %s", s2)
-	log.Printf("Matching pairs: %d", matchingPairs)
-	log.Printf("Total pairs: %d", totalPairs)
-	log.Printf("Calculated similarity: %f", similarity)
-
 	return similarity
 }
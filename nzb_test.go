@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dx314/movie_beacon_bot/callbackdata"
+	"github.com/dx314/movie_beacon_bot/db"
+	"github.com/google/uuid"
+)
+
+const (
+	testChatID = 1001
+	testUserID = 2002
+)
+
+// storeTestRelease stores a search result ready to be picked in testChatID.
+func storeTestRelease(t *testing.T, tb *testBot) db.NzbInfo {
+	t.Helper()
+	info := db.NzbInfo{
+		ID:          uuid.New().String(),
+		Url:         "https://indexer.example/get/abc123.nzb",
+		Name:        "The Matrix (1999)",
+		Category:    "movies",
+		ChatID:      testChatID,
+		Status:      "Pending",
+		LastUpdated: tb.clock.Now().Unix(),
+	}
+	if err := tb.storeNZBInfo(info.ID, info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// pickRelease presses the button offering info.
+func pickRelease(t *testing.T, tb *testBot, info db.NzbInfo) {
+	t.Helper()
+	data, err := callbackdata.Encode(callbackdata.PickRelease{ID: info.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.pressButton(t, testChatID, testUserID, data)
+}
+
+func TestPickReleaseCompletes(t *testing.T) {
+	tb := newTestBot(t, &fakeDownloads{script: []fakeProgress{
+		{status: "Queued", progress: "Queued"},
+		{status: "Downloading", progress: "Progress: 50%"},
+		{status: "Completed", progress: "Progress: 100%"},
+	}})
+	release := storeTestRelease(t, tb)
+	other := storeTestRelease(t, tb)
+
+	pickRelease(t, tb, release)
+	waitForMonitor(t, tb.Bot, tb.sender.Texts, "Status: Completed")
+
+	if added := tb.downloads.Added(); !slices.Equal(added, []string{release.Url}) {
+		t.Errorf("AddURL calls = %q, want %q", added, release.Url)
+	}
+	info := tb.download(t, release.ID)
+	if info.Status != "Completed" || info.Selected != 1 || info.SabnzbdID == "" {
+		t.Errorf("download = status %q, selected %d, SABnzbd ID %q, want Completed, selected and queued",
+			info.Status, info.Selected, info.SabnzbdID)
+	}
+	if _, err := tb.store.GetNZBInfo(context.Background(), other.ID); err == nil {
+		t.Error("the option not picked was kept")
+	}
+
+	texts := tb.sender.Texts()
+	if !slices.ContainsFunc(texts, func(s string) bool { return strings.Contains(s, "added to SABnzbd") }) {
+		t.Errorf("no message announcing the download in %q", texts)
+	}
+}
+
+func TestProgressErrorFailsDownload(t *testing.T) {
+	tb := newTestBot(t, &fakeDownloads{script: []fakeProgress{
+		{status: "Downloading", progress: "Progress: 10%"},
+		{err: errors.New("connection refused")},
+	}})
+	release := storeTestRelease(t, tb)
+
+	pickRelease(t, tb, release)
+	waitForMonitor(t, tb.Bot, tb.sender.Texts, "Error monitoring")
+
+	if info := tb.download(t, release.ID); info.Status != "Failed" {
+		t.Errorf("status = %q, want Failed", info.Status)
+	}
+	texts := tb.sender.Texts()
+	if last := texts[len(texts)-1]; !strings.Contains(last, "connection refused") {
+		t.Errorf("last message = %q, want the Progress error", last)
+	}
+}
+
+func TestPickReleaseOverQuota(t *testing.T) {
+	tb := newTestBot(t, &fakeDownloads{script: []fakeProgress{{status: "Completed", progress: "Progress: 100%"}}})
+	tb.quotas = quotaLimits{GrabsPerDay: 1}
+	first := storeTestRelease(t, tb)
+	pickRelease(t, tb, first)
+	waitForMonitor(t, tb.Bot, tb.sender.Texts, "Status: Completed")
+
+	second := storeTestRelease(t, tb)
+	pickRelease(t, tb, second)
+
+	if added := tb.downloads.Added(); len(added) != 1 {
+		t.Errorf("AddURL called %d times, want 1", len(added))
+	}
+	if info := tb.download(t, second.ID); info.Selected != 0 {
+		t.Error("release over the quota was selected")
+	}
+	texts := tb.sender.Texts()
+	if !slices.ContainsFunc(texts, func(s string) bool { return strings.Contains(s, "limit of 1 downloads a day") }) {
+		t.Errorf("no quota message in %q", texts)
+	}
+}
@@ -4,14 +4,27 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
-	"os"
 )
 
 const omdbBaseURL = "http://www.omdbapi.com/"
 
+// omdbClient talks to the OMDB API.
+type omdbClient struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+func newOMDBClient(baseURL, apiKey string, httpClient *http.Client) *omdbClient {
+	if baseURL == "" {
+		baseURL = omdbBaseURL
+	}
+	return &omdbClient{baseURL: baseURL, apiKey: apiKey, http: httpClient}
+}
+
 type OMDBSearchResult struct {
 	Title  string `json:"Title"`
 	Year   string `json:"Year"`
@@ -33,22 +46,33 @@ var CategoryToType = map[string]string{
 	"kids_tv":     "series",
 }
 
-func lookupSeries(name, year string) (*OMDBTVSearchResponse, error) {
-	apiKey := os.Getenv("OMDB_API_KEY")
+// LookupSeries fetches the details of a series by its exact title.
+func (c *omdbClient) LookupSeries(name, year string) (*OMDBTVSearchResponse, error) {
+	params := url.Values{}
+	params.Add("t", name)
+	params.Add("y", year)
+	return c.fetchDetails(params)
+}
+
+// Details fetches the full details of a movie or series by IMDb ID.
+func (c *omdbClient) Details(imdbID string) (*OMDBTVSearchResponse, error) {
+	params := url.Values{}
+	params.Add("i", imdbID)
+	params.Add("plot", "full")
+	return c.fetchDetails(params)
+}
+
+func (c *omdbClient) fetchDetails(params url.Values) (*OMDBTVSearchResponse, error) {
+	apiKey := c.apiKey
 	if apiKey == "" {
-		log.Println("OMDB_API_KEY environment variable is not set")
 		return nil, fmt.Errorf("OMDB_API_KEY environment variable is not set")
 	}
-
-	params := url.Values{}
 	params.Add("apikey", apiKey)
-	params.Add("t", name)
-	params.Add("y", year)
 
-	fullURL := omdbBaseURL + "?" + params.Encode()
-	log.Printf("Requesting URL: %s", fullURL)
+	fullURL := c.baseURL + "?" + params.Encode()
+	slog.Debug("Requesting OMDB details", "url", fullURL)
 
-	resp, err := http.Get(fullURL)
+	resp, err := c.http.Get(fullURL)
 	if err != nil {
 		return nil, fmt.Errorf("error making request: %v", err)
 	}
@@ -61,7 +85,7 @@ func lookupSeries(name, year string) (*OMDBTVSearchResponse, error) {
 	}
 
 	if err := json.Unmarshal(body, &result); err != nil {
-		fmt.Println(string(body))
+		slog.Debug("Undecodable OMDB response", "body", string(body))
 		return nil, fmt.Errorf("failed to unmarshal OMDB response: %v", err)
 	}
 
@@ -72,59 +96,57 @@ func lookupSeries(name, year string) (*OMDBTVSearchResponse, error) {
 	return &result, nil
 }
 
-func searchOMDB(title, year, category string) ([]OMDBSearchResult, error) {
-	log.Printf("Searching OMDB for title: '%s', year: '%s', category: '%s'", title, year, category)
+// SearchTitles finds movies or series matching a title, preferring an exact match.
+func (c *omdbClient) SearchTitles(title, year, category string) ([]OMDBSearchResult, error) {
+	slog.Debug("Searching OMDB", "title", title, "year", year, "category", category)
 
-	apiKey := os.Getenv("OMDB_API_KEY")
+	apiKey := c.apiKey
 	if apiKey == "" {
-		log.Println("OMDB_API_KEY environment variable is not set")
 		return nil, fmt.Errorf("OMDB_API_KEY environment variable is not set")
 	}
 
 	searchType := CategoryToType[category]
-	log.Printf("Mapped category '%s' to OMDB search type: '%s'", category, searchType)
 
 	// Try specific match first
-	specificResult, err := trySpecificMatch(apiKey, title, year, searchType)
+	specificResult, err := c.trySpecificMatch(apiKey, title, year, searchType)
 	if err == nil {
-		log.Printf("Specific match found: %+v", specificResult)
+		slog.Debug("OMDB specific match found", "imdb_id", specificResult.ImdbID, "title", specificResult.Title)
 		return []OMDBSearchResult{specificResult}, nil
 	}
-	log.Printf("Specific match failed: %v. Falling back to search.", err)
+	slog.Debug("OMDB specific match failed, falling back to search", "err", err)
 
 	// Fall back to search
-	searchResults, err := performSearch(apiKey, title, year, searchType)
+	searchResults, err := c.performSearch(apiKey, title, year, searchType)
 	if err != nil {
 		if err.Error() == "too many results found, please provide more specific search terms" {
-			log.Printf("Too many results found. Attempting to refine search.")
 			// Try to refine the search by combining title and year
 			refinedTitle := fmt.Sprintf("%s %s", title, year)
-			searchResults, err = performSearch(apiKey, refinedTitle, "", searchType)
+			searchResults, err = c.performSearch(apiKey, refinedTitle, "", searchType)
 			if err != nil {
-				log.Printf("Refined search failed: %v", err)
+				slog.Warn("OMDB refined search failed", "title", refinedTitle, "err", err)
 				return nil, fmt.Errorf("no suitable results found, please try a more specific search")
 			}
 		} else {
-			log.Printf("Search failed: %v", err)
+			slog.Warn("OMDB search failed", "title", title, "year", year, "err", err)
 			return nil, fmt.Errorf("no results found")
 		}
 	}
 
-	log.Printf("Search successful. Returning %d results.", len(searchResults))
+	slog.Debug("OMDB search succeeded", "results", len(searchResults))
 	return searchResults, nil
 }
 
-func trySpecificMatch(apiKey, title, year, searchType string) (OMDBSearchResult, error) {
+func (c *omdbClient) trySpecificMatch(apiKey, title, year, searchType string) (OMDBSearchResult, error) {
 	params := url.Values{}
 	params.Add("apikey", apiKey)
 	params.Add("t", title)
 	params.Add("y", year)
 	params.Add("type", searchType)
 
-	fullURL := omdbBaseURL + "?" + params.Encode()
-	log.Printf("Trying specific match with URL: %s", fullURL)
+	fullURL := c.baseURL + "?" + params.Encode()
+	slog.Debug("Trying OMDB specific match", "url", fullURL)
 
-	resp, err := http.Get(fullURL)
+	resp, err := c.http.Get(fullURL)
 	if err != nil {
 		return OMDBSearchResult{}, fmt.Errorf("error making request: %v", err)
 	}
@@ -155,17 +177,17 @@ func trySpecificMatch(apiKey, title, year, searchType string) (OMDBSearchResult,
 	}, nil
 }
 
-func performSearch(apiKey, title, year, searchType string) ([]OMDBSearchResult, error) {
+func (c *omdbClient) performSearch(apiKey, title, year, searchType string) ([]OMDBSearchResult, error) {
 	params := url.Values{}
 	params.Add("apikey", apiKey)
 	params.Add("s", title)
 	params.Add("y", year)
 	params.Add("type", searchType)
 
-	fullURL := omdbBaseURL + "?" + params.Encode()
-	log.Printf("Performing search with URL: %s", fullURL)
+	fullURL := c.baseURL + "?" + params.Encode()
+	slog.Debug("Performing OMDB search", "url", fullURL)
 
-	resp, err := http.Get(fullURL)
+	resp, err := c.http.Get(fullURL)
 	if err != nil {
 		return nil, fmt.Errorf("error making request: %v", err)
 	}
@@ -178,7 +200,7 @@ func performSearch(apiKey, title, year, searchType string) ([]OMDBSearchResult,
 
 	if searchResp.Response == "False" {
 		if searchResp.Error == "Too many results." {
-			log.Printf("OMDB search returned too many results for query: %s %s", title, year)
+			slog.Debug("OMDB search returned too many results", "title", title, "year", year)
 			return nil, fmt.Errorf("too many results found, please provide more specific search terms")
 		}
 		if searchResp.Error != "" {
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dx314/movie_beacon_bot/db"
+)
+
+const (
+	// webhookMaxAttempts is how many times a delivery is tried before it is
+	// dropped. With webhookBackoff that covers about fifteen hours.
+	webhookMaxAttempts = 12
+	// webhookPollInterval is how often the outbox is checked for retries that
+	// have come due.
+	webhookPollInterval = 10 * time.Second
+	// webhookBatch is how many deliveries are sent per pass.
+	webhookBatch = 50
+)
+
+// outgoingWebhook POSTs events to a URL, signed with its secret.
+type outgoingWebhook struct {
+	Name   string
+	URL    string
+	Secret string
+	// Events is the event types sent, or every type when empty.
+	Events []string
+}
+
+// wants reports whether the webhook is subscribed to events of type typ.
+func (w outgoingWebhook) wants(typ string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, typ)
+}
+
+// webhookOutbox queues events for the configured webhooks in the database and
+// delivers them, retrying failures with backoff. Queued deliveries survive
+// restarts.
+type webhookOutbox struct {
+	store Store
+	http  *http.Client
+	clock Clock
+	hooks map[string]outgoingWebhook
+
+	// wake is signalled when a delivery is queued, so it goes out right away.
+	wake chan struct{}
+}
+
+// loadWebhookOutbox returns an outbox for the webhooks named in
+// OUTGOING_WEBHOOKS, or nil when none are configured. Each name is configured
+// with OUTGOING_WEBHOOK_<NAME>_URL, _SECRET and _EVENTS, a comma separated list
+// of event types (every type when empty).
+func loadWebhookOutbox(store Store, httpClient *http.Client) (*webhookOutbox, error) {
+	names := os.Getenv("OUTGOING_WEBHOOKS")
+	if names == "" {
+		return nil, nil
+	}
+
+	o := &webhookOutbox{
+		store: store,
+		http:  httpClient,
+		clock: realClock{},
+		hooks: make(map[string]outgoingWebhook),
+		wake:  make(chan struct{}, 1),
+	}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OUTGOING_WEBHOOK_" + strings.ToUpper(name) + "_"
+		hook := outgoingWebhook{
+			Name:   name,
+			URL:    os.Getenv(prefix + "URL"),
+			Secret: os.Getenv(prefix + "SECRET"),
+		}
+		if hook.URL == "" {
+			return nil, fmt.Errorf("%sURL is not set", prefix)
+		}
+		if hook.Secret == "" {
+			return nil, fmt.Errorf("%sSECRET is not set", prefix)
+		}
+		for _, typ := range strings.Split(os.Getenv(prefix+"EVENTS"), ",") {
+			typ = strings.TrimSpace(typ)
+			if typ == "" {
+				continue
+			}
+			if !slices.Contains(eventTypes, typ) {
+				return nil, fmt.Errorf("unknown event %q in %sEVENTS", typ, prefix)
+			}
+			hook.Events = append(hook.Events, typ)
+		}
+		o.hooks[name] = hook
+	}
+	return o, nil
+}
+
+// Enqueue stores a delivery of event for each webhook subscribed to it. It is
+// subscribed to the bot's event bus.
+func (o *webhookOutbox) Enqueue(event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding event", "event", event.Type, "err", err)
+		return
+	}
+
+	now := o.clock.Now().Unix()
+	queued := false
+	for _, hook := range o.hooks {
+		if !hook.wants(event.Type) {
+			continue
+		}
+		err := o.store.InsertWebhookDelivery(context.Background(), db.InsertWebhookDeliveryParams{
+			Webhook:     hook.Name,
+			Event:       event.Type,
+			Payload:     string(payload),
+			NextAttempt: now,
+			CreatedAt:   now,
+		})
+		if err != nil {
+			slog.Error("Error queueing webhook delivery", "webhook", hook.Name, "event", event.Type, "err", err)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run delivers queued events until the process exits.
+func (o *webhookOutbox) Run() {
+	for {
+		o.deliverDue()
+		select {
+		case <-o.wake:
+		case <-o.clock.After(webhookPollInterval):
+		}
+	}
+}
+
+// deliverDue sends every delivery whose next attempt has come.
+func (o *webhookOutbox) deliverDue() {
+	ctx := context.Background()
+	for {
+		due, err := o.store.GetDueWebhookDeliveries(ctx, db.GetDueWebhookDeliveriesParams{
+			NextAttempt: o.clock.Now().Unix(),
+			Limit:       webhookBatch,
+		})
+		if err != nil {
+			slog.Error("Error loading webhook deliveries", "err", err)
+			return
+		}
+		for _, delivery := range due {
+			o.attempt(ctx, delivery)
+		}
+		if len(due) < webhookBatch {
+			return
+		}
+	}
+}
+
+// attempt sends a delivery, removing it from the outbox once it succeeds or has
+// run out of attempts, and otherwise scheduling a retry.
+func (o *webhookOutbox) attempt(ctx context.Context, delivery db.WebhookDelivery) {
+	log := slog.With("webhook", delivery.Webhook, "event", delivery.Event, "delivery_id", delivery.ID)
+
+	hook, ok := o.hooks[delivery.Webhook]
+	if !ok {
+		log.Warn("Dropping delivery for a webhook that is no longer configured")
+		o.remove(ctx, delivery)
+		return
+	}
+
+	err := o.send(ctx, hook, delivery)
+	if err == nil {
+		log.Debug("Delivered webhook")
+		o.remove(ctx, delivery)
+		return
+	}
+
+	attempts := delivery.Attempts + 1
+	if attempts >= webhookMaxAttempts {
+		log.Error("Giving up on webhook delivery", "attempts", attempts, "err", err)
+		o.remove(ctx, delivery)
+		return
+	}
+
+	retryIn := webhookBackoff(attempts)
+	log.Warn("Webhook delivery failed", "attempts", attempts, "retry_in", retryIn, "err", err)
+	err = o.store.RescheduleWebhookDelivery(ctx, db.RescheduleWebhookDeliveryParams{
+		Attempts:    attempts,
+		NextAttempt: o.clock.Now().Add(retryIn).Unix(),
+		LastError:   redactSecrets(err.Error()),
+		ID:          delivery.ID,
+	})
+	if err != nil {
+		log.Error("Error rescheduling webhook delivery", "err", err)
+	}
+}
+
+func (o *webhookOutbox) remove(ctx context.Context, delivery db.WebhookDelivery) {
+	if err := o.store.DeleteWebhookDelivery(ctx, delivery.ID); err != nil {
+		slog.Error("Error removing webhook delivery", "delivery_id", delivery.ID, "err", err)
+	}
+}
+
+// send POSTs the delivery's payload. The body is signed with the webhook's
+// secret in the X-Beacon-Signature-256 header as "sha256=" followed by the hex
+// encoded HMAC-SHA256.
+func (o *webhookOutbox) send(ctx context.Context, hook outgoingWebhook, delivery db.WebhookDelivery) error {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "movie-beacon-bot")
+	req.Header.Set("X-Beacon-Event", delivery.Event)
+	req.Header.Set("X-Beacon-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Beacon-Signature-256", signWebhook(hook.Secret, body))
+
+	resp, err := o.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the signature header value for body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is how long to wait before retrying after the given number of
+// failed attempts: 30 seconds, doubling each time up to six hours.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := 30 * time.Second
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= 6*time.Hour {
+			return 6 * time.Hour
+		}
+	}
+	return backoff
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dx314/movie_beacon_bot/db"
+)
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"type":"download.completed"}`)
+	got := signWebhook("webhook-secret", body)
+
+	// Receivers check the header against this exact format
+	if want := "sha256=fd7e57f4c37847ef2174eb44bec4ea42cc5194396545903b91a72e4efe1df841"; got != want {
+		t.Errorf("signWebhook() = %q, want %q", got, want)
+	}
+	if !regexp.MustCompile(`^sha256=[0-9a-f]{64}$`).MatchString(got) {
+		t.Errorf("signWebhook() = %q, want sha256= and 64 lowercase hex digits", got)
+	}
+	if other := signWebhook("other-secret", body); hmac.Equal([]byte(other), []byte(got)) {
+		t.Error("signatures with different secrets match")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	want := []time.Duration{
+		30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute,
+		32 * time.Minute, 64 * time.Minute, 128 * time.Minute, 256 * time.Minute, 6 * time.Hour, 6 * time.Hour,
+	}
+	var total time.Duration
+	for attempts := 1; attempts <= len(want); attempts++ {
+		got := webhookBackoff(attempts)
+		if got != want[attempts-1] {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", attempts, got, want[attempts-1])
+		}
+		if attempts < webhookMaxAttempts {
+			total += got
+		}
+	}
+	// The retries of a delivery span about fifteen hours
+	if total < 14*time.Hour || total > 16*time.Hour {
+		t.Errorf("retries span %v, want about fifteen hours", total)
+	}
+}
+
+func TestOutboxRetriesUntilMaxAttempts(t *testing.T) {
+	var mu sync.Mutex
+	var signatures []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		signatures = append(signatures, r.Header.Get("X-Beacon-Signature-256"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	store := newTestStore(t)
+	clock := newFakeClock()
+	o := &webhookOutbox{
+		store: store,
+		http:  server.Client(),
+		clock: clock,
+		hooks: map[string]outgoingWebhook{"ci": {Name: "ci", URL: server.URL, Secret: "webhook-secret"}},
+		wake:  make(chan struct{}, 1),
+	}
+	o.Enqueue(Event{ID: "1", Type: eventDownloadCompleted, Time: clock.Now()})
+
+	for attempts := 1; attempts <= webhookMaxAttempts; attempts++ {
+		o.deliverDue()
+		due, err := store.GetDueWebhookDeliveries(context.Background(), db.GetDueWebhookDeliveriesParams{
+			NextAttempt: clock.Now().Add(7 * time.Hour).Unix(), // Past any backoff
+			Limit:       10,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempts == webhookMaxAttempts {
+			if len(due) != 0 {
+				t.Errorf("delivery kept after %d attempts", attempts)
+			}
+			break
+		}
+		if len(due) != 1 {
+			t.Fatalf("%d deliveries queued after %d attempts, want 1", len(due), attempts)
+		}
+		if got, want := time.Unix(due[0].NextAttempt, 0).Sub(clock.Now()), webhookBackoff(attempts); got != want {
+			t.Errorf("retry %d scheduled in %v, want %v", attempts, got, want)
+		}
+		if due[0].LastError == "" {
+			t.Errorf("no error recorded after attempt %d", attempts)
+		}
+		<-clock.After(webhookBackoff(attempts))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(signatures) != webhookMaxAttempts {
+		t.Errorf("delivery sent %d times, want %d", len(signatures), webhookMaxAttempts)
+	}
+	for _, sig := range signatures {
+		if sig != signatures[0] || sig == "" {
+			t.Errorf("signatures = %q, want the same one on every attempt", signatures)
+			break
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	defaultMovieTemplate  = "{Title} ({Year})/{Title} ({Year}) - {Resolution}.{ext}"
+	defaultSeriesTemplate = "{Series}/Season {SS}/{Series} - S{SS}E{EE}.{ext}"
+)
+
+var subtitleExtensions = map[string]bool{
+	".srt": true, ".sub": true, ".idx": true, ".ass": true, ".ssa": true, ".vtt": true,
+}
+
+// postProcessor renames completed downloads and moves (or hardlinks) them into
+// the library root for their category.
+type postProcessor struct {
+	hardlink bool
+	roots    map[string]string // Category -> library root
+	movie    string            // Path template for movies
+	series   string            // Path template for episodes
+}
+
+// loadPostProcessor reads the post-processing settings. It returns nil when
+// POSTPROCESS_MODE is not set.
+func loadPostProcessor() (*postProcessor, error) {
+	mode := strings.ToLower(os.Getenv("POSTPROCESS_MODE"))
+	if mode == "" {
+		return nil, nil
+	}
+	if mode != "move" && mode != "hardlink" {
+		return nil, fmt.Errorf("unknown POSTPROCESS_MODE %q, expected move or hardlink", mode)
+	}
+
+	p := &postProcessor{
+		hardlink: mode == "hardlink",
+		roots:    make(map[string]string),
+		movie:    os.Getenv("RENAME_TEMPLATE_MOVIE"),
+		series:   os.Getenv("RENAME_TEMPLATE_SERIES"),
+	}
+	if p.movie == "" {
+		p.movie = defaultMovieTemplate
+	}
+	if p.series == "" {
+		p.series = defaultSeriesTemplate
+	}
+	for category := range nzbGeekCategories {
+		p.roots[category] = os.Getenv("LIBRARY_ROOT_" + strings.ToUpper(category))
+	}
+	return p, nil
+}
+
+// releaseInfo is what can be read from a scene release or file name.
+type releaseInfo struct {
+	Title      string
+	Year       string
+	Season     int
+	Episode    int
+	Resolution string
+}
+
+var (
+	episodeRegex = regexp.MustCompile(`(?i)\bS(\d{1,2})[ ._-]?E(\d{1,3})\b`)
+	seasonRegex  = regexp.MustCompile(`(?i)\bS(?:eason[ ._]?)?(\d{1,2})\b`)
+)
+
+// parseReleaseName pulls the title, year, episode and resolution out of a name
+// like "Show.Name.S01E02.720p.WEB-DL-GRP". The title is everything before the
+// first of those tags. The year is the last one before the episode or
+// resolution, so a year in the title stays there ("Blade Runner 2049 2017").
+func parseReleaseName(name string) releaseInfo {
+	clean := strings.NewReplacer(".", " ", "_", " ").Replace(name)
+	info := releaseInfo{Resolution: resolutionFromName(clean)}
+	cut := len(clean)
+
+	if m := episodeRegex.FindStringSubmatchIndex(clean); m != nil {
+		info.Season, _ = strconv.Atoi(clean[m[2]:m[3]])
+		info.Episode, _ = strconv.Atoi(clean[m[4]:m[5]])
+		cut = m[0]
+	} else if m := seasonRegex.FindStringSubmatchIndex(clean); m != nil && m[0] > 0 {
+		info.Season, _ = strconv.Atoi(clean[m[2]:m[3]])
+		cut = m[0]
+	}
+	if loc := resolutionRegex.FindStringIndex(clean); loc != nil && loc[0] > 0 && loc[0] < cut {
+		cut = loc[0]
+	}
+
+	// A year at the very start is part of the title ("2001 A Space Odyssey 1968")
+	year := -1
+	for _, loc := range yearRegex.FindAllStringIndex(clean, -1) {
+		if loc[0] > 0 && loc[1] <= cut {
+			year = loc[0]
+		}
+	}
+	if year > 0 {
+		info.Year = clean[year : year+4]
+		cut = year
+	}
+
+	info.Title = strings.Trim(strings.Join(strings.Fields(clean[:cut]), " "), " -([")
+	return info
+}
+
+// releaseFor is what's known about a download: the title and year from OMDB
+// when it was matched to a title, otherwise what its name says.
+func releaseFor(name string, details *OMDBTVSearchResponse) releaseInfo {
+	info := parseReleaseName(name)
+	if details != nil {
+		info.Title = details.Title
+		// Series have a range of years, like "2008–2013"
+		if year := yearRegex.FindString(details.Year); year != "" {
+			info.Year = year
+		}
+	}
+	return info
+}
+
+var (
+	unsafePathChars = strings.NewReplacer("/", "-", "\\", "-", ":", " -", "*", "", "?", "", "\"", "'", "<", "", ">", "", "|", "-")
+	emptyParens     = regexp.MustCompile(`\s*\(\s*\)`)
+	danglingDash    = regexp.MustCompile(`\s+-\s*(\.|/|$)`)
+)
+
+// renderTemplate fills in a path template. Placeholders whose value is unknown
+// are dropped along with the brackets or dash around them.
+func renderTemplate(tmpl string, info releaseInfo, ext string) string {
+	if !strings.Contains(tmpl, "{ext}") {
+		tmpl += ".{ext}"
+	}
+	values := []string{
+		"{Title}", info.Title,
+		"{Series}", info.Title,
+		"{Year}", info.Year,
+		"{Resolution}", info.Resolution,
+		"{Season}", strconv.Itoa(info.Season),
+		"{Episode}", strconv.Itoa(info.Episode),
+		"{SS}", addLeadingZero(info.Season),
+		"{EE}", addLeadingZero(info.Episode),
+	}
+	for i := 1; i < len(values); i += 2 {
+		values[i] = strings.TrimSpace(unsafePathChars.Replace(values[i]))
+	}
+	path := strings.NewReplacer(values...).Replace(tmpl)
+	path = emptyParens.ReplaceAllString(path, "")
+	path = danglingDash.ReplaceAllString(path, "$1")
+	return strings.Replace(path, "{ext}", strings.TrimPrefix(ext, "."), 1)
+}
+
+// mediaFile is a video found in a download along with its subtitles.
+type mediaFile struct {
+	path      string
+	size      int64
+	subtitles []string
+}
+
+// findMediaFiles returns the videos in dir, skipping samples, with each video's
+// subtitles. For a movie only the largest video is kept.
+func findMediaFiles(dir string, series bool) ([]*mediaFile, error) {
+	var videos []*mediaFile
+	var subtitles []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		switch {
+		case videoExtensions[ext]:
+			if strings.Contains(strings.ToLower(path), "sample") {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			videos = append(videos, &mediaFile{path: path, size: info.Size()})
+		case subtitleExtensions[ext]:
+			subtitles = append(subtitles, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(videos) == 0 {
+		return nil, errors.New("no video files found")
+	}
+
+	sort.Slice(videos, func(i, j int) bool { return videos[i].size > videos[j].size })
+	if !series {
+		videos = videos[:1]
+	}
+
+	for _, sub := range subtitles {
+		if video := subtitleOwner(sub, videos); video != nil {
+			video.subtitles = append(video.subtitles, sub)
+		}
+	}
+	return videos, nil
+}
+
+// subtitleOwner matches a subtitle to a video by episode, then by file name. A
+// lone video gets every subtitle.
+func subtitleOwner(sub string, videos []*mediaFile) *mediaFile {
+	if len(videos) == 1 {
+		return videos[0]
+	}
+	if m := episodeRegex.FindString(filepath.Base(sub)); m != "" {
+		for _, v := range videos {
+			if strings.EqualFold(episodeRegex.FindString(filepath.Base(v.path)), m) {
+				return v
+			}
+		}
+	}
+	subBase := filepath.Base(sub)
+	for _, v := range videos {
+		base := strings.TrimSuffix(filepath.Base(v.path), filepath.Ext(v.path))
+		if strings.HasPrefix(subBase, base) {
+			return v
+		}
+	}
+	return nil
+}
+
+// subtitleSuffix keeps a subtitle's language and flags, e.g. ".en.forced.srt" for
+// "Movie.en.forced.srt" next to "Movie.mkv".
+func subtitleSuffix(sub, video string) string {
+	base := filepath.Base(sub)
+	videoBase := strings.TrimSuffix(filepath.Base(video), filepath.Ext(video))
+	if strings.HasPrefix(base, videoBase+".") {
+		return base[len(videoBase):]
+	}
+	return filepath.Ext(sub)
+}
+
+// Process renames and places a completed download. It returns the final path:
+// the file itself for a single video, or the folder holding them otherwise.
+// A file that can't be placed doesn't stop the others; the error then names
+// the files that failed, along with the path of those that were placed.
+func (p *postProcessor) Process(category string, release releaseInfo, storage string) (string, error) {
+	root := p.roots[category]
+	if root == "" {
+		return "", fmt.Errorf("no library root configured for category %s", category)
+	}
+
+	series := isSeriesCategory(category)
+	files, err := findMediaFiles(storage, series)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", storage, err)
+	}
+
+	tmpl := p.movie
+	if series {
+		tmpl = p.series
+	}
+
+	var placed []string
+	var failed []error
+	for _, file := range files {
+		info := parseReleaseName(filepath.Base(file.path))
+		// The release is usually more reliable than scene file names
+		info.Title = release.Title
+		if info.Year == "" || !series {
+			info.Year = release.Year
+		}
+		if info.Resolution == "" {
+			info.Resolution = release.Resolution
+		}
+		if series && info.Episode == 0 {
+			slog.Warn("Skipping file with no episode number in its name", "path", file.path)
+			continue
+		}
+
+		target := filepath.Join(root, renderTemplate(tmpl, info, filepath.Ext(file.path)))
+		if err := p.place(file.path, target); err != nil {
+			slog.Error("Error placing file", "path", file.path, "err", err)
+			failed = append(failed, err)
+			continue
+		}
+		placed = append(placed, target)
+
+		targetBase := strings.TrimSuffix(target, filepath.Ext(target))
+		for _, sub := range file.subtitles {
+			if err := p.place(sub, targetBase+subtitleSuffix(sub, file.path)); err != nil {
+				slog.Error("Error placing subtitle", "path", sub, "err", err)
+			}
+		}
+	}
+
+	err = errors.Join(failed...)
+	if len(placed) == 0 {
+		if err == nil {
+			err = fmt.Errorf("%s: no files could be placed", storage)
+		}
+		return "", err
+	}
+	if !p.hardlink {
+		removeEmptyDirs(storage)
+	}
+	if len(placed) == 1 {
+		return placed[0], err
+	}
+	return commonDir(placed), err
+}
+
+// place moves or hardlinks src to dst, creating dst's folder.
+func (p *postProcessor) place(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+
+	if p.hardlink {
+		if err := os.Link(src, dst); err != nil {
+			return fmt.Errorf("failed to hardlink %s: %v", src, err)
+		}
+		return nil
+	}
+
+	err := os.Rename(src, dst)
+	if errors.Is(err, syscall.EXDEV) {
+		// Different filesystems, so fall back to copying
+		err = moveByCopy(src, dst)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to move %s: %v", src, err)
+	}
+	return nil
+}
+
+func moveByCopy(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// removeEmptyDirs deletes dir if nothing but empty folders is left in it.
+func removeEmptyDirs(dir string) {
+	empty := true
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			empty = false
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if empty {
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Warn("Error removing directory", "path", dir, "err", err)
+		}
+	}
+}
+
+func commonDir(paths []string) string {
+	dir := filepath.Dir(paths[0])
+	for _, p := range paths[1:] {
+		for !inDir(p, dir) {
+			dir = filepath.Dir(dir)
+		}
+	}
+	return dir
+}
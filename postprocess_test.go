@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseReleaseName(t *testing.T) {
+	tests := []struct {
+		name string
+		want releaseInfo
+	}{
+		{"The.Matrix.1999.1080p.BluRay.x264-GROUP", releaseInfo{Title: "The Matrix", Year: "1999", Resolution: "1080p"}},
+		{"Blade.Runner.2049.2017.2160p.UHD.BluRay-GROUP", releaseInfo{Title: "Blade Runner 2049", Year: "2017", Resolution: "2160p"}},
+		{"2001.A.Space.Odyssey.1968.720p.BluRay-GROUP", releaseInfo{Title: "2001 A Space Odyssey", Year: "1968", Resolution: "720p"}},
+		{"Breaking.Bad.S01E02.720p.WEB-DL-GRP", releaseInfo{Title: "Breaking Bad", Season: 1, Episode: 2, Resolution: "720p"}},
+		{"Doctor.Who.2005.S10E01.1080p.WEB-GRP", releaseInfo{Title: "Doctor Who", Year: "2005", Season: 10, Episode: 1, Resolution: "1080p"}},
+		{"The.Wire.Season.3.DVDRip-GRP", releaseInfo{Title: "The Wire", Season: 3}},
+		{"Movie_Title_2019_4K_HDR", releaseInfo{Title: "Movie Title", Year: "2019", Resolution: "2160p"}},
+		{"The Matrix (1999)", releaseInfo{Title: "The Matrix", Year: "1999"}},
+		{"Untitled", releaseInfo{Title: "Untitled"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseReleaseName(tt.name); got != tt.want {
+				t.Errorf("parseReleaseName(%q) = %+v, want %+v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleaseForPrefersOMDB(t *testing.T) {
+	tests := []struct {
+		name    string
+		details *OMDBTVSearchResponse
+		want    releaseInfo
+	}{
+		{"Blade Runner 2049 (2049)", &OMDBTVSearchResponse{Title: "Blade Runner 2049", Year: "2017"}, releaseInfo{Title: "Blade Runner 2049", Year: "2017"}},
+		{"Breaking Bad (2008)", &OMDBTVSearchResponse{Title: "Breaking Bad", Year: "2008–2013"}, releaseInfo{Title: "Breaking Bad", Year: "2008"}},
+		{"The.Matrix.1999.1080p", nil, releaseInfo{Title: "The Matrix", Year: "1999", Resolution: "1080p"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := releaseFor(tt.name, tt.details); got != tt.want {
+				t.Errorf("releaseFor(%q) = %+v, want %+v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	tests := []struct {
+		name string
+		tmpl string
+		info releaseInfo
+		ext  string
+		want string
+	}{
+		{"movie", defaultMovieTemplate, releaseInfo{Title: "The Matrix", Year: "1999", Resolution: "1080p"}, ".mkv",
+			"The Matrix (1999)/The Matrix (1999) - 1080p.mkv"},
+		{"movie without year or resolution", defaultMovieTemplate, releaseInfo{Title: "The Matrix"}, ".mkv",
+			"The Matrix/The Matrix.mkv"},
+		{"episode", defaultSeriesTemplate, releaseInfo{Title: "Breaking Bad", Season: 1, Episode: 2}, ".mkv",
+			"Breaking Bad/Season 01/Breaking Bad - S01E02.mkv"},
+		{"unsafe characters", defaultMovieTemplate, releaseInfo{Title: "Mission: Impossible? AC/DC", Year: "1996", Resolution: "720p"}, ".mp4",
+			"Mission - Impossible AC-DC (1996)/Mission - Impossible AC-DC (1996) - 720p.mp4"},
+		{"no extension placeholder", "{Title}", releaseInfo{Title: "The Matrix"}, ".avi", "The Matrix.avi"},
+		{"unpadded numbers", "{Series} {Season}x{Episode}", releaseInfo{Title: "Lost", Season: 4, Episode: 12}, ".mkv", "Lost 4x12.mkv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderTemplate(tt.tmpl, tt.info, tt.ext); got != tt.want {
+				t.Errorf("renderTemplate(%q) = %q, want %q", tt.tmpl, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubtitleOwner(t *testing.T) {
+	episode1 := &mediaFile{path: "/dl/Show.S01E01.720p.mkv"}
+	episode2 := &mediaFile{path: "/dl/Show.S01E02.720p.mkv"}
+	extras := &mediaFile{path: "/dl/Show.Behind.The.Scenes.mkv"}
+	videos := []*mediaFile{episode1, episode2, extras}
+
+	tests := []struct {
+		sub    string
+		videos []*mediaFile
+		want   *mediaFile
+	}{
+		{"/dl/Subs/Show.S01E02.en.srt", videos, episode2},
+		{"/dl/Subs/show.s01e01.English.srt", videos, episode1},
+		{"/dl/Show.Behind.The.Scenes.en.srt", videos, extras},
+		{"/dl/Subs/English.srt", videos, nil},
+		{"/dl/Subs/Show.S02E01.en.srt", videos, nil},
+		{"/dl/Subs/English.srt", []*mediaFile{episode1}, episode1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sub, func(t *testing.T) {
+			if got := subtitleOwner(tt.sub, tt.videos); got != tt.want {
+				t.Errorf("subtitleOwner(%q) = %v, want %v", tt.sub, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessPlacesTheRestWhenAFileFails(t *testing.T) {
+	storage := t.TempDir()
+	root := t.TempDir()
+	for _, name := range []string{"Show.S01E01.mkv", "Show.S01E02.mkv", "Show.S01E03.mkv"} {
+		if err := os.WriteFile(filepath.Join(storage, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Episode 2 is already in the library
+	taken := filepath.Join(root, "Show", "Season 01", "Show - S01E02.mkv")
+	if err := os.MkdirAll(filepath.Dir(taken), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(taken, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &postProcessor{roots: map[string]string{"tv": root}, series: defaultSeriesTemplate}
+	path, err := p.Process("tv", releaseInfo{Title: "Show"}, storage)
+	if err == nil || !strings.Contains(err.Error(), taken) {
+		t.Errorf("Process() error = %v, want one naming %s", err, taken)
+	}
+	if want := filepath.Join(root, "Show", "Season 01"); path != want {
+		t.Errorf("Process() = %q, want %q", path, want)
+	}
+	for _, episode := range []string{"Show - S01E01.mkv", "Show - S01E03.mkv"} {
+		if _, err := os.Stat(filepath.Join(root, "Show", "Season 01", episode)); err != nil {
+			t.Errorf("%s wasn't placed: %v", episode, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(storage, "Show.S01E02.mkv")); err != nil {
+		t.Errorf("the episode that failed was lost: %v", err)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dx314/movie_beacon_bot/db"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	quotaDay  = 24 * time.Hour
+	quotaWeek = 7 * quotaDay
+	// quotaOverrideDefault is how long /quota USER lift lasts without a duration.
+	quotaOverrideDefault = 24 * time.Hour
+)
+
+// quotaLimits caps how much users can ask of the bot. Zero means unlimited.
+// Day and week are rolling windows ending now.
+type quotaLimits struct {
+	CommandsPerMinute int
+	GrabsPerDay       int
+	BytesPerDay       int64
+	BytesPerWeek      int64
+	// MaxActive caps how many downloads can be in SABnzbd at once, across all
+	// users.
+	MaxActive int
+}
+
+// loadQuotaLimits reads QUOTA_COMMANDS_PER_MINUTE, QUOTA_GRABS_PER_DAY,
+// QUOTA_BYTES_PER_DAY, QUOTA_BYTES_PER_WEEK and MAX_CONCURRENT_DOWNLOADS. Sizes
+// may carry a unit, e.g. "50GB".
+func loadQuotaLimits() (quotaLimits, error) {
+	var limits quotaLimits
+	counts := map[string]*int{
+		"QUOTA_COMMANDS_PER_MINUTE": &limits.CommandsPerMinute,
+		"QUOTA_GRABS_PER_DAY":       &limits.GrabsPerDay,
+		"MAX_CONCURRENT_DOWNLOADS":  &limits.MaxActive,
+	}
+	for name, limit := range counts {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return quotaLimits{}, fmt.Errorf("invalid %s %q", name, v)
+		}
+		*limit = n
+	}
+	sizes := map[string]*int64{
+		"QUOTA_BYTES_PER_DAY":  &limits.BytesPerDay,
+		"QUOTA_BYTES_PER_WEEK": &limits.BytesPerWeek,
+	}
+	for name, limit := range sizes {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		n, err := parseSize(v)
+		if err != nil {
+			return quotaLimits{}, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		*limit = n
+	}
+	return limits, nil
+}
+
+// perUser reports whether any per-user download limit is set.
+func (l quotaLimits) perUser() bool {
+	return l.GrabsPerDay > 0 || l.BytesPerDay > 0 || l.BytesPerWeek > 0
+}
+
+// grabber is who a download is being queued for.
+type grabber struct {
+	// UserID is charged for the download. Zero charges nobody.
+	UserID int64
+	// Admin skips every limit, including MaxActive.
+	Admin bool
+	// IgnoreDiskSpace queues the download even if it won't fit, once an admin
+	// has confirmed it.
+	IgnoreDiskSpace bool
+}
+
+// quotaError is returned when a download would go over a limit.
+type quotaError struct {
+	msg string
+}
+
+func (e *quotaError) Error() string {
+	return e.msg
+}
+
+func (e *quotaError) HTTPStatus() int {
+	return http.StatusTooManyRequests
+}
+
+// quotaUsage is what a user has downloaded recently.
+type quotaUsage struct {
+	GrabsToday int64
+	BytesToday int64
+	BytesWeek  int64
+	// LiftedUntil is when an admin's override of the user's limits ends, or
+	// zero when there is none.
+	LiftedUntil time.Time
+}
+
+func (b *Bot) quotaUsage(userID int64) (quotaUsage, error) {
+	ctx := context.Background()
+	now := b.clock.Now()
+
+	var usage quotaUsage
+	day, err := b.store.GetGrabUsage(ctx, db.GetGrabUsageParams{UserID: userID, GrabbedAt: now.Add(-quotaDay).Unix()})
+	if err != nil {
+		return usage, err
+	}
+	week, err := b.store.GetGrabUsage(ctx, db.GetGrabUsageParams{UserID: userID, GrabbedAt: now.Add(-quotaWeek).Unix()})
+	if err != nil {
+		return usage, err
+	}
+	usage.GrabsToday, usage.BytesToday, usage.BytesWeek = day.Grabs, day.Bytes, week.Bytes
+
+	expiresAt, err := b.store.GetQuotaOverride(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return usage, err
+	}
+	if err == nil && expiresAt > now.Unix() {
+		usage.LiftedUntil = time.Unix(expiresAt, 0)
+	}
+	return usage, nil
+}
+
+// checkQuota returns a *quotaError if queueing nzbInfo for by would go over a
+// limit.
+func (b *Bot) checkQuota(by grabber, nzbInfo db.NzbInfo) error {
+	if by.Admin {
+		return nil
+	}
+
+	if b.quotas.MaxActive > 0 {
+		active, err := b.store.GetIncompleteDownloads(context.Background())
+		if err != nil {
+			return fmt.Errorf("error counting active downloads: %w", err)
+		}
+		// A release claimed by the API is already selected, but isn't running
+		active = slices.DeleteFunc(active, func(info db.NzbInfo) bool { return info.ID == nzbInfo.ID })
+		if len(active) >= b.quotas.MaxActive {
+			return &quotaError{fmt.Sprintf("%d downloads are already running, the most allowed at once. Please try again when one finishes.", len(active))}
+		}
+	}
+
+	if !b.quotas.perUser() || by.UserID == 0 {
+		return nil
+	}
+	usage, err := b.quotaUsage(by.UserID)
+	if err != nil {
+		return fmt.Errorf("error checking quota: %w", err)
+	}
+	if !usage.LiftedUntil.IsZero() {
+		return nil
+	}
+
+	var reason string
+	switch {
+	case b.quotas.GrabsPerDay > 0 && usage.GrabsToday >= int64(b.quotas.GrabsPerDay):
+		reason = fmt.Sprintf("You've reached your limit of %d downloads a day.", b.quotas.GrabsPerDay)
+	case b.quotas.BytesPerDay > 0 && usage.BytesToday+nzbInfo.Size > b.quotas.BytesPerDay:
+		reason = fmt.Sprintf("That release is %s, more than the %s you have left today.",
+			formatSize(nzbInfo.Size), formatSize(max(0, b.quotas.BytesPerDay-usage.BytesToday)))
+	case b.quotas.BytesPerWeek > 0 && usage.BytesWeek+nzbInfo.Size > b.quotas.BytesPerWeek:
+		reason = fmt.Sprintf("That release is %s, more than the %s you have left this week.",
+			formatSize(nzbInfo.Size), formatSize(max(0, b.quotas.BytesPerWeek-usage.BytesWeek)))
+	default:
+		return nil
+	}
+	return &quotaError{reason + "\n\n" + b.describeQuota(usage)}
+}
+
+// recordGrab charges a queued download to its grabber, and forgets grabs too
+// old to count against any limit.
+func (b *Bot) recordGrab(by grabber, nzbInfo db.NzbInfo) {
+	if by.UserID == 0 {
+		return
+	}
+	ctx := context.Background()
+	now := b.clock.Now()
+	err := b.store.InsertGrab(ctx, db.InsertGrabParams{
+		UserID:    by.UserID,
+		NzbID:     nzbInfo.ID,
+		Size:      nzbInfo.Size,
+		GrabbedAt: now.Unix(),
+	})
+	if err != nil {
+		slog.Error("Error recording grab", "user_id", by.UserID, "nzb_id", nzbInfo.ID, "err", err)
+	}
+	if err := b.store.DeleteGrabsBefore(ctx, now.Add(-quotaWeek).Unix()); err != nil {
+		slog.Error("Error removing old grabs", "err", err)
+	}
+}
+
+// describeQuota lists a user's usage against each per-user limit.
+func (b *Bot) describeQuota(usage quotaUsage) string {
+	var lines []string
+	if b.quotas.GrabsPerDay > 0 {
+		lines = append(lines, fmt.Sprintf("Downloads in the last 24 hours: %d of %d", usage.GrabsToday, b.quotas.GrabsPerDay))
+	}
+	if b.quotas.BytesPerDay > 0 {
+		lines = append(lines, fmt.Sprintf("Data in the last 24 hours: %s of %s", formatSize(usage.BytesToday), formatSize(b.quotas.BytesPerDay)))
+	}
+	if b.quotas.BytesPerWeek > 0 {
+		lines = append(lines, fmt.Sprintf("Data in the last 7 days: %s of %s", formatSize(usage.BytesWeek), formatSize(b.quotas.BytesPerWeek)))
+	}
+	if len(lines) == 0 {
+		return "There are no download limits."
+	}
+	if !usage.LiftedUntil.IsZero() {
+		lines = append(lines, "Limits lifted by an admin until "+usage.LiftedUntil.Format("Jan 2 15:04 MST"))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// remainingQuota describes what a user has left, or returns "" when there are
+// no per-user limits.
+func (b *Bot) remainingQuota(userID int64) string {
+	if !b.quotas.perUser() {
+		return ""
+	}
+	usage, err := b.quotaUsage(userID)
+	if err != nil {
+		slog.Error("Error checking quota", "user_id", userID, "err", err)
+		return ""
+	}
+	if !usage.LiftedUntil.IsZero() {
+		return "Your download limits are lifted until " + usage.LiftedUntil.Format("Jan 2 15:04 MST") + "."
+	}
+
+	var parts []string
+	if b.quotas.GrabsPerDay > 0 {
+		parts = append(parts, fmt.Sprintf("%d downloads today", max(0, int64(b.quotas.GrabsPerDay)-usage.GrabsToday)))
+	}
+	if b.quotas.BytesPerDay > 0 {
+		parts = append(parts, formatSize(max(0, b.quotas.BytesPerDay-usage.BytesToday))+" today")
+	}
+	if b.quotas.BytesPerWeek > 0 {
+		parts = append(parts, formatSize(max(0, b.quotas.BytesPerWeek-usage.BytesWeek))+" this week")
+	}
+	return "Remaining: " + strings.Join(parts, ", ")
+}
+
+// handleQuotaCommand shows users their download limits. Admins can look at
+// anyone's with "/quota USER_ID", lift them with "/quota USER_ID lift
+// [DURATION]" (24h by default) and end that with "/quota USER_ID restore".
+func (b *Bot) handleQuotaCommand(message *tgbotapi.Message) {
+	args := strings.Fields(message.CommandArguments())
+	userID := message.From.ID
+	if len(args) > 0 {
+		if !isAdmin(message.From, message.Chat.ID) {
+			b.sendErrorMessage(message.Chat.ID, "Only admins can see or change other users' limits.")
+			return
+		}
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			b.sendErrorMessage(message.Chat.ID, "Usage: /quota USER_ID [lift [DURATION]|restore]")
+			return
+		}
+		userID = id
+	}
+
+	if len(args) > 1 {
+		b.overrideQuota(message.Chat.ID, userID, args[1:])
+		return
+	}
+
+	usage, err := b.quotaUsage(userID)
+	if err != nil {
+		slog.Error("Error checking quota", "user_id", userID, "err", err)
+		b.sendErrorMessage(message.Chat.ID, "Failed to look up the download limits.")
+		return
+	}
+	text := b.describeQuota(usage)
+	if b.quotas.MaxActive > 0 {
+		text += fmt.Sprintf("\nAt most %d downloads run at once.", b.quotas.MaxActive)
+	}
+	b.sender.Send(tgbotapi.NewMessage(message.Chat.ID, text))
+}
+
+// overrideQuota lifts or restores userID's limits for an admin.
+func (b *Bot) overrideQuota(chatID, userID int64, args []string) {
+	ctx := context.Background()
+	switch args[0] {
+	case "lift":
+		duration := quotaOverrideDefault
+		if len(args) > 1 {
+			d, err := time.ParseDuration(args[1])
+			if err != nil || d <= 0 {
+				b.sendErrorMessage(chatID, "Give the duration like 12h or 90m.")
+				return
+			}
+			duration = d
+		}
+		until := b.clock.Now().Add(duration)
+		err := b.store.UpsertQuotaOverride(ctx, db.UpsertQuotaOverrideParams{UserID: userID, ExpiresAt: until.Unix()})
+		if err != nil {
+			slog.Error("Error lifting quota", "user_id", userID, "err", err)
+			b.sendErrorMessage(chatID, "Failed to lift the limits.")
+			return
+		}
+		slog.Info("Lifted download limits", "user_id", userID, "until", until)
+		b.sender.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Download limits lifted for %d until %s.", userID, until.Format("Jan 2 15:04 MST"))))
+	case "restore":
+		if err := b.store.DeleteQuotaOverride(ctx, userID); err != nil {
+			slog.Error("Error restoring quota", "user_id", userID, "err", err)
+			b.sendErrorMessage(chatID, "Failed to restore the limits.")
+			return
+		}
+		slog.Info("Restored download limits", "user_id", userID)
+		b.sender.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Download limits apply to %d again.", userID)))
+	default:
+		b.sendErrorMessage(chatID, "Usage: /quota USER_ID [lift [DURATION]|restore]")
+	}
+}
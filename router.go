@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dx314/movie_beacon_bot/callbackdata"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Request is a single update being routed, along with the name of the route that
+// matched it so middleware can log and count by route.
+type Request struct {
+	Update tgbotapi.Update
+	Route  string
+	// Log carries the update, chat and user IDs so a request's log lines can be
+	// correlated.
+	Log *slog.Logger
+}
+
+// User returns the Telegram user that sent the update, if any.
+func (r *Request) User() *tgbotapi.User {
+	return r.Update.SentFrom()
+}
+
+// ChatID returns the chat the update belongs to, or 0 if there is none.
+func (r *Request) ChatID() int64 {
+	if chat := r.Update.FromChat(); chat != nil {
+		return chat.ID
+	}
+	return 0
+}
+
+type HandlerFunc func(req *Request)
+
+type Middleware func(next HandlerFunc) HandlerFunc
+
+type commandRoute struct {
+	name        string
+	description string
+	handler     func(message *tgbotapi.Message)
+}
+
+type callbackRoute struct {
+	name    string
+	handler func(query *tgbotapi.CallbackQuery, action callbackdata.Action)
+}
+
+// Router maps commands, button actions and free text input to handlers,
+// running every update through the registered middleware chain.
+type Router struct {
+	sender     Sender
+	commands   map[string]commandRoute
+	callbacks  map[string]callbackRoute
+	input      func(message *tgbotapi.Message)
+	middleware []Middleware
+}
+
+func NewRouter(sender Sender) *Router {
+	r := &Router{
+		sender:    sender,
+		commands:  make(map[string]commandRoute),
+		callbacks: make(map[string]callbackRoute),
+	}
+	r.Command("help", "Show available commands", r.handleHelp)
+	return r
+}
+
+// Use appends middleware to the chain. The first middleware added is the outermost.
+func (r *Router) Use(mw ...Middleware) {
+	r.middleware = append(r.middleware, mw...)
+}
+
+// Command registers a handler for /name. Commands with an empty description are
+// handled but left out of /help and the Telegram command menu.
+func (r *Router) Command(name, description string, handler func(message *tgbotapi.Message)) {
+	r.commands[name] = commandRoute{name: name, description: description, handler: handler}
+}
+
+// Callback registers a handler for button presses carrying an action of the given
+// callbackdata kind.
+func (r *Router) Callback(kind, name string, handler func(query *tgbotapi.CallbackQuery, action callbackdata.Action)) {
+	r.callbacks[kind] = callbackRoute{name: name, handler: handler}
+}
+
+// Input registers the handler for plain text messages that are not commands.
+func (r *Router) Input(handler func(message *tgbotapi.Message)) {
+	r.input = handler
+}
+
+// Dispatch routes an update to its handler through the middleware chain.
+func (r *Router) Dispatch(update tgbotapi.Update) {
+	route, handler := r.match(update)
+	if handler == nil {
+		return
+	}
+
+	h := handler
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+	req := &Request{Update: update, Route: route}
+	req.Log = slog.With("update_id", update.UpdateID, "route", route, "chat_id", req.ChatID())
+	if user := req.User(); user != nil {
+		req.Log = req.Log.With("user_id", user.ID)
+	}
+	h(req)
+}
+
+func (r *Router) match(update tgbotapi.Update) (string, HandlerFunc) {
+	switch {
+	case update.Message != nil && update.Message.IsCommand():
+		message := update.Message
+		cmd, ok := r.commands[message.Command()]
+		if !ok {
+			return "unknown", func(*Request) { r.handleUnknown(message) }
+		}
+		return "/" + cmd.name, func(*Request) { cmd.handler(message) }
+	case update.Message != nil:
+		if r.input == nil {
+			return "", nil
+		}
+		message := update.Message
+		return "input", func(*Request) { r.input(message) }
+	case update.CallbackQuery != nil:
+		query := update.CallbackQuery
+		action, err := callbackdata.Decode(query.Data)
+		if err != nil {
+			return "callback:invalid", func(*Request) { r.handleInvalidCallback(query, err) }
+		}
+		cb, ok := r.callbacks[action.Kind()]
+		if !ok {
+			return "callback:invalid", func(*Request) { r.handleInvalidCallback(query, callbackdata.ErrUnknownKind) }
+		}
+		return "callback:" + cb.name, func(*Request) { cb.handler(query, action) }
+	}
+	return "", nil
+}
+
+// visibleCommands returns the commands shown to users, sorted by name.
+func (r *Router) visibleCommands() []commandRoute {
+	var cmds []commandRoute
+	for _, cmd := range r.commands {
+		if cmd.description != "" {
+			cmds = append(cmds, cmd)
+		}
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].name < cmds[j].name })
+	return cmds
+}
+
+// HelpText renders the list of visible commands.
+func (r *Router) HelpText() string {
+	var sb strings.Builder
+	sb.WriteString("Available commands:\n\n")
+	for _, cmd := range r.visibleCommands() {
+		sb.WriteString(fmt.Sprintf("/%s - %s\n", cmd.name, cmd.description))
+	}
+	return sb.String()
+}
+
+// SyncCommands publishes the visible commands to Telegram so the command menu
+// matches what the router handles.
+func (r *Router) SyncCommands() error {
+	var botCommands []tgbotapi.BotCommand
+	for _, cmd := range r.visibleCommands() {
+		botCommands = append(botCommands, tgbotapi.BotCommand{Command: cmd.name, Description: cmd.description})
+	}
+	_, err := r.sender.Request(tgbotapi.NewSetMyCommands(botCommands...))
+	return err
+}
+
+func (r *Router) handleHelp(message *tgbotapi.Message) {
+	r.sender.Send(tgbotapi.NewMessage(message.Chat.ID, r.HelpText()))
+}
+
+func (r *Router) handleUnknown(message *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "I don't know that command. Use /help to see what I can do.")
+	r.sender.Send(msg)
+}
+
+// handleInvalidCallback answers presses on buttons whose data can't be decoded,
+// usually because they were sent by an older version of the bot.
+func (r *Router) handleInvalidCallback(query *tgbotapi.CallbackQuery, err error) {
+	slog.Warn("Rejecting callback data", "data", query.Data, "err", err)
+	r.sender.Request(tgbotapi.NewCallback(query.ID, "This button has expired."))
+	if query.Message != nil {
+		r.sender.Send(tgbotapi.NewMessage(query.Message.Chat.ID, "That menu has expired. Please start a new search."))
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// sabnzbdClient talks to the SABnzbd API.
+type sabnzbdClient struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+func newSABnzbdClient(baseURL, apiKey string, httpClient *http.Client) *sabnzbdClient {
+	return &sabnzbdClient{baseURL: baseURL, apiKey: apiKey, http: httpClient}
+}
+
+// Version returns the SABnzbd version, confirming the API is reachable.
+func (c *sabnzbdClient) Version(ctx context.Context) (string, error) {
+	apiURL := fmt.Sprintf("%s/api?output=json&apikey=%s&mode=version", c.baseURL, c.apiKey)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get SABnzbd version: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad status from SABnzbd API: %s", resp.Status)
+	}
+
+	var result struct {
+		Version string `json:"version"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode SABnzbd response: %v", err)
+	}
+	if result.Version == "" {
+		return "", fmt.Errorf("SABnzbd returned no version: %s", result.Error)
+	}
+	return result.Version, nil
+}
+
+// Progress reports the status of a download, checking the queue first and then
+// the history.
+func (c *sabnzbdClient) Progress(nzbID string) (string, string, error) {
+	if nzbID == "" {
+		return "Unknown", "", errors.New("NZB ID not provided")
+	}
+	apiURL := fmt.Sprintf("%s/api?output=json&apikey=%s&mode=queue&nzo_ids=%s", c.baseURL, c.apiKey, nzbID)
+
+	resp, err := c.http.Get(apiURL)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get SABnzbd queue: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("bad status from SABnzbd API: %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	var result struct {
+		Queue struct {
+			Slots []struct {
+				Status          string `json:"status"`
+				Filename        string `json:"filename"`
+				PercentComplete string `json:"percentage"`
+				SizeMB          string `json:"mb"`
+				SizeLeft        string `json:"mbleft"`
+			} `json:"slots"`
+		} `json:"queue"`
+	}
+
+	if err := json.Unmarshal(body, &result); err != nil {
+		slog.Debug("Undecodable SABnzbd response", "body", string(body))
+		return "", "", fmt.Errorf("failed to decode SABnzbd response: %v", err)
+	}
+
+	for _, slot := range result.Queue.Slots {
+		if slot.Status == "Downloading" || slot.Status == "Queued" {
+			totalSize, _ := strconv.ParseFloat(slot.SizeMB, 64)
+			sizeLeft, _ := strconv.ParseFloat(slot.SizeLeft, 64)
+			downloaded := totalSize - sizeLeft
+			percentage, _ := strconv.ParseFloat(strings.TrimRight(slot.PercentComplete, "%"), 64)
+
+			progress := fmt.Sprintf("Progress: %.2f MB / %.2f MB (%.1f%%)", downloaded, totalSize, percentage)
+			return slot.Status, progress, nil
+		}
+	}
+
+	// If not found in queue, check history
+	status, progress, err := c.checkHistory(nzbID)
+	if err != nil {
+		return "", "", err
+	}
+
+	// If not found in history either, it might have been deleted
+	if status == "Unknown" {
+		return "Deleted", "Download has been removed from queue", nil
+	}
+
+	return status, progress, nil
+}
+
+// AddURL queues an NZB by URL and returns its nzo_id.
+func (c *sabnzbdClient) AddURL(nzbURL, category string) (string, error) {
+	apiURL := fmt.Sprintf("%s/api?output=json&apikey=%s&mode=addurl&name=%s&cat=%s",
+		c.baseURL, c.apiKey, url.QueryEscape(nzbURL), url.QueryEscape(category))
+
+	slog.Info("Adding NZB to SABnzbd", "category", category, "url", apiURL)
+
+	resp, err := c.http.Get(apiURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to add NZB to SABnzbd: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad status from SABnzbd API: %s", resp.Status)
+	}
+
+	var result struct {
+		Status bool     `json:"status"`
+		NzoIDs []string `json:"nzo_ids"`
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	if err := json.Unmarshal(body, &result); err != nil {
+		slog.Debug("Undecodable SABnzbd response", "body", string(body))
+		return "", fmt.Errorf("failed to decode SABnzbd response: %v", err)
+	}
+
+	if !result.Status || len(result.NzoIDs) == 0 {
+		return "", fmt.Errorf("SABnzbd failed to add NZB")
+	}
+
+	return result.NzoIDs[0], nil
+}
+
+// Delete removes a download from the queue along with its files.
+func (c *sabnzbdClient) Delete(nzbID string) error {
+	apiURL := fmt.Sprintf("%s/api?output=json&apikey=%s&mode=queue&name=delete&del_files=1&value=%s",
+		c.baseURL, c.apiKey, url.QueryEscape(nzbID))
+
+	resp, err := c.http.Get(apiURL)
+	if err != nil {
+		return fmt.Errorf("failed to delete SABnzbd download: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status from SABnzbd API: %s", resp.Status)
+	}
+
+	var result struct {
+		Status bool   `json:"status"`
+		Error  string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode SABnzbd response: %v", err)
+	}
+	if !result.Status {
+		return fmt.Errorf("SABnzbd failed to delete download: %s", result.Error)
+	}
+	return nil
+}
+
+// FreeSpace returns the free space on SABnzbd's download and complete folders,
+// whichever has less, minus what is still to be downloaded for the queue.
+func (c *sabnzbdClient) FreeSpace() (int64, error) {
+	apiURL := fmt.Sprintf("%s/api?output=json&apikey=%s&mode=queue&limit=1", c.baseURL, c.apiKey)
+
+	resp, err := c.http.Get(apiURL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get SABnzbd queue: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("bad status from SABnzbd API: %s", resp.Status)
+	}
+
+	var result struct {
+		Queue struct {
+			DiskSpace1 string `json:"diskspace1"` // GB free in the download folder
+			DiskSpace2 string `json:"diskspace2"` // GB free in the complete folder
+			SizeLeft   string `json:"mbleft"`
+		} `json:"queue"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("failed to decode SABnzbd response: %v", err)
+	}
+	if result.Error != "" {
+		return 0, fmt.Errorf("SABnzbd error: %s", result.Error)
+	}
+
+	download, err1 := strconv.ParseFloat(result.Queue.DiskSpace1, 64)
+	complete, err2 := strconv.ParseFloat(result.Queue.DiskSpace2, 64)
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("SABnzbd reported no disk space: %q, %q", result.Queue.DiskSpace1, result.Queue.DiskSpace2)
+	}
+	left, _ := strconv.ParseFloat(result.Queue.SizeLeft, 64)
+	return int64(min(download, complete)*(1<<30) - left*(1<<20)), nil
+}
+
+// fetchHistory returns SABnzbd's history entries for a download.
+func (c *sabnzbdClient) fetchHistory(nzbID string) (SabNZBResponse, error) {
+	var result SabNZBResponse
+	apiURL := fmt.Sprintf("%s/api?output=json&apikey=%s&mode=history&nzo_ids=%s", c.baseURL, c.apiKey, nzbID)
+
+	resp, err := c.http.Get(apiURL)
+	if err != nil {
+		return result, fmt.Errorf("failed to get SABnzbd history: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("bad status from SABnzbd API: %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return result, fmt.Errorf("failed to read SABnzbd response: %v", err)
+	}
+
+	if err := json.Unmarshal(body, &result); err != nil {
+		slog.Debug("Undecodable SABnzbd response", "body", string(body))
+		return result, fmt.Errorf("failed to unmarshal SABnzbd response: %v", err)
+	}
+	return result, nil
+}
+
+// StoragePath returns where SABnzbd put a completed download.
+func (c *sabnzbdClient) StoragePath(nzbID string) (string, error) {
+	result, err := c.fetchHistory(nzbID)
+	if err != nil {
+		return "", err
+	}
+	for _, slot := range result.History.Slots {
+		if slot.NzoID == nzbID && slot.Status == "Completed" {
+			return slot.Storage, nil
+		}
+	}
+	return "", fmt.Errorf("download %s has not completed", nzbID)
+}
+
+func (c *sabnzbdClient) checkHistory(nzbID string) (string, string, error) {
+	result, err := c.fetchHistory(nzbID)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, slot := range result.History.Slots {
+		if slot.NzoID == nzbID {
+			if slot.Status == "Completed" {
+				totalTime, err := calculateTotalTime(slot.DownloadTime, slot.PostprocTime)
+				if err != nil {
+					slog.Error("Error calculating total time", "err", err)
+					return "Completed", "100% (Total time: Unknown)", nil
+				}
+				sizeInMB := float64(int64(slot.Completed)) / 1024 / 1024
+				progress := fmt.Sprintf("Progress: %.2f MB / %.2f MB (100%%)\nTotal time: %d seconds\nStorage: %s",
+					sizeInMB, sizeInMB, totalTime, slot.Storage)
+				return "Completed", progress, nil
+			}
+			return slot.Status, "100%", nil
+		}
+	}
+
+	return "Unknown", "Unknown", nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dx314/movie_beacon_bot/db"
+)
+
+// maxResults is how many releases are offered at once, one per button emoji.
+const maxResults = 9
+
+// sizeBounds is the range of MB per minute of runtime a release is expected to
+// be in. Zero leaves that side open.
+type sizeBounds struct {
+	Min, Max float64
+}
+
+// defaultSizeBounds are loose enough for small encodes and remuxes alike, and
+// still catch 40 MB "movies" and mislabelled season packs.
+var defaultSizeBounds = map[string]sizeBounds{
+	"2160p": {Min: 20, Max: 1000},
+	"1080p": {Min: 5, Max: 400},
+	"720p":  {Min: 3, Max: 150},
+	"sd":    {Min: 1, Max: 60},
+	"other": {Min: 1, Max: 1000}, // No resolution in the name
+}
+
+// sizeFilter rejects releases whose size doesn't make sense for their runtime
+// and resolution.
+type sizeFilter struct {
+	// bounds is keyed by resolution, or by "category/resolution" to override
+	// it for one category
+	bounds map[string]sizeBounds
+}
+
+// loadSizeFilter reads SIZE_FILTER_<RESOLUTION> and
+// SIZE_FILTER_<CATEGORY>_<RESOLUTION>, e.g. SIZE_FILTER_KIDS_MOVIES_1080P=2-200,
+// in MB per minute. Either side of the range can be left empty. It returns nil
+// when SIZE_FILTER is "off".
+func loadSizeFilter() (*sizeFilter, error) {
+	if os.Getenv("SIZE_FILTER") == "off" {
+		return nil, nil
+	}
+	f := &sizeFilter{bounds: make(map[string]sizeBounds)}
+	for resolution, bounds := range defaultSizeBounds {
+		f.bounds[resolution] = bounds
+		name := "SIZE_FILTER_" + strings.ToUpper(resolution)
+		if err := f.parse(name, resolution); err != nil {
+			return nil, err
+		}
+		for category := range nzbGeekCategories {
+			name := "SIZE_FILTER_" + strings.ToUpper(category) + "_" + strings.ToUpper(resolution)
+			if err := f.parse(name, category+"/"+resolution); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return f, nil
+}
+
+func (f *sizeFilter) parse(name, key string) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	lo, hi, ok := strings.Cut(v, "-")
+	var bounds sizeBounds
+	var err1, err2 error
+	if lo = strings.TrimSpace(lo); lo != "" {
+		bounds.Min, err1 = strconv.ParseFloat(lo, 64)
+	}
+	if hi = strings.TrimSpace(hi); hi != "" {
+		bounds.Max, err2 = strconv.ParseFloat(hi, 64)
+	}
+	if !ok || err1 != nil || err2 != nil || bounds.Max != 0 && bounds.Max < bounds.Min {
+		return fmt.Errorf("invalid %s %q, expected MIN-MAX in MB per minute", name, v)
+	}
+	f.bounds[key] = bounds
+	return nil
+}
+
+// sizeResolution groups the resolution parsed from a release name.
+func sizeResolution(resolution string) string {
+	switch resolution {
+	case "4k", "uhd", "2160p":
+		return "2160p"
+	case "1080p", "720p":
+		return resolution
+	case "":
+		return "other"
+	default:
+		return "sd"
+	}
+}
+
+// check returns why item is filtered out, or "" if it looks fine. runtime is in
+// minutes, per episode for series. Releases of unknown size or runtime, and
+// season packs, pass.
+func (f *sizeFilter) check(category string, item Item, runtime int) string {
+	size := item.Size()
+	if size <= 0 || runtime <= 0 {
+		return ""
+	}
+	if isSeriesCategory(category) && !episodeRegex.MatchString(item.Title) {
+		return ""
+	}
+
+	resolution := sizeResolution(parseMovieTitle(item.Title).Resolution)
+	bounds, ok := f.bounds[category+"/"+resolution]
+	if !ok {
+		bounds = f.bounds[resolution]
+	}
+	rate := float64(size) / (1 << 20) / float64(runtime)
+	label := resolution
+	if resolution == "other" {
+		label = "an unknown resolution"
+	}
+	switch {
+	case bounds.Min > 0 && rate < bounds.Min:
+		return fmt.Sprintf("%s for %d min is %.1f MB/min, too small for %s (at least %g)",
+			formatSize(size), runtime, rate, label, bounds.Min)
+	case bounds.Max > 0 && rate > bounds.Max:
+		return fmt.Sprintf("%s for %d min is %.1f MB/min, too big for %s (at most %g)",
+			formatSize(size), runtime, rate, label, bounds.Max)
+	}
+	return ""
+}
+
+// FilteredItem is a release left out of the results, and why.
+type FilteredItem struct {
+	Item
+	Reason string
+}
+
+// filterReleases drops passworded releases and releases whose size doesn't fit
+// the title's runtime, skips repeats of a release, and cuts the rest down to
+// maxResults. Repeats aren't counted in Filtered or FilteredCount: the first
+// copy is already shown or filtered.
+func (b *Bot) filterReleases(result SearchResult, imdbID, category string) SearchResult {
+	var runtime int
+	if b.sizes != nil && len(result.Items) > 0 {
+		runtime = b.runtime(imdbID)
+	}
+
+	seen := make(map[string]bool)
+	var kept []Item
+	for _, item := range result.Items {
+		if id := item.ID(); id != "" {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		}
+
+		var reason string
+		switch {
+		case item.Newznab.Passworded:
+			reason = "passworded"
+		case b.sizes != nil:
+			reason = b.sizes.check(category, item, runtime)
+		}
+		if reason != "" {
+			slog.Debug("Filtered out release", "title", item.Title, "reason", reason)
+			result.Filtered = append(result.Filtered, FilteredItem{Item: item, Reason: reason})
+			continue
+		}
+		kept = append(kept, item)
+	}
+	result.Items = kept
+
+	result.FilteredCount = len(result.Filtered)
+	result.RemainingCount = len(result.Items)
+	if len(result.Items) > maxResults {
+		result.Items = result.Items[:maxResults]
+	}
+	observeShown(result)
+	return result
+}
+
+// runtime returns a title's runtime in minutes from OMDB, or 0 if it isn't
+// known.
+func (b *Bot) runtime(imdbID string) int {
+	if imdbID == "" {
+		return 0
+	}
+	details, err := b.metadata.Details(imdbID)
+	if err != nil {
+		slog.Warn("Error looking up runtime", "imdb_id", imdbID, "err", err)
+		return 0
+	}
+	minutes, _ := strconv.Atoi(strings.TrimSuffix(details.Runtime, " min"))
+	return minutes
+}
+
+// filteredView is what the "Show filtered" button on a results note shows.
+type filteredView struct {
+	msgData   db.MsgDatum
+	items     []FilteredItem
+	expiresAt time.Time
+}
+
+// filteredViews holds the filtered releases of recent searches, keyed by the
+// note that offers them. They are kept in memory, so the buttons stop working
+// after a restart.
+type filteredViews struct {
+	sync.Mutex
+	views map[filteredKey]filteredView
+}
+
+type filteredKey struct {
+	chatID    int64
+	messageID int
+}
+
+func (v *filteredViews) put(chatID int64, messageID int, view filteredView) {
+	v.Lock()
+	defer v.Unlock()
+	for key, old := range v.views {
+		if view.expiresAt.After(old.expiresAt.Add(conversationTTL)) {
+			delete(v.views, key)
+		}
+	}
+	v.views[filteredKey{chatID, messageID}] = view
+}
+
+// take returns and forgets the view offered by a message.
+func (v *filteredViews) take(chatID int64, messageID int, now time.Time) (filteredView, bool) {
+	v.Lock()
+	defer v.Unlock()
+	key := filteredKey{chatID, messageID}
+	view, ok := v.views[key]
+	delete(v.views, key)
+	return view, ok && now.Before(view.expiresAt)
+}
@@ -5,8 +5,8 @@ WHERE id = ?
 LIMIT 1;
 
 -- name: UpsertNZBInfo :exec
-INSERT INTO nzb_info (id, url, name, category, sabnzbd_id, chat_id, message_id, status, last_updated, selected)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+INSERT INTO nzb_info (id, url, name, category, sabnzbd_id, chat_id, message_id, status, last_updated, selected, imdb_id, size, guid, search_id)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 ON CONFLICT(id)
     DO UPDATE
     SET url          = excluded.url,
@@ -17,7 +17,11 @@ ON CONFLICT(id)
         message_id   = excluded.message_id,
         status       = excluded.status,
         last_updated = excluded.last_updated,
-        selected     = excluded.selected;
+        selected     = excluded.selected,
+        imdb_id      = excluded.imdb_id,
+        size         = excluded.size,
+        guid         = excluded.guid,
+        search_id    = excluded.search_id;
 
 -- name: GetMessageData :one
 SELECT * FROM msg_data
@@ -28,7 +32,7 @@ DELETE FROM msg_data
 WHERE message_id = ?;
 
 -- name: InsertMessageData :one
-INSERT INTO msg_data (message_id, user_id, category, year, search) VALUES (?, ?, ?, ?, ?) RETURNING *;
+INSERT INTO msg_data (message_id, user_id, category, year, search, imdb_id) VALUES (?, ?, ?, ?, ?, ?) RETURNING *;
 
 -- name: DeleteNZBInfo :exec
 DELETE
@@ -39,10 +43,211 @@ WHERE id = ?;
 SELECT *
 FROM nzb_info
 WHERE selected = TRUE
-  AND status NOT IN ('Completed', 'Failed');
+  AND status NOT IN ('Completed', 'Failed', 'Cancelled');
+
+-- name: GetGrabbedRelease :one
+SELECT *
+FROM nzb_info
+WHERE guid = ?
+  AND selected = TRUE
+ORDER BY last_updated DESC
+LIMIT 1;
+
+-- name: SetNZBPath :exec
+UPDATE nzb_info
+SET path = ?
+WHERE id = ?;
+
+-- name: GetCompletedDownloads :many
+SELECT *
+FROM nzb_info
+WHERE chat_id = ?
+  AND status = 'Completed'
+ORDER BY last_updated DESC
+LIMIT ?;
+
+-- name: ListDownloads :many
+SELECT *
+FROM nzb_info
+WHERE selected = TRUE
+ORDER BY last_updated DESC
+LIMIT ?;
+
+-- name: ListChatDownloads :many
+SELECT *
+FROM nzb_info
+WHERE chat_id = ?
+  AND selected = TRUE
+ORDER BY last_updated DESC
+LIMIT ?;
+
+-- name: ClaimRelease :execrows
+UPDATE nzb_info
+SET selected = TRUE
+WHERE id = ?
+  AND selected = FALSE;
 
 -- name: DeleteUnselectedOptions :exec
 DELETE
 FROM nzb_info
 WHERE chat_id = ?
+  AND search_id = ?
   AND selected = FALSE;
+
+-- name: GetConversation :one
+SELECT *
+FROM conversation
+WHERE user_id = ?
+LIMIT 1;
+
+-- name: UpsertConversation :exec
+INSERT INTO conversation (user_id, chat_id, state, category, name, year, message_id, expires_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(user_id)
+    DO UPDATE
+    SET chat_id    = excluded.chat_id,
+        state      = excluded.state,
+        category   = excluded.category,
+        name       = excluded.name,
+        year       = excluded.year,
+        message_id = excluded.message_id,
+        expires_at = excluded.expires_at;
+
+-- name: DeleteConversation :exec
+DELETE
+FROM conversation
+WHERE user_id = ?;
+
+-- name: DeleteExpiredConversations :exec
+DELETE
+FROM conversation
+WHERE expires_at < ?;
+
+-- name: InsertAPIKey :exec
+INSERT INTO api_key (key_hash, user_id, scopes, created_at)
+VALUES (?, ?, ?, ?);
+
+-- name: GetAPIKey :one
+SELECT *
+FROM api_key
+WHERE key_hash = ?
+LIMIT 1;
+
+-- name: TouchAPIKey :exec
+UPDATE api_key
+SET last_used = ?
+WHERE key_hash = ?;
+
+-- name: DeleteUserAPIKeys :exec
+DELETE
+FROM api_key
+WHERE user_id = ?;
+
+-- name: InsertWebhookDelivery :exec
+INSERT INTO webhook_delivery (webhook, event, payload, next_attempt, created_at)
+VALUES (?, ?, ?, ?, ?);
+
+-- name: GetDueWebhookDeliveries :many
+SELECT *
+FROM webhook_delivery
+WHERE next_attempt <= ?
+ORDER BY id
+LIMIT ?;
+
+-- name: RescheduleWebhookDelivery :exec
+UPDATE webhook_delivery
+SET attempts     = ?,
+    next_attempt = ?,
+    last_error   = ?
+WHERE id = ?;
+
+-- name: DeleteWebhookDelivery :exec
+DELETE
+FROM webhook_delivery
+WHERE id = ?;
+
+-- name: UpsertPlatformRef :one
+INSERT INTO platform_ref (platform, kind, external_id)
+VALUES (?, ?, ?)
+ON CONFLICT(platform, kind, external_id)
+    DO UPDATE
+    SET external_id = excluded.external_id
+RETURNING id;
+
+-- name: GetPlatformRef :one
+SELECT *
+FROM platform_ref
+WHERE id = ?
+LIMIT 1;
+
+-- name: GetUserLink :one
+SELECT linked_to
+FROM user_link
+WHERE user_id = ?
+LIMIT 1;
+
+-- name: UpsertUserLink :exec
+INSERT INTO user_link (user_id, linked_to)
+VALUES (?, ?)
+ON CONFLICT(user_id)
+    DO UPDATE
+    SET linked_to = excluded.linked_to;
+
+-- name: DeleteUserLink :exec
+DELETE
+FROM user_link
+WHERE user_id = ?;
+
+-- name: InsertGrab :exec
+INSERT INTO grab (user_id, nzb_id, size, grabbed_at)
+VALUES (?, ?, ?, ?);
+
+-- name: GetGrabUsage :one
+SELECT COUNT(*)                               AS grabs,
+       CAST(COALESCE(SUM(size), 0) AS INTEGER) AS bytes
+FROM grab
+WHERE user_id = ?
+  AND grabbed_at >= ?;
+
+-- name: DeleteGrabsBefore :exec
+DELETE
+FROM grab
+WHERE grabbed_at < ?;
+
+-- name: GetQuotaOverride :one
+SELECT expires_at
+FROM quota_override
+WHERE user_id = ?
+LIMIT 1;
+
+-- name: UpsertQuotaOverride :exec
+INSERT INTO quota_override (user_id, expires_at)
+VALUES (?, ?)
+ON CONFLICT(user_id)
+    DO UPDATE
+    SET expires_at = excluded.expires_at;
+
+-- name: DeleteQuotaOverride :exec
+DELETE
+FROM quota_override
+WHERE user_id = ?;
+
+-- name: IncrementIndexerUsage :exec
+INSERT INTO indexer_usage (indexer, day, hits, grabs)
+VALUES (?, ?, ?, ?)
+ON CONFLICT(indexer, day)
+    DO UPDATE
+    SET hits  = hits + excluded.hits,
+        grabs = grabs + excluded.grabs;
+
+-- name: GetIndexerUsage :one
+SELECT *
+FROM indexer_usage
+WHERE indexer = ?
+  AND day = ?
+LIMIT 1;
+
+-- name: DeleteIndexerUsageBefore :exec
+DELETE
+FROM indexer_usage
+WHERE day < ?;
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dx314/movie_beacon_bot/callbackdata"
+	"github.com/dx314/movie_beacon_bot/db"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const openSubtitlesBaseURL = "https://api.opensubtitles.com/api/v1"
+
+// languageCodes maps ISO 639-2 codes and English names to the two letter codes
+// subtitle providers use.
+var languageCodes = map[string]string{
+	"eng": "en", "english": "en",
+	"spa": "es", "spanish": "es",
+	"fre": "fr", "fra": "fr", "french": "fr",
+	"ger": "de", "deu": "de", "german": "de",
+	"ita": "it", "italian": "it",
+	"por": "pt", "portuguese": "pt",
+	"dut": "nl", "nld": "nl", "dutch": "nl",
+	"swe": "sv", "swedish": "sv",
+	"nor": "no", "nob": "no", "norwegian": "no",
+	"dan": "da", "danish": "da",
+	"fin": "fi", "finnish": "fi",
+	"pol": "pl", "polish": "pl",
+	"rus": "ru", "russian": "ru",
+	"jpn": "ja", "japanese": "ja",
+	"chi": "zh", "zho": "zh", "chinese": "zh",
+	"kor": "ko", "korean": "ko",
+	"ara": "ar", "arabic": "ar",
+	"heb": "he", "hebrew": "he",
+	"gre": "el", "ell": "el", "greek": "el",
+	"tur": "tr", "turkish": "tr",
+}
+
+// isoLanguages is every ISO 639-1 code.
+var isoLanguages = func() map[string]bool {
+	codes := make(map[string]bool)
+	for _, code := range strings.Fields(`
+		aa ab ae af ak am an ar as av ay az ba be bg bi bm bn bo br bs ca ce ch co cr cs cu cv cy
+		da de dv dz ee el en eo es et eu fa ff fi fj fo fr fy ga gd gl gn gu gv ha he hi ho hr ht
+		hu hy hz ia id ie ig ii ik io is it iu ja jv ka kg ki kj kk kl km kn ko kr ks ku kv kw ky
+		la lb lg li ln lo lt lu lv mg mh mi mk ml mn mr ms mt my na nb nd ne ng nl nn no nr nv ny
+		oc oj om or os pa pi pl ps pt qu rm rn ro ru rw sa sc sd se sg si sk sl sm sn so sq sr ss
+		st su sv sw ta te tg th ti tk tl tn to tr ts tt tw ty ug uk ur uz ve vi vo wa wo xh yi yo
+		za zh zu`) {
+		codes[code] = true
+	}
+	return codes
+}()
+
+// subtitleFlags are tags in subtitle file names that aren't languages, even
+// where they look like one: hearing impaired ("hi" is also Hindi), SDH, closed
+// captions and forced.
+var subtitleFlags = map[string]bool{"hi": true, "sdh": true, "cc": true, "forced": true}
+
+// normalizeLanguage returns the two letter code for a language code or name, or
+// "" if it isn't recognised.
+func normalizeLanguage(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if isoLanguages[code] {
+		return code
+	}
+	return languageCodes[code]
+}
+
+// subtitleFetcher finds missing subtitles through an OpenSubtitles-style REST API.
+type subtitleFetcher struct {
+	baseURL   string
+	apiKey    string
+	token     string
+	languages []string
+	http      *http.Client
+}
+
+// loadSubtitleFetcher returns a fetcher when SUBTITLE_LANGUAGES is set.
+func loadSubtitleFetcher(httpClient *http.Client) (*subtitleFetcher, error) {
+	var languages []string
+	for _, lang := range strings.Split(os.Getenv("SUBTITLE_LANGUAGES"), ",") {
+		if lang = strings.TrimSpace(lang); lang == "" {
+			continue
+		}
+		code := normalizeLanguage(lang)
+		if code == "" {
+			return nil, fmt.Errorf("unknown subtitle language %q", lang)
+		}
+		languages = append(languages, code)
+	}
+	if len(languages) == 0 {
+		return nil, nil
+	}
+
+	f := &subtitleFetcher{
+		baseURL:   strings.TrimRight(os.Getenv("SUBTITLES_API_URL"), "/"),
+		apiKey:    os.Getenv("SUBTITLES_API_KEY"),
+		token:     os.Getenv("SUBTITLES_API_TOKEN"),
+		languages: languages,
+		http:      httpClient,
+	}
+	if f.baseURL == "" {
+		f.baseURL = openSubtitlesBaseURL
+	}
+	if f.apiKey == "" {
+		return nil, errors.New("SUBTITLES_API_KEY must be set when SUBTITLE_LANGUAGES is set")
+	}
+	return f, nil
+}
+
+// movieHash is the OpenSubtitles hash: the file size plus the little-endian
+// uint64 words of its first and last 64 KiB.
+func movieHash(path string) (string, error) {
+	const chunkSize = 64 * 1024
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+	if size < chunkSize {
+		return "", errors.New("file too small to hash")
+	}
+
+	hash := uint64(size)
+	buf := make([]byte, chunkSize)
+	for _, offset := range []int64{0, size - chunkSize} {
+		if _, err := f.ReadAt(buf, offset); err != nil {
+			return "", err
+		}
+		for i := 0; i < chunkSize; i += 8 {
+			hash += binary.LittleEndian.Uint64(buf[i:])
+		}
+	}
+	return fmt.Sprintf("%016x", hash), nil
+}
+
+// existingSubtitles returns the languages a video already has, either as
+// subtitle files beside it (e.g. "Movie.en.srt") or as embedded streams.
+func existingSubtitles(video string) map[string]string {
+	have := make(map[string]string) // Language -> "bundled" or "embedded"
+
+	base := strings.TrimSuffix(filepath.Base(video), filepath.Ext(video))
+	entries, _ := os.ReadDir(filepath.Dir(video))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !subtitleExtensions[strings.ToLower(filepath.Ext(name))] || !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		tags := strings.Split(strings.TrimSuffix(name[len(base)+1:], filepath.Ext(name)), ".")
+		for _, tag := range tags {
+			if subtitleFlags[strings.ToLower(tag)] {
+				continue
+			}
+			if lang := normalizeLanguage(tag); lang != "" {
+				have[lang] = "bundled"
+			}
+		}
+	}
+
+	for _, lang := range embeddedSubtitles(video) {
+		if _, ok := have[lang]; !ok {
+			have[lang] = "embedded"
+		}
+	}
+	return have
+}
+
+// embeddedSubtitles lists the subtitle stream languages in a video using
+// ffprobe, if it is installed.
+func embeddedSubtitles(video string) []string {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		return nil
+	}
+	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "s",
+		"-show_entries", "stream_tags=language", "-of", "csv=p=0", video).Output()
+	if err != nil {
+		slog.Warn("Error probing for subtitles", "path", video, "err", err)
+		return nil
+	}
+
+	var languages []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if lang := normalizeLanguage(line); lang != "" {
+			languages = append(languages, lang)
+		}
+	}
+	return languages
+}
+
+func (f *subtitleFetcher) request(method, path string, body interface{}, v interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, f.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Api-Key", f.apiKey)
+	req.Header.Set("User-Agent", "MovieBeaconBot v1")
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach subtitle provider: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status from subtitle provider: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode subtitle provider response: %v", err)
+	}
+	return nil
+}
+
+type subtitleSearchResponse struct {
+	Data []struct {
+		Attributes struct {
+			Language       string `json:"language"`
+			DownloadCount  int    `json:"download_count"`
+			MoviehashMatch bool   `json:"moviehash_match"`
+			Files          []struct {
+				FileID int `json:"file_id"`
+			} `json:"files"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+// search finds the best subtitle file for a video in lang, preferring ones made
+// for this exact file. It returns 0 if there is none.
+func (f *subtitleFetcher) search(video, imdbID, lang string, series bool) (int, error) {
+	params := url.Values{"languages": {lang}}
+	id := strings.TrimLeft(strings.TrimPrefix(imdbID, "tt"), "0")
+	if series {
+		info := parseReleaseName(filepath.Base(video))
+		if info.Episode == 0 {
+			return 0, nil
+		}
+		params.Set("parent_imdb_id", id)
+		params.Set("season_number", strconv.Itoa(info.Season))
+		params.Set("episode_number", strconv.Itoa(info.Episode))
+	} else {
+		params.Set("imdb_id", id)
+	}
+	if hash, err := movieHash(video); err == nil {
+		params.Set("moviehash", hash)
+	}
+
+	var result subtitleSearchResponse
+	if err := f.request(http.MethodGet, "/subtitles?"+params.Encode(), nil, &result); err != nil {
+		return 0, err
+	}
+
+	candidates := result.Data[:0]
+	for _, d := range result.Data {
+		if normalizeLanguage(d.Attributes.Language) == lang && len(d.Attributes.Files) > 0 {
+			candidates = append(candidates, d)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i].Attributes, candidates[j].Attributes
+		if a.MoviehashMatch != b.MoviehashMatch {
+			return a.MoviehashMatch
+		}
+		return a.DownloadCount > b.DownloadCount
+	})
+	return candidates[0].Attributes.Files[0].FileID, nil
+}
+
+// download saves subtitle file fileID as dst.
+func (f *subtitleFetcher) download(fileID int, dst string) error {
+	var link struct {
+		Link string `json:"link"`
+	}
+	body := map[string]interface{}{"file_id": fileID, "sub_format": "srt"}
+	if err := f.request(http.MethodPost, "/download", body, &link); err != nil {
+		return err
+	}
+
+	resp, err := f.http.Get(link.Link)
+	if err != nil {
+		return fmt.Errorf("failed to download subtitle: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status downloading subtitle: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read subtitle: %v", err)
+	}
+	return os.WriteFile(dst, data, 0o644)
+}
+
+// subtitleResult counts what happened to each configured language across the
+// videos in a download.
+type subtitleResult struct {
+	present    map[string]int
+	downloaded map[string]int
+	missing    map[string]int
+}
+
+// Fetch makes sure every video has subtitles in the configured languages,
+// downloading those that are missing.
+func (f *subtitleFetcher) Fetch(videos []string, imdbID string, series bool) subtitleResult {
+	result := subtitleResult{
+		present:    make(map[string]int),
+		downloaded: make(map[string]int),
+		missing:    make(map[string]int),
+	}
+
+	for _, video := range videos {
+		have := existingSubtitles(video)
+		for _, lang := range f.languages {
+			if _, ok := have[lang]; ok {
+				result.present[lang]++
+				continue
+			}
+			if imdbID == "" {
+				result.missing[lang]++
+				continue
+			}
+
+			fileID, err := f.search(video, imdbID, lang, series)
+			if err != nil {
+				slog.Error("Error searching subtitles", "language", lang, "path", video, "err", err)
+			}
+			if fileID == 0 {
+				result.missing[lang]++
+				continue
+			}
+
+			dst := strings.TrimSuffix(video, filepath.Ext(video)) + "." + lang + ".srt"
+			if err := f.download(fileID, dst); err != nil {
+				slog.Error("Error downloading subtitles", "language", lang, "path", video, "err", err)
+				result.missing[lang]++
+				continue
+			}
+			result.downloaded[lang]++
+		}
+	}
+	return result
+}
+
+// Summary describes the result in one line per language, e.g. "en: downloaded".
+// Counts are shown when the download has several videos.
+func (r subtitleResult) Summary(languages []string, videos int) string {
+	var lines []string
+	for _, lang := range languages {
+		var parts []string
+		for _, c := range []struct {
+			label string
+			n     int
+		}{{"already there", r.present[lang]}, {"downloaded", r.downloaded[lang]}, {"not found", r.missing[lang]}} {
+			switch {
+			case c.n == 0:
+			case videos == 1:
+				parts = append(parts, c.label)
+			default:
+				parts = append(parts, fmt.Sprintf("%d %s", c.n, c.label))
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", lang, strings.Join(parts, ", ")))
+	}
+	return "Subtitles:\n" + strings.Join(lines, "\n")
+}
+
+// fetchSubtitles gets missing subtitles for a completed download at path and
+// returns a summary for the user.
+func (b *Bot) fetchSubtitles(nzbInfo db.NzbInfo, path string) string {
+	series := isSeriesCategory(nzbInfo.Category)
+
+	videos := []string{path}
+	if info, err := os.Stat(path); err != nil {
+		return fmt.Sprintf("Subtitles: couldn't read %s", path)
+	} else if info.IsDir() {
+		files, err := findMediaFiles(path, series)
+		if err != nil {
+			return fmt.Sprintf("Subtitles: %v", err)
+		}
+		videos = videos[:0]
+		for _, file := range files {
+			videos = append(videos, file.path)
+		}
+	}
+
+	result := b.subtitles.Fetch(videos, nzbInfo.ImdbID, series)
+	return result.Summary(b.subtitles.languages, len(videos))
+}
+
+// downloadPath returns where a completed download is, asking SABnzbd for
+// downloads finished before paths were recorded.
+func (b *Bot) downloadPath(nzbInfo db.NzbInfo) (string, error) {
+	if nzbInfo.Path != "" {
+		return nzbInfo.Path, nil
+	}
+	return b.downloads.StoragePath(nzbInfo.SabnzbdID)
+}
+
+// handleSubsCommand lists recent downloads to fetch subtitles for.
+func (b *Bot) handleSubsCommand(message *tgbotapi.Message) {
+	downloads, err := b.store.GetCompletedDownloads(context.Background(), db.GetCompletedDownloadsParams{
+		ChatID: message.Chat.ID,
+		Limit:  10,
+	})
+	if err != nil {
+		slog.Error("Error getting completed downloads", "err", err)
+		b.sendErrorMessage(message.Chat.ID, "Failed to load your downloads.")
+		return
+	}
+	if len(downloads) == 0 {
+		b.sender.Send(tgbotapi.NewMessage(message.Chat.ID, "There are no completed downloads yet."))
+		return
+	}
+
+	var buttons [][]tgbotapi.InlineKeyboardButton
+	for _, d := range downloads {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardRow(
+			actionButton(d.Name, callbackdata.FetchSubtitles{ID: d.ID}),
+		))
+	}
+	buttons = append(buttons, tgbotapi.NewInlineKeyboardRow(actionButton("❌ Cancel", callbackdata.Cancel{})))
+
+	if _, err := b.sendWithButtons(message.Chat.ID, "Fetch subtitles for which download?", buttons); err != nil {
+		slog.Error("Error sending subtitle menu", "err", err)
+	}
+}
+
+// handleSubsCallback fetches subtitles for the download picked from /subs.
+func (b *Bot) handleSubsCallback(query *tgbotapi.CallbackQuery, action callbackdata.Action) {
+	defer b.finishCallback(query)
+
+	nzbInfo, err := b.getNZBInfo(action.(callbackdata.FetchSubtitles).ID)
+	if err != nil {
+		slog.Error("Error retrieving NZB info", "err", err)
+		b.sendErrorMessage(query.Message.Chat.ID, "That download is no longer known.")
+		return
+	}
+
+	b.sender.Request(tgbotapi.NewCallback(query.ID, "Looking for subtitles..."))
+
+	// Hashing, probing and the providers are slow, so look in the background and
+	// fill the answer in when done, like completed downloads
+	chatID := query.Message.Chat.ID
+	msg, err := b.sender.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("%s\nLooking for subtitles...", nzbInfo.Name)))
+	if err != nil {
+		slog.Error("Error sending subtitle status message", "chat_id", chatID, "err", err)
+		return
+	}
+	b.goSafe("subtitles", func() {
+		text := fmt.Sprintf("Couldn't find the files for %s.", nzbInfo.Name)
+		if path, err := b.downloadPath(nzbInfo); err != nil {
+			slog.Error("Error finding download", "release", nzbInfo.Name, "err", err)
+		} else {
+			text = fmt.Sprintf("%s\n%s", nzbInfo.Name, b.fetchSubtitles(nzbInfo, path))
+		}
+		if err := b.editMessage(chatID, msg.MessageID, text); err != nil {
+			slog.Error("Error editing message", "chat_id", chatID, "message_id", msg.MessageID, "err", err)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeLanguage(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"en", "en"},
+		{"EN", "en"},
+		{" pt ", "pt"},
+		{"hi", "hi"},
+		{"eng", "en"},
+		{"ger", "de"},
+		{"deu", "de"},
+		{"French", "fr"},
+		{"xx", ""},
+		{"zz", ""},
+		{"cc", ""},
+		{"sdh", ""},
+		{"forced", ""},
+		{"720p", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := normalizeLanguage(tt.in); got != tt.want {
+				t.Errorf("normalizeLanguage(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExistingSubtitles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  map[string]string
+	}{
+		{"language", []string{"Movie.en.srt"}, map[string]string{"en": "bundled"}},
+		{"ISO 639-2 code", []string{"Movie.ger.srt"}, map[string]string{"de": "bundled"}},
+		{"hearing impaired", []string{"Movie.en.hi.srt"}, map[string]string{"en": "bundled"}},
+		{"flags", []string{"Movie.es.sdh.srt", "Movie.fr.cc.ass", "Movie.de.forced.srt"},
+			map[string]string{"es": "bundled", "fr": "bundled", "de": "bundled"}},
+		{"flag alone", []string{"Movie.hi.srt", "Movie.forced.srt"}, map[string]string{}},
+		{"not a language", []string{"Movie.xx.srt", "Movie.srt"}, map[string]string{}},
+		{"other video", []string{"Other.en.srt"}, map[string]string{}},
+		{"not a subtitle", []string{"Movie.en.nfo"}, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range append(tt.files, "Movie.mkv") {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := existingSubtitles(filepath.Join(dir, "Movie.mkv")); !maps.Equal(got, tt.want) {
+				t.Errorf("existingSubtitles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,52 +2,63 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/dx314/movie_beacon_bot/callbackdata"
 	"github.com/dx314/movie_beacon_bot/db"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	"github.com/google/uuid"
 	"html"
-	"io/ioutil"
-	"log"
-	"net/http"
+	"log/slog"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-var messageCache = make(map[int]string)
-
 // editMessage edits a message with the given text
-func editMessage(chatID int64, messageID int, text string) error {
-	s, _ := messageCache[messageID]
+func (b *Bot) editMessage(chatID int64, messageID int, text string) error {
+	b.messageCacheMutex.Lock()
+	s := b.messageCache[messageID]
+	b.messageCache[messageID] = text
+	b.messageCacheMutex.Unlock()
 	if s == text {
 		return nil
 	}
 
-	messageCache[messageID] = text
-
-	fmt.Printf("editMessage: %v, %v, %v\n", chatID, messageID, text)
 	msg := tgbotapi.NewEditMessageText(chatID, messageID, text)
-	_, err := bot.Send(msg)
+	_, err := b.sender.Send(msg)
 	if err != nil {
-		log.Printf("Error editing message: %v", err)
+		slog.Error("Error editing message", "err", err)
 	}
 	return err
 }
 
-// sendErrorMessage sends an error message to the user
-func sendResultsAsButtons(chatID int64, msgData *db.MsgDatum, items []Item) {
+// editMessageWithLink edits a message and attaches a single URL button to it.
+func (b *Bot) editMessageWithLink(chatID int64, messageID int, text, label, link string) error {
+	b.messageCacheMutex.Lock()
+	b.messageCache[messageID] = text
+	b.messageCacheMutex.Unlock()
+
+	markup := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL(label, link)),
+	)
+	_, err := b.sender.Send(tgbotapi.NewEditMessageTextAndMarkup(chatID, messageID, text, markup))
+	return err
+}
+
+// sendResultsAsButtons offers the NZB results under heading and returns the ID
+// of the sent message, or 0 if nothing was offered. reasons, if given, says why
+// each item was filtered out.
+func (b *Bot) sendResultsAsButtons(chatID int64, msgData *db.MsgDatum, heading string, items []Item, reasons []string) int {
 	if len(items) == 0 {
 		msg := tgbotapi.NewMessage(chatID, "No results found.")
-		bot.Send(msg)
-		return
+		b.sender.Send(msg)
+		return 0
 	}
 
 	var buttons [][]tgbotapi.InlineKeyboardButton
 	var messageText strings.Builder
-	messageText.WriteString("Search Results:\n\n")
+	messageText.WriteString(heading + "\n\n")
 
 	distinctEmojis := []string{"🍎", "🍌", "🍒", "🍊", "🍋", "🥝", "🍍", "🥭", "🍉"}
 
@@ -61,13 +72,12 @@ func sendResultsAsButtons(chatID int64, msgData *db.MsgDatum, items []Item) {
 
 	for i := 0; i < numResults; i++ {
 		item := items[i]
-		size, _ := strconv.ParseInt(item.Enclosure.Length, 10, 64)
-		age := calculateAge(item.PubDate)
+		size := item.Size()
+		age := calculateAge(item.Posted())
 
-		nzbUUID := uuid.New().String()
 		titleInfo := parseMovieTitle(item.Title)
 
-		itemText := fmt.Sprintf("%s <b>%s</b>\n   <b>Year:</b> %s   <b>Size:</b> %s\n   <b>Resolution:</b> %s<b>   Release:</b> %s\n   <b>Age:</b> %s\n\n",
+		itemText := fmt.Sprintf("%s <b>%s</b>\n   <b>Year:</b> %s   <b>Size:</b> %s\n   <b>Resolution:</b> %s<b>   Release:</b> %s\n   <b>Age:</b> %s",
 			distinctEmojis[i],
 			html.EscapeString(titleInfo.Title),
 			html.EscapeString(titleInfo.Year),
@@ -75,25 +85,26 @@ func sendResultsAsButtons(chatID int64, msgData *db.MsgDatum, items []Item) {
 			html.EscapeString(titleInfo.Resolution),
 			html.EscapeString(titleInfo.LastTag),
 			html.EscapeString(age))
-
-		messageText.WriteString(itemText)
-
-		nzbInfo := db.NzbInfo{
-			Url:         item.Enclosure.URL,
-			Name:        fmt.Sprintf("%s (%s)", titleInfo.Title, titleInfo.Year),
-			ChatID:      chatID,
-			Status:      "Pending",
-			LastUpdated: time.Now().Unix(),
-			Selected:    0, // Initialize as not selected
-			Category:    msgData.Category,
+		if item.Newznab.Grabs >= 0 {
+			itemText += fmt.Sprintf("   <b>Grabs:</b> %d", item.Newznab.Grabs)
+		}
+		itemText += "\n"
+		if grabbed, ok := b.grabbedBefore(item); ok {
+			itemText += fmt.Sprintf("   <b>Grabbed before:</b> %s\n", html.EscapeString(grabbed))
 		}
+		if i < len(reasons) {
+			itemText += fmt.Sprintf("   <b>Filtered:</b> %s\n", html.EscapeString(reasons[i]))
+		}
+
+		messageText.WriteString(itemText + "\n")
 
-		if err := storeNZBInfo(nzbUUID, nzbInfo); err != nil {
-			log.Printf("Error storing NZB info: %v", err)
+		nzbInfo, err := b.storeRelease(chatID, "", msgData.Category, msgData.ImdbID, item)
+		if err != nil {
+			slog.Error("Error storing NZB info", "err", err)
 			continue
 		}
 
-		button := tgbotapi.NewInlineKeyboardButtonData(distinctEmojis[i], nzbUUID)
+		button := actionButton(distinctEmojis[i], callbackdata.PickRelease{ID: nzbInfo.ID})
 		currentRow = append(currentRow, button)
 
 		// Create a new row after every 3 buttons, or for the last button
@@ -104,7 +115,7 @@ func sendResultsAsButtons(chatID int64, msgData *db.MsgDatum, items []Item) {
 	}
 
 	// Add the cancel button as the 10th button
-	cancelButton := tgbotapi.NewInlineKeyboardButtonData("❌ Cancel", "cancel")
+	cancelButton := actionButton("❌ Cancel", callbackdata.Cancel{})
 	if len(currentRow) > 0 {
 		currentRow = append(currentRow, cancelButton)
 		buttons = append(buttons, currentRow)
@@ -116,327 +127,422 @@ func sendResultsAsButtons(chatID int64, msgData *db.MsgDatum, items []Item) {
 	msg.ParseMode = "HTML"
 
 	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(buttons...)
-	sentMsg, err := bot.Send(msg)
+	sentMsg, err := b.sender.Send(msg)
 
 	if err != nil {
-		log.Printf("Error sending message with buttons: %v", err)
+		slog.Error("Error sending message with buttons", "err", err)
+		return 0
 	}
 
-	if _, err := queries.InsertMessageData(context.Background(), db.InsertMessageDataParams{
+	if _, err := b.store.InsertMessageData(context.Background(), db.InsertMessageDataParams{
 		MessageID: sentMsg.MessageID,
 		UserID:    sentMsg.From.ID,
 		Category:  msgData.Category,
 		Year:      msgData.Year,
 		Search:    msgData.Search,
+		ImdbID:    msgData.ImdbID,
 	}); err != nil {
-		log.Printf("Error inserting message data: %v", err)
+		slog.Error("Error inserting message data", "err", err)
 	}
+	return sentMsg.MessageID
 }
 
-// handleCallbackQuery handles the callback query when a user selects an option
-func handleCallbackQuery(query *tgbotapi.CallbackQuery) {
-	// Defer the deletion of the message data
-	defer func(msgID int) {
-		err := queries.DeleteMessageData(context.Background(), msgID)
-		if err != nil {
-			log.Printf("Error deleting message data for msg %d: %v", query.Message.MessageID, err)
+// grabbedBefore describes the last download of the same release, found by its
+// indexer GUID.
+func (b *Bot) grabbedBefore(item Item) (string, bool) {
+	guid := item.ID()
+	if guid == "" {
+		return "", false
+	}
+	info, err := b.store.GetGrabbedRelease(context.Background(), guid)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Error looking up earlier grab", "guid", guid, "err", err)
 		}
+		return "", false
+	}
+	return fmt.Sprintf("%s on %s", info.Status, time.Unix(info.LastUpdated, 0).Format("Jan 2, 2006")), true
+}
 
-		// Delete the OMDB results message
-		deleteMsg := tgbotapi.NewDeleteMessage(query.Message.Chat.ID, query.Message.MessageID)
-		if _, err := bot.Request(deleteMsg); err != nil {
-			log.Printf("Error deleting OMDB results message: %v", err)
-		}
-	}(query.Message.MessageID)
+// actionButton creates an inline button carrying an encoded action. Actions that
+// can't be encoded fall back to cancelling the menu.
+func actionButton(text string, action callbackdata.Action) tgbotapi.InlineKeyboardButton {
+	data, err := callbackdata.Encode(action)
+	if err != nil {
+		slog.Error("Error encoding callback data", "button", text, "err", err)
+		data, _ = callbackdata.Encode(callbackdata.Cancel{})
+	}
+	return tgbotapi.NewInlineKeyboardButtonData(text, data)
+}
 
-	if strings.HasPrefix(query.Data, "tvimdb:") {
-		parts := strings.Split(strings.TrimPrefix(query.Data, "tvimdb:"), ":")
-		imdbID := parts[0]
-		season := "S" + strAddLeadingZero(parts[1])
+// finishCallback deletes the message the buttons were attached to along with its
+// stored search data.
+func (b *Bot) finishCallback(query *tgbotapi.CallbackQuery) {
+	err := b.store.DeleteMessageData(context.Background(), query.Message.MessageID)
+	if err != nil {
+		slog.Error("Error deleting message data", "message_id", query.Message.MessageID, "err", err)
+	}
 
-		msgData, err := queries.GetMessageData(context.Background(), query.Message.MessageID)
-		if err != nil {
-			fmt.Printf("no row found for message id %d\n", query.Message.MessageID)
-			panic(err)
-		}
-		if msgData.Category == "" {
-			panic("Category not set in message data")
-		}
+	deleteMsg := tgbotapi.NewDeleteMessage(query.Message.Chat.ID, query.Message.MessageID)
+	if _, err := b.sender.Request(deleteMsg); err != nil {
+		slog.Error("Error deleting results message", "err", err)
+	}
+}
 
-		callback := tgbotapi.NewCallback(query.ID, "Searching for NZBs...")
-		if _, err := bot.Request(callback); err != nil {
-			log.Printf("Error answering callback query: %v", err)
-		}
+// getCallbackMessageData loads the search data stored for the message a button was
+// pressed on. The row is gone if the button was already used or the menu is stale,
+// in which case the user is told to search again.
+func (b *Bot) getCallbackMessageData(query *tgbotapi.CallbackQuery) (db.MsgDatum, error) {
+	msgData, err := b.store.GetMessageData(context.Background(), query.Message.MessageID)
+	if err == nil && msgData.Category == "" {
+		err = errors.New("category not set in message data")
+	}
+	if err != nil {
+		slog.Warn("Error loading message data", "message_id", query.Message.MessageID, "err", err)
+		b.sender.Request(tgbotapi.NewCallback(query.ID, "This menu has expired."))
+		b.sendErrorMessage(query.Message.Chat.ID, "That menu has expired. Please start a new search.")
+		return db.MsgDatum{}, err
+	}
+	return msgData, nil
+}
 
-		searchResult, err := searchNZBGeek(msgData.Search+"."+season+".", "", msgData.Category)
+// sendSearchResults sends the NZB results along with a note about filtered items,
+// returning the ID of the results message.
+func (b *Bot) sendSearchResults(chatID int64, msgData *db.MsgDatum, searchResult SearchResult) int {
+	messageID := b.sendResultsAsButtons(chatID, msgData, "Search Results:", searchResult.Items, nil)
+	if searchResult.FilteredCount > 0 {
+		infoMsg := fmt.Sprintf("Found %d results. %d were filtered out, showing %d relevant results.",
+			searchResult.TotalFound, searchResult.FilteredCount, len(searchResult.Items))
+		buttons := [][]tgbotapi.InlineKeyboardButton{{actionButton("🔍 Show filtered", callbackdata.ShowFiltered{})}}
+		note, err := b.sendWithButtons(chatID, infoMsg, buttons)
 		if err != nil {
-			errorMsg := fmt.Sprintf("Error searching NZBGeek: %v", err)
-			log.Println(errorMsg)
-			msg := tgbotapi.NewMessage(query.Message.Chat.ID, errorMsg)
-			bot.Send(msg)
-			return
-		}
-
-		if searchResult.RemainingCount == 0 {
-			if searchResult.TotalFound == 0 {
-				msg := tgbotapi.NewMessage(query.Message.Chat.ID, fmt.Sprintf("No results found for: %s (%s)", msgData.Search, imdbID))
-				bot.Send(msg)
-			} else {
-				sendResultsAsButtons(query.Message.Chat.ID, &msgData, searchResult.Items)
-				if searchResult.FilteredCount > 0 {
-					infoMsg := fmt.Sprintf("Found %d results. %d were filtered out, showing %d relevant results.",
-						searchResult.TotalFound, searchResult.FilteredCount, len(searchResult.Items))
-					bot.Send(tgbotapi.NewMessage(query.Message.Chat.ID, infoMsg))
-				}
-			}
+			slog.Error("Error sending filtered results note", "err", err)
 		} else {
-			sendResultsAsButtons(query.Message.Chat.ID, &msgData, searchResult.Items)
-			if searchResult.FilteredCount > 0 {
-				infoMsg := fmt.Sprintf("Found %d results. %d were filtered out, showing %d relevant results.",
-					searchResult.TotalFound, searchResult.FilteredCount, len(searchResult.Items))
-				bot.Send(tgbotapi.NewMessage(query.Message.Chat.ID, infoMsg))
-			}
+			b.filtered.put(chatID, note.MessageID, filteredView{
+				msgData:   *msgData,
+				items:     searchResult.Filtered,
+				expiresAt: b.clock.Now().Add(conversationTTL),
+			})
 		}
+	}
+	return messageID
+}
+
+// handleShowFilteredCallback lists the releases a search left out and why, so
+// they can be picked anyway.
+func (b *Bot) handleShowFilteredCallback(query *tgbotapi.CallbackQuery, action callbackdata.Action) {
+	view, ok := b.filtered.take(query.Message.Chat.ID, query.Message.MessageID, b.clock.Now())
+	if !ok {
+		b.sender.Request(tgbotapi.NewCallback(query.ID, "This menu has expired."))
 		return
 	}
+	defer b.finishCallback(query)
+	b.sender.Request(tgbotapi.NewCallback(query.ID, ""))
 
-	if strings.HasPrefix(query.Data, "imdb:") {
-		imdbID := strings.TrimPrefix(query.Data, "imdb:")
-		msgData, err := queries.GetMessageData(context.Background(), query.Message.MessageID)
-		if err != nil {
-			fmt.Printf("no row found for message id %d\n", query.Message.MessageID)
-			panic(err)
-		}
-		if msgData.Category == "" {
-			panic("Category not set in message data")
-		}
+	var items []Item
+	var reasons []string
+	for _, filtered := range view.items[:min(len(view.items), maxResults)] {
+		items = append(items, filtered.Item)
+		reasons = append(reasons, filtered.Reason)
+	}
+	b.sendResultsAsButtons(query.Message.Chat.ID, &view.msgData, "Filtered out:", items, reasons)
+}
 
-		callback := tgbotapi.NewCallback(query.ID, "Searching for NZBs...")
-		if _, err := bot.Request(callback); err != nil {
-			log.Printf("Error answering callback query: %v", err)
-		}
+// handleTVSeasonCallback searches for a season after the user picks it from the list
+func (b *Bot) handleTVSeasonCallback(query *tgbotapi.CallbackQuery, action callbackdata.Action) {
+	defer b.finishCallback(query)
 
-		searchResult, err := lookupNZBGeek(imdbID, msgData.Category)
-		if err != nil {
-			errorMsg := fmt.Sprintf("Error looking up on NZBGeek: %v", err)
-			log.Println(errorMsg)
-			msg := tgbotapi.NewMessage(query.Message.Chat.ID, errorMsg)
-			bot.Send(msg)
-			return
-		}
+	pick := action.(callbackdata.PickSeason)
+	imdbID := pick.ImdbID
 
-		if searchResult.TotalFound == 0 {
-			log.Println("Searching NZBGeek as fallback...")
-			searchResult, err = searchNZBGeek(msgData.Search, msgData.Year, msgData.Category)
-			if err != nil {
-				errorMsg := fmt.Sprintf("Error searching NZBGeek: %v", err)
-				log.Println(errorMsg)
-				msg := tgbotapi.NewMessage(query.Message.Chat.ID, errorMsg)
-				bot.Send(msg)
-				return
-			}
-		}
+	msgData, err := b.getCallbackMessageData(query)
+	if err != nil {
+		return
+	}
 
-		if searchResult.RemainingCount == 0 {
-			msg := tgbotapi.NewMessage(query.Message.Chat.ID, fmt.Sprintf("No results found for IMDb ID: %s", imdbID))
-			bot.Send(msg)
-		} else {
-			sendResultsAsButtons(query.Message.Chat.ID, &msgData, searchResult.Items)
-			if searchResult.FilteredCount > 0 {
-				infoMsg := fmt.Sprintf("Found %d results. %d were filtered out, showing %d relevant results.",
-					searchResult.TotalFound, searchResult.FilteredCount, len(searchResult.Items))
-				bot.Send(tgbotapi.NewMessage(query.Message.Chat.ID, infoMsg))
-			}
-		}
+	callback := tgbotapi.NewCallback(query.ID, "Searching for NZBs...")
+	if _, err := b.sender.Request(callback); err != nil {
+		slog.Error("Error answering callback query", "err", err)
+	}
 
+	q := newReleaseQuery(imdbID, msgData.Category, msgData.Search, "")
+	q.Season = pick.Season
+	searchResult, err := b.findReleases(q)
+	if err != nil {
+		errorMsg := describeIndexerError(err)
+		slog.Error("Error searching NZBGeek", "chat_id", query.Message.Chat.ID, "err", err)
+		msg := tgbotapi.NewMessage(query.Message.Chat.ID, errorMsg)
+		b.sender.Send(msg)
 		return
 	}
 
-	if query.Data != "cancel" {
-		// Rest of the existing handleCallbackQuery function for handling NZB selection
-		nzbUUID := query.Data
-		nzbInfo, err := getNZBInfo(nzbUUID)
-		if err != nil {
-			log.Printf("Error retrieving NZB info: %v", err)
-			sendErrorMessage(query.Message.Chat.ID, "Failed to retrieve the download information.")
-			return
-		}
+	if searchResult.RemainingCount == 0 && searchResult.TotalFound == 0 {
+		msg := tgbotapi.NewMessage(query.Message.Chat.ID, fmt.Sprintf("No results found for: %s (%s)", msgData.Search, imdbID))
+		b.sender.Send(msg)
+		b.endConversation(query.From.ID)
+		return
+	}
+	messageID := b.sendSearchResults(query.Message.Chat.ID, &msgData, searchResult)
+	b.advanceConversation(query.From.ID, statePickRelease, messageID)
+}
 
-		sabnzbdID, err := addNZBToSABnzbd(nzbInfo.Url, nzbInfo.Category)
-		if err != nil {
-			log.Printf("Error adding NZB to SABnzbd: %v", err)
-			sendErrorMessage(query.Message.Chat.ID, "Failed to add the NZB to SABnzbd.")
-			return
-		}
+// handleIMDBCallback looks up NZBs after the user picks an OMDB result, first
+// checking whether the title is already in the library
+func (b *Bot) handleIMDBCallback(query *tgbotapi.CallbackQuery, action callbackdata.Action) {
+	defer b.finishCallback(query)
 
-		nzbInfo.SabnzbdID = sabnzbdID
-		nzbInfo.Status = "Queued"
-		nzbInfo.LastUpdated = time.Now().Unix()
-		nzbInfo.Selected = 1 // Mark as selected
+	imdbID := action.(callbackdata.PickTitle).ImdbID
+	msgData, err := b.getCallbackMessageData(query)
+	if err != nil {
+		return
+	}
 
-		msg := tgbotapi.NewMessage(query.Message.Chat.ID, fmt.Sprintf("NZB '%s' added to SABnzbd. Initializing...", nzbInfo.Name))
-		sentMsg, err := bot.Send(msg)
-		if err != nil {
-			log.Printf("Error sending initial status message: %v", err)
+	if b.library != nil {
+		if item, ok := b.library.lookup(imdbID); ok {
+			b.offerUpgrade(query, msgData, item)
 			return
 		}
-
-		nzbInfo.MessageID = sentMsg.MessageID
-		if err := storeNZBInfo(nzbUUID, nzbInfo); err != nil {
-			log.Printf("Error updating NZB info with SABnzbd ID: %v", err)
-		}
-
-		go monitorDownloadProgress(nzbUUID)
 	}
 
-	// Delete the results message
-	deleteMsg := tgbotapi.NewDeleteMessage(query.Message.Chat.ID, query.Message.MessageID)
-	if _, err := bot.Request(deleteMsg); err != nil {
-		log.Printf("Error deleting NZBGeek results message: %v", err)
-	}
+	b.searchReleases(query, msgData, imdbID)
+}
 
-	// Remove unselected options from the database
-	if err := queries.DeleteUnselectedOptions(context.Background(), query.Message.Chat.ID); err != nil {
-		log.Printf("Error removing unselected options: %v", err)
+// handleUpgradeCallback searches for a title the user already has, for a better copy
+func (b *Bot) handleUpgradeCallback(query *tgbotapi.CallbackQuery, action callbackdata.Action) {
+	defer b.finishCallback(query)
+
+	msgData, err := b.getCallbackMessageData(query)
+	if err != nil {
+		return
 	}
+	b.searchReleases(query, msgData, action.(callbackdata.Upgrade).ImdbID)
 }
 
-func checkSABnzbdHistory(nzbID string) (string, string, error) {
-	apiURL := fmt.Sprintf("%s/api?output=json&apikey=%s&mode=history&nzo_ids=%s", sabnzbdAPI, sabnzbdAPIKey, nzbID)
+// offerUpgrade tells the user the title is already in the library and lets them
+// search for another copy anyway.
+func (b *Bot) offerUpgrade(query *tgbotapi.CallbackQuery, msgData db.MsgDatum, item LibraryItem) {
+	b.sender.Request(tgbotapi.NewCallback(query.ID, ""))
 
-	resp, err := http.Get(apiURL)
+	text := fmt.Sprintf("%s is already in the library", item.Title)
+	if details := item.Describe(); details != "" {
+		text += fmt.Sprintf(" (%s)", details)
+	}
+	text += "."
+
+	buttons := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			actionButton("⬆️ Upgrade", callbackdata.Upgrade{ImdbID: item.ImdbID}),
+			actionButton("Cancel", callbackdata.Cancel{}),
+		),
+	}
+	msg, err := b.sendWithButtons(query.Message.Chat.ID, text, buttons)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to get SABnzbd history: %v", err)
+		slog.Error("Error sending library match", "err", err)
+		b.endConversation(query.From.ID)
+		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", "", fmt.Errorf("bad status from SABnzbd API: %s", resp.Status)
+	if _, err := b.store.InsertMessageData(context.Background(), db.InsertMessageDataParams{
+		MessageID: msg.MessageID,
+		UserID:    query.From.ID,
+		Category:  msgData.Category,
+		Search:    msgData.Search,
+		Year:      msgData.Year,
+		ImdbID:    item.ImdbID,
+	}); err != nil {
+		slog.Error("Error inserting message data", "err", err)
 	}
+	b.advanceConversation(query.From.ID, stateConfirmUpgrade, msg.MessageID)
+}
 
-	var result SabNZBResponse
+// searchReleases looks up NZBs for an IMDb ID, falling back to a text search, and
+// offers the results
+func (b *Bot) searchReleases(query *tgbotapi.CallbackQuery, msgData db.MsgDatum, imdbID string) {
+	callback := tgbotapi.NewCallback(query.ID, "Searching for NZBs...")
+	if _, err := b.sender.Request(callback); err != nil {
+		slog.Error("Error answering callback query", "err", err)
+	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	searchResult, err := b.findReleases(newReleaseQuery(imdbID, msgData.Category, msgData.Search, msgData.Year))
 	if err != nil {
-		return "", "", fmt.Errorf("failed to read SABnzbd response: %v", err)
-	}
-
-	if err := json.Unmarshal(body, &result); err != nil {
-		fmt.Println(string(body))
-		return "", "", fmt.Errorf("failed to unmarshal SABnzbd response: %v", err)
-	}
-
-	for _, slot := range result.History.Slots {
-		if slot.NzoID == nzbID {
-			if slot.Status == "Completed" {
-				totalTime, err := calculateTotalTime(slot.DownloadTime, slot.PostprocTime)
-				if err != nil {
-					log.Printf("Error calculating total time: %v", err)
-					return "Completed", "100% (Total time: Unknown)", nil
-				}
-				sizeInMB := float64(int64(slot.Completed)) / 1024 / 1024
-				progress := fmt.Sprintf("Progress: %.2f MB / %.2f MB (100%%)\nTotal time: %d seconds\nStorage: %s",
-					sizeInMB, sizeInMB, totalTime, slot.Storage)
-				return "Completed", progress, nil
-			}
-			return slot.Status, "100%", nil
-		}
+		errorMsg := describeIndexerError(err)
+		slog.Error("Error searching NZBGeek", "chat_id", query.Message.Chat.ID, "imdb_id", imdbID, "err", err)
+		msg := tgbotapi.NewMessage(query.Message.Chat.ID, errorMsg)
+		b.sender.Send(msg)
+		return
 	}
 
-	return "Unknown", "Unknown", nil
+	if searchResult.RemainingCount == 0 && searchResult.FilteredCount == 0 {
+		msg := tgbotapi.NewMessage(query.Message.Chat.ID, fmt.Sprintf("No results found for IMDb ID: %s", imdbID))
+		b.sender.Send(msg)
+		b.endConversation(query.From.ID)
+		return
+	}
+	msgData.ImdbID = imdbID
+	messageID := b.sendSearchResults(query.Message.Chat.ID, &msgData, searchResult)
+	b.advanceConversation(query.From.ID, statePickRelease, messageID)
 }
 
-var commandCategories = map[string]string{
-	"movie": "movies",
-	"km":    "kids_movies",
-	"ktv":   "kids_tv",
-	"tv":    "tv",
-}
+// handleCancelCallback removes the results message and any options left unpicked
+func (b *Bot) handleCancelCallback(query *tgbotapi.CallbackQuery, action callbackdata.Action) {
+	defer b.finishCallback(query)
 
-type UserState struct {
-	ChatID    int64
-	State     string
-	Category  string
-	CreatedAt time.Time
-}
+	b.endConversation(query.From.ID)
 
-type UserStateStore struct {
-	sync.Mutex
-	m map[int64]UserState
+	// Remove unselected options from the database
+	if err := b.store.DeleteUnselectedOptions(context.Background(), db.DeleteUnselectedOptionsParams{ChatID: query.Message.Chat.ID}); err != nil {
+		slog.Error("Error removing unselected options", "err", err)
+	}
 }
 
-func NewUserStateStore() *UserStateStore {
-	return &UserStateStore{m: make(map[int64]UserState)}
-}
+// handleNZBCallback sends the NZB the user picked to SABnzbd and starts monitoring it
+func (b *Bot) handleNZBCallback(query *tgbotapi.CallbackQuery, action callbackdata.Action) {
+	nzbUUID := action.(callbackdata.PickRelease).ID
+	if !b.claimRelease(query, nzbUUID) {
+		return
+	}
+	defer b.finishCallback(query)
 
-func (s *UserStateStore) Set(userID int64, state UserState) {
-	s.Lock()
-	defer s.Unlock()
-	s.m[userID] = state
+	b.endConversation(query.From.ID)
+	by := grabber{UserID: query.From.ID, Admin: isAdmin(query.From, query.Message.Chat.ID)}
+	b.grabRelease(query.Message.Chat.ID, nzbUUID, by)
 }
 
-func (s *UserStateStore) Get(userID int64) (UserState, bool) {
-	s.Lock()
-	defer s.Unlock()
-	state, ok := s.m[userID]
-	return state, ok
+// handleForceCallback queues a release an admin confirmed despite the lack of
+// disk space.
+func (b *Bot) handleForceCallback(query *tgbotapi.CallbackQuery, action callbackdata.Action) {
+	if !isAdmin(query.From, query.Message.Chat.ID) {
+		b.sender.Request(tgbotapi.NewCallback(query.ID, "Only admins can do that."))
+		return
+	}
+	nzbUUID := action.(callbackdata.ForceRelease).ID
+	if !b.claimRelease(query, nzbUUID) {
+		return
+	}
+	defer b.finishCallback(query)
+
+	b.grabRelease(query.Message.Chat.ID, nzbUUID, grabber{UserID: query.From.ID, Admin: true, IgnoreDiskSpace: true})
 }
 
-func (s *UserStateStore) Delete(userID int64) {
-	s.Lock()
-	defer s.Unlock()
-	delete(s.m, userID)
+// claimRelease marks a release as picked before it is queued, so pressing its
+// button twice can't queue it twice. It answers the press and returns false
+// if the release was already picked or is gone.
+func (b *Bot) claimRelease(query *tgbotapi.CallbackQuery, nzbUUID string) bool {
+	claimed, err := b.store.ClaimRelease(context.Background(), nzbUUID)
+	if err != nil {
+		slog.Error("Error claiming release", "id", nzbUUID, "err", err)
+		b.sender.Request(tgbotapi.NewCallback(query.ID, "Something went wrong. Please try again."))
+		return false
+	}
+	if claimed == 0 {
+		b.sender.Request(tgbotapi.NewCallback(query.ID, "This button has expired."))
+		return false
+	}
+	return true
 }
 
-var UserStates = NewUserStateStore()
-
-func handleCommand(message *tgbotapi.Message) {
-	cat, _ := commandCategories[message.Command()]
-	switch message.Command() {
-	case "start":
-		msg := tgbotapi.NewMessage(message.Chat.ID, "Welcome! Use /movie [movie name] [year] to search for movies.")
-		bot.Send(msg)
-	case "ktv":
-		fallthrough
-	case "tv":
-		args := message.CommandArguments()
-		if args == "" {
-			us := UserState{ChatID: message.Chat.ID, State: "input", Category: cat, CreatedAt: time.Now()}
-			UserStates.Set(message.From.ID, us)
-
-			msg := tgbotapi.NewMessage(message.Chat.ID, "Please provide the name and year.")
-			bot.Send(msg)
-			return
-		} else {
-			doTVCommand(message, cat, args)
+// grabRelease queues a stored release claimed in chatID and reports why when it
+// can't be, giving up the claim so it can be picked again.
+func (b *Bot) grabRelease(chatID int64, nzbUUID string, by grabber) {
+	nzbInfo, err := b.getNZBInfo(nzbUUID)
+	if err != nil {
+		slog.Error("Error retrieving NZB info", "err", err)
+		b.sendErrorMessage(chatID, "Failed to retrieve the download information.")
+		return
+	}
+
+	if err := b.queueDownload(nzbInfo, by); err != nil {
+		// Put the release back so it can be picked again
+		nzbInfo.Selected = 0
+		if err := b.storeNZBInfo(nzbInfo.ID, nzbInfo); err != nil {
+			slog.Error("Error releasing claim", "id", nzbInfo.ID, "err", err)
 		}
-	case "km":
-		fallthrough
-	case "movie":
-		args := message.CommandArguments()
-		if args == "" {
-			us := UserState{ChatID: message.Chat.ID, State: "input", Category: cat, CreatedAt: time.Now()}
-			UserStates.Set(message.From.ID, us)
-
-			msg := tgbotapi.NewMessage(message.Chat.ID, "Please provide the name and year.")
-			bot.Send(msg)
-			return
-		} else {
-			doMovieCommand(message, cat, args)
+		var diskErr *diskSpaceError
+		var userErr userError
+		switch {
+		case errors.As(err, &diskErr) && by.Admin:
+			b.sendWithButtons(chatID, diskErr.Error()+"\n\nDownload it anyway?", [][]tgbotapi.InlineKeyboardButton{{
+				actionButton("Download anyway", callbackdata.ForceRelease{ID: nzbUUID}),
+				actionButton("Cancel", callbackdata.Cancel{}),
+			}})
+		case errors.As(err, &userErr):
+			b.sendErrorMessage(chatID, userErr.Error())
+		default:
+			slog.Error("Error adding NZB to SABnzbd", "err", err)
+			b.sendErrorMessage(chatID, "Failed to add the NZB to SABnzbd.")
+		}
+		return
+	}
+	if !by.Admin {
+		if remaining := b.remainingQuota(by.UserID); remaining != "" {
+			b.sender.Send(tgbotapi.NewMessage(chatID, remaining))
 		}
-	default:
-		msg := tgbotapi.NewMessage(message.Chat.ID, "I don't know that command. Use /movie, /tv, /km (kids movies), or /ktv (kids TV) to search.")
-		bot.Send(msg)
 	}
+
+	// Remove unselected options from the database
+	if err := b.store.DeleteUnselectedOptions(context.Background(), db.DeleteUnselectedOptionsParams{ChatID: chatID}); err != nil {
+		slog.Error("Error removing unselected options", "err", err)
+	}
+}
+
+// newBotRouter registers every command and callback the bot understands.
+func (b *Bot) newBotRouter() *Router {
+	r := NewRouter(b.sender)
+	if b.health != nil {
+		r.Use(b.health.trackUpdates)
+	}
+	r.Use(b.recoverMiddleware, loggingMiddleware, metricsMiddleware)
+	if b.linkAccounts {
+		r.Use(b.linkMiddleware)
+	}
+	r.Use(b.authMiddleware(), b.rateLimitMiddleware())
+
+	r.Command("start", "", b.handleStart)
+	r.Command("movie", "Search for a movie: /movie [name] [year]", b.searchCommand("movies"))
+	r.Command("km", "Search for a kids movie: /km [name] [year]", b.searchCommand("kids_movies"))
+	r.Command("tv", "Search for a TV show: /tv [name] [year]", b.searchCommand("tv"))
+	r.Command("ktv", "Search for a kids TV show: /ktv [name] [year]", b.searchCommand("kids_tv"))
+	r.Command("cancel", "Cancel the current search", b.handleCancelCommand)
+	r.Command("quota", "Show your download limits", b.handleQuotaCommand)
+	if b.subtitles != nil {
+		r.Command("subs", "Fetch subtitles for a past download", b.handleSubsCommand)
+	}
+	if b.health != nil {
+		r.Command("status", "", b.handleStatusCommand)
+	}
+	if b.apiKeys {
+		r.Command("apikey", "Get a key for the JSON API", b.handleAPIKeyCommand)
+	}
+	if b.linkAccounts {
+		r.Command("link", "Link your Discord or Matrix account", b.handleLinkCommand)
+	}
+
+	r.Callback(callbackdata.KindSeason, "tv_season", b.handleTVSeasonCallback)
+	r.Callback(callbackdata.KindTitle, "imdb", b.handleIMDBCallback)
+	r.Callback(callbackdata.KindUpgrade, "upgrade", b.handleUpgradeCallback)
+	r.Callback(callbackdata.KindCancel, "cancel", b.handleCancelCallback)
+	r.Callback(callbackdata.KindSubs, "subs", b.handleSubsCallback)
+	r.Callback(callbackdata.KindRelease, "nzb", b.handleNZBCallback)
+	r.Callback(callbackdata.KindForce, "force", b.handleForceCallback)
+	r.Callback(callbackdata.KindFiltered, "show_filtered", b.handleShowFilteredCallback)
+
+	r.Input(b.handleInput)
+	return r
+}
+
+func (b *Bot) handleStart(message *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "Welcome! Use /movie [movie name] [year] to search for movies, or /help to see all commands.")
+	b.sender.Send(msg)
 }
 
-func doTVCommand(message *tgbotapi.Message, cat string, args string) {
-	name, year := parseMovieCommand(args)
-	omdbResults, err := lookupSeries(name, year)
+// doTVSearch looks the series up on OMDB and offers its seasons
+func (b *Bot) doTVSearch(conv *db.Conversation) {
+	omdbResults, err := b.metadata.LookupSeries(conv.Name, conv.Year)
 	if err != nil {
-		log.Printf("OMDB search failed: %v", err)
-		msg := tgbotapi.NewMessage(message.Chat.ID, "No results found.")
-		bot.Send(msg)
+		slog.Warn("OMDB search failed", "chat_id", conv.ChatID, "err", err)
+		msg := tgbotapi.NewMessage(conv.ChatID, "No results found.")
+		b.sender.Send(msg)
+		conv.State = ""
 		return
 	}
 
@@ -450,38 +556,57 @@ func doTVCommand(message *tgbotapi.Message, cat string, args string) {
 				ImdbID: omdbResults.ImdbID,
 			},
 		}
-		sendOMDBResultsAsButtons(message.Chat.ID, cat, name, omdbResults.Year, omdbItems)
+		conv.State = statePickTitle
+		conv.MessageID = b.sendOMDBResultsAsButtons(conv.ChatID, conv.Category, conv.Name, omdbResults.Year, omdbItems)
+		return
 	}
 	var buttons [][]tgbotapi.InlineKeyboardButton
 	for i := 0; i < totalSeasons+1; i++ {
-		s := addLeadingZero(i)
-		if s == "00" {
-			s = "00 - Specials"
+		buttonText := fmt.Sprintf("S%s", addLeadingZero(i))
+		if i == 0 {
+			buttonText += " - Specials"
 		}
-		buttonText := fmt.Sprintf("S%s", s)
-		button := tgbotapi.NewInlineKeyboardButtonData(buttonText, fmt.Sprintf("tvimdb:%s:%s", omdbResults.ImdbID, s))
+		button := actionButton(buttonText, callbackdata.PickSeason{ImdbID: omdbResults.ImdbID, Season: i})
 		buttons = append(buttons, tgbotapi.NewInlineKeyboardRow(button))
 	}
 
 	// Add the cancel button as the 10th button
-	cancelButton := tgbotapi.NewInlineKeyboardButtonData("❌ Cancel", "cancel")
+	cancelButton := actionButton("❌ Cancel", callbackdata.Cancel{})
 	buttons = append(buttons, []tgbotapi.InlineKeyboardButton{cancelButton})
 
-	msg, err := bot.SendMessageWithButtons(message.Chat.ID, omdbResults.Title, buttons)
+	// A series in the library may still be missing seasons, so rather than
+	// offering an upgrade like movies, say so above the seasons
+	text := omdbResults.Title
+	if b.library != nil {
+		if item, ok := b.library.lookup(omdbResults.ImdbID); ok {
+			text += "\n\nAlready in the library"
+			if details := item.Describe(); details != "" {
+				text += fmt.Sprintf(" (%s)", details)
+			}
+			text += ". Pick a season to add or upgrade."
+		}
+	}
+
+	msg, err := b.sendWithButtons(conv.ChatID, text, buttons)
 	if err != nil {
-		log.Printf("Error sending message with buttons: %v", err)
+		slog.Error("Error sending message with buttons", "err", err)
+		conv.State = ""
+		return
 	}
 
-	if _, err := queries.InsertMessageData(context.Background(), db.InsertMessageDataParams{
+	if _, err := b.store.InsertMessageData(context.Background(), db.InsertMessageDataParams{
 		MessageID: msg.MessageID,
 		UserID:    msg.From.ID,
-		Category:  cat,
-		Search:    args,
+		Category:  conv.Category,
+		Search:    conv.Name,
 		Year:      omdbResults.Year,
+		ImdbID:    omdbResults.ImdbID,
 	}); err != nil {
-		log.Printf("Error inserting message data: %v", err)
+		slog.Error("Error inserting message data", "err", err)
 	}
 
+	conv.State = statePickSeason
+	conv.MessageID = msg.MessageID
 }
 
 func parseTVCommand(args string) (string, string, string) {
@@ -511,74 +636,66 @@ func parseTVCommand(args string) (string, string, string) {
 	return name, season, year
 }
 
-func doMovieCommand(message *tgbotapi.Message, cat string, args string) {
-	name, year := parseMovieCommand(args)
-	if year == "" {
-		userStates[message.Chat.ID] = name
-		msg := tgbotapi.NewMessage(message.Chat.ID, fmt.Sprintf("Please provide the year for: %s", name))
-		bot.Send(msg)
-	} else {
-		omdbResults, err := searchOMDB(name, year, cat)
-		if err != nil {
-			log.Printf("OMDB search failed: %v", err)
-			var errorMsg string
-			if err.Error() == "no suitable results found, please try a more specific search" {
-				errorMsg = "No bueno. The search was too broad. Please try a more specific search with both title and year."
-			} else {
-				errorMsg = "No bueno. Couldn't find any matching results."
-			}
-			msg := tgbotapi.NewMessage(message.Chat.ID, errorMsg)
-			bot.Send(msg)
-			return
+// doMovieSearch searches OMDB for the movie and offers the matches
+func (b *Bot) doMovieSearch(conv *db.Conversation) {
+	omdbResults, err := b.metadata.SearchTitles(conv.Name, conv.Year, conv.Category)
+	if err != nil {
+		slog.Warn("OMDB search failed", "chat_id", conv.ChatID, "err", err)
+		var errorMsg string
+		if err.Error() == "no suitable results found, please try a more specific search" {
+			errorMsg = "No bueno. The search was too broad. Please try a more specific search with both title and year."
+		} else {
+			errorMsg = "No bueno. Couldn't find any matching results."
 		}
-		sendOMDBResultsAsButtons(message.Chat.ID, cat, name, year, omdbResults)
-	}
-}
-
-func handleInput(message *tgbotapi.Message) {
-	state, ok := UserStates.Get(message.From.ID)
-	if !ok {
+		msg := tgbotapi.NewMessage(conv.ChatID, errorMsg)
+		b.sender.Send(msg)
+		conv.State = ""
 		return
 	}
-	doMovieCommand(message, state.Category, message.Text)
-	UserStates.Delete(message.From.ID)
+
+	conv.State = statePickTitle
+	conv.MessageID = b.sendOMDBResultsAsButtons(conv.ChatID, conv.Category, conv.Name, conv.Year, omdbResults)
 }
 
-func sendOMDBResultsAsButtons(chatID int64, category, search, year string, items []OMDBSearchResult) {
+// sendOMDBResultsAsButtons offers the OMDB matches and returns the ID of the sent
+// message, or 0 if nothing was offered.
+func (b *Bot) sendOMDBResultsAsButtons(chatID int64, category, search, year string, items []OMDBSearchResult) int {
 	if len(items) == 0 {
 		msg := tgbotapi.NewMessage(chatID, "No results found.")
-		bot.Send(msg)
-		return
+		b.sender.Send(msg)
+		return 0
 	}
 
 	var buttons [][]tgbotapi.InlineKeyboardButton
 	for _, item := range items {
 		buttonText := fmt.Sprintf("%s (%s)", item.Title, item.Year)
-		button := tgbotapi.NewInlineKeyboardButtonData(buttonText, fmt.Sprintf("imdb:%s", item.ImdbID))
+		button := actionButton(buttonText, callbackdata.PickTitle{ImdbID: item.ImdbID})
 		buttons = append(buttons, tgbotapi.NewInlineKeyboardRow(button))
 	}
 
 	// Add the cancel button as the 10th button
-	cancelButton := tgbotapi.NewInlineKeyboardButtonData("❌ Cancel", "cancel")
+	cancelButton := actionButton("❌ Cancel", callbackdata.Cancel{})
 	buttons = append(buttons, []tgbotapi.InlineKeyboardButton{cancelButton})
 
-	msg, err := bot.SendMessageWithButtons(chatID, "IMDB Results:", buttons)
+	msg, err := b.sendWithButtons(chatID, "IMDB Results:", buttons)
 	if err != nil {
-		log.Printf("Error sending message with buttons: %v", err)
+		slog.Error("Error sending message with buttons", "err", err)
+		return 0
 	}
 
-	if _, err := queries.InsertMessageData(context.Background(), db.InsertMessageDataParams{
+	if _, err := b.store.InsertMessageData(context.Background(), db.InsertMessageDataParams{
 		MessageID: msg.MessageID,
 		UserID:    msg.From.ID,
 		Category:  category,
 		Search:    search,
 		Year:      year,
 	}); err != nil {
-		log.Printf("Error inserting message data: %v", err)
+		slog.Error("Error inserting message data", "err", err)
 	}
+	return msg.MessageID
 }
 
-func fatalf(chatID int64, format string, args ...interface{}) {
-	sendErrorMessage(chatID, "Closing down to catastrophic error: "+fmt.Sprintf(format, args...))
-	log.Fatalf(format, args...)
+func (b *Bot) fatalf(chatID int64, format string, args ...interface{}) {
+	b.sendErrorMessage(chatID, "Closing down to catastrophic error: "+fmt.Sprintf(format, args...))
+	fatal("Closing down", "err", fmt.Sprintf(format, args...))
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// webhookConfig holds the settings used when the bot receives updates via a webhook
+// instead of long polling.
+type webhookConfig struct {
+	URL      string // Public URL Telegram will POST updates to
+	Listen   string // Local address for the HTTP server
+	Secret   string // Value expected in the secret token header
+	CertFile string // Optional self-signed certificate uploaded to Telegram
+	KeyFile  string // Private key for CertFile, enables TLS on the local server
+}
+
+func loadWebhookConfig() (webhookConfig, error) {
+	cfg := webhookConfig{
+		URL:      os.Getenv("TELEGRAM_WEBHOOK_URL"),
+		Listen:   os.Getenv("TELEGRAM_WEBHOOK_LISTEN"),
+		Secret:   os.Getenv("TELEGRAM_WEBHOOK_SECRET"),
+		CertFile: os.Getenv("TELEGRAM_WEBHOOK_CERT"),
+		KeyFile:  os.Getenv("TELEGRAM_WEBHOOK_KEY"),
+	}
+	if cfg.URL == "" {
+		return cfg, errors.New("TELEGRAM_WEBHOOK_URL environment variable is not set")
+	}
+	if cfg.Listen == "" {
+		cfg.Listen = ":8443"
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return cfg, errors.New("TELEGRAM_WEBHOOK_CERT and TELEGRAM_WEBHOOK_KEY must be set together")
+	}
+	return cfg, nil
+}
+
+// webhookReceiver serves incoming Telegram updates over HTTP and feeds them into
+// the same channel type used by long polling.
+type webhookReceiver struct {
+	api     *tgbotapi.BotAPI
+	cfg     webhookConfig
+	server  *http.Server
+	updates chan tgbotapi.Update
+	errs    chan error
+	done    chan struct{} // Closed by Stop, so handlers stop sending updates
+}
+
+// startWebhook registers the webhook with Telegram and starts the HTTP server.
+func startWebhook(api *tgbotapi.BotAPI, cfg webhookConfig) (*webhookReceiver, error) {
+	hookURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook URL: %v", err)
+	}
+
+	path := hookURL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	wr := &webhookReceiver{
+		api:     api,
+		cfg:     cfg,
+		updates: make(chan tgbotapi.Update, api.Buffer),
+		errs:    make(chan error, 1),
+		done:    make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, wr.handleUpdate)
+	wr.server = &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		var err error
+		if cfg.CertFile != "" {
+			err = wr.server.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+		} else {
+			err = wr.server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			wr.errs <- fmt.Errorf("webhook server failed: %w", err)
+		}
+	}()
+
+	if err := wr.setWebhook(); err != nil {
+		wr.server.Close()
+		return nil, err
+	}
+
+	slog.Info("Listening for webhook updates", "addr", cfg.Listen, "path", path)
+	return wr, nil
+}
+
+// setWebhook calls setWebhook directly because the library's WebhookConfig has no
+// secret_token field.
+func (wr *webhookReceiver) setWebhook() error {
+	params := tgbotapi.Params{"url": wr.cfg.URL}
+	params.AddNonEmpty("secret_token", wr.cfg.Secret)
+
+	var (
+		resp *tgbotapi.APIResponse
+		err  error
+	)
+	if wr.cfg.CertFile != "" {
+		files := []tgbotapi.RequestFile{{
+			Name: "certificate",
+			Data: tgbotapi.FilePath(wr.cfg.CertFile),
+		}}
+		resp, err = wr.api.UploadFiles("setWebhook", params, files)
+	} else {
+		resp, err = wr.api.MakeRequest("setWebhook", params)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set webhook: %v", err)
+	}
+	if !resp.Ok {
+		return fmt.Errorf("failed to set webhook: %s", resp.Description)
+	}
+	return nil
+}
+
+func (wr *webhookReceiver) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if wr.cfg.Secret != "" {
+		token := r.Header.Get(webhookSecretHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(wr.cfg.Secret)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	update, err := wr.api.HandleUpdate(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Telegram resends updates that don't get a 2xx, so one that arrives
+	// while stopping is left for the next run
+	select {
+	case wr.updates <- *update:
+	case <-wr.done:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	}
+}
+
+// Updates returns the channel that incoming updates are delivered on.
+func (wr *webhookReceiver) Updates() tgbotapi.UpdatesChannel {
+	return wr.updates
+}
+
+// Errors returns a channel that gets an error if the HTTP server stops serving.
+func (wr *webhookReceiver) Errors() <-chan error {
+	return wr.errs
+}
+
+// Stop removes the webhook from Telegram and shuts the HTTP server down. The
+// updates channel is only closed once every handler has returned; if ctx ends
+// first it's left open, since a handler still running could send on it.
+func (wr *webhookReceiver) Stop(ctx context.Context) {
+	if _, err := wr.api.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		slog.Error("Error deleting webhook", "err", err)
+	}
+	close(wr.done)
+	if err := wr.server.Shutdown(ctx); err != nil {
+		slog.Error("Error shutting down webhook server", "err", err)
+		return
+	}
+	close(wr.updates)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestHandleUpdateAfterStop(t *testing.T) {
+	wr := &webhookReceiver{
+		api:     &tgbotapi.BotAPI{},
+		updates: make(chan tgbotapi.Update), // Nothing reads it, as after a timed out Shutdown
+		done:    make(chan struct{}),
+	}
+	close(wr.done)
+
+	rec := httptest.NewRecorder()
+	wr.handleUpdate(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"update_id":1}`)))
+
+	// Telegram resends the update to the next run
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("handleUpdate() status = %d after Stop, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHandleUpdate(t *testing.T) {
+	wr := &webhookReceiver{
+		api:     &tgbotapi.BotAPI{},
+		cfg:     webhookConfig{Secret: "hook-secret"},
+		updates: make(chan tgbotapi.Update, 1),
+		done:    make(chan struct{}),
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"update_id":7}`))
+	wr.handleUpdate(httptest.NewRecorder(), req)
+	if len(wr.updates) != 0 {
+		t.Fatal("update without the secret delivered")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"update_id":7}`))
+	req.Header.Set(webhookSecretHeader, "hook-secret")
+	rec := httptest.NewRecorder()
+	wr.handleUpdate(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("handleUpdate() status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	select {
+	case update := <-wr.updates:
+		if update.UpdateID != 7 {
+			t.Errorf("update ID = %d, want 7", update.UpdateID)
+		}
+	default:
+		t.Error("update not delivered")
+	}
+}